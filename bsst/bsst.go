@@ -5,11 +5,14 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"io"
 	"math"
 	"math/bits"
 	"os"
 	"sort"
+	"sync"
 
 	"github.com/minio/sha256-simd"
 	"github.com/multiformats/go-multihash"
@@ -38,7 +41,27 @@ const (
 	LevelFactor = 16384 // could be 24576, but we want to avoid deeper level misses
 )
 
-const BsstMagic = "BSST\x00\x00\x01\x00"
+const (
+	BsstMagic   = "BSST\x00\x00\x01\x00"
+	BsstMagicV2 = "BSST\x00\x00\x02\x00"
+)
+
+const (
+	VersionV1 = 1
+	VersionV2 = 2
+
+	// BucketUserEntriesV2 is the number of user entries in a v2 bucket, the
+	// last user entry slot of v1 holds the bucket checksum
+	BucketUserEntriesV2 = BucketUserEntries - 1
+	BucketChecksumEntry = BucketUserEntriesV2
+
+	bucketChecksumOff = BucketChecksumEntry * EntrySize
+	bucketBloomOff    = BucketUserEntries * EntrySize
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrCorrupted = errors.New("bsst corrupted")
 
 type Source interface {
 	// List calls the callback with multihashes in sorted order.
@@ -51,11 +74,15 @@ BSST file format:
 
 bbst file: [bucketHdr: [header]\0...] [bucket0: [ent...][entHdr: bktHead]] [bucket1: ...
 
-header: ["BSST\x00\x00\x01\x00"] {buckets: i64, bucketSize: i64, entries: i64, salt: [32]byte, levels: i64, levelFactor: i64, finalized: bool}:cbormap
+header: ["BSST\x00\x00\x01\x00" (v1) | "BSST\x00\x00\x02\x00" (v2)] {buckets: i64, bucketSize: i64, entries: i64, salt: [32]byte, levels: i64, levelFactor: i64, finalized: bool}:cbormap
 
-bktHead: [bloom: [64]byte]
+bktHead: [bloom: [32]byte]
 
-ent: [hash: [32]byte, off: le64]
+ent: [hash: [24]byte, off: le64]
+
+v2 buckets: [ent0..ent125][entSum: [crc32c: le32][0: [28]byte]][bktHead]
+  crc32c is computed over [bucketIdx: le64] followed by the whole bucket with entSum zeroed,
+  so that both bit flips and buckets written at a wrong offset are detected
 
 */
 
@@ -74,17 +101,28 @@ type BSST struct {
 	f *os.File
 	h *BSSTHeader
 
+	version int
+
+	// closeLk protects f and data from being closed / unmapped while lookups
+	// are in progress
+	closeLk sync.RWMutex
+
+	// data is the read-only mapping of the whole file in mmap mode
+	data     []byte
+	prefetch bool
+
 	CreateSample []multihash.Multihash
 }
 
 var BsstCIDSampleSize = 1024
 
-func Create(path string, entries int64, source Source) (bsst *BSST, err error) {
-	f, err := os.Create(path)
-	if err != nil {
-		return nil, xerrors.Errorf("open file: %w", err)
-	}
+// Create writes a new index with entries from source, and opens it with the
+// given options
+func Create(path string, entries int64, source Source, opts ...OpenOption) (bsst *BSST, err error) {
+	return create(path, VersionV2, entries, source, opts...)
+}
 
+func create(path string, version int, entries int64, source Source, opts ...OpenOption) (*BSST, error) {
 	header := &BSSTHeader{
 		L0Buckets:  (entries + MeanEntriesPerBucket - 1) / MeanEntriesPerBucket, // ceil entries / MeanEntriesPerBucket
 		BucketSize: BucketSize,
@@ -98,33 +136,16 @@ func Create(path string, entries int64, source Source) (bsst *BSST, err error) {
 		return nil, xerrors.Errorf("generate salt: %w", err)
 	}
 
-	var hdrBuf [BucketSize]byte
-
-	copy(hdrBuf[:], BsstMagic)
-
-	if err := header.MarshalCBOR(bytes.NewBuffer(hdrBuf[8:])); err != nil {
-		return nil, xerrors.Errorf("marshal header: %w", err)
-	}
-
-	if _, err := f.Write(hdrBuf[:]); err != nil {
-		return nil, xerrors.Errorf("write header: %w", err)
-	}
-
-	// sync header
-	if err := f.Sync(); err != nil {
-		return nil, xerrors.Errorf("sync header: %w", err)
-	}
-
 	// <todo mhh sorted source>
 
 	// collect buckets
 	// todo this in-memory stuff won't scale
 	// could dump sorted to disk after some size, then merge (2x more writes, but eh..)
-	var nextLevel []multiHashHash
+	var ents []multiHashHash
 
 	createSample := make([]multihash.Multihash, 0, BsstCIDSampleSize)
 
-	err = source.List(func(c multihash.Multihash, offs []int64) error {
+	err := source.List(func(c multihash.Multihash, offs []int64) error {
 		if len(createSample) < BsstCIDSampleSize {
 			// copy c data
 
@@ -132,7 +153,7 @@ func Create(path string, entries int64, source Source) (bsst *BSST, err error) {
 			createSample = append(createSample, c)
 		}
 		for i, off := range offs {
-			nextLevel = append(nextLevel, header.makeMHH(c, int64(i), off))
+			ents = append(ents, header.makeMHH(c, int64(i), off))
 		}
 		return nil
 	})
@@ -140,24 +161,133 @@ func Create(path string, entries int64, source Source) (bsst *BSST, err error) {
 		return nil, xerrors.Errorf("write buckets: %w", err)
 	}
 
+	if err := writeBSST(path, version, header, ents); err != nil {
+		return nil, err
+	}
+
+	// reopen in read-only mode
+	bsst, err := Open(path, opts...)
+	if err != nil {
+		return nil, xerrors.Errorf("reopen bsst: %w", err)
+	}
+
+	bsst.CreateSample = createSample
+
+	return bsst, nil
+}
+
+// Convert writes a copy of the src index in the latest format to path.
+// Entry keys are already salted hashes, so the source salt is kept.
+func Convert(src *BSST, path string, opts ...OpenOption) (*BSST, error) {
+	var ents []multiHashHash
+
+	err := src.iterBuckets(func(level, bucketIdx int64, bucket []byte) error {
+		for entIdx := 0; entIdx < src.userEntries(); entIdx++ {
+			ent := bucket[entIdx*EntrySize : (entIdx+1)*EntrySize]
+			if isNullEntry(ent) {
+				break
+			}
+
+			var mhh multiHashHash
+			copy(mhh.mhh[:], ent[:EntKeyBytes])
+			mhh.off = int64(binary.LittleEndian.Uint64(ent[EntKeyBytes:]))
+
+			ents = append(ents, mhh)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("reading source buckets: %w", err)
+	}
+
+	header := &BSSTHeader{
+		L0Buckets:  src.h.L0Buckets,
+		BucketSize: BucketSize,
+		Entries:    src.h.Entries,
+		Salt:       src.h.Salt,
+
+		Levels:      1,
+		LevelFactor: LevelFactor,
+		Finalized:   false,
+	}
+
+	if err := writeBSST(path, VersionV2, header, ents); err != nil {
+		return nil, err
+	}
+
+	return Open(path, opts...)
+}
+
+func writeBSST(path string, version int, header *BSSTHeader, ents []multiHashHash) error {
 	// sort buckets
 
 	// todo parallel merge sort
-	sort.Slice(nextLevel, func(i, j int) bool {
-		return bytes.Compare(nextLevel[i].mhh[:], nextLevel[j].mhh[:]) < 0
+	sort.Slice(ents, func(i, j int) bool {
+		return bytes.Compare(ents[i].mhh[:], ents[j].mhh[:]) < 0
 	})
 
-	// </todo>
+	return writeSortedBSST(path, version, header, sliceIter(ents))
+}
+
+// entIter returns the next entry, false when there are no more entries
+type entIter func() (multiHashHash, bool, error)
+
+func sliceIter(ents []multiHashHash) entIter {
+	return func() (multiHashHash, bool, error) {
+		if len(ents) == 0 {
+			return multiHashHash{}, false, nil
+		}
+		e := ents[0]
+		ents = ents[1:]
+		return e, true, nil
+	}
+}
+
+// writeSortedBSST writes an index with entries from an mhh-sorted iterator.
+// Only entries overflowing into higher levels are kept in memory.
+func writeSortedBSST(path string, version int, header *BSSTHeader, list entIter) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return xerrors.Errorf("open file: %w", err)
+	}
+
+	var hdrBuf [BucketSize]byte
+
+	switch version {
+	case VersionV1:
+		copy(hdrBuf[:], BsstMagic)
+	case VersionV2:
+		copy(hdrBuf[:], BsstMagicV2)
+	default:
+		return xerrors.Errorf("unknown bsst version %d", version)
+	}
+
+	userEntries := uint64(BucketUserEntries)
+	if version >= VersionV2 {
+		userEntries = BucketUserEntriesV2
+	}
+
+	if err := header.MarshalCBOR(bytes.NewBuffer(hdrBuf[8:])); err != nil {
+		return xerrors.Errorf("marshal header: %w", err)
+	}
+
+	if _, err := f.Write(hdrBuf[:]); err != nil {
+		return xerrors.Errorf("write header: %w", err)
+	}
+
+	// sync header
+	if err := f.Sync(); err != nil {
+		return xerrors.Errorf("sync header: %w", err)
+	}
 
 	// write buckets
 	bufWriter := bufio.NewWriterSize(f, 4<<20)
-	nullEntry := [EntrySize]byte{}
-	var offBuf [EntrySize - EntKeyBytes]byte
 
 	inBucket := uint64(0)
 	bucketEnts := uint64(0)
 
-	var bloomHead [BucketBloomFilterSize]byte
+	// bucket being written; unused entries stay zeroed as padding
+	var bucketBuf [BucketSize]byte
 
 	//bSizes := map[uint64]int64{}
 
@@ -168,20 +298,19 @@ func Create(path string, entries int64, source Source) (bsst *BSST, err error) {
 
 		//bSizes[bucketEnts]++
 
-		// pad up to BucketUserEntries entries
-		for bucketEnts < BucketUserEntries {
-			if _, err := bufWriter.Write(nullEntry[:]); err != nil {
-				return xerrors.Errorf("write padding entry: %w", err)
-			}
-			bucketEnts++
+		if version >= VersionV2 {
+			sum := bucketChecksum(inBucket, bucketBuf[:])
+			binary.LittleEndian.PutUint32(bucketBuf[bucketChecksumOff:], sum)
 		}
 
-		// write bloom filter / header padding
-		if _, err := bufWriter.Write(bloomHead[:]); err != nil {
-			return xerrors.Errorf("write header entry filter: %w", err)
+		if _, err := bufWriter.Write(bucketBuf[:]); err != nil {
+			return xerrors.Errorf("write bucket: %w", err)
 		}
 
-		// reset temp vars
+		// reset temp vars (also resets the bloom filter)
+		for i := range bucketBuf {
+			bucketBuf[i] = 0
+		}
 		inBucket++
 		bucketEnts = 0
 
@@ -193,13 +322,33 @@ func Create(path string, entries int64, source Source) (bsst *BSST, err error) {
 	levelBuckets := uint64(header.L0Buckets)
 	prevLevelBuckets := uint64(0)
 
-	for len(nextLevel) > 0 {
-		list := nextLevel
-		nextLevel = []multiHashHash{}
+	// empty indexes have no buckets, and no levels
+	if levelBuckets == 0 {
+		_, ok, err := list()
+		if err != nil {
+			return xerrors.Errorf("getting next entry: %w", err)
+		}
+		if ok {
+			return xerrors.Errorf("index with no buckets has entries")
+		}
+	}
+
+	for levelBuckets > 0 {
+		var nextLevel []multiHashHash
+		var levelEnts bool
 
 		bucketRange := math.MaxUint64 / levelBuckets // todo techincally +1?? (if changing note this is also calculated below)
 
-		for _, hash := range list {
+		for {
+			hash, ok, err := list()
+			if err != nil {
+				return xerrors.Errorf("getting next entry: %w", err)
+			}
+			if !ok {
+				break
+			}
+			levelEnts = true
+
 			// first 64 bits of hash to calculate bucket
 			hashidx := binary.BigEndian.Uint64(hash.mhh[:8])
 			bucketIdx := prevLevelBuckets + (hashidx / bucketRange)
@@ -207,77 +356,69 @@ func Create(path string, entries int64, source Source) (bsst *BSST, err error) {
 
 			for inBucket != bucketIdx {
 				if err := flushBucket(bucketIdx); err != nil {
-					return nil, err
-				}
-
-				// reset bloom
-				for i := range bloomHead[:BucketBloomFilterSize] {
-					bloomHead[i] = 0
+					return err
 				}
 			}
 
 			// update bloom filter first, so that even if this entry won't fit in this level, we know that it doesn't
 			// exist in one i/o if it's not in bloom
-			bloomHead[bloomEntIdx/8] |= 1 << (bloomEntIdx % 8)
+			bucketBuf[bucketBloomOff+bloomEntIdx/8] |= 1 << (bloomEntIdx % 8)
 
 			// check if we have space for this entry
-			if bucketEnts >= BucketUserEntries {
+			if bucketEnts >= userEntries {
 				nextLevel = append(nextLevel, hash)
 				continue
 			}
 
 			// write entry
-			if _, err := bufWriter.Write(hash.mhh[:EntKeyBytes]); err != nil {
-				return nil, xerrors.Errorf("write entry: %w", err)
-			}
-			binary.LittleEndian.PutUint64(offBuf[:], uint64(hash.off))
-			if _, err := bufWriter.Write(offBuf[:]); err != nil {
-				return nil, xerrors.Errorf("write entry offset: %w", err)
-			}
+			entOff := bucketEnts * EntrySize
+			copy(bucketBuf[entOff:], hash.mhh[:EntKeyBytes])
+			binary.LittleEndian.PutUint64(bucketBuf[entOff+EntKeyBytes:], uint64(hash.off))
 
 			bucketEnts++
 			ents++
 		}
 
+		if !levelEnts {
+			break
+		}
+
 		// flush last buckets
 		for inBucket < levelBuckets+prevLevelBuckets { // todo is the condition right?
 			if err := flushBucket(levelBuckets + prevLevelBuckets); err != nil {
-				return nil, err
-			}
-
-			// todo could only do this once
-			for i := range bloomHead[:BucketBloomFilterSize] {
-				bloomHead[i] = 0
+				return err
 			}
 		}
 
 		level++
 		prevLevelBuckets += levelBuckets
 		levelBuckets = (levelBuckets + LevelFactor - 1) / LevelFactor // ceil(levelBuckets / LevelFactor)
+
+		list = sliceIter(nextLevel)
 	}
 
 	header.Levels = int64(level)
 
 	if err := bufWriter.Flush(); err != nil {
-		return nil, xerrors.Errorf("flush buckets: %w", err)
+		return xerrors.Errorf("flush buckets: %w", err)
 	}
 
 	if err := f.Sync(); err != nil {
-		return nil, xerrors.Errorf("sync buckets: %w", err)
+		return xerrors.Errorf("sync buckets: %w", err)
 	}
 
 	// finalize header
 	header.Finalized = true
 	if _, err := f.Seek(8, io.SeekStart); err != nil {
-		return nil, xerrors.Errorf("seek to header: %w", err)
+		return xerrors.Errorf("seek to header: %w", err)
 	}
 
 	if err := header.MarshalCBOR(f); err != nil {
-		return nil, xerrors.Errorf("marshal header: %w", err)
+		return xerrors.Errorf("marshal header: %w", err)
 	}
 
 	if err := f.Sync(); err != nil {
-		return nil, xerrors.Errorf("sync header: %w", err)
+		return xerrors.Errorf("sync header: %w", err)
 	}
 
 	// print bSizes sorted by key
@@ -296,21 +437,41 @@ func Create(path string, entries int64, source Source) (bsst *BSST, err error) {
 	//fmt.Println("ents ", ents, " bkt ", header.L0Buckets, " ibe ", ibe)
 
 	if err := f.Close(); err != nil {
-		return nil, xerrors.Errorf("close written bsst: %w", err)
+		return xerrors.Errorf("close written bsst: %w", err)
 	}
 
-	// reopen in read-only mode
-	bsst, err = Open(path)
-	if err != nil {
-		return nil, xerrors.Errorf("reopen bsst: %w", err)
-	}
+	return nil
+}
 
-	bsst.CreateSample = createSample
+type openOptions struct {
+	mmap     bool
+	prefetch bool
+}
 
-	return bsst, nil
+type OpenOption func(*openOptions)
+
+// WithMmap makes lookups read buckets from a read-only memory mapping of the
+// index file instead of issuing a ReadAt syscall for every bucket
+func WithMmap(mmap bool) OpenOption {
+	return func(o *openOptions) {
+		o.mmap = mmap
+	}
 }
 
-func Open(path string) (*BSST, error) {
+// WithPrefetch makes batched lookups ask the kernel to read all buckets
+// needed by a batch level upfront (madvise WILLNEED). Only used with WithMmap.
+func WithPrefetch(prefetch bool) OpenOption {
+	return func(o *openOptions) {
+		o.prefetch = prefetch
+	}
+}
+
+func Open(path string, opts ...OpenOption) (*BSST, error) {
+	opt := &openOptions{}
+	for _, o := range opts {
+		o(opt)
+	}
+
 	f, err := os.OpenFile(path, os.O_RDONLY, 0644)
 	if err != nil {
 		return nil, xerrors.Errorf("open file: %w", err)
@@ -321,7 +482,13 @@ func Open(path string) (*BSST, error) {
 		return nil, xerrors.Errorf("read header: %w", err)
 	}
 
-	if !bytes.Equal(hdrBuf[:8], []byte(BsstMagic)) {
+	var version int
+	switch string(hdrBuf[:8]) {
+	case BsstMagic:
+		version = VersionV1
+	case BsstMagicV2:
+		version = VersionV2
+	default:
 		return nil, xerrors.Errorf("invalid magic")
 	}
 
@@ -330,10 +497,187 @@ func Open(path string) (*BSST, error) {
 		return nil, xerrors.Errorf("unmarshal header: %w", err)
 	}
 
-	return &BSST{
+	bs := &BSST{
 		f: f,
 		h: &header,
-	}, nil
+
+		version: version,
+	}
+
+	if opt.mmap {
+		st, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, xerrors.Errorf("stat bsst: %w", err)
+		}
+
+		bs.data, err = mmapFile(f, st.Size())
+		if err != nil {
+			_ = f.Close()
+			return nil, xerrors.Errorf("mmap bsst: %w", err)
+		}
+		bs.prefetch = opt.prefetch
+	}
+
+	return bs, nil
+}
+
+// Version returns the on-disk format version of the index
+func (h *BSST) Version() int {
+	return h.version
+}
+
+func (h *BSST) Header() BSSTHeader {
+	return *h.h
+}
+
+func (h *BSST) userEntries() int {
+	if h.version >= VersionV2 {
+		return BucketUserEntriesV2
+	}
+	return BucketUserEntries
+}
+
+func bucketChecksum(bucketIdx uint64, bucket []byte) uint32 {
+	var idxBuf [8]byte
+	binary.LittleEndian.PutUint64(idxBuf[:], bucketIdx)
+
+	sum := crc32.Update(0, castagnoli, idxBuf[:])
+	sum = crc32.Update(sum, castagnoli, bucket[:bucketChecksumOff])
+	sum = crc32.Update(sum, castagnoli, make([]byte, EntrySize))
+	return crc32.Update(sum, castagnoli, bucket[bucketChecksumOff+EntrySize:])
+}
+
+// bucket returns bucket data, checking the bucket checksum in v2 files. In
+// mmap mode the returned slice points into the mapping, otherwise the bucket
+// is read into buf.
+func (h *BSST) bucket(bucketIdx uint64, buf *[BucketSize]byte) ([]byte, error) {
+	var bucket []byte
+
+	off := (bucketIdx + 1) * BucketSize
+	if h.data != nil {
+		if off+BucketSize > uint64(len(h.data)) {
+			return nil, xerrors.Errorf("bucket %d beyond end of mapped file: %w", bucketIdx, ErrCorrupted)
+		}
+		bucket = h.data[off : off+BucketSize]
+	} else {
+		if _, err := h.f.ReadAt(buf[:], int64(off)); err != nil {
+			return nil, xerrors.Errorf("read bucket: %w", err)
+		}
+		bucket = buf[:]
+	}
+
+	if h.version >= VersionV2 {
+		stored := binary.LittleEndian.Uint32(bucket[bucketChecksumOff:])
+		if sum := bucketChecksum(bucketIdx, bucket); sum != stored {
+			return nil, xerrors.Errorf("bucket %d checksum mismatch (stored %08x, computed %08x): %w", bucketIdx, stored, sum, ErrCorrupted)
+		}
+	}
+
+	return bucket, nil
+}
+
+// iterBuckets calls the callback with every bucket in the index, level by level
+func (h *BSST) iterBuckets(cb func(level, bucketIdx int64, bucket []byte) error) error {
+	var bucketBuf [BucketSize]byte
+
+	levelBuckets := h.h.L0Buckets
+	prevLevelBuckets := int64(0)
+
+	for level := int64(0); level < h.h.Levels; level++ {
+		for bucketIdx := prevLevelBuckets; bucketIdx < prevLevelBuckets+levelBuckets; bucketIdx++ {
+			bucket, err := h.bucket(uint64(bucketIdx), &bucketBuf)
+			if err != nil {
+				return err
+			}
+
+			if err := cb(level, bucketIdx, bucket); err != nil {
+				return err
+			}
+		}
+
+		prevLevelBuckets += levelBuckets
+		levelBuckets = (levelBuckets + LevelFactor - 1) / LevelFactor
+	}
+
+	return nil
+}
+
+// Verify scans all levels of the index, checking bucket checksums (v2), and
+// that every entry is in the bucket and bloom filter position its key maps to.
+// Returned errors wrap ErrCorrupted when index data is inconsistent.
+func (h *BSST) Verify() error {
+	if !h.h.Finalized {
+		return xerrors.Errorf("index not finalized: %w", ErrCorrupted)
+	}
+
+	var totalBuckets int64
+	levelBuckets := h.h.L0Buckets
+	for level := int64(0); level < h.h.Levels; level++ {
+		totalBuckets += levelBuckets
+		levelBuckets = (levelBuckets + LevelFactor - 1) / LevelFactor
+	}
+
+	st, err := h.f.Stat()
+	if err != nil {
+		return xerrors.Errorf("stat index file: %w", err)
+	}
+	if expect := (totalBuckets + 1) * BucketSize; st.Size() != expect {
+		return xerrors.Errorf("index file size %d, expected %d: %w", st.Size(), expect, ErrCorrupted)
+	}
+
+	var curLevel int64 = -1
+	var bucketRange, prevLevelBuckets, nextLevelStart uint64
+	levelBuckets = h.h.L0Buckets
+
+	return h.iterBuckets(func(level, bucketIdx int64, bucket []byte) error {
+		if level != curLevel {
+			curLevel = level
+			prevLevelBuckets = nextLevelStart
+			bucketRange = math.MaxUint64 / uint64(levelBuckets)
+			nextLevelStart += uint64(levelBuckets)
+			levelBuckets = (levelBuckets + LevelFactor - 1) / LevelFactor
+		}
+
+		var k [32]byte
+		var prevKey []byte
+		padding := false
+
+		for entIdx := 0; entIdx < h.userEntries(); entIdx++ {
+			ent := bucket[entIdx*EntrySize : (entIdx+1)*EntrySize]
+			if isNullEntry(ent) {
+				padding = true
+				continue
+			}
+			if padding {
+				return xerrors.Errorf("bucket %d: entry %d after padding: %w", bucketIdx, entIdx, ErrCorrupted)
+			}
+
+			copy(k[:], ent[:EntKeyBytes])
+			entBucket, bloomEntIdx := bucketInd(k, bucketRange, prevLevelBuckets)
+			if entBucket != uint64(bucketIdx) {
+				return xerrors.Errorf("bucket %d: entry %d belongs to bucket %d: %w", bucketIdx, entIdx, entBucket, ErrCorrupted)
+			}
+			if bucket[bucketBloomOff+bloomEntIdx/8]&(1<<(bloomEntIdx%8)) == 0 {
+				return xerrors.Errorf("bucket %d: entry %d missing from bloom filter: %w", bucketIdx, entIdx, ErrCorrupted)
+			}
+			if prevKey != nil && bytes.Compare(prevKey, ent[:EntKeyBytes]) >= 0 {
+				return xerrors.Errorf("bucket %d: entry %d out of order: %w", bucketIdx, entIdx, ErrCorrupted)
+			}
+			prevKey = ent[:EntKeyBytes]
+		}
+
+		return nil
+	})
+}
+
+func isNullEntry(ent []byte) bool {
+	for _, b := range ent {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
 }
 
 func bucketInd(k [32]byte, bucketRange, prevLevelBuckets uint64) (uint64, uint64) {
@@ -367,167 +711,229 @@ func (h *BSSTHeader) makeMHKey(c multihash.Multihash, i int64) [32]byte {
 }
 
 func (h *BSST) Has(c []multihash.Multihash) ([]bool, error) {
-	keys := make([][32]byte, len(c))
-	for i, k := range c {
-		keys[i] = h.h.makeMHKey(k, 0) // todo support multiple results
+	out := make([]bool, len(c))
+
+	err := h.lookup(c, func(i int, ent []byte) {
+		out[i] = true
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	out := make([]bool, len(c))
+	return out, nil
+}
+
+// Get returns offsets to data, -1 if not found
+func (h *BSST) Get(c []multihash.Multihash) ([]int64, error) {
+	out := make([]int64, len(c))
+	for i := range out {
+		out[i] = -1
+	}
+
+	err := h.lookup(c, func(i int, ent []byte) {
+		out[i] = int64(binary.LittleEndian.Uint64(ent[EntKeyBytes : EntKeyBytes+8]))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+type lookupKey struct {
+	i           int
+	key         [32]byte
+	bucketIdx   uint64
+	bloomEntIdx uint64
+}
+
+// lookup finds entries for a batch of multihashes level by level. Within each
+// level keys are sorted by bucket, so that every bucket is read at most once
+// per batch, in file order.
+func (h *BSST) lookup(c []multihash.Multihash, found func(i int, ent []byte)) error {
+	h.closeLk.RLock()
+	defer h.closeLk.RUnlock()
+
+	if h.f == nil {
+		return xerrors.Errorf("bsst closed")
+	}
+
+	pending := make([]lookupKey, len(c))
+	for i, k := range c {
+		pending[i] = lookupKey{
+			i:   i,
+			key: h.h.makeMHKey(k, 0), // todo support multiple results
+		}
+	}
 
 	var bucketBuf [BucketSize]byte
 
-top:
-	for i, k := range keys {
-		levelBuckets := uint64(h.h.L0Buckets)
-		prevLevelBuckets := uint64(0)
+	levelBuckets := uint64(h.h.L0Buckets)
+	prevLevelBuckets := uint64(0)
 
-		for level := int64(0); level < h.h.Levels; level++ {
-			bucketRange := math.MaxUint64 / levelBuckets
-			bucketIdx, bloomEntIdx := bucketInd(k, bucketRange, prevLevelBuckets)
+	for level := int64(0); level < h.h.Levels && len(pending) > 0; level++ {
+		bucketRange := math.MaxUint64 / levelBuckets
+		for i := range pending {
+			pending[i].bucketIdx, pending[i].bloomEntIdx = bucketInd(pending[i].key, bucketRange, prevLevelBuckets)
+		}
 
-			if _, err := h.f.ReadAt(bucketBuf[:], int64(bucketIdx+1)*BucketSize); err != nil { // todo use mmap so we get page caching for free
-				return nil, xerrors.Errorf("read bucket: %w", err)
+		sort.Slice(pending, func(i, j int) bool {
+			return pending[i].bucketIdx < pending[j].bucketIdx
+		})
+
+		if h.prefetch {
+			h.prefetchBuckets(pending)
+		}
+
+		// keys which may be in next levels, filtered in place
+		next := pending[:0]
+
+		var bucket []byte
+		loaded := uint64(math.MaxUint64)
+
+		for _, lk := range pending {
+			if lk.bucketIdx != loaded {
+				var err error
+				bucket, err = h.bucket(lk.bucketIdx, &bucketBuf)
+				if err != nil {
+					return err
+				}
+				loaded = lk.bucketIdx
 			}
 
 			// check if exists in bloom
-			bloomOff := uint64(BucketUserEntries * EntrySize)
-			if bucketBuf[bloomOff+bloomEntIdx/8]&(1<<(bloomEntIdx%8)) == 0 {
+			if bucket[bucketBloomOff+lk.bloomEntIdx/8]&(1<<(lk.bloomEntIdx%8)) == 0 {
 				// definitely not in bucket or next levels
 				continue
 			}
 
-			// calculate minimum possible offset from bloom filter
-			// note: this assumes 32byte bloom
-			b0 := binary.LittleEndian.Uint64(bucketBuf[bloomOff+0 : bloomOff+8]) // LE because smallest byte is first
-			b1 := binary.LittleEndian.Uint64(bucketBuf[bloomOff+8 : bloomOff+16])
-			b2 := binary.LittleEndian.Uint64(bucketBuf[bloomOff+16 : bloomOff+24])
-			b3 := binary.LittleEndian.Uint64(bucketBuf[bloomOff+24 : bloomOff+32])
-
-			// now generate a mask that is bloomEntIdx bits long
-			mLast := uint64(0xffffffffffffffff) >> (63 - (bloomEntIdx % 64))
-
-			var inM1, inM2, inM3 uint64
-
-			/*
-				if bloomEntIdx > 63 {
-					inM1 = 1
-				}
-				if bloomEntIdx > 127 {
-					inM2 = 1
-				}
-				if bloomEntIdx > 191 {
-					inM3 = 1
-				}
-			*/
-			// bloomEntIdx is 0 <= x < 256
-
-			/*
-				inM0 = true
-				inM1 = bei:b7 | bei:b6
-				inM2 = bei:b7
-				inM3 = bei:b7 & bei:b6
-			*/
-
-			bei6 := bloomEntIdx >> 6
-
-			inM2 = (bloomEntIdx >> 7) & 1
-			inM1 = inM2 | bei6
-			inM3 = inM2 & bei6
-
-			m0 := mLast | (-inM1)
-			m1 := (mLast & (-inM1)) | (-inM2)
-			m2 := (mLast & (-inM2)) | (-inM3)
-			m3 := mLast & (-inM3)
-
-			// count bits
-			minOffIdx := (bits.OnesCount64(b0&m0) + bits.OnesCount64(b1&m1) + bits.OnesCount64(b2&m2) + bits.OnesCount64(b3&m3)) - 1
-			for entIdx := minOffIdx; entIdx < BucketUserEntries; entIdx++ {
-				if bytes.Equal(bucketBuf[entIdx*EntrySize:entIdx*EntrySize+EntKeyBytes], k[:EntKeyBytes]) {
-					out[i] = true
-					continue top
-				}
+			if ent := h.findInBucket(bucket, lk.key, lk.bloomEntIdx); ent != nil {
+				found(lk.i, ent)
+				continue
 			}
 
-			prevLevelBuckets += levelBuckets
-			levelBuckets = (levelBuckets + LevelFactor - 1) / LevelFactor
+			next = append(next, lk)
 		}
+
+		pending = next
+
+		prevLevelBuckets += levelBuckets
+		levelBuckets = (levelBuckets + LevelFactor - 1) / LevelFactor
 	}
 
-	return out, nil
+	return nil
 }
 
-// Get returns offsets to data, -1 if not found
-func (h *BSST) Get(c []multihash.Multihash) ([]int64, error) {
-	// todo dedupe code with Has
+// findInBucket returns the entry matching key, or nil if it's not in the bucket
+func (h *BSST) findInBucket(bucket []byte, k [32]byte, bloomEntIdx uint64) []byte {
+	// calculate minimum possible offset from bloom filter
+	// note: this assumes 32byte bloom
+	bloomOff := uint64(bucketBloomOff)
+	b0 := binary.LittleEndian.Uint64(bucket[bloomOff+0 : bloomOff+8]) // LE because smallest byte is first
+	b1 := binary.LittleEndian.Uint64(bucket[bloomOff+8 : bloomOff+16])
+	b2 := binary.LittleEndian.Uint64(bucket[bloomOff+16 : bloomOff+24])
+	b3 := binary.LittleEndian.Uint64(bucket[bloomOff+24 : bloomOff+32])
 
-	keys := make([][32]byte, len(c))
-	for i, k := range c {
-		keys[i] = h.h.makeMHKey(k, 0) // todo support multiple results
+	// now generate a mask that is bloomEntIdx bits long
+	mLast := uint64(0xffffffffffffffff) >> (63 - (bloomEntIdx % 64))
+
+	var inM1, inM2, inM3 uint64
+
+	/*
+		if bloomEntIdx > 63 {
+			inM1 = 1
+		}
+		if bloomEntIdx > 127 {
+			inM2 = 1
+		}
+		if bloomEntIdx > 191 {
+			inM3 = 1
+		}
+	*/
+	// bloomEntIdx is 0 <= x < 256
+
+	/*
+		inM0 = true
+		inM1 = bei:b7 | bei:b6
+		inM2 = bei:b7
+		inM3 = bei:b7 & bei:b6
+	*/
+
+	bei6 := bloomEntIdx >> 6
+
+	inM2 = (bloomEntIdx >> 7) & 1
+	inM1 = inM2 | bei6
+	inM3 = inM2 & bei6
+
+	m0 := mLast | (-inM1)
+	m1 := (mLast & (-inM1)) | (-inM2)
+	m2 := (mLast & (-inM2)) | (-inM3)
+	m3 := mLast & (-inM3)
+
+	// count bits
+	minOffIdx := (bits.OnesCount64(b0&m0) + bits.OnesCount64(b1&m1) + bits.OnesCount64(b2&m2) + bits.OnesCount64(b3&m3)) - 1
+	for entIdx := minOffIdx; entIdx < h.userEntries(); entIdx++ {
+		if bytes.Equal(bucket[entIdx*EntrySize:entIdx*EntrySize+EntKeyBytes], k[:EntKeyBytes]) {
+			return bucket[entIdx*EntrySize : (entIdx+1)*EntrySize]
+		}
 	}
 
-	out := make([]int64, len(c))
+	return nil
+}
 
-	var bucketBuf [BucketSize]byte
+// prefetchBuckets hints the kernel to read the (sorted) buckets of a lookup
+// batch, merging adjacent buckets into a single range
+func (h *BSST) prefetchBuckets(keys []lookupKey) {
+	if h.data == nil || len(keys) < 2 {
+		return
+	}
 
-top:
-	for i, k := range keys {
-		levelBuckets := uint64(h.h.L0Buckets)
-		prevLevelBuckets := uint64(0)
+	pageSize := uint64(os.Getpagesize())
 
-		for level := int64(0); level < h.h.Levels; level++ {
-			bucketRange := math.MaxUint64 / levelBuckets
-			bucketIdx, bloomEntIdx := bucketInd(k, bucketRange, prevLevelBuckets)
+	var start, end uint64
+	flush := func() {
+		if end > start {
+			// best-effort, ignore errors
+			_ = madviseWillNeed(h.data[start:end])
+		}
+	}
 
-			if _, err := h.f.ReadAt(bucketBuf[:], int64(bucketIdx+1)*BucketSize); err != nil { // todo use mmap so we get page caching for free
-				return nil, xerrors.Errorf("read bucket: %w", err)
-			}
+	for _, lk := range keys {
+		bStart := (lk.bucketIdx + 1) * BucketSize
+		bEnd := bStart + BucketSize
 
-			// check if exists in bloom
-			bloomOff := uint64(BucketUserEntries * EntrySize)
-			if bucketBuf[bloomOff+bloomEntIdx/8]&(1<<(bloomEntIdx%8)) == 0 {
-				// definitely not in bucket
-				continue
-			}
+		// madvise needs page aligned addresses
+		bStart -= bStart % pageSize
 
-			// calculate minimum possible offset from bloom filter
-			// note: this assumes 32byte bloom
-			b0 := binary.LittleEndian.Uint64(bucketBuf[bloomOff+0 : bloomOff+8]) // LE because smallest byte is first
-			b1 := binary.LittleEndian.Uint64(bucketBuf[bloomOff+8 : bloomOff+16])
-			b2 := binary.LittleEndian.Uint64(bucketBuf[bloomOff+16 : bloomOff+24])
-			b3 := binary.LittleEndian.Uint64(bucketBuf[bloomOff+24 : bloomOff+32])
-
-			// now generate a mask that is bloomEntIdx bits long
-			mLast := uint64(0xffffffffffffffff) >> (63 - (bloomEntIdx % 64))
-
-			var inM1, inM2, inM3 uint64
-			bei6 := bloomEntIdx >> 6
-
-			inM2 = (bloomEntIdx >> 7) & 1
-			inM1 = inM2 | bei6
-			inM3 = inM2 & bei6
-
-			m0 := mLast | (-inM1)
-			m1 := (mLast & (-inM1)) | (-inM2)
-			m2 := (mLast & (-inM2)) | (-inM3)
-			m3 := mLast & (-inM3)
-
-			// count bits
-			minOffIdx := (bits.OnesCount64(b0&m0) + bits.OnesCount64(b1&m1) + bits.OnesCount64(b2&m2) + bits.OnesCount64(b3&m3)) - 1
-			for entIdx := minOffIdx; entIdx < BucketUserEntries; entIdx++ {
-				if bytes.Equal(bucketBuf[entIdx*EntrySize:entIdx*EntrySize+EntKeyBytes], k[:EntKeyBytes]) {
-					out[i] = int64(binary.LittleEndian.Uint64(bucketBuf[entIdx*EntrySize+EntKeyBytes : entIdx*EntrySize+EntKeyBytes+8]))
-					continue top
-				}
+		if bStart <= end {
+			if bEnd > end {
+				end = bEnd
 			}
-
-			prevLevelBuckets += levelBuckets
-			levelBuckets = (levelBuckets + LevelFactor - 1) / LevelFactor
+			continue
 		}
-	}
 
-	return out, nil
+		flush()
+		start, end = bStart, bEnd
+	}
+	flush()
 }
 
 func (h *BSST) Close() error {
-	return h.f.Close()
+	h.closeLk.Lock()
+	defer h.closeLk.Unlock()
+
+	if h.f == nil {
+		return nil
+	}
+
+	if h.data != nil {
+		if err := munmap(h.data); err != nil {
+			return xerrors.Errorf("munmap: %w", err)
+		}
+		h.data = nil
+	}
+
+	err := h.f.Close()
+	h.f = nil
+	return err
 }
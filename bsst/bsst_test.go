@@ -2,9 +2,12 @@ package bsst
 
 import (
 	"encoding/binary"
+	"fmt"
+	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/filecoin-project/lotus/lib/must"
 	mh "github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
 )
@@ -60,3 +63,244 @@ func TestBSSTCreate(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, n, got)
 }
+
+func checkAllEntries(t *testing.T, bsst *BSST, n int64) {
+	err := (&testSource{n: n}).List(func(c mh.Multihash, offs []int64) error {
+		h, err := bsst.Has([]mh.Multihash{c})
+		require.NoError(t, err)
+		require.True(t, h[0])
+
+		r, err := bsst.Get([]mh.Multihash{c})
+		require.NoError(t, err)
+		require.Equal(t, offs[0], r[0])
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestBSSTVerify(t *testing.T) {
+	n := int64(200_000)
+	path := filepath.Join(t.TempDir(), "a.bsst")
+
+	bsst, err := Create(path, n, &testSource{n: n})
+	require.NoError(t, err)
+	require.Equal(t, VersionV2, bsst.Version())
+	require.NoError(t, bsst.Verify())
+	require.NoError(t, bsst.Close())
+
+	// flip a bit in the first entry of the first bucket
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	require.NoError(t, err)
+	var b [1]byte
+	_, err = f.ReadAt(b[:], BucketSize+3)
+	require.NoError(t, err)
+	b[0] ^= 0x10
+	_, err = f.WriteAt(b[:], BucketSize+3)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	bsst, err = Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, bsst.Close()) })
+
+	require.ErrorIs(t, bsst.Verify(), ErrCorrupted)
+}
+
+func TestBSSTV1Compat(t *testing.T) {
+	n := int64(200_000)
+	dir := t.TempDir()
+
+	v1, err := create(filepath.Join(dir, "v1.bsst"), VersionV1, n, &testSource{n: n})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, v1.Close()) })
+
+	require.Equal(t, VersionV1, v1.Version())
+	require.NoError(t, v1.Verify())
+	checkAllEntries(t, v1, n)
+
+	v2, err := Convert(v1, filepath.Join(dir, "v2.bsst"))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, v2.Close()) })
+
+	require.Equal(t, VersionV2, v2.Version())
+	require.NoError(t, v2.Verify())
+	checkAllEntries(t, v2, n)
+}
+
+func testKeys(n, from, count int64) []mh.Multihash {
+	keys := make([]mh.Multihash, 0, count)
+	for i := from; i < from+count; i++ {
+		var ib [8]byte
+		binary.LittleEndian.PutUint64(ib[:], uint64(i%n))
+
+		keys = append(keys, mh.Multihash(must.One(mh.Sum(ib[:], mh.SHA2_256, -1))))
+	}
+	return keys
+}
+
+func TestBSSTBatchedLookup(t *testing.T) {
+	n := int64(200_000)
+	path := filepath.Join(t.TempDir(), "a.bsst")
+
+	bs, err := Create(path, n, &testSource{n: n})
+	require.NoError(t, err)
+	require.NoError(t, bs.Close())
+
+	modes := map[string][]OpenOption{
+		"readat":        nil,
+		"mmap":          {WithMmap(true)},
+		"mmap-prefetch": {WithMmap(true), WithPrefetch(true)},
+	}
+
+	for name, opts := range modes {
+		t.Run(name, func(t *testing.T) {
+			bs, err := Open(path, opts...)
+			require.NoError(t, err)
+			t.Cleanup(func() { require.NoError(t, bs.Close()) })
+
+			const batch = 1000
+			for from := int64(0); from < n; from += batch {
+				keys := testKeys(n, from, batch)
+
+				// one key not in the index
+				missing := must.One(mh.Sum([]byte("missing"), mh.SHA2_256, -1))
+				keys = append(keys, missing)
+
+				has, err := bs.Has(keys)
+				require.NoError(t, err)
+				offs, err := bs.Get(keys)
+				require.NoError(t, err)
+
+				for i := range keys[:batch] {
+					require.True(t, has[i])
+					require.Equal(t, (from+int64(i))|0x7faa_0000_c000_0000, offs[i])
+				}
+				require.False(t, has[batch])
+				require.Equal(t, int64(-1), offs[batch])
+			}
+		})
+	}
+}
+
+func BenchmarkBSSTGet(b *testing.B) {
+	n := int64(1_000_000)
+	path := filepath.Join(b.TempDir(), "a.bsst")
+
+	bs, err := Create(path, n, &testSource{n: n})
+	require.NoError(b, err)
+	require.NoError(b, bs.Close())
+
+	modes := []struct {
+		name string
+		opts []OpenOption
+	}{
+		{"readat", nil},
+		{"mmap", []OpenOption{WithMmap(true)}},
+		{"mmap-prefetch", []OpenOption{WithMmap(true), WithPrefetch(true)}},
+	}
+
+	for _, mode := range modes {
+		for _, batch := range []int64{1, 64, 1024} {
+			b.Run(fmt.Sprintf("%s/batch-%d", mode.name, batch), func(b *testing.B) {
+				bs, err := Open(path, mode.opts...)
+				require.NoError(b, err)
+				defer bs.Close()
+
+				batches := make([][]mh.Multihash, 64)
+				for i := range batches {
+					batches[i] = testKeys(n, int64(i)*batch*7919, batch)
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					if _, err := bs.Get(batches[i%len(batches)]); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(int64(b.N)*batch), "ns/key")
+			})
+		}
+	}
+}
+
+type rangeSource struct {
+	from, to int64
+}
+
+func (r *rangeSource) List(f func(c mh.Multihash, offs []int64) error) error {
+	for i := r.from; i < r.to; i++ {
+		var ib [8]byte
+		binary.LittleEndian.PutUint64(ib[:], uint64(i))
+
+		h, err := mh.Sum(ib[:], mh.SHA2_256, -1)
+		if err != nil {
+			return err
+		}
+
+		if err := f(h, []int64{i}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestBSSTMerge(t *testing.T) {
+	dir := t.TempDir()
+
+	// force multiple sorted runs
+	defer func(e int) { MergeRunEntries = e }(MergeRunEntries)
+	MergeRunEntries = 10_000
+
+	// overlapping ranges, [5000, 6000) is in the first two inputs
+	ranges := []*rangeSource{{0, 6_000}, {5_000, 40_000}, {40_000, 100_000}}
+
+	var inputs []MergeInput
+	for i, r := range ranges {
+		bs, err := Create(filepath.Join(dir, fmt.Sprintf("%d.bsst", i)), r.to-r.from, r)
+		require.NoError(t, err)
+		t.Cleanup(func() { require.NoError(t, bs.Close()) })
+
+		group := int64(i)
+		inputs = append(inputs, MergeInput{
+			Index: bs,
+			Keys:  r,
+			Transform: func(v int64) (int64, error) {
+				return group<<56 | v, nil
+			},
+		})
+	}
+
+	merged, err := Merge(filepath.Join(dir, "merged.bsst"), inputs)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, merged.Close()) })
+
+	require.NoError(t, merged.Verify())
+	require.Equal(t, int64(100_000), merged.Header().Entries)
+
+	_, err = os.Stat(filepath.Join(dir, "merged.bsst.merge"))
+	require.True(t, os.IsNotExist(err))
+
+	err = (&rangeSource{0, 100_000}).List(func(c mh.Multihash, offs []int64) error {
+		r, err := merged.Get([]mh.Multihash{c})
+		require.NoError(t, err)
+
+		var group int64
+		switch {
+		case offs[0] < 6_000:
+			group = 0
+		case offs[0] < 40_000:
+			group = 1
+		default:
+			group = 2
+		}
+
+		require.Equal(t, group<<56|offs[0], r[0])
+		return nil
+	})
+	require.NoError(t, err)
+}
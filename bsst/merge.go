@@ -0,0 +1,349 @@
+package bsst
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// MergeRunEntries is the number of entries sorted in memory before being
+// spilled to disk as a sorted run while merging (~40 bytes per entry)
+var MergeRunEntries = 4 << 20
+
+// mergeLookupBatch is the number of keys looked up in input indexes at once
+const mergeLookupBatch = 4096
+
+// MergeInput is an index merged by Merge
+type MergeInput struct {
+	// Index is the index being merged, values of merged entries are read from it
+	Index *BSST
+
+	// Keys lists multihashes stored in Index. Index keys are salted hashes which
+	// can't be turned back into multihashes, so keys have to come from the data
+	// the index was created from (e.g. the group car). Listed offsets are ignored.
+	Keys Source
+
+	// Transform maps Index values into the merged index value space, e.g.
+	// packing a group id with the offset. Nil keeps values as-is.
+	Transform func(v int64) (int64, error)
+}
+
+// Merge creates a single index at path containing entries of all inputs.
+// Entries are hashed with a new salt and sorted in runs of MergeRunEntries,
+// which are spilled to a temporary directory next to path, then merged into
+// the new index, so memory use doesn't depend on the total number of entries.
+//
+// If a multihash is present in multiple inputs, the value from the first input
+// is kept. The merged header counts unique entries, which are found with an
+// extra pass over the sorted runs before the index is written.
+func Merge(path string, inputs []MergeInput, opts ...OpenOption) (*BSST, error) {
+	header := &BSSTHeader{
+		BucketSize: BucketSize,
+
+		Levels:      1,
+		LevelFactor: LevelFactor,
+		Finalized:   false,
+	}
+
+	if _, err := rand.Read(header.Salt[:]); err != nil {
+		return nil, xerrors.Errorf("generate salt: %w", err)
+	}
+
+	runDir := path + ".merge"
+	if err := os.Mkdir(runDir, 0755); err != nil {
+		return nil, xerrors.Errorf("creating merge run dir: %w", err)
+	}
+	defer os.RemoveAll(runDir) // nolint:errcheck
+
+	rw := &runWriter{
+		dir: runDir,
+		buf: make([]multiHashHash, 0, MergeRunEntries),
+	}
+
+	for i, in := range inputs {
+		if err := in.addTo(header, rw); err != nil {
+			return nil, xerrors.Errorf("reading merge input %d: %w", i, err)
+		}
+	}
+
+	err := rw.flush()
+	if err != nil {
+		return nil, err
+	}
+
+	// duplicates are only dropped when runs are merged, so count them first,
+	// the number of level 0 buckets depends on the number of entries
+	header.Entries, err = countRuns(rw.runs)
+	if err != nil {
+		return nil, err
+	}
+	header.L0Buckets = (header.Entries + MeanEntriesPerBucket - 1) / MeanEntriesPerBucket // ceil entries / MeanEntriesPerBucket
+
+	runs, err := openRuns(rw.runs)
+	if err != nil {
+		return nil, err
+	}
+	defer runs.close()
+
+	if err := writeSortedBSST(path, VersionV2, header, runs.next); err != nil {
+		return nil, err
+	}
+
+	return Open(path, opts...)
+}
+
+func (in *MergeInput) addTo(header *BSSTHeader, rw *runWriter) error {
+	keys := make([]multihash.Multihash, 0, mergeLookupBatch)
+
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+
+		vals, err := in.Index.Get(keys)
+		if err != nil {
+			return xerrors.Errorf("index lookup: %w", err)
+		}
+
+		for i, k := range keys {
+			if vals[i] == -1 {
+				return xerrors.Errorf("key %s listed by source not found in index", k)
+			}
+
+			v := vals[i]
+			if in.Transform != nil {
+				v, err = in.Transform(v)
+				if err != nil {
+					return xerrors.Errorf("transform value: %w", err)
+				}
+			}
+
+			if err := rw.add(header.makeMHH(k, 0, v)); err != nil {
+				return err
+			}
+		}
+
+		keys = keys[:0]
+		return nil
+	}
+
+	err := in.Keys.List(func(c multihash.Multihash, _ []int64) error {
+		// sources may reuse the multihash buffer
+		keys = append(keys, append(multihash.Multihash(nil), c...))
+
+		if len(keys) >= mergeLookupBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("listing keys: %w", err)
+	}
+
+	return flush()
+}
+
+// run file format: [mhh: [32]byte, off: le64]...
+const runEntrySize = 32 + 8
+
+type runWriter struct {
+	dir  string
+	buf  []multiHashHash
+	runs []string
+}
+
+func (rw *runWriter) add(e multiHashHash) error {
+	rw.buf = append(rw.buf, e)
+	if len(rw.buf) >= MergeRunEntries {
+		return rw.flush()
+	}
+	return nil
+}
+
+func (rw *runWriter) flush() error {
+	if len(rw.buf) == 0 {
+		return nil
+	}
+
+	// stable, so that on duplicates entries from earlier inputs stay first
+	sort.SliceStable(rw.buf, func(i, j int) bool {
+		return bytes.Compare(rw.buf[i].mhh[:], rw.buf[j].mhh[:]) < 0
+	})
+
+	runPath := filepath.Join(rw.dir, strconv.Itoa(len(rw.runs)))
+	f, err := os.Create(runPath)
+	if err != nil {
+		return xerrors.Errorf("create run file: %w", err)
+	}
+
+	bw := bufio.NewWriterSize(f, 4<<20)
+	var entBuf [runEntrySize]byte
+
+	for _, e := range rw.buf {
+		copy(entBuf[:], e.mhh[:])
+		binary.LittleEndian.PutUint64(entBuf[32:], uint64(e.off))
+		if _, err := bw.Write(entBuf[:]); err != nil {
+			_ = f.Close()
+			return xerrors.Errorf("write run entry: %w", err)
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		_ = f.Close()
+		return xerrors.Errorf("flush run file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return xerrors.Errorf("close run file: %w", err)
+	}
+
+	rw.runs = append(rw.runs, runPath)
+	rw.buf = rw.buf[:0]
+
+	return nil
+}
+
+type runReader struct {
+	f   *os.File
+	br  *bufio.Reader
+	cur multiHashHash
+	seq int // run order, to keep values from earlier inputs on duplicates
+}
+
+func (r *runReader) read() (bool, error) {
+	var entBuf [runEntrySize]byte
+	if _, err := io.ReadFull(r.br, entBuf[:]); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, xerrors.Errorf("read run entry: %w", err)
+	}
+
+	copy(r.cur.mhh[:], entBuf[:32])
+	r.cur.off = int64(binary.LittleEndian.Uint64(entBuf[32:]))
+	return true, nil
+}
+
+// runHeap is a k-way merge of sorted runs
+type runHeap []*runReader
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool {
+	c := bytes.Compare(h[i].cur.mhh[:], h[j].cur.mhh[:])
+	if c == 0 {
+		return h[i].seq < h[j].seq
+	}
+	return c < 0
+}
+func (h runHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)   { *h = append(*h, x.(*runReader)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+type runMerger struct {
+	h     runHeap
+	files []*os.File
+
+	last    [32]byte
+	hasLast bool
+}
+
+func openRuns(paths []string) (*runMerger, error) {
+	m := &runMerger{}
+
+	for i, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			m.close()
+			return nil, xerrors.Errorf("open run file: %w", err)
+		}
+		m.files = append(m.files, f)
+
+		r := &runReader{
+			f:   f,
+			br:  bufio.NewReaderSize(f, 1<<20),
+			seq: i,
+		}
+
+		ok, err := r.read()
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		if ok {
+			m.h = append(m.h, r)
+		}
+	}
+
+	heap.Init(&m.h)
+	return m, nil
+}
+
+// next is an entIter returning merged entries in mhh order, skipping duplicates
+func (m *runMerger) next() (multiHashHash, bool, error) {
+	for m.h.Len() > 0 {
+		r := m.h[0]
+		e := r.cur
+
+		ok, err := r.read()
+		if err != nil {
+			return multiHashHash{}, false, err
+		}
+		if ok {
+			heap.Fix(&m.h, 0)
+		} else {
+			heap.Pop(&m.h)
+		}
+
+		if m.hasLast && m.last == e.mhh {
+			// duplicate from a later input
+			continue
+		}
+		m.last = e.mhh
+		m.hasLast = true
+
+		return e, true, nil
+	}
+
+	return multiHashHash{}, false, nil
+}
+
+// countRuns returns the number of unique entries in sorted runs
+func countRuns(paths []string) (int64, error) {
+	m, err := openRuns(paths)
+	if err != nil {
+		return 0, err
+	}
+	defer m.close()
+
+	var n int64
+	for {
+		_, ok, err := m.next()
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return n, nil
+		}
+		n++
+	}
+}
+
+func (m *runMerger) close() {
+	for _, f := range m.files {
+		_ = f.Close()
+	}
+}
@@ -0,0 +1,43 @@
+package bsst
+
+import (
+	"path/filepath"
+	"testing"
+
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBSSTEmpty(t *testing.T) {
+	dir := t.TempDir()
+
+	empty, err := Create(filepath.Join(dir, "empty.bsst"), 0, &testSource{n: 0})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, empty.Close()) })
+
+	merged, err := Merge(filepath.Join(dir, "merged.bsst"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, merged.Close()) })
+
+	// merging empty inputs
+	mergedEmpty, err := Merge(filepath.Join(dir, "merged-empty.bsst"), []MergeInput{{Index: empty, Keys: &testSource{n: 0}}})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, mergedEmpty.Close()) })
+
+	err = (&testSource{n: 1}).List(func(c mh.Multihash, offs []int64) error {
+		for _, bs := range []*BSST{empty, merged, mergedEmpty} {
+			require.Zero(t, bs.Header().Entries)
+			require.NoError(t, bs.Verify())
+
+			h, err := bs.Has([]mh.Multihash{c})
+			require.NoError(t, err)
+			require.False(t, h[0])
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	// entries need buckets
+	_, err = Create(filepath.Join(dir, "bad.bsst"), 0, &testSource{n: 1})
+	require.ErrorContains(t, err, "no buckets")
+}
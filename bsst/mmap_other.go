@@ -0,0 +1,21 @@
+//go:build !unix
+
+package bsst
+
+import (
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, xerrors.Errorf("mmap not supported on this platform")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
+
+func madviseWillNeed(data []byte) error {
+	return nil
+}
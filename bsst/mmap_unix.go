@@ -0,0 +1,32 @@
+//go:build unix
+
+package bsst
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	data, err := unix.Mmap(int(f.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	// bucket access is random, readahead only pollutes the page cache
+	if err := unix.Madvise(data, unix.MADV_RANDOM); err != nil {
+		_ = unix.Munmap(data)
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func munmap(data []byte) error {
+	return unix.Munmap(data)
+}
+
+func madviseWillNeed(data []byte) error {
+	return unix.Madvise(data, unix.MADV_WILLNEED)
+}
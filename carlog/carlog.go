@@ -11,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime/debug"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -25,6 +26,7 @@ import (
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log"
 	"github.com/ipld/go-car"
+	carv2 "github.com/ipld/go-car/v2"
 	pool "github.com/libp2p/go-buffer-pool"
 
 	"github.com/lotus-web3/ribs/bsst"
@@ -38,6 +40,7 @@ const (
 	HeadSize = 512
 
 	LevelIndex     = "index.level"
+	HLogIndex      = "index.hlog"
 	BsstIndex      = "index.bsst"
 	BsstIndexCanon = "fil.bsst"
 	HashSample     = "sample.mhlist"
@@ -75,16 +78,21 @@ var placeholderCid = func() cid.Cid {
 type CarLog struct {
 	staging CarStorageProvider
 
+	fs FS
+
+	// rootedCar enables the rooted CAR layout, see AddRoots
+	rootedCar bool
+
 	// index = dir, data = file
 	IndexPath, DataPath string
 
 	// head is a file which contains cbor-map-serialized Head, padded up to head
 	// size
-	head *os.File
+	head File
 
 	// data contains a log of all written data
 	// [carv1 header][carv1 block...]
-	data *os.File
+	data File
 
 	// dataPos wraps data file, and keeps track of the current position
 	dataPos *appendCounter
@@ -152,22 +160,35 @@ type Head struct {
 	LayerOffsets []int64 // byte offsets of the start of each layer
 }
 
-func Create(staging CarStorageProvider, indexPath, dataPath string, _ TruncCleanup) (*CarLog, error) {
+// ErrNotCreated is returned by Open when the carlog doesn't exist, or Create
+// didn't complete
+var ErrNotCreated = errors.New("carlog not created")
+
+func Create(staging CarStorageProvider, indexPath, dataPath string, _ TruncCleanup, opts ...OpenOption) (_ *CarLog, err error) {
+	opt := makeOpenOptions(opts)
+
+	// files opened so far, closed if creation fails
+	var closers []io.Closer
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, c := range closers {
+			_ = c.Close()
+		}
+	}()
+
 	blkLogPath := filepath.Join(dataPath, BlockLog)
 
-	if err := os.Mkdir(indexPath, 0755); err != nil {
+	if err := opt.fs.Mkdir(indexPath, 0755); err != nil {
 		return nil, xerrors.Errorf("mkdir index path (%s): %w", indexPath, err)
 	}
 
-	headFile, err := os.OpenFile(filepath.Join(indexPath, HeadName), os.O_RDWR|os.O_SYNC|os.O_CREATE|os.O_EXCL, 0666)
-	if err != nil {
-		return nil, xerrors.Errorf("opening head: %w", err)
-	}
-
-	dataFile, err := os.OpenFile(blkLogPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	dataFile, err := opt.fs.OpenFile(blkLogPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
-		return nil, xerrors.Errorf("opening head: %w", err)
+		return nil, xerrors.Errorf("opening data: %w", err)
 	}
+	closers = append(closers, dataFile)
 
 	// setup carv1 header
 	carHead := &car.CarHeader{
@@ -186,7 +207,23 @@ func Create(staging CarStorageProvider, indexPath, dataPath string, _ TruncClean
 		return nil, xerrors.Errorf("getting car header length: %w", err)
 	}
 
-	// write head file
+	idx, err := openRWIndex(opt.fs, opt.writableIndex, opt.writableIndex.path(indexPath), true)
+	if err != nil {
+		return nil, xerrors.Errorf("creating %s index: %w", opt.writableIndex, err)
+	}
+	closers = append(closers, idx)
+
+	// write head file last, under a temp name, so that an existing head means
+	// that the carlog was fully created
+	headPath := filepath.Join(indexPath, HeadName)
+	headTempPath := headPath + ".temp"
+
+	headFile, err := opt.fs.OpenFile(headTempPath, os.O_RDWR|os.O_SYNC|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, xerrors.Errorf("opening head: %w", err)
+	}
+	closers = append(closers, headFile)
+
 	h := &Head{
 		Valid:     true,
 		RetiredAt: int64(at),
@@ -210,17 +247,16 @@ func Create(staging CarStorageProvider, indexPath, dataPath string, _ TruncClean
 		return nil, xerrors.Errorf("head sync (new head: %x): %w", headBuf[:], err)
 	}
 
-	// new index is always level
-
-	idx, err := OpenLevelDBIndex(filepath.Join(indexPath, LevelIndex), true)
-	if err != nil {
-		return nil, xerrors.Errorf("creating leveldb index: %w", err)
+	if err := opt.fs.Rename(headTempPath, headPath); err != nil {
+		return nil, xerrors.Errorf("renaming head: %w", err)
 	}
 
 	ac := &appendCounter{dataFile, int64(at)}
 
 	return &CarLog{
-		staging: staging,
+		staging:   staging,
+		fs:        opt.fs,
+		rootedCar: opt.rootedCar,
 
 		IndexPath:    indexPath,
 		DataPath:     dataPath,
@@ -238,8 +274,13 @@ func Create(staging CarStorageProvider, indexPath, dataPath string, _ TruncClean
 	}, nil
 }
 
-func Open(staging CarStorageProvider, indexPath, dataPath string, tc TruncCleanup) (*CarLog, error) {
-	headFile, err := os.OpenFile(filepath.Join(indexPath, HeadName), os.O_RDWR|os.O_SYNC, 0666)
+func Open(staging CarStorageProvider, indexPath, dataPath string, tc TruncCleanup, opts ...OpenOption) (*CarLog, error) {
+	opt := makeOpenOptions(opts)
+
+	headFile, err := opt.fs.OpenFile(filepath.Join(indexPath, HeadName), os.O_RDWR|os.O_SYNC, 0666)
+	if os.IsNotExist(err) {
+		return nil, xerrors.Errorf("opening head: %s: %w", err, ErrNotCreated)
+	}
 	if err != nil {
 		return nil, xerrors.Errorf("opening head: %w", err)
 	}
@@ -269,7 +310,9 @@ func Open(staging CarStorageProvider, indexPath, dataPath string, tc TruncCleanu
 		// todo if offloaded, check if datafile exists and remove
 
 		return &CarLog{
-			staging: staging,
+			staging:   staging,
+			fs:        opt.fs,
+			rootedCar: opt.rootedCar,
 
 			IndexPath: indexPath,
 			DataPath:  dataPath,
@@ -279,7 +322,7 @@ func Open(staging CarStorageProvider, indexPath, dataPath string, tc TruncCleanu
 	}
 
 	// open data
-	dataFile, err := os.OpenFile(blkLogPath, os.O_RDWR|os.O_SYNC, 0666)
+	dataFile, err := opt.fs.OpenFile(blkLogPath, os.O_RDWR|os.O_SYNC, 0666)
 	noDataFile := os.IsNotExist(err) && h.External && !h.Offloaded // External files may have data available only on external storage before being only available on Filecoin
 	var dataLen int64
 
@@ -306,7 +349,9 @@ func Open(staging CarStorageProvider, indexPath, dataPath string, tc TruncCleanu
 	}
 
 	jb := &CarLog{
-		staging: staging,
+		staging:   staging,
+		fs:        opt.fs,
+		rootedCar: opt.rootedCar,
 
 		IndexPath: indexPath,
 		DataPath:  dataPath,
@@ -345,46 +390,37 @@ func Open(staging CarStorageProvider, indexPath, dataPath string, tc TruncCleanu
 
 			jb.rIdx = idx
 		} else {
-			idx, err := OpenLevelDBIndex(filepath.Join(indexPath, LevelIndex), false)
-			if err != nil && !os.IsNotExist(err) {
-				return nil, xerrors.Errorf("opening leveldb index: %w", err)
+			kind, err := existingIndexKind(opt.fs, indexPath)
+			if err != nil {
+				return nil, xerrors.Errorf("checking writable index: %w", err)
 			}
-			if os.IsNotExist(err) {
-				log.Errorw("leveldb index missing, attempting to fix", "error", err, "path", filepath.Join(indexPath, LevelIndex))
 
-				idx, err = OpenLevelDBIndex(filepath.Join(indexPath, LevelIndex+".temp"), true)
-				if err != nil {
-					return nil, xerrors.Errorf("creating (fixLevelIndex) leveldb index: %w", err)
-				}
+			switch {
+			case kind == "":
+				log.Errorw("writable index missing, attempting to fix", "path", indexPath, "kind", opt.writableIndex)
 
-				err := jb.fixLevelIndex(h, idx)
+				kind = opt.writableIndex
+				err := replaceRWIndex(opt.fs, indexPath, kind, func(w WritableIndex) error {
+					return jb.fixIndex(h, w)
+				})
 				if err != nil {
-					log.Errorw("fixing leveldb index failed", "error", err, "path", filepath.Join(indexPath, LevelIndex))
-					return nil, xerrors.Errorf("fixing leveldb index: %w", err)
-				}
-
-				if err := idx.Close(); err != nil {
-					log.Errorw("closing temp level index failed", "error", err, "path", filepath.Join(indexPath, LevelIndex))
-					return nil, xerrors.Errorf("closing temp level index: %w", err)
+					log.Errorw("fixing writable index failed", "error", err, "path", indexPath)
+					return nil, xerrors.Errorf("fixing writable index: %w", err)
 				}
 
-				if err := os.RemoveAll(filepath.Join(indexPath, LevelIndex)); err != nil {
-					log.Errorw("removing old level index failed", "error", err, "path", filepath.Join(indexPath, LevelIndex))
-					return nil, xerrors.Errorf("removing old level index: %w", err)
-				}
-
-				if err := os.Rename(filepath.Join(indexPath, LevelIndex+".temp"), filepath.Join(indexPath, LevelIndex)); err != nil {
-					log.Errorw("renaming temp level index failed", "error", err, "path", filepath.Join(indexPath, LevelIndex))
-					return nil, xerrors.Errorf("renaming temp level index: %w", err)
-				}
+				log.Errorw("writable index fixed", "path", indexPath, "kind", kind)
+			case kind != opt.writableIndex && !h.ReadOnly:
+				log.Warnw("migrating writable index", "path", indexPath, "from", kind, "to", opt.writableIndex)
 
-				idx, err = OpenLevelDBIndex(filepath.Join(indexPath, LevelIndex), false)
-				if err != nil {
-					log.Errorw("opening fixed leveldb index failed", "error", err, "path", filepath.Join(indexPath, LevelIndex))
-					return nil, xerrors.Errorf("opening fixed leveldb index: %w", err)
+				if err := migrateRWIndex(opt.fs, indexPath, kind, opt.writableIndex); err != nil {
+					return nil, err
 				}
+				kind = opt.writableIndex
+			}
 
-				log.Errorw("leveldb index fixed", "path", filepath.Join(indexPath, LevelIndex))
+			idx, err := openRWIndex(opt.fs, kind, kind.path(indexPath), false)
+			if err != nil {
+				return nil, xerrors.Errorf("opening %s index: %w", kind, err)
 			}
 
 			jb.rIdx = idx
@@ -422,6 +458,9 @@ func Open(staging CarStorageProvider, indexPath, dataPath string, tc TruncCleanu
 			return nil, xerrors.Errorf("stat top-trunc data len: %w", err)
 		}
 		dataLen = dataInfo.Size()
+
+		jb.dataEnd = 0
+		jb.dataLen = dataLen
 	}
 
 	// todo right now we're calling this on every startup when writable
@@ -507,7 +546,8 @@ func (j *CarLog) truncate(offset, size int64, onRemove TruncCleanup) error {
 	return nil
 }
 
-func (j *CarLog) fixLevelIndex(h Head, w WritableIndex) error {
+// fixIndex rebuilds the writable index from data
+func (j *CarLog) fixIndex(h Head, w WritableIndex) error {
 	mhsBuf := make([]mh.Multihash, 0, 50000)
 	offsBuf := make([]int64, 0, 50000)
 
@@ -526,7 +566,7 @@ func (j *CarLog) fixLevelIndex(h Head, w WritableIndex) error {
 			mhsBuf = mhsBuf[:0]
 			offsBuf = offsBuf[:0]
 
-			log.Errorw("fixLevelIndex", "done", done)
+			log.Errorw("fixIndex", "done", done)
 		}
 
 		return nil
@@ -557,7 +597,8 @@ type WritableIndex interface {
 	// Truncate returns a list of multihashes to remove from the index
 	ToTruncate(atOrAbove int64) ([]mh.Multihash, error)
 
-	// todo Sync() error
+	// Sync makes all previous Put / Del calls durable
+	Sync() error
 
 	Close() error
 }
@@ -727,8 +768,10 @@ func (j *CarLog) Commit() (int64, error) {
 		return 0, xerrors.Errorf("sync data: %w", err)
 	}
 
-	// todo index is sync for now, and we're single threaded, so if there were any
-	// puts, just update head
+	// index entries for committed data must be durable before the head is moved
+	if err := j.wIdx.Sync(); err != nil {
+		return 0, xerrors.Errorf("sync index: %w", err)
+	}
 
 	err := j.mutHead(func(h *Head) error {
 		if h.RetiredAt == j.dataLen {
@@ -1073,8 +1116,8 @@ func (j *CarLog) Finalize(ctx context.Context) error {
 			if err != nil {
 				return err
 			}
-			if err := j.dropLevel(); err != nil {
-				return xerrors.Errorf("drop level index: %w", err)
+			if err := j.dropWritableIndex(); err != nil {
+				return xerrors.Errorf("drop writable index: %w", err)
 			}
 
 			if !hasTop {
@@ -1150,13 +1193,21 @@ func (j *CarLog) Finalize(ctx context.Context) error {
 			if err != nil {
 				return err
 			}
-			if err := j.dropLevel(); err != nil {
-				return xerrors.Errorf("drop level index: %w", err)
+			if err := j.dropWritableIndex(); err != nil {
+				return xerrors.Errorf("drop writable index: %w", err)
 			}
 
 			// local data dropped after CommP
 		}
+	} else {
+		j.idxLk.Unlock()
 
+		// finalized, but the top car may not have been written before a crash
+		if !hasTop {
+			if err := j.genTopCar(); err != nil {
+				return xerrors.Errorf("generating top car: %w", err)
+			}
+		}
 	}
 
 	return nil
@@ -1177,7 +1228,7 @@ func (j *CarLog) LoadData(ctx context.Context, car io.Reader, sz int64) error {
 
 	// closed head means that we're offloaded, open data file
 	filPath := filepath.Join(j.DataPath, FilCar)
-	df, err := os.OpenFile(filPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	df, err := j.fs.OpenFile(filPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return xerrors.Errorf("opening data file: %w", err)
 	}
@@ -1189,7 +1240,7 @@ func (j *CarLog) LoadData(ctx context.Context, car io.Reader, sz int64) error {
 
 	if err != nil {
 		// remove file
-		rerr := os.Remove(filPath)
+		rerr := j.fs.Remove(filPath)
 		if rerr != nil {
 			log.Errorf("removing file after failed copy: %s", rerr)
 		}
@@ -1199,7 +1250,7 @@ func (j *CarLog) LoadData(ctx context.Context, car io.Reader, sz int64) error {
 
 	if n != sz {
 		// remove file
-		rerr := os.Remove(filPath)
+		rerr := j.fs.Remove(filPath)
 		if rerr != nil {
 			log.Errorf("removing file after failed copy: %s", rerr)
 		}
@@ -1255,7 +1306,7 @@ func (j *CarLog) FinDataReload(ctx context.Context, blkEnts int64, carSz int64)
 
 	// closed head means that we're offloaded, open data file
 	filPath := filepath.Join(j.DataPath, FilCar)
-	df, err := os.OpenFile(filPath, os.O_RDONLY, 0644)
+	df, err := j.fs.OpenFile(filPath, os.O_RDONLY, 0644)
 	if err != nil {
 		return xerrors.Errorf("opening data file: %w", err)
 	}
@@ -1315,14 +1366,14 @@ func (j *CarLog) FinDataReload(ctx context.Context, blkEnts int64, carSz int64)
 	}
 
 	// cleanup fil.car
-	if err := os.Remove(filPath); err != nil {
+	if err := j.fs.Remove(filPath); err != nil {
 		return xerrors.Errorf("removing fil.car: %w", err)
 	}
 
 	// if not-extern: todo
 
 	// reopen head
-	headFile, err := os.OpenFile(filepath.Join(j.IndexPath, HeadName), os.O_RDWR|os.O_SYNC, 0666)
+	headFile, err := j.fs.OpenFile(filepath.Join(j.IndexPath, HeadName), os.O_RDWR|os.O_SYNC, 0666)
 	if err != nil {
 		return xerrors.Errorf("opening head: %w", err)
 	}
@@ -1364,16 +1415,12 @@ func (j *CarLog) FinDataReload(ctx context.Context, blkEnts int64, carSz int64)
 	return nil
 }
 
-func (j *CarLog) dropLevel() error {
+func (j *CarLog) dropWritableIndex() error {
 	if j.wIdx != nil {
-		return xerrors.Errorf("cannot drop level on read-write jbob")
+		return xerrors.Errorf("cannot drop writable index on read-write jbob")
 	}
 
-	if err := os.RemoveAll(filepath.Join(j.IndexPath, LevelIndex)); err != nil {
-		return xerrors.Errorf("removing leveldb index: %w", err)
-	}
-
-	return nil
+	return dropRWIndexes(j.fs, j.IndexPath)
 }
 
 // ARITY IS A FUNDAMENTAL PARAMETER, IT CANNOT BE CHANGED without rewriting all data
@@ -1436,8 +1483,14 @@ func (j *CarLog) genTopCar() error {
 		return nil
 	}
 
+	// data block offsets, for the rooted car layout
+	var dataOffs []int64
+
 	err = j.iterate(j.dataEnd, func(off int64, length uint64, c cid.Cid, data []byte) error {
 		curLinks = append(curLinks, c)
+		if j.rootedCar {
+			dataOffs = append(dataOffs, off)
+		}
 
 		if len(curLinks) == arity {
 			if err := writeLinkBlock(curLinks); err != nil {
@@ -1533,6 +1586,10 @@ func (j *CarLog) genTopCar() error {
 		}
 	}
 
+	if err := j.genLayout(dataOffs); err != nil {
+		return xerrors.Errorf("generating car layout: %w", err)
+	}
+
 	j.readStateLk.Lock()
 	j.layerOffsets = layerOffsets
 
@@ -1553,6 +1610,12 @@ func (j *CarLog) genTopCar() error {
 
 // returns car size and root cid
 func (j *CarLog) WriteCar(w io.Writer) (int64, cid.Cid, error) {
+	return j.writeCar(w, nil)
+}
+
+// writeCar writes the deal CAR, calling onBlock with the offset of each
+// section relative to the start of the CAR
+func (j *CarLog) writeCar(w io.Writer, onBlock func(c cid.Cid, off int64)) (int64, cid.Cid, error) {
 	// todo support serving from fil.car
 
 	j.readStateLk.Lock()
@@ -1589,17 +1652,59 @@ func (j *CarLog) WriteCar(w io.Writer) (int64, cid.Cid, error) {
 		return 0, cid.Undef, xerrors.Errorf("reading root block (lo: %#v; rsat: %d, rsbase: %d; data: %v): %w", j.layerOffsets, layers[len(layers)-1].rs.(*readSeekerFromReaderAt).pos, layers[len(layers)-1].rs.(*readSeekerFromReaderAt).base, j.data, err)
 	}
 
+	layout, err := j.readLayout()
+	if err != nil {
+		return 0, cid.Undef, xerrors.Errorf("reading car layout: %w", err)
+	}
+
 	// todo consider buffering the writes
 
 	sw := &sizerWriter{w: w}
 	w = sw
 
+	roots := []cid.Cid{rcid}
+	if layout != nil {
+		roots = append(roots, layout.roots...)
+	}
+
 	if err := car.WriteHeader(&car.CarHeader{
-		Roots:   []cid.Cid{rcid},
+		Roots:   roots,
 		Version: 1,
 	}, w); err != nil {
 		return 0, cid.Undef, xerrors.Errorf("write car header: %w", err)
 	}
+
+	// with the rooted layout, user DAGs go first, and are skipped in the top tree
+	var written []int64
+	if layout != nil {
+		var entBuf []byte
+		for _, loc := range layout.order {
+			entBuf, err = j.readEntry(loc, entBuf)
+			if err != nil {
+				return 0, cid.Undef, xerrors.Errorf("reading dag block: %w", err)
+			}
+			if onBlock != nil {
+				_, c, err := cid.CidFromBytes(entBuf)
+				if err != nil {
+					return 0, cid.Undef, xerrors.Errorf("parsing dag block cid: %w", err)
+				}
+				onBlock(c, sw.s)
+			}
+			if err := carutil.LdWrite(w, entBuf); err != nil {
+				return 0, cid.Undef, xerrors.Errorf("writing dag block: %w", err)
+			}
+
+			off, _ := fromOffsetLen(loc)
+			written = append(written, off)
+		}
+
+		sort.Slice(written, func(i, k int) bool { return written[i] < written[k] })
+	}
+	isWritten := func(off int64) bool {
+		i := sort.Search(len(written), func(i int) bool { return written[i] >= off })
+		return i < len(written) && written[i] == off
+	}
+	dataAt := j.layerOffsets[0]
 	_, err = layers[len(layers)-1].rs.Seek(0, io.SeekStart)
 	if err != nil {
 		return 0, cid.Undef, xerrors.Errorf("seeking to start of last layer: %w", err)
@@ -1611,6 +1716,9 @@ func (j *CarLog) WriteCar(w io.Writer) (int64, cid.Cid, error) {
 	var writeNode func(c cid.Cid, data []byte, atLayer int) error
 	writeNode = func(c cid.Cid, data []byte, atLayer int) error {
 		// write block
+		if onBlock != nil {
+			onBlock(c, sw.s)
+		}
 		if err := carutil.LdWrite(w, c.Bytes(), data); err != nil {
 			return xerrors.Errorf("writing node from layer %d: %w", atLayer, err)
 		}
@@ -1642,6 +1750,15 @@ func (j *CarLog) WriteCar(w io.Writer) (int64, cid.Cid, error) {
 				return xerrors.Errorf("expected cid %s, got %s, layer %d", ci, c, atLayer)
 			}
 
+			if atLayer-1 == 0 {
+				at := dataAt
+				dataAt += int64(carutil.LdSize(c.Bytes(), data))
+
+				if isWritten(at) {
+					continue
+				}
+			}
+
 			// write block
 			if err := writeNode(c, data, atLayer-1); err != nil {
 				return err
@@ -1658,6 +1775,63 @@ func (j *CarLog) WriteCar(w io.Writer) (int64, cid.Cid, error) {
 	return sw.s, rcid, nil
 }
 
+// CarSize returns the size of the CAR written by WriteCar. Reads the whole CAR
+func (j *CarLog) CarSize() (int64, error) {
+	n, _, err := j.WriteCar(io.Discard)
+	return n, err
+}
+
+// WriteCarV2 writes the deal CAR wrapped in a CARv2 with a MultihashIndexSorted
+// index of all blocks, so that it can be imported elsewhere without
+// re-indexing. carSize is the size of the CAR written by WriteCar, needed
+// upfront for the CARv2 header. Returns the size of the CARv2.
+//
+// Index records are sorted in runs of CarV2IndexRunEntries spilled to a
+// temporary directory under IndexPath, so memory use doesn't depend on the
+// number of blocks.
+func (j *CarLog) WriteCarV2(w io.Writer, carSize int64) (int64, cid.Cid, error) {
+	hdr := carv2.NewHeader(uint64(carSize))
+	hdr.Characteristics.SetFullyIndexed(true)
+
+	if _, err := w.Write(carv2.Pragma); err != nil {
+		return 0, cid.Undef, xerrors.Errorf("write carv2 pragma: %w", err)
+	}
+	if _, err := hdr.WriteTo(w); err != nil {
+		return 0, cid.Undef, xerrors.Errorf("write carv2 header: %w", err)
+	}
+
+	iw, err := newMHIndexWriter(j.IndexPath)
+	if err != nil {
+		return 0, cid.Undef, err
+	}
+	defer iw.cleanup() // nolint:errcheck
+
+	// multihashes aren't stored in bsst indexes, so collect them from the
+	// written sections
+	var idxErr error
+	n, root, err := j.writeCar(w, func(c cid.Cid, off int64) {
+		if idxErr == nil {
+			idxErr = iw.add(c, uint64(off))
+		}
+	})
+	if err != nil {
+		return 0, cid.Undef, err
+	}
+	if idxErr != nil {
+		return 0, cid.Undef, xerrors.Errorf("building carv2 index: %w", idxErr)
+	}
+	if n != carSize {
+		return 0, cid.Undef, xerrors.Errorf("car size %d doesn't match expected %d", n, carSize)
+	}
+
+	in, err := iw.writeTo(w)
+	if err != nil {
+		return 0, cid.Undef, xerrors.Errorf("write carv2 index: %w", err)
+	}
+
+	return int64(hdr.IndexOffset) + in, root, nil
+}
+
 type cardata struct {
 	rs io.ReadSeeker
 	br *bufio.Reader
@@ -1825,10 +1999,10 @@ func (j *CarLog) Offload() error {
 	}
 
 	// remove indexes
-	if err := os.RemoveAll(filepath.Join(j.IndexPath, BsstIndex)); err != nil {
+	if err := j.fs.RemoveAll(filepath.Join(j.IndexPath, BsstIndex)); err != nil {
 		return xerrors.Errorf("removing bsst index: %w", err)
 	}
-	if err := os.RemoveAll(filepath.Join(j.IndexPath, BsstIndexCanon)); err != nil {
+	if err := j.fs.RemoveAll(filepath.Join(j.IndexPath, BsstIndexCanon)); err != nil {
 		return xerrors.Errorf("removing external bsst index: %w", err)
 	}
 
@@ -1857,7 +2031,7 @@ func (j *CarLog) offloadData() error {
 
 	// remove data file
 	blkLogPath := filepath.Join(j.DataPath, BlockLog)
-	if err := os.RemoveAll(blkLogPath); err != nil {
+	if err := j.fs.RemoveAll(blkLogPath); err != nil {
 		return xerrors.Errorf("removing data file: %w", err)
 	}
 
@@ -13,6 +13,11 @@ import (
 
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipld/go-car"
+	carv2 "github.com/ipld/go-car/v2"
+	carbs "github.com/ipld/go-car/v2/blockstore"
+	carindex "github.com/ipld/go-car/v2/index"
 	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/xerrors"
@@ -29,7 +34,7 @@ func TestCarLogBasic(t *testing.T) {
 		}
 	})
 
-	jb, err := Create(nil, filepath.Join(td, "index"), filepath.Join(td, "data.car"), nil)
+	jb, err := Create(nil, filepath.Join(td, "index"), td, nil)
 	require.NoError(t, err)
 
 	b := blocks.NewBlock([]byte("hello world"))
@@ -56,7 +61,7 @@ func TestCarLogBasic(t *testing.T) {
 		return nil
 	}
 
-	jb, err = Open(nil, filepath.Join(td, "index"), filepath.Join(td, "data.car"), noTrunc)
+	jb, err = Open(nil, filepath.Join(td, "index"), td, noTrunc)
 	require.NoError(t, err)
 
 	// test that we can read the data back out again
@@ -81,7 +86,7 @@ func TestCarLogBasic(t *testing.T) {
 	err = jb.Close()
 	require.NoError(t, err)
 
-	jb, err = Open(nil, filepath.Join(td, "index"), filepath.Join(td, "data.car"), noTrunc)
+	jb, err = Open(nil, filepath.Join(td, "index"), td, noTrunc)
 	require.NoError(t, err)
 
 	err = jb.View([]multihash.Multihash{h}, func(i int, found bool, b []byte) error {
@@ -113,7 +118,7 @@ func TestCarLogBasic(t *testing.T) {
 
 	require.NoError(t, jb.Close())
 	// test open offloaded
-	jb, err = Open(nil, filepath.Join(td, "index"), filepath.Join(td, "data.car"), noTrunc)
+	jb, err = Open(nil, filepath.Join(td, "index"), td, noTrunc)
 	require.NoError(t, err)
 
 	err = jb.View([]multihash.Multihash{h}, func(i int, found bool, b []byte) error {
@@ -128,6 +133,356 @@ func TestCarLogBasic(t *testing.T) {
 	require.NoError(t, jb.Close())
 }
 
+func testBlocks(t *testing.T, n int) ([]multihash.Multihash, []blocks.Block) {
+	mhList := make([]multihash.Multihash, n)
+	blockList := make([]blocks.Block, n)
+
+	for i := 0; i < n; i++ {
+		data := make([]byte, 64)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		mh, err := multihash.Sum(data, multihash.SHA2_256, -1)
+		require.NoError(t, err)
+
+		b, _ := blocks.NewBlockWithCid(data, cid.NewCidV1(cid.Raw, mh))
+		mhList[i] = b.Cid().Hash()
+		blockList[i] = b
+	}
+
+	return mhList, blockList
+}
+
+func requireBlocks(t *testing.T, jb *CarLog, mhList []multihash.Multihash, blockList []blocks.Block) {
+	err := jb.View(mhList, func(i int, found bool, b []byte) error {
+		require.True(t, found)
+		require.Equal(t, blockList[i].RawData(), b)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCarLogRootedCar(t *testing.T) {
+	td := t.TempDir()
+	indexPath := filepath.Join(td, "index")
+
+	jb, err := Create(nil, indexPath, td, nil, WithRootedCar(true))
+	require.NoError(t, err)
+
+	put := func(blks ...blocks.Block) {
+		mhs := make([]multihash.Multihash, len(blks))
+		for i, b := range blks {
+			mhs[i] = b.Cid().Hash()
+		}
+		require.NoError(t, jb.Put(mhs, blks))
+	}
+	node := func(links ...cid.Cid) blocks.Block {
+		nd, err := cbor.WrapObject(links, multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		return nd
+	}
+
+	_, fill := testBlocks(t, 20)
+	_, leaves := testBlocks(t, 4)
+	left := node(leaves[0].Cid(), leaves[1].Cid())
+	right := node(leaves[2].Cid(), leaves[3].Cid())
+	root := node(left.Cid(), right.Cid())
+
+	// bottom-up, interleaved with unrelated blocks
+	put(fill[:10]...)
+	put(leaves...)
+	put(fill[10:]...)
+	put(left, right, root)
+
+	require.NoError(t, jb.AddRoots([]cid.Cid{root.Cid()}))
+
+	_, err = jb.Commit()
+	require.NoError(t, err)
+	require.NoError(t, jb.MarkReadOnly())
+	require.NoError(t, jb.Finalize(context.TODO()))
+
+	var carBuf bytes.Buffer
+	_, topRoot, err := jb.WriteCar(&carBuf)
+	require.NoError(t, err)
+	carBytes := carBuf.Bytes()
+
+	cr, err := car.NewCarReader(&carBuf)
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{topRoot, root.Cid()}, cr.Header.Roots)
+
+	var order []multihash.Multihash
+	seen := map[string]int{}
+	for {
+		b, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		order = append(order, b.Cid().Hash())
+		seen[string(b.Cid().Hash())]++
+	}
+
+	// the user dag comes first, depth-first
+	dag := []blocks.Block{root, left, leaves[0], leaves[1], right, leaves[2], leaves[3]}
+	for i, b := range dag {
+		require.Equal(t, b.Cid().Hash(), order[i], "block %d", i)
+	}
+
+	// all blocks are still there, once
+	for _, b := range append(fill, dag...) {
+		require.Equal(t, 1, seen[string(b.Cid().Hash())], "block %s", b.Cid())
+	}
+	for k, n := range seen {
+		require.Equal(t, 1, n, "block %s", multihash.Multihash(k))
+	}
+
+	// the layout is persisted
+	require.NoError(t, jb.Close())
+	jb, err = Open(nil, indexPath, td, nil)
+	require.NoError(t, err)
+
+	carBuf.Reset()
+	_, _, err = jb.WriteCar(&carBuf)
+	require.NoError(t, err)
+	require.Equal(t, carBytes, carBuf.Bytes())
+	require.NoError(t, jb.Close())
+}
+
+func TestCarLogWriteCarV2(t *testing.T) {
+	td := t.TempDir()
+
+	// force multiple sorted index runs
+	defer func(e int) { CarV2IndexRunEntries = e }(CarV2IndexRunEntries)
+	CarV2IndexRunEntries = 64
+
+	jb, err := Create(nil, filepath.Join(td, "index"), td, nil)
+	require.NoError(t, err)
+
+	mhs, blks := testBlocks(t, 300)
+	require.NoError(t, jb.Put(mhs, blks))
+
+	_, err = jb.Commit()
+	require.NoError(t, err)
+	require.NoError(t, jb.MarkReadOnly())
+	require.NoError(t, jb.Finalize(context.TODO()))
+
+	var carBuf bytes.Buffer
+	carSize, root, err := jb.WriteCar(&carBuf)
+	require.NoError(t, err)
+
+	size, err := jb.CarSize()
+	require.NoError(t, err)
+	require.Equal(t, carSize, size)
+
+	var v2Buf bytes.Buffer
+	v2Size, v2Root, err := jb.WriteCarV2(&v2Buf, carSize)
+	require.NoError(t, err)
+	require.Equal(t, root, v2Root)
+	require.Equal(t, int64(v2Buf.Len()), v2Size)
+	require.NoError(t, jb.Close())
+
+	cr, err := carv2.NewReader(bytes.NewReader(v2Buf.Bytes()))
+	require.NoError(t, err)
+	require.True(t, cr.Header.Characteristics.IsFullyIndexed())
+
+	// the payload is the plain deal car
+	dr, err := cr.DataReader()
+	require.NoError(t, err)
+	payload, err := io.ReadAll(dr)
+	require.NoError(t, err)
+	require.Equal(t, carBuf.Bytes(), payload)
+
+	// and all blocks can be read through the embedded index
+	bs, err := carbs.NewReadOnly(bytes.NewReader(v2Buf.Bytes()), nil)
+	require.NoError(t, err)
+
+	for _, b := range blks {
+		got, err := bs.Get(context.TODO(), b.Cid())
+		require.NoError(t, err)
+		require.Equal(t, b.RawData(), got.RawData())
+	}
+
+	has, err := bs.Has(context.TODO(), root)
+	require.NoError(t, err)
+	require.True(t, has)
+
+	// run files are removed
+	ents, err := os.ReadDir(filepath.Join(td, "index"))
+	require.NoError(t, err)
+	for _, e := range ents {
+		require.NotContains(t, e.Name(), "carv2-index-")
+	}
+}
+
+func TestMHIndexWriter(t *testing.T) {
+	defer func(e int) { CarV2IndexRunEntries = e }(CarV2IndexRunEntries)
+	CarV2IndexRunEntries = 100
+
+	iw, err := newMHIndexWriter(t.TempDir())
+	require.NoError(t, err)
+	defer iw.cleanup() // nolint:errcheck
+
+	// multiple hash functions and digest widths
+	var records []carindex.Record
+	for i := 0; i < 1000; i++ {
+		data := make([]byte, 16+i%8)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		var c cid.Cid
+		switch i % 3 {
+		case 0:
+			h, err := multihash.Sum(data, multihash.SHA2_256, -1)
+			require.NoError(t, err)
+			c = cid.NewCidV1(cid.Raw, h)
+		case 1:
+			h, err := multihash.Sum(data, multihash.BLAKE2B_MIN+31, -1)
+			require.NoError(t, err)
+			c = cid.NewCidV1(cid.DagCBOR, h)
+		default:
+			h, err := multihash.Sum(data, multihash.IDENTITY, -1)
+			require.NoError(t, err)
+			c = cid.NewCidV1(cid.Raw, h)
+		}
+
+		records = append(records, carindex.Record{Cid: c, Offset: uint64(i) * 100})
+		require.NoError(t, iw.add(c, uint64(i)*100))
+	}
+
+	var got bytes.Buffer
+	n, err := iw.writeTo(&got)
+	require.NoError(t, err)
+	require.Equal(t, int64(got.Len()), n)
+
+	// same bytes as the in-memory go-car index
+	idx := carindex.NewMultihashSorted()
+	require.NoError(t, idx.Load(records))
+
+	var expect bytes.Buffer
+	_, err = carindex.WriteTo(idx, &expect)
+	require.NoError(t, err)
+
+	require.Equal(t, expect.Bytes(), got.Bytes())
+}
+
+func TestCarLogHashLogIndex(t *testing.T) {
+	td := t.TempDir()
+	indexPath, dataPath := filepath.Join(td, "index"), td
+
+	noTrunc := func(to int64, h []multihash.Multihash) error {
+		require.Fail(t, "not expected")
+		return nil
+	}
+
+	jb, err := Create(nil, indexPath, dataPath, nil, WithWritableIndex(IndexHashLog))
+	require.NoError(t, err)
+
+	mhList, blockList := testBlocks(t, 3000)
+
+	require.NoError(t, jb.Put(mhList, blockList))
+	_, err = jb.Commit()
+	require.NoError(t, err)
+	require.NoError(t, jb.Close())
+
+	_, err = os.Stat(filepath.Join(indexPath, HLogIndex))
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(indexPath, LevelIndex))
+	require.True(t, os.IsNotExist(err))
+
+	// simulate a torn index write
+	f, err := os.OpenFile(filepath.Join(indexPath, HLogIndex), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{hlogOpPut, 1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	jb, err = Open(nil, indexPath, dataPath, noTrunc, WithWritableIndex(IndexHashLog))
+	require.NoError(t, err)
+
+	requireBlocks(t, jb, mhList, blockList)
+
+	// keep writing after replay
+	mhList2, blockList2 := testBlocks(t, 100)
+	require.NoError(t, jb.Put(mhList2, blockList2))
+	_, err = jb.Commit()
+	require.NoError(t, err)
+
+	requireBlocks(t, jb, mhList2, blockList2)
+
+	require.NoError(t, jb.MarkReadOnly())
+	require.NoError(t, jb.Finalize(context.TODO()))
+
+	requireBlocks(t, jb, mhList, blockList)
+
+	_, err = os.Stat(filepath.Join(indexPath, HLogIndex))
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, jb.Close())
+}
+
+func TestHashLogIndexListSorted(t *testing.T) {
+	idx, err := OpenHashLogIndex(filepath.Join(t.TempDir(), HLogIndex), true)
+	require.NoError(t, err)
+	defer idx.Close()
+
+	mhList, _ := testBlocks(t, 1000)
+	offs := make([]int64, len(mhList))
+	for i := range offs {
+		offs[i] = int64(i)
+	}
+	require.NoError(t, idx.Put(mhList, offs))
+
+	var prev multihash.Multihash
+	var n int
+	require.NoError(t, idx.List(func(c multihash.Multihash, _ []int64) error {
+		require.Negative(t, bytes.Compare(prev, c))
+		prev = append(prev[:0], c...)
+		n++
+		return nil
+	}))
+	require.Equal(t, len(mhList), n)
+}
+
+func TestCarLogIndexMigration(t *testing.T) {
+	td := t.TempDir()
+	indexPath, dataPath := filepath.Join(td, "index"), td
+
+	noTrunc := func(to int64, h []multihash.Multihash) error {
+		require.Fail(t, "not expected")
+		return nil
+	}
+
+	jb, err := Create(nil, indexPath, dataPath, nil)
+	require.NoError(t, err)
+
+	mhList, blockList := testBlocks(t, 3000)
+
+	require.NoError(t, jb.Put(mhList, blockList))
+	_, err = jb.Commit()
+	require.NoError(t, err)
+	require.NoError(t, jb.Close())
+
+	// reopen with hashlog, migrating the level index
+	jb, err = Open(nil, indexPath, dataPath, noTrunc, WithWritableIndex(IndexHashLog))
+	require.NoError(t, err)
+
+	kind, err := existingIndexKind(OSFS{}, indexPath)
+	require.NoError(t, err)
+	require.Equal(t, IndexHashLog, kind)
+
+	requireBlocks(t, jb, mhList, blockList)
+	require.NoError(t, jb.Close())
+
+	// missing index is rebuilt from data
+	require.NoError(t, os.Remove(filepath.Join(indexPath, HLogIndex)))
+
+	jb, err = Open(nil, indexPath, dataPath, noTrunc, WithWritableIndex(IndexHashLog))
+	require.NoError(t, err)
+
+	requireBlocks(t, jb, mhList, blockList)
+	require.NoError(t, jb.Close())
+}
+
 func TestCarLog3K(t *testing.T) {
 	td := t.TempDir()
 	t.Cleanup(func() {
@@ -139,7 +494,7 @@ func TestCarLog3K(t *testing.T) {
 		}
 	})
 
-	jb, err := Create(nil, filepath.Join(td, "index"), filepath.Join(td, "data.car"), nil)
+	jb, err := Create(nil, filepath.Join(td, "index"), td, nil)
 	require.NoError(t, err)
 
 	const numBlocks = 3000
@@ -191,7 +546,7 @@ func TestCarLog3K(t *testing.T) {
 		return nil
 	}
 
-	jb, err = Open(nil, filepath.Join(td, "index"), filepath.Join(td, "data.car"), noTrunc)
+	jb, err = Open(nil, filepath.Join(td, "index"), td, noTrunc)
 	require.NoError(t, err)
 
 	err = jb.View(mhList, func(i int, found bool, b []byte) error {
@@ -212,7 +567,7 @@ func TestCarLog3K(t *testing.T) {
 	require.NoError(t, err)
 
 	//require.NoError(t, VerifyCar(filepath.Join(td, "canon.car")))
-	//require.NoError(t, VerifyCar(filepath.Join(td, "data.car")))
+	//require.NoError(t, VerifyCar(td))
 }
 
 /*
@@ -286,7 +641,7 @@ func TestCarStaging(t *testing.T) {
 
 	tsp := &testStagingProvider{}
 
-	jb, err := Create(tsp, filepath.Join(td, "index"), filepath.Join(td, "data.car"), nil)
+	jb, err := Create(tsp, filepath.Join(td, "index"), td, nil)
 	require.NoError(t, err)
 
 	const numBlocks = 3000
@@ -334,7 +689,7 @@ func TestCarStaging(t *testing.T) {
 		return nil
 	}
 
-	jb, err = Open(tsp, filepath.Join(td, "index"), filepath.Join(td, "data.car"), noTrunc)
+	jb, err = Open(tsp, filepath.Join(td, "index"), td, noTrunc)
 	require.NoError(t, err)
 
 	err = jb.View(mhList, func(i int, found bool, b []byte) error {
@@ -355,7 +710,7 @@ func TestCarStaging(t *testing.T) {
 	err = jb.Close()
 	require.NoError(t, err)
 
-	jb, err = Open(tsp, filepath.Join(td, "index"), filepath.Join(td, "data.car"), noTrunc)
+	jb, err = Open(tsp, filepath.Join(td, "index"), td, noTrunc)
 	require.NoError(t, err)
 
 	err = jb.View(mhList, func(i int, found bool, b []byte) error {
@@ -396,6 +751,13 @@ func (t *testStagingProvider) Upload(ctx context.Context, size int64, src func(w
 	return nil
 }
 
+func (t *testStagingProvider) Has(ctx context.Context) (bool, error) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	return len(t.bdata) > 0, nil
+}
+
 func (t *testStagingProvider) ReadCar(ctx context.Context, off, size int64) (io.ReadCloser, error) {
 	t.lk.Lock()
 	defer t.lk.Unlock()
@@ -0,0 +1,284 @@
+package carlog
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// CarV2IndexRunEntries is the number of records sorted in memory before being
+// spilled to disk as a sorted run while writing a CARv2 index
+var CarV2IndexRunEntries = 1 << 20
+
+/*
+mhIndexWriter writes a CARv2 MultihashIndexSorted index, byte-for-byte the same
+as carindex.MultihashIndexSorted, without keeping all records in memory.
+
+index: [codec: uvarint(0x0401)][codes: le32][code...]
+code: [code: le64][widths: le32][width...]             (sorted by code)
+width: [width: le32][bytes: le64][[digest][off: le64]...] (sorted by width, then digest)
+
+width is the digest length + 8. Records are sorted in runs of
+CarV2IndexRunEntries, spilled to a temporary directory, then merged while the
+index is written.
+
+run file format: [code: uvarint][digestLen: uvarint][digest][off: le64]...
+*/
+type mhIndexWriter struct {
+	dir  string
+	buf  []mhIndexRecord
+	runs []string
+
+	// records per multihash code and digest length
+	counts map[uint64]map[int]int64
+}
+
+type mhIndexRecord struct {
+	code   uint64
+	digest []byte
+	off    uint64
+}
+
+func (a *mhIndexRecord) less(b *mhIndexRecord) bool {
+	if a.code != b.code {
+		return a.code < b.code
+	}
+	if len(a.digest) != len(b.digest) {
+		return len(a.digest) < len(b.digest)
+	}
+	return bytes.Compare(a.digest, b.digest) < 0
+}
+
+// newMHIndexWriter creates a writer spilling runs to a new directory in dir,
+// which is removed by cleanup
+func newMHIndexWriter(dir string) (*mhIndexWriter, error) {
+	runDir, err := os.MkdirTemp(dir, "carv2-index-")
+	if err != nil {
+		return nil, xerrors.Errorf("creating index run dir: %w", err)
+	}
+
+	return &mhIndexWriter{
+		dir:    runDir,
+		counts: map[uint64]map[int]int64{},
+	}, nil
+}
+
+func (w *mhIndexWriter) add(c cid.Cid, off uint64) error {
+	dm, err := multihash.Decode(c.Hash())
+	if err != nil {
+		return xerrors.Errorf("decoding multihash: %w", err)
+	}
+
+	if w.counts[dm.Code] == nil {
+		w.counts[dm.Code] = map[int]int64{}
+	}
+	w.counts[dm.Code][len(dm.Digest)]++
+
+	w.buf = append(w.buf, mhIndexRecord{code: dm.Code, digest: dm.Digest, off: off})
+	if len(w.buf) >= CarV2IndexRunEntries {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *mhIndexWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	sort.Slice(w.buf, func(i, j int) bool {
+		return w.buf[i].less(&w.buf[j])
+	})
+
+	runPath := filepath.Join(w.dir, strconv.Itoa(len(w.runs)))
+	f, err := os.Create(runPath)
+	if err != nil {
+		return xerrors.Errorf("create run file: %w", err)
+	}
+
+	bw := bufio.NewWriterSize(f, 1<<20)
+	var entBuf []byte
+
+	for _, r := range w.buf {
+		entBuf = binary.AppendUvarint(entBuf[:0], r.code)
+		entBuf = binary.AppendUvarint(entBuf, uint64(len(r.digest)))
+		entBuf = append(entBuf, r.digest...)
+		entBuf = binary.LittleEndian.AppendUint64(entBuf, r.off)
+
+		if _, err := bw.Write(entBuf); err != nil {
+			_ = f.Close()
+			return xerrors.Errorf("write run entry: %w", err)
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		_ = f.Close()
+		return xerrors.Errorf("flush run file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return xerrors.Errorf("close run file: %w", err)
+	}
+
+	w.runs = append(w.runs, runPath)
+	w.buf = w.buf[:0]
+
+	return nil
+}
+
+// writeTo writes the index, returning the number of bytes written
+func (w *mhIndexWriter) writeTo(out io.Writer) (int64, error) {
+	if err := w.flush(); err != nil {
+		return 0, err
+	}
+
+	var rh mhRunHeap
+	for _, p := range w.runs {
+		f, err := os.Open(p)
+		if err != nil {
+			return 0, xerrors.Errorf("open run file: %w", err)
+		}
+		defer f.Close() // nolint:errcheck
+
+		r := &mhRunReader{br: bufio.NewReaderSize(f, 1<<20)}
+		ok, err := r.read()
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			rh = append(rh, r)
+		}
+	}
+	heap.Init(&rh)
+
+	ac := &appendCounter{w: out}
+	bw := bufio.NewWriterSize(ac, 1<<20)
+
+	le := func(v any) error {
+		return binary.Write(bw, binary.LittleEndian, v)
+	}
+
+	if _, err := bw.Write(binary.AppendUvarint(nil, uint64(multicodec.CarMultihashIndexSorted))); err != nil {
+		return 0, xerrors.Errorf("write index codec: %w", err)
+	}
+	if err := le(int32(len(w.counts))); err != nil {
+		return 0, xerrors.Errorf("write index header: %w", err)
+	}
+
+	// code and digest length of the previous record
+	var curCode uint64
+	curLen := -1
+	var entBuf []byte
+
+	for rh.Len() > 0 {
+		r := rh[0]
+		e := r.cur
+
+		newCode := curLen == -1 || e.code != curCode
+		if newCode {
+			if err := le(e.code); err != nil {
+				return 0, xerrors.Errorf("write code header: %w", err)
+			}
+			if err := le(int32(len(w.counts[e.code]))); err != nil {
+				return 0, xerrors.Errorf("write code header: %w", err)
+			}
+		}
+		if newCode || len(e.digest) != curLen {
+			width := len(e.digest) + 8
+			if err := le(uint32(width)); err != nil {
+				return 0, xerrors.Errorf("write width header: %w", err)
+			}
+			if err := le(int64(width) * w.counts[e.code][len(e.digest)]); err != nil {
+				return 0, xerrors.Errorf("write width header: %w", err)
+			}
+		}
+
+		entBuf = append(entBuf[:0], e.digest...)
+		entBuf = binary.LittleEndian.AppendUint64(entBuf, e.off)
+		if _, err := bw.Write(entBuf); err != nil {
+			return 0, xerrors.Errorf("write index entry: %w", err)
+		}
+
+		curCode, curLen = e.code, len(e.digest)
+
+		ok, err := r.read()
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			heap.Fix(&rh, 0)
+		} else {
+			heap.Pop(&rh)
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return 0, xerrors.Errorf("flush index: %w", err)
+	}
+
+	return ac.Pos(), nil
+}
+
+func (w *mhIndexWriter) cleanup() error {
+	return os.RemoveAll(w.dir)
+}
+
+type mhRunReader struct {
+	br  *bufio.Reader
+	cur mhIndexRecord
+}
+
+func (r *mhRunReader) read() (bool, error) {
+	code, err := binary.ReadUvarint(r.br)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, xerrors.Errorf("read run entry: %w", err)
+	}
+
+	dlen, err := binary.ReadUvarint(r.br)
+	if err != nil {
+		return false, xerrors.Errorf("read run entry: %w", err)
+	}
+
+	var offBuf [8]byte
+	r.cur.code = code
+	if uint64(cap(r.cur.digest)) < dlen {
+		r.cur.digest = make([]byte, dlen)
+	}
+	r.cur.digest = r.cur.digest[:dlen]
+	if _, err := io.ReadFull(r.br, r.cur.digest); err != nil {
+		return false, xerrors.Errorf("read run entry: %w", err)
+	}
+	if _, err := io.ReadFull(r.br, offBuf[:]); err != nil {
+		return false, xerrors.Errorf("read run entry: %w", err)
+	}
+	r.cur.off = binary.LittleEndian.Uint64(offBuf[:])
+
+	return true, nil
+}
+
+// mhRunHeap is a k-way merge of sorted runs
+type mhRunHeap []*mhRunReader
+
+func (h mhRunHeap) Len() int           { return len(h) }
+func (h mhRunHeap) Less(i, j int) bool { return h[i].cur.less(&h[j].cur) }
+func (h mhRunHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *mhRunHeap) Push(x any)        { *h = append(*h, x.(*mhRunReader)) }
+func (h *mhRunHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,155 @@
+package carlog_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/lotus-web3/ribs/carlog"
+	"github.com/lotus-web3/ribs/carlog/faultfs"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+// crashWorkload writes a few committed batches, reopens the carlog, writes more
+// and finalizes it, recording blocks whose Commit succeeded in committed
+func crashWorkload(td string, fs *faultfs.FS, committed map[string][]byte) error {
+	opts := []carlog.OpenOption{carlog.WithFS(fs), carlog.WithWritableIndex(carlog.IndexHashLog)}
+	indexPath := filepath.Join(td, "index")
+
+	jb, err := carlog.Create(nil, indexPath, td, nil, opts...)
+	if err != nil {
+		return err
+	}
+
+	putBatch := func(batch int) error {
+		blks := faultfs.Blocks(batch, 16)
+		mhs := make([]multihash.Multihash, len(blks))
+		for i, b := range blks {
+			mhs[i] = b.Cid().Hash()
+		}
+
+		if err := jb.Put(mhs, blks); err != nil {
+			return err
+		}
+		if _, err := jb.Commit(); err != nil {
+			return err
+		}
+
+		for _, b := range blks {
+			committed[string(b.Cid().Hash())] = b.RawData()
+		}
+		return nil
+	}
+
+	for batch := 0; batch < 3; batch++ {
+		if err := putBatch(batch); err != nil {
+			return err
+		}
+	}
+
+	if err := jb.Close(); err != nil {
+		return err
+	}
+
+	jb, err = carlog.Open(nil, indexPath, td, func(int64, []multihash.Multihash) error {
+		return errors.New("unexpected truncate")
+	}, opts...)
+	if err != nil {
+		return err
+	}
+
+	if err := putBatch(3); err != nil {
+		return err
+	}
+
+	if err := jb.MarkReadOnly(); err != nil {
+		return err
+	}
+	if err := jb.Finalize(context.TODO()); err != nil {
+		return err
+	}
+
+	return jb.Close()
+}
+
+func requireCommitted(t *testing.T, jb *carlog.CarLog, committed map[string][]byte) {
+	mhs := make([]multihash.Multihash, 0, len(committed))
+	for k := range committed {
+		mhs = append(mhs, multihash.Multihash(k))
+	}
+
+	err := jb.View(mhs, func(i int, found bool, data []byte) error {
+		if !found {
+			return fmt.Errorf("committed block %s not found", mhs[i])
+		}
+		if string(data) != string(committed[string(mhs[i])]) {
+			return fmt.Errorf("committed block %s has bad data", mhs[i])
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// requireRecovered reopens a crashed carlog, checks that it has all committed
+// blocks, and that it can still be finalized
+func requireRecovered(t *testing.T, td string, crashAt int, committed map[string][]byte) {
+	opts := []carlog.OpenOption{carlog.WithWritableIndex(carlog.IndexHashLog)}
+
+	jb, err := carlog.Open(nil, filepath.Join(td, "index"), td, func(to int64, mhs []multihash.Multihash) error {
+		for _, m := range mhs {
+			if _, ok := committed[string(m)]; ok {
+				return fmt.Errorf("truncating committed block %s", m)
+			}
+		}
+		return nil
+	}, opts...)
+	if len(committed) == 0 && err != nil {
+		// crashed while creating the carlog, nothing to recover
+		return
+	}
+	require.NoError(t, err, "reopen after crash at op %d", crashAt)
+
+	requireCommitted(t, jb, committed)
+
+	if len(committed) == 0 {
+		// empty carlogs can't be finalized
+		require.NoError(t, jb.Close())
+		return
+	}
+
+	// the carlog must be usable after recovery
+	err = jb.MarkReadOnly()
+	if !errors.Is(err, carlog.ErrReadOnly) {
+		require.NoError(t, err, "crash at op %d", crashAt)
+	}
+	require.NoError(t, jb.Finalize(context.TODO()), "finalize after crash at op %d", crashAt)
+	requireCommitted(t, jb, committed)
+	require.NoError(t, jb.Close())
+}
+
+func TestCarLogCrash(t *testing.T) {
+	faultfs.Run(t, crashWorkload, requireRecovered)
+}
+
+func TestCarLogCreateClosesOnError(t *testing.T) {
+	create := func(fs *faultfs.FS) (*carlog.CarLog, error) {
+		td := t.TempDir()
+		return carlog.Create(nil, filepath.Join(td, "index"), td, nil, carlog.WithFS(fs), carlog.WithWritableIndex(carlog.IndexHashLog))
+	}
+
+	clean := faultfs.New(-1, false)
+	jb, err := create(clean)
+	require.NoError(t, err)
+	ops := clean.Ops()
+	require.NoError(t, jb.Close())
+
+	for crashAt := 0; crashAt < ops; crashAt++ {
+		ffs := faultfs.New(crashAt, false)
+		_, err := create(ffs)
+		require.ErrorIs(t, err, faultfs.ErrCrashed, "crash at op %d", crashAt)
+		require.Zero(t, ffs.OpenFiles(), "files left open after crash at op %d", crashAt)
+	}
+}
@@ -0,0 +1,66 @@
+package faultfs
+
+import (
+	"encoding/binary"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/require"
+)
+
+// Workload performs file operations through fs in dir, recording data which
+// must survive a crash in committed (keyed by multihash). It must return the
+// error of the first failed operation, and release anything it opened without
+// syncing, as a dying process would.
+type Workload func(dir string, fs *FS, committed map[string][]byte) error
+
+// Check verifies that data recovered from dir after a crash at op crashAt
+// contains all of committed
+type Check func(t *testing.T, dir string, crashAt int, committed map[string][]byte)
+
+// Run runs workload once without crashing to count its mutating file
+// operations, then crashes it at each of them, in "process" and "power-loss"
+// subtests. After each crash all files opened through the FS are closed, and
+// check is called.
+func Run(t *testing.T, workload Workload, check Check) {
+	t.Run("process", func(t *testing.T) {
+		run(t, workload, check, false)
+	})
+	t.Run("power-loss", func(t *testing.T) {
+		run(t, workload, check, true)
+	})
+}
+
+func run(t *testing.T, workload Workload, check Check, powerLoss bool) {
+	clean := New(-1, false)
+	require.NoError(t, workload(t.TempDir(), clean, map[string][]byte{}))
+	require.False(t, clean.Crashed())
+	clean.CloseAll()
+
+	for crashAt := 0; crashAt < clean.Ops(); crashAt++ {
+		dir := t.TempDir()
+		committed := map[string][]byte{}
+
+		ffs := New(crashAt, powerLoss)
+		err := workload(dir, ffs, committed)
+		require.ErrorIs(t, err, ErrCrashed, "crash at op %d", crashAt)
+		require.True(t, ffs.Crashed())
+		ffs.CloseAll()
+
+		check(t, dir, crashAt, committed)
+	}
+}
+
+// Blocks returns n deterministic blocks of a workload batch, so that every
+// workload run performs the same file operations. Blocks are a mix of small
+// ones and ones larger than AtomicWriteSize, so that some writes get torn.
+func Blocks(batch, n int) []blocks.Block {
+	out := make([]blocks.Block, n)
+	for i := range out {
+		data := make([]byte, 100+(i%3)*400)
+		binary.LittleEndian.PutUint64(data, uint64(batch))
+		binary.LittleEndian.PutUint64(data[8:], uint64(i))
+		out[i] = blocks.NewBlock(data)
+	}
+	return out
+}
@@ -0,0 +1,383 @@
+// Package faultfs implements a carlog.FS which simulates a crash at a chosen
+// mutating file operation. Used to check that carlogs (and groups built on them)
+// recover all committed data after a crash at any point.
+package faultfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/lotus-web3/ribs/carlog"
+)
+
+// ErrCrashed is returned by the crashing operation and all operations after it
+var ErrCrashed = errors.New("faultfs: simulated crash")
+
+// AtomicWriteSize is the largest write which is never torn by a crash, matching
+// the sector size the carlog head relies on
+const AtomicWriteSize = 512
+
+// FS wraps OS file operations, counting mutating operations (writes, syncs,
+// truncation, creation, renames and removals). When the count reaches the crash
+// point the operation is interrupted (writes larger than AtomicWriteSize are
+// torn, other operations don't happen), and every following operation, reads
+// included, fails with ErrCrashed, like in a process which died.
+//
+// With power loss simulation, data appended to files since their last sync (or
+// O_SYNC write) is also dropped at the crash point. This model assumes that
+// writes after the synced size are appends; in-place overwrites, truncation and
+// directory operations are treated as durable.
+type FS struct {
+	lk sync.Mutex
+
+	crashAt   int
+	powerLoss bool
+
+	ops     int
+	crashed bool
+
+	files  []*file
+	synced map[string]int64 // path -> durable size
+}
+
+// New creates a FS which crashes at mutating operation crashAt (counted from 0),
+// or never if crashAt is negative
+func New(crashAt int, powerLoss bool) *FS {
+	return &FS{
+		crashAt:   crashAt,
+		powerLoss: powerLoss,
+		synced:    map[string]int64{},
+	}
+}
+
+// Ops returns the number of mutating operations which were attempted
+func (f *FS) Ops() int {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	return f.ops
+}
+
+// Crashed returns true if the crash point was reached
+func (f *FS) Crashed() bool {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	return f.crashed
+}
+
+// OpenFiles returns the number of files opened through the FS which weren't
+// closed yet
+func (f *FS) OpenFiles() int {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	return len(f.files)
+}
+
+// CloseAll closes all files opened through the FS which weren't closed yet,
+// releasing resources held by a crashed process
+func (f *FS) CloseAll() {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	for _, fl := range f.files {
+		_ = fl.f.Close()
+	}
+	f.files = nil
+}
+
+// mutate counts a mutating operation, returning false if it must not happen.
+// Must be called with lk held
+func (f *FS) mutate() bool {
+	if f.crashed {
+		return false
+	}
+
+	op := f.ops
+	f.ops++
+
+	if op == f.crashAt {
+		f.crash()
+		return false
+	}
+	return true
+}
+
+func (f *FS) crash() {
+	f.crashed = true
+
+	if !f.powerLoss {
+		return
+	}
+
+	for path, size := range f.synced {
+		st, err := os.Stat(path)
+		if err != nil || st.Size() <= size {
+			continue
+		}
+		if err := os.Truncate(path, size); err != nil {
+			panic(err) // test helper, nothing sensible to do
+		}
+	}
+}
+
+func (f *FS) OpenFile(name string, flag int, perm os.FileMode) (carlog.File, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		if !f.mutate() {
+			return nil, ErrCrashed
+		}
+	} else if f.crashed {
+		return nil, ErrCrashed
+	}
+
+	osf, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := osf.Stat()
+	if err != nil {
+		_ = osf.Close()
+		return nil, err
+	}
+	if _, ok := f.synced[name]; !ok || flag&os.O_TRUNC != 0 {
+		// files which existed before are assumed to be durable
+		f.synced[name] = st.Size()
+	}
+
+	fl := &file{
+		fs:    f,
+		f:     osf,
+		name:  name,
+		osync: flag&os.O_SYNC != 0,
+	}
+	f.files = append(f.files, fl)
+
+	return fl, nil
+}
+
+func (f *FS) Mkdir(name string, perm os.FileMode) error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	if !f.mutate() {
+		return ErrCrashed
+	}
+	return os.Mkdir(name, perm)
+}
+
+func (f *FS) Stat(name string) (os.FileInfo, error) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	if f.crashed {
+		return nil, ErrCrashed
+	}
+	return os.Stat(name)
+}
+
+func (f *FS) Rename(oldpath, newpath string) error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	if !f.mutate() {
+		return ErrCrashed
+	}
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	f.forget(newpath)
+	for path, size := range f.synced {
+		if path == oldpath || strings.HasPrefix(path, oldpath+string(filepath.Separator)) {
+			delete(f.synced, path)
+			f.synced[newpath+strings.TrimPrefix(path, oldpath)] = size
+		}
+	}
+	return nil
+}
+
+func (f *FS) Remove(name string) error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	if !f.mutate() {
+		return ErrCrashed
+	}
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	f.forget(name)
+	return nil
+}
+
+func (f *FS) RemoveAll(path string) error {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	if !f.mutate() {
+		return ErrCrashed
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	f.forget(path)
+	return nil
+}
+
+// forget drops sync state of path and everything under it
+func (f *FS) forget(path string) {
+	for p := range f.synced {
+		if p == path || strings.HasPrefix(p, path+string(filepath.Separator)) {
+			delete(f.synced, p)
+		}
+	}
+}
+
+func (f *FS) markSynced(fl *file) error {
+	st, err := fl.f.Stat()
+	if err != nil {
+		return err
+	}
+	f.synced[fl.name] = st.Size()
+	return nil
+}
+
+var _ carlog.FS = &FS{}
+
+type file struct {
+	fs    *FS
+	f     *os.File
+	name  string
+	osync bool
+}
+
+func (fl *file) crashed() bool {
+	fl.fs.lk.Lock()
+	defer fl.fs.lk.Unlock()
+	return fl.fs.crashed
+}
+
+func (fl *file) Read(p []byte) (int, error) {
+	if fl.crashed() {
+		return 0, ErrCrashed
+	}
+	return fl.f.Read(p)
+}
+
+func (fl *file) ReadAt(p []byte, off int64) (int, error) {
+	if fl.crashed() {
+		return 0, ErrCrashed
+	}
+	return fl.f.ReadAt(p, off)
+}
+
+func (fl *file) Seek(offset int64, whence int) (int64, error) {
+	if fl.crashed() {
+		return 0, ErrCrashed
+	}
+	return fl.f.Seek(offset, whence)
+}
+
+func (fl *file) Stat() (os.FileInfo, error) {
+	if fl.crashed() {
+		return nil, ErrCrashed
+	}
+	return fl.f.Stat()
+}
+
+func (fl *file) Write(p []byte) (int, error) {
+	return fl.write(p, func(b []byte) (int, error) {
+		return fl.f.Write(b)
+	})
+}
+
+func (fl *file) WriteAt(p []byte, off int64) (int, error) {
+	return fl.write(p, func(b []byte) (int, error) {
+		return fl.f.WriteAt(b, off)
+	})
+}
+
+func (fl *file) write(p []byte, w func([]byte) (int, error)) (int, error) {
+	fl.fs.lk.Lock()
+	defer fl.fs.lk.Unlock()
+
+	if fl.fs.crashed {
+		return 0, ErrCrashed
+	}
+
+	if fl.fs.ops != fl.fs.crashAt {
+		fl.fs.ops++
+
+		n, err := w(p)
+		if err == nil && fl.osync {
+			err = fl.fs.markSynced(fl)
+		}
+		return n, err
+	}
+
+	// crash point, tear the write; with power loss the torn part is then dropped
+	// unless it was written in place
+	fl.fs.ops++
+
+	var n int
+	if len(p) > AtomicWriteSize {
+		n, _ = w(p[:len(p)/2])
+	}
+	fl.fs.crash()
+
+	return n, ErrCrashed
+}
+
+func (fl *file) Sync() error {
+	fl.fs.lk.Lock()
+	defer fl.fs.lk.Unlock()
+
+	if !fl.fs.mutate() {
+		return ErrCrashed
+	}
+	if err := fl.f.Sync(); err != nil {
+		return err
+	}
+	return fl.fs.markSynced(fl)
+}
+
+func (fl *file) Truncate(size int64) error {
+	fl.fs.lk.Lock()
+	defer fl.fs.lk.Unlock()
+
+	if !fl.fs.mutate() {
+		return ErrCrashed
+	}
+	if err := fl.f.Truncate(size); err != nil {
+		return err
+	}
+	if fl.fs.synced[fl.name] > size {
+		fl.fs.synced[fl.name] = size
+	}
+	return nil
+}
+
+func (fl *file) Close() error {
+	fl.fs.lk.Lock()
+	defer fl.fs.lk.Unlock()
+
+	for i, of := range fl.fs.files {
+		if of == fl {
+			fl.fs.files = append(fl.fs.files[:i], fl.fs.files[i+1:]...)
+			break
+		}
+	}
+
+	err := fl.f.Close()
+	if fl.fs.crashed {
+		return ErrCrashed
+	}
+	return err
+}
+
+var _ carlog.File = &file{}
@@ -1,11 +1,23 @@
 package carlog
 
 import (
+	"os"
+
 	"github.com/lotus-web3/ribs/bsst"
 	mh "github.com/multiformats/go-multihash"
 	"golang.org/x/xerrors"
 )
 
+// bsstOpenOpts configure how bsst indexes are read. RBS_BSST_MMAP=1 enables
+// mmap-backed lookups, RBS_BSST_PREFETCH=1 additionally prefetches buckets of
+// batched lookups.
+var bsstOpenOpts = func() []bsst.OpenOption {
+	return []bsst.OpenOption{
+		bsst.WithMmap(os.Getenv("RBS_BSST_MMAP") == "1"),
+		bsst.WithPrefetch(os.Getenv("RBS_BSST_PREFETCH") == "1"),
+	}
+}()
+
 type BSSTIndex struct {
 	bsi *bsst.BSST
 }
@@ -18,12 +30,17 @@ func (b *BSSTIndex) Get(c []mh.Multihash) ([]int64, error) {
 	return b.bsi.Get(c)
 }
 
+// BSST returns the underlying index, e.g. for use as a bsst.MergeInput
+func (b *BSSTIndex) BSST() *bsst.BSST {
+	return b.bsi
+}
+
 func (b *BSSTIndex) Close() error {
 	return b.bsi.Close()
 }
 
 func (b *BSSTIndex) Entries() (int64, error) {
-	panic("not supported")
+	return b.bsi.Header().Entries, nil
 }
 
 func (b *BSSTIndex) List(f func(c mh.Multihash, offs []int64) error) error {
@@ -31,7 +48,7 @@ func (b *BSSTIndex) List(f func(c mh.Multihash, offs []int64) error) error {
 }
 
 func OpenBSSTIndex(path string) (*BSSTIndex, error) {
-	bss, err := bsst.Open(path)
+	bss, err := bsst.Open(path, bsstOpenOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -50,7 +67,7 @@ func CreateBSSTIndex(path string, index IndexSource) (*BSSTIndex, error) {
 	if err != nil {
 		return nil, xerrors.Errorf("getting level index entries: %w", err)
 	}
-	bss, err := bsst.Create(path, ents, index)
+	bss, err := bsst.Create(path, ents, index, bsstOpenOpts...)
 	if err != nil {
 		return nil, xerrors.Errorf("bsst create: %w", err)
 	}
@@ -59,4 +76,17 @@ func CreateBSSTIndex(path string, index IndexSource) (*BSSTIndex, error) {
 	}, nil
 }
 
+// MergeBSSTIndexes creates a single index at path covering multiple group
+// indexes, e.g. when aggregating groups. Values are mapped with each input's
+// Transform, so that they can identify both the group and the offset.
+func MergeBSSTIndexes(path string, inputs []bsst.MergeInput) (*BSSTIndex, error) {
+	bss, err := bsst.Merge(path, inputs, bsstOpenOpts...)
+	if err != nil {
+		return nil, xerrors.Errorf("bsst merge: %w", err)
+	}
+	return &BSSTIndex{
+		bsi: bss,
+	}, nil
+}
+
 var _ ReadableIndex = (*BSSTIndex)(nil)
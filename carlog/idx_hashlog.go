@@ -0,0 +1,318 @@
+package carlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+/*
+HashLog index file format:
+
+[record...]
+
+record: [op: u8][off: le64][mhLen: uvarint][mh: [mhLen]byte][crc32c: le32]
+
+op: 1 - put, 2 - delete
+crc32c covers all preceding record bytes
+
+A partially written / corrupted record at the end of the log (unclean shutdown)
+is dropped and cut off when the log is opened.
+*/
+
+const (
+	hlogOpPut = 1
+	hlogOpDel = 2
+)
+
+var hlogCastagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// HashLogIndex is an append-only log of index writes, kept in an in-memory map
+// which is rebuilt from the log on open. Compared to LevelDBIndex it has no
+// background compaction and a single file, at the cost of memory proportional
+// to the number of entries in the group.
+type HashLogIndex struct {
+	lk sync.RWMutex
+
+	f  File
+	bw *bufio.Writer
+
+	ents map[string]int64
+}
+
+func OpenHashLogIndex(path string, create bool) (*HashLogIndex, error) {
+	return openHashLogIndex(OSFS{}, path, create)
+}
+
+func openHashLogIndex(fs FS, path string, create bool) (*HashLogIndex, error) {
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE | os.O_EXCL
+	}
+
+	f, err := fs.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &HashLogIndex{
+		f:    f,
+		ents: map[string]int64{},
+	}
+
+	validLen, err := h.replay()
+	if err != nil {
+		_ = f.Close()
+		return nil, xerrors.Errorf("replaying hashlog index: %w", err)
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, xerrors.Errorf("stat hashlog index: %w", err)
+	}
+
+	if st.Size() > validLen {
+		log.Errorw("hashlog index has an invalid tail, truncating", "path", path, "size", st.Size(), "valid", validLen)
+
+		if err := f.Truncate(validLen); err != nil {
+			_ = f.Close()
+			return nil, xerrors.Errorf("truncating hashlog index tail: %w", err)
+		}
+	}
+
+	if _, err := f.Seek(validLen, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, xerrors.Errorf("seeking to hashlog end: %w", err)
+	}
+
+	h.bw = bufio.NewWriterSize(f, 1<<20)
+
+	return h, nil
+}
+
+// replay loads the log into the entry map, returning the length of the valid
+// part of the log
+func (h *HashLogIndex) replay() (int64, error) {
+	br := bufio.NewReaderSize(h.f, 4<<20)
+
+	var valid int64
+	var hdr [1 + 8]byte
+	var sumBuf [4]byte
+	var lenBuf [binary.MaxVarintLen64]byte
+	mhBuf := make([]byte, 0, 64)
+
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return valid, nil // clean EOF or torn record
+		}
+
+		mhLen, err := binary.ReadUvarint(br)
+		if err != nil || mhLen > 1024 {
+			return valid, nil
+		}
+
+		if cap(mhBuf) < int(mhLen) {
+			mhBuf = make([]byte, mhLen)
+		}
+		mhBuf = mhBuf[:mhLen]
+
+		if _, err := io.ReadFull(br, mhBuf); err != nil {
+			return valid, nil
+		}
+		if _, err := io.ReadFull(br, sumBuf[:]); err != nil {
+			return valid, nil
+		}
+
+		lenLen := binary.PutUvarint(lenBuf[:], mhLen)
+
+		sum := crc32.Update(0, hlogCastagnoli, hdr[:])
+		sum = crc32.Update(sum, hlogCastagnoli, lenBuf[:lenLen])
+		sum = crc32.Update(sum, hlogCastagnoli, mhBuf)
+		if sum != binary.LittleEndian.Uint32(sumBuf[:]) {
+			return valid, nil
+		}
+
+		switch hdr[0] {
+		case hlogOpPut:
+			h.ents[string(mhBuf)] = int64(binary.LittleEndian.Uint64(hdr[1:]))
+		case hlogOpDel:
+			delete(h.ents, string(mhBuf))
+		default:
+			return 0, xerrors.Errorf("unknown hashlog op %d at %d", hdr[0], valid)
+		}
+
+		valid += int64(len(hdr)) + int64(lenLen) + int64(mhLen) + int64(len(sumBuf))
+	}
+}
+
+func (h *HashLogIndex) writeRecord(op byte, m multihash.Multihash, off int64) error {
+	var buf [1 + 8 + binary.MaxVarintLen64]byte
+	buf[0] = op
+	binary.LittleEndian.PutUint64(buf[1:], uint64(off))
+	n := 1 + 8 + binary.PutUvarint(buf[1+8:], uint64(len(m)))
+
+	sum := crc32.Update(0, hlogCastagnoli, buf[:n])
+	sum = crc32.Update(sum, hlogCastagnoli, m)
+
+	var sumBuf [4]byte
+	binary.LittleEndian.PutUint32(sumBuf[:], sum)
+
+	if _, err := h.bw.Write(buf[:n]); err != nil {
+		return err
+	}
+	if _, err := h.bw.Write(m); err != nil {
+		return err
+	}
+	_, err := h.bw.Write(sumBuf[:])
+	return err
+}
+
+func (h *HashLogIndex) Has(c []multihash.Multihash) ([]bool, error) {
+	h.lk.RLock()
+	defer h.lk.RUnlock()
+
+	out := make([]bool, len(c))
+	for i, m := range c {
+		_, out[i] = h.ents[string(m)]
+	}
+
+	return out, nil
+}
+
+func (h *HashLogIndex) Put(c []multihash.Multihash, offs []int64) error {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	for i, m := range c {
+		if offs[i] == -1 {
+			continue
+		}
+
+		if err := h.writeRecord(hlogOpPut, m, offs[i]); err != nil {
+			return xerrors.Errorf("writing hashlog put: %w", err)
+		}
+		h.ents[string(m)] = offs[i]
+	}
+
+	if err := h.bw.Flush(); err != nil {
+		return xerrors.Errorf("flushing hashlog: %w", err)
+	}
+
+	return nil
+}
+
+// Get returns offsets to data, -1 if not found
+func (h *HashLogIndex) Get(c []multihash.Multihash) ([]int64, error) {
+	h.lk.RLock()
+	defer h.lk.RUnlock()
+
+	out := make([]int64, len(c))
+	for i, m := range c {
+		off, ok := h.ents[string(m)]
+		if !ok {
+			out[i] = -1
+			continue
+		}
+		out[i] = off
+	}
+
+	return out, nil
+}
+
+func (h *HashLogIndex) Entries() (int64, error) {
+	h.lk.RLock()
+	defer h.lk.RUnlock()
+
+	return int64(len(h.ents)), nil
+}
+
+// List calls f with entries sorted by multihash, as required by bsst.Source
+func (h *HashLogIndex) List(f func(c multihash.Multihash, offs []int64) error) error {
+	h.lk.RLock()
+	defer h.lk.RUnlock()
+
+	keys := make([]string, 0, len(h.ents))
+	for m := range h.ents {
+		keys = append(keys, m)
+	}
+	sort.Strings(keys)
+
+	for _, m := range keys {
+		if err := f(multihash.Multihash(m), []int64{h.ents[m]}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *HashLogIndex) ToTruncate(atOrAbove int64) ([]multihash.Multihash, error) {
+	h.lk.RLock()
+	defer h.lk.RUnlock()
+
+	var mhashes []multihash.Multihash
+	for m, off := range h.ents {
+		if offs, _ := fromOffsetLen(off); offs >= atOrAbove {
+			mhashes = append(mhashes, multihash.Multihash(m))
+		}
+	}
+
+	return mhashes, nil
+}
+
+func (h *HashLogIndex) Del(c []multihash.Multihash) error {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	for _, m := range c {
+		if err := h.writeRecord(hlogOpDel, m, 0); err != nil {
+			return xerrors.Errorf("writing hashlog delete: %w", err)
+		}
+		delete(h.ents, string(m))
+	}
+
+	if err := h.bw.Flush(); err != nil {
+		return xerrors.Errorf("flushing hashlog: %w", err)
+	}
+
+	return h.f.Sync()
+}
+
+func (h *HashLogIndex) Sync() error {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	if err := h.bw.Flush(); err != nil {
+		return xerrors.Errorf("flushing hashlog: %w", err)
+	}
+
+	return h.f.Sync()
+}
+
+func (h *HashLogIndex) Close() error {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	// the file is closed even if flushing fails
+	if err := h.bw.Flush(); err != nil {
+		_ = h.f.Close()
+		return xerrors.Errorf("flushing hashlog: %w", err)
+	}
+	if err := h.f.Sync(); err != nil {
+		_ = h.f.Close()
+		return xerrors.Errorf("syncing hashlog: %w", err)
+	}
+
+	return h.f.Close()
+}
+
+var _ WritableIndex = &HashLogIndex{}
+var _ ReadableIndex = &HashLogIndex{}
@@ -156,7 +156,17 @@ func (l *LevelDBIndex) Del(c []multihash.Multihash) error {
 	return l.DB.Write(batch, &opt.WriteOptions{Sync: true})
 }
 
-// todo sync
+// levelSyncKey is never a valid multihash, so it is never present in the index
+var levelSyncKey = []byte{0}
+
+func (l *LevelDBIndex) Sync() error {
+	// leveldb has no explicit sync, and empty batches return early, so sync the
+	// journal with a no-op delete
+	batch := new(leveldb.Batch)
+	batch.Delete(levelSyncKey)
+
+	return l.DB.Write(batch, &opt.WriteOptions{Sync: true})
+}
 
 func (l *LevelDBIndex) Close() error {
 	return l.DB.Close()
@@ -0,0 +1,212 @@
+package carlog
+
+import (
+	"os"
+	"path/filepath"
+
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// IndexKind selects the index implementation used by writable carlogs
+type IndexKind string
+
+const (
+	IndexLevelDB IndexKind = "leveldb"
+	IndexHashLog IndexKind = "hashlog"
+)
+
+// DefaultWritableIndex is the writable index kind used when not set with
+// WithWritableIndex
+const DefaultWritableIndex = IndexLevelDB
+
+func ParseIndexKind(s string) (IndexKind, error) {
+	switch IndexKind(s) {
+	case IndexLevelDB, IndexHashLog:
+		return IndexKind(s), nil
+	default:
+		return "", xerrors.Errorf("unknown writable index kind %q", s)
+	}
+}
+
+type openOptions struct {
+	writableIndex IndexKind
+	fs            FS
+	rootedCar     bool
+}
+
+type OpenOption func(*openOptions)
+
+// WithWritableIndex sets the index kind used for new writable carlogs. Opened
+// writable carlogs using a different index kind are migrated to it.
+func WithWritableIndex(kind IndexKind) OpenOption {
+	return func(o *openOptions) {
+		o.writableIndex = kind
+	}
+}
+
+// WithFS sets the file system used for head, data and writable index files
+func WithFS(fs FS) OpenOption {
+	return func(o *openOptions) {
+		o.fs = fs
+	}
+}
+
+// WithRootedCar enables laying out DAGs under roots recorded with AddRoots
+// depth-first in the CAR written by WriteCar. Applies to carlogs finalized
+// while opened with the option.
+func WithRootedCar(enable bool) OpenOption {
+	return func(o *openOptions) {
+		o.rootedCar = enable
+	}
+}
+
+func makeOpenOptions(opts []OpenOption) *openOptions {
+	o := &openOptions{
+		writableIndex: DefaultWritableIndex,
+		fs:            OSFS{},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// OptionsFS returns the file system set with WithFS in opts, OSFS by default
+func OptionsFS(opts ...OpenOption) FS {
+	return makeOpenOptions(opts).fs
+}
+
+// rwIndex is an index usable both for writing and reading (before finalization)
+type rwIndex interface {
+	WritableIndex
+	ReadableIndex
+}
+
+func (k IndexKind) path(indexPath string) string {
+	switch k {
+	case IndexHashLog:
+		return filepath.Join(indexPath, HLogIndex)
+	default:
+		return filepath.Join(indexPath, LevelIndex)
+	}
+}
+
+// openRWIndex opens a writable index. Note that the leveldb index doesn't use fs
+func openRWIndex(fs FS, kind IndexKind, path string, create bool) (rwIndex, error) {
+	switch kind {
+	case IndexLevelDB:
+		return OpenLevelDBIndex(path, create)
+	case IndexHashLog:
+		return openHashLogIndex(fs, path, create)
+	default:
+		return nil, xerrors.Errorf("unknown writable index kind %q", kind)
+	}
+}
+
+// existingIndexKind returns the kind of writable index present in indexPath,
+// or an empty kind if there is none
+func existingIndexKind(fs FS, indexPath string) (IndexKind, error) {
+	for _, kind := range []IndexKind{IndexLevelDB, IndexHashLog} {
+		_, err := fs.Stat(kind.path(indexPath))
+		if err == nil {
+			return kind, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", xerrors.Errorf("stat %s index: %w", kind, err)
+		}
+	}
+
+	return "", nil
+}
+
+// replaceRWIndex builds a new index of the given kind in a temp location with
+// fill, then swaps it in place of any existing writable index
+func replaceRWIndex(fs FS, indexPath string, kind IndexKind, fill func(w WritableIndex) error) error {
+	tempPath := kind.path(indexPath) + ".temp"
+
+	if err := fs.RemoveAll(tempPath); err != nil {
+		return xerrors.Errorf("removing stale temp index: %w", err)
+	}
+
+	idx, err := openRWIndex(fs, kind, tempPath, true)
+	if err != nil {
+		return xerrors.Errorf("creating temp %s index: %w", kind, err)
+	}
+
+	if err := fill(idx); err != nil {
+		_ = idx.Close()
+		return err
+	}
+
+	if err := idx.Close(); err != nil {
+		return xerrors.Errorf("closing temp index: %w", err)
+	}
+
+	if err := dropRWIndexes(fs, indexPath); err != nil {
+		return err
+	}
+
+	if err := fs.Rename(tempPath, kind.path(indexPath)); err != nil {
+		return xerrors.Errorf("renaming temp index: %w", err)
+	}
+
+	return nil
+}
+
+// migrateRWIndex copies entries from an existing writable index into a new
+// index of a different kind
+func migrateRWIndex(fs FS, indexPath string, from, to IndexKind) error {
+	src, err := openRWIndex(fs, from, from.path(indexPath), false)
+	if err != nil {
+		return xerrors.Errorf("opening %s index: %w", from, err)
+	}
+
+	err = replaceRWIndex(fs, indexPath, to, func(w WritableIndex) error {
+		mhsBuf := make([]mh.Multihash, 0, 50000)
+		offsBuf := make([]int64, 0, 50000)
+
+		err := src.List(func(c mh.Multihash, offs []int64) error {
+			mhsBuf = append(mhsBuf, append(mh.Multihash(nil), c...))
+			offsBuf = append(offsBuf, offs[0])
+
+			if len(mhsBuf) >= 50000 {
+				if err := w.Put(mhsBuf, offsBuf); err != nil {
+					return xerrors.Errorf("putting to index: %w", err)
+				}
+				mhsBuf = mhsBuf[:0]
+				offsBuf = offsBuf[:0]
+			}
+			return nil
+		})
+		if err != nil {
+			return xerrors.Errorf("listing %s index: %w", from, err)
+		}
+
+		if len(mhsBuf) > 0 {
+			if err := w.Put(mhsBuf, offsBuf); err != nil {
+				return xerrors.Errorf("putting to index: %w", err)
+			}
+		}
+
+		// close the source before it gets removed
+		return src.Close()
+	})
+	if err != nil {
+		_ = src.Close()
+		return xerrors.Errorf("migrating %s index to %s: %w", from, to, err)
+	}
+
+	return nil
+}
+
+// dropRWIndexes removes writable indexes of all kinds
+func dropRWIndexes(fs FS, indexPath string) error {
+	for _, kind := range []IndexKind{IndexLevelDB, IndexHashLog} {
+		if err := fs.RemoveAll(kind.path(indexPath)); err != nil {
+			return xerrors.Errorf("removing %s index: %w", kind, err)
+		}
+	}
+
+	return nil
+}
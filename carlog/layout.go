@@ -0,0 +1,393 @@
+package carlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	_ "github.com/ipld/go-codec-dagpb"
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/multicodec"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+/*
+Rooted CAR layout
+
+Applications can record roots of DAGs written to a carlog with AddRoots. When
+the carlog is opened WithRootedCar, top car generation also computes a layout,
+which makes WriteCar emit each recorded DAG depth-first right after the CAR
+header, and lists the DAG roots in the header after the top tree root. Blocks
+not reachable from recorded roots follow in the canonical (top tree) order.
+
+Blocks in the log are keyed by multihash only, so DAGs are walked following
+full CIDs, starting from recorded roots.
+
+roots file format: [[cidLen: uvarint][cid: [cidLen]byte]...]
+layout file format: [nRoots: uvarint][[cidLen: uvarint][cid]...][offLen: le64...]
+*/
+
+const (
+	RootsFile  = "car.roots"
+	LayoutFile = "car.layout"
+)
+
+// AddRoots records roots of DAGs written to the carlog. Roots are hints, roots
+// which aren't in the carlog when it's finalized are ignored.
+func (j *CarLog) AddRoots(roots []cid.Cid) error {
+	j.idxLk.RLock()
+	defer j.idxLk.RUnlock()
+
+	if j.wIdx == nil {
+		return xerrors.Errorf("cannot add roots to read-only (or closing) jbob")
+	}
+
+	f, err := j.fs.OpenFile(filepath.Join(j.IndexPath, RootsFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return xerrors.Errorf("opening roots file: %w", err)
+	}
+	defer f.Close() // nolint:errcheck
+
+	// drop a torn tail from an unclean shutdown before appending
+	_, validLen, err := readRoots(f)
+	if err != nil {
+		return xerrors.Errorf("reading roots: %w", err)
+	}
+	if err := f.Truncate(validLen); err != nil {
+		return xerrors.Errorf("truncating roots file: %w", err)
+	}
+
+	var buf bytes.Buffer
+	for _, r := range roots {
+		writeCid(&buf, r)
+	}
+
+	if _, err := f.WriteAt(buf.Bytes(), validLen); err != nil {
+		return xerrors.Errorf("writing roots: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return xerrors.Errorf("syncing roots: %w", err)
+	}
+
+	return f.Close()
+}
+
+func writeCid(w *bytes.Buffer, c cid.Cid) {
+	var lenBuf [binary.MaxVarintLen64]byte
+	cb := c.Bytes()
+	w.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(cb)))])
+	w.Write(cb)
+}
+
+// readCid reads a cid written with writeCid
+func readCid(br *bufio.Reader) (cid.Cid, int64, error) {
+	cl, err := binary.ReadUvarint(br)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	if cl > 512 {
+		return cid.Undef, 0, xerrors.Errorf("cid too long (%d bytes)", cl)
+	}
+
+	cb := make([]byte, cl)
+	if _, err := io.ReadFull(br, cb); err != nil {
+		return cid.Undef, 0, err
+	}
+
+	n, c, err := cid.CidFromBytes(cb)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+	if n != len(cb) {
+		return cid.Undef, 0, xerrors.Errorf("trailing bytes after cid")
+	}
+
+	var lenBuf [binary.MaxVarintLen64]byte
+	return c, int64(binary.PutUvarint(lenBuf[:], cl)) + int64(cl), nil
+}
+
+// readRoots reads all valid roots from the roots file, returning the length
+// of the valid part of the file
+func readRoots(f io.ReaderAt) ([]cid.Cid, int64, error) {
+	br := bufio.NewReader(io.NewSectionReader(f, 0, 1<<62))
+
+	var roots []cid.Cid
+	var valid int64
+	for {
+		c, n, err := readCid(br)
+		if err != nil {
+			return roots, valid, nil // clean EOF or torn record
+		}
+
+		roots = append(roots, c)
+		valid += n
+	}
+}
+
+func (j *CarLog) loadRoots() ([]cid.Cid, error) {
+	f, err := j.fs.OpenFile(filepath.Join(j.IndexPath, RootsFile), os.O_RDONLY, 0644)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("opening roots file: %w", err)
+	}
+	defer f.Close() // nolint:errcheck
+
+	roots, _, err := readRoots(f)
+	return roots, err
+}
+
+type carLayout struct {
+	// roots of DAGs found in the carlog, listed in the CAR header after the top root
+	roots []cid.Cid
+
+	// order lists index values (offset/length in the data file) of data blocks
+	// written before the top tree, in order
+	order []int64
+}
+
+// genLayout computes and saves the rooted CAR layout. dataOffs are sorted
+// offsets of all data blocks. Called during top car generation, before layer
+// offsets are saved in the head.
+func (j *CarLog) genLayout(dataOffs []int64) error {
+	layoutPath := filepath.Join(j.IndexPath, LayoutFile)
+
+	var roots []cid.Cid
+	if j.rootedCar {
+		var err error
+		roots, err = j.loadRoots()
+		if err != nil {
+			return xerrors.Errorf("loading roots: %w", err)
+		}
+	}
+
+	if len(roots) == 0 {
+		// canonical layout, remove any layout from an interrupted attempt
+		return j.fs.RemoveAll(layoutPath)
+	}
+
+	visited := make([]uint64, (len(dataOffs)+63)/64)
+	visit := func(loc int64) bool {
+		off, _ := fromOffsetLen(loc)
+		i := sort.Search(len(dataOffs), func(i int) bool { return dataOffs[i] >= off })
+		if i == len(dataOffs) || dataOffs[i] != off {
+			return false
+		}
+		if visited[i/64]&(1<<(i%64)) != 0 {
+			return false
+		}
+		visited[i/64] |= 1 << (i % 64)
+		return true
+	}
+
+	var layout carLayout
+	seenRoots := map[cid.Cid]struct{}{}
+
+	type ent struct {
+		c   cid.Cid
+		loc int64
+	}
+
+	for _, root := range roots {
+		if _, seen := seenRoots[root]; seen {
+			continue
+		}
+		seenRoots[root] = struct{}{}
+
+		locs, err := j.rIdx.Get([]mh.Multihash{root.Hash()})
+		if err != nil {
+			return xerrors.Errorf("getting root location: %w", err)
+		}
+		if locs[0] == -1 {
+			continue // root written to another group
+		}
+
+		layout.roots = append(layout.roots, root)
+
+		// depth-first, pre-order
+		stack := []ent{{c: root, loc: locs[0]}}
+		for len(stack) > 0 {
+			e := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			if !visit(e.loc) {
+				continue
+			}
+			layout.order = append(layout.order, e.loc)
+
+			links, err := j.blockLinks(e.c, e.loc)
+			if err != nil {
+				return xerrors.Errorf("getting links of %s: %w", e.c, err)
+			}
+			if len(links) == 0 {
+				continue
+			}
+
+			lmhs := make([]mh.Multihash, len(links))
+			for i, l := range links {
+				lmhs[i] = l.Hash()
+			}
+			locs, err := j.rIdx.Get(lmhs)
+			if err != nil {
+				return xerrors.Errorf("getting link locations: %w", err)
+			}
+
+			for i := len(links) - 1; i >= 0; i-- {
+				if locs[i] == -1 {
+					continue // not in this carlog
+				}
+				stack = append(stack, ent{c: links[i], loc: locs[i]})
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	var lenBuf [binary.MaxVarintLen64]byte
+	buf.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(layout.roots)))])
+	for _, r := range layout.roots {
+		writeCid(&buf, r)
+	}
+	var offBuf [8]byte
+	for _, loc := range layout.order {
+		binary.LittleEndian.PutUint64(offBuf[:], uint64(loc))
+		buf.Write(offBuf[:])
+	}
+
+	tempPath := layoutPath + ".temp"
+	f, err := j.fs.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return xerrors.Errorf("creating layout file: %w", err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return xerrors.Errorf("writing layout: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return xerrors.Errorf("syncing layout: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return xerrors.Errorf("closing layout file: %w", err)
+	}
+
+	if err := j.fs.Rename(tempPath, layoutPath); err != nil {
+		return xerrors.Errorf("renaming layout file: %w", err)
+	}
+
+	log.Infow("generated rooted car layout", "roots", len(layout.roots), "blocks", len(layout.order), "totalBlocks", len(dataOffs), "indexPath", j.IndexPath)
+
+	return nil
+}
+
+// readLayout loads the rooted CAR layout, nil if the CAR uses the canonical layout
+func (j *CarLog) readLayout() (*carLayout, error) {
+	f, err := j.fs.OpenFile(filepath.Join(j.IndexPath, LayoutFile), os.O_RDONLY, 0644)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("opening layout file: %w", err)
+	}
+	defer f.Close() // nolint:errcheck
+
+	br := bufio.NewReader(io.NewSectionReader(f, 0, 1<<62))
+
+	nRoots, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, xerrors.Errorf("reading layout root count: %w", err)
+	}
+
+	var layout carLayout
+	for i := uint64(0); i < nRoots; i++ {
+		c, _, err := readCid(br)
+		if err != nil {
+			return nil, xerrors.Errorf("reading layout root: %w", err)
+		}
+		layout.roots = append(layout.roots, c)
+	}
+
+	var offBuf [8]byte
+	for {
+		if _, err := io.ReadFull(br, offBuf[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, xerrors.Errorf("reading layout entry: %w", err)
+		}
+		layout.order = append(layout.order, int64(binary.LittleEndian.Uint64(offBuf[:])))
+	}
+
+	return &layout, nil
+}
+
+// readEntry reads the raw (cid + data) log entry at the given index location
+func (j *CarLog) readEntry(loc int64, buf []byte) ([]byte, error) {
+	off, entLen := fromOffsetLen(loc)
+	if cap(buf) < entLen {
+		buf = make([]byte, entLen)
+	}
+	buf = buf[:entLen]
+
+	var lenBuf [binary.MaxVarintLen64]byte
+	lenlen := binary.PutUvarint(lenBuf[:], uint64(entLen))
+
+	if _, err := j.data.ReadAt(buf, off+int64(lenlen)); err != nil {
+		return nil, xerrors.Errorf("reading entry: %w", err)
+	}
+
+	return buf, nil
+}
+
+// blockLinks returns links of the block with cid c stored at loc. Blocks in
+// codecs which can't be decoded are treated as leaves.
+func (j *CarLog) blockLinks(c cid.Cid, loc int64) ([]cid.Cid, error) {
+	if c.Prefix().Codec == cid.Raw {
+		return nil, nil
+	}
+
+	ent, err := j.readEntry(loc, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	n, _, err := cid.CidFromBytes(ent)
+	if err != nil {
+		return nil, xerrors.Errorf("parsing cid: %w", err)
+	}
+
+	dec, err := multicodec.LookupDecoder(c.Prefix().Codec)
+	if err != nil {
+		return nil, nil
+	}
+
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := dec(nb, bytes.NewReader(ent[n:])); err != nil {
+		log.Warnw("rooted car layout: can't decode block, treating as leaf", "cid", c, "error", err)
+		return nil, nil
+	}
+
+	links, err := traversal.SelectLinks(nb.Build())
+	if err != nil {
+		log.Warnw("rooted car layout: can't select links, treating as leaf", "cid", c, "error", err)
+		return nil, nil
+	}
+
+	out := make([]cid.Cid, 0, len(links))
+	for _, l := range links {
+		if cl, ok := l.(cidlink.Link); ok {
+			out = append(out, cl.Cid)
+		}
+	}
+
+	return out, nil
+}
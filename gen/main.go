@@ -6,6 +6,7 @@ import (
 
 	"github.com/lotus-web3/ribs/bsst"
 	"github.com/lotus-web3/ribs/carlog"
+	"github.com/lotus-web3/ribs/ributil/boosttypes"
 
 	gen "github.com/whyrusleeping/cbor-gen"
 )
@@ -22,4 +23,10 @@ func main() {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+
+	err = gen.WriteMapEncodersToFile("./ributil/boosttypes/direct_cbor_gen.go", "boosttypes", boosttypes.DirectDealParams{})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
@@ -47,6 +47,17 @@ type Batch interface {
 	// In case of conflicts, Put operation will be preferred over Unlink
 	Unlink(ctx context.Context, c []multihash.Multihash) error
 
+	// Roots records cids of roots of DAGs written with Put. Groups finalized with
+	// rooted CARs enabled lay out DAGs under those roots depth-first at the start
+	// of their deal CAR, and list the roots in the CAR header. Roots are hints,
+	// recorded in groups written to by the batch on Flush.
+	Roots(ctx context.Context, roots []cid.Cid) error
+
+	// Policy sets the name of the replication policy class recorded in groups
+	// written to by the batch on Flush. Groups written by batches with different
+	// policies get the policy of the last flush.
+	Policy(ctx context.Context, policy string) error
+
 	// Flush commits data to the blockstore. The batch can be reused after commit
 	Flush(ctx context.Context) error
 
@@ -75,6 +86,10 @@ type Storage interface {
 
 	ReadCar(ctx context.Context, group GroupKey, sz func(int64), out io.Writer) error
 
+	// ReadCarV2 writes the group deal CAR wrapped in a CARv2 with a
+	// MultihashIndexSorted index appended after the payload
+	ReadCarV2(ctx context.Context, group GroupKey, out io.Writer) error
+
 	// HashSample returns a sample of hashes from the group saved when the group was finalized
 	HashSample(ctx context.Context, group GroupKey) ([]multihash.Multihash, error)
 
@@ -84,9 +99,38 @@ type Storage interface {
 
 	LoadFilCar(ctx context.Context, group GroupKey, f io.Reader, sz int64) error
 
+	// ImportCar streams blocks from a CARv1 or CARv2 into writable groups.
+	// Blocks already stored are skipped, and block data is verified against
+	// CIDs. progress, if not nil, is called after each written batch.
+	ImportCar(ctx context.Context, car io.Reader, opts ImportCarOpts, progress func(ImportProgress)) (ImportProgress, error)
+
 	Subscribe(GroupSub)
 }
 
+type ImportCarOpts struct {
+	// PreserveRoots records the CAR header roots as roots of groups written by
+	// the import, see Batch.Roots
+	PreserveRoots bool
+}
+
+type ImportProgress struct {
+	Roots []cid.Cid
+
+	// Blocks/Bytes read from the CAR
+	Blocks, Bytes int64
+
+	// blocks skipped because they were already stored
+	DuplicateBlocks, DuplicateBytes int64
+
+	// groups written to
+	Groups []GroupKey
+
+	Done bool
+
+	// Error is set when a streamed import failed
+	Error string
+}
+
 type GroupDesc struct {
 	RootCid, PieceCid cid.Cid
 	CarSize           int64
@@ -3,6 +3,7 @@ package ribs
 import (
 	"context"
 	"io"
+	"time"
 
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-jsonrpc"
@@ -16,6 +17,10 @@ type RIBS interface {
 
 	Wallet() Wallet
 	DealDiag() RIBSDiag
+	DealConfig() DealConfigurator
+	Policies() PolicyManager
+	Claims() ClaimExtender
+	Admin() DealAdmin
 
 	io.Closer
 }
@@ -122,6 +127,10 @@ type DealMeta struct {
 	Error      string
 	DealID     int64
 
+	// direct deals have a verified registry allocation instead of a market deal
+	Direct       bool
+	AllocationID int64
+
 	BytesRecv int64
 	TxSize    int64
 	PubCid    string
@@ -132,26 +141,447 @@ type DealMeta struct {
 }
 
 type Wallet interface {
+	// WalletInfo returns the state of the default wallet
 	WalletInfo() (WalletInfo, error)
 
+	// Wallets returns the state of all client wallets
+	Wallets() ([]WalletInfo, error)
+
+	// NewWallet creates a new secp256k1 client wallet with the default role
+	NewWallet(ctx context.Context) (address.Address, error)
+	SetWalletRole(addr address.Address, role WalletRole) error
+
 	MarketAdd(ctx context.Context, amount abi.TokenAmount) (cid.Cid, error)
 	MarketWithdraw(ctx context.Context, amount abi.TokenAmount) (cid.Cid, error)
 
 	Withdraw(ctx context.Context, amount abi.TokenAmount, to address.Address) (cid.Cid, error)
+
+	// Budget returns spend committed to live deals against the configured caps
+	Budget(ctx context.Context) (BudgetStatus, error)
+
+	// LedgerEntries returns up to limit ledger entries with ids lower than
+	// before (all if 0), newest first
+	LedgerEntries(before int64, limit int) ([]LedgerEntry, error)
+	LedgerSummary(by LedgerGrouping) ([]LedgerSummary, error)
+
+	// Messages returns up to limit messages sent by ribs with ids lower than
+	// before (all if 0), newest first
+	Messages(before int64, limit int) ([]MessageInfo, error)
+}
+
+// DealConfigurator manages the dealmaking policy. Changes are persisted and
+// picked up by the deal, transfer and wallet loops without a restart.
+type DealConfigurator interface {
+	Get() DealConfig
+
+	// Set validates and stores a new config. Fields overridden with RIBS_*
+	// environment variables keep their env value, which isn't persisted.
+	Set(cfg DealConfig) error
+}
+
+// DealConfig holds dealmaking knobs, stored as JSON next to the RIBS database
+type DealConfig struct {
+	// price in attoFIL/GiB/epoch
+	MaxPrice      float64
+	MaxVerifPrice float64
+
+	// piece size range ribs is aiming for
+	MinPieceSize, MaxPieceSize int64
+
+	// groups with pieces smaller than MinPieceSize waiting for aggregation are
+	// dealt in an aggregate padded to MinPieceSize after this long
+	AggregateMaxWait Duration
+
+	// deal start epoch offset from the current head
+	DealStartTime abi.ChainEpoch
+
+	// replacement deals are made for deals ending within RenewBefore epochs,
+	// so that groups keep their target replica count; sealed verified deals
+	// are kept alive by claim extension instead
+	RenewBefore abi.ChainEpoch
+
+	MinimumReplicaCount, TargetReplicaCount int
+
+	// verified deals aren't made with less datacap
+	MinDatacap abi.StoragePower
+
+	// make verified deals of groups with the default policy through direct
+	// data onboarding. Requires ExperimentalDirectDeals
+	DirectDeals bool
+
+	// enables direct deals over the experimental ribs direct deal protocol.
+	// No mainstream storage provider serves it (boost onboards direct data
+	// only offline, with boostd import-direct), so direct deals are only
+	// accepted by providers running a compatible deal handler. Without it
+	// DirectDeals policies make market deals.
+	ExperimentalDirectDeals bool
+
+	// transfers slower than MinTransferMbps (scaled by concurrent transfers to
+	// the same provider, capped at a share of LinkSpeedMbps) are dropped
+	MinTransferMbps, LinkSpeedMbps int
+	MaxTransferRetries             int
+
+	// time the sp has to start the first transfer, and for data to not be flowing
+	TransferIdleTimeout Duration
+
+	// market balance is topped up to AutoMarketBalance when available funds
+	// drop below MinMarketBalance
+	MinMarketBalance, AutoMarketBalance abi.TokenAmount
+
+	// max number of groups with data kept locally
+	MaxLocalGroupCount int
+
+	// caps on non-failed replicas of one group with a single provider, and
+	// with providers sharing an owner address; 0 disables the owner cap
+	MaxReplicasPerSP, MaxReplicasPerOwner int
+
+	// don't put replicas of one group with providers sharing a libp2p peer
+	// ID, or an IP range (/24 for IPv4, /48 for IPv6) of crawled public
+	// multiaddrs. ASNs aren't considered
+	DistinctPeerIDs, DistinctIPRanges bool
+
+	// provider reputation scores weigh deal history with this half-life,
+	// combining components with ScoreWeights
+	ScoreHalfLife Duration
+	ScoreWeights  ScoreWeights
+
+	// caps on payments due for live deals in the next 30 days, and on the
+	// total price of live deals, in attoFIL; zero disables a cap. New deals
+	// and escrow top-ups which would exceed a cap aren't made.
+	MonthlyBudget, TotalBudget abi.TokenAmount
+
+	// sent messages not on chain after MessageReplaceAfter are replaced with
+	// higher gas fees, capped at MaxMessageFee (fee cap * gas limit) attoFIL
+	MessageReplaceAfter Duration
+	MaxMessageFee       abi.TokenAmount
+
+	// verified claims of sealed deals are extended to the max term every
+	// ClaimExtendInterval, with up to ClaimExtendBatchSize claims in a message
+	// and up to ClaimExtendMaxMessages messages per cycle (0 for no limit).
+	// Extension messages are only planned unless SendClaimExtensions is set;
+	// without it verified deals are renewed before their end like other deals.
+	ClaimExtendInterval    Duration
+	ClaimExtendBatchSize   int
+	ClaimExtendMaxMessages int
+	SendClaimExtensions    bool
+}
+
+// ScoreWeights are relative weights of provider score components
+type ScoreWeights struct {
+	DealSuccess, Acceptance, SealTime float64
+	Retrieval, TTFB                   float64
+	Price                             float64
+}
+
+// PolicyManager manages replication policy classes and their assignment to
+// groups. Groups without a policy, or with an unknown one, use the default
+// policy derived from DealConfig.
+type PolicyManager interface {
+	Policies() ([]ReplicationPolicy, error)
+	SetPolicy(p ReplicationPolicy) error
+	RemovePolicy(name string) error
+
+	GroupPolicy(group GroupKey) (ReplicationPolicy, error)
+	SetGroupPolicy(group GroupKey, policy string) error
+
+	// SetProviderLabels sets region and organization of a provider, used by
+	// policies with diversity limits
+	SetProviderLabels(sp int64, region, org string) error
+
+	// ProviderAccess returns providers on the allow and deny lists
+	ProviderAccess() (map[int64]ProviderAccess, error)
+
+	// SetProviderAccess puts a provider on the allow or deny list, or removes
+	// it from both with ProviderAccessDefault. When the allow list isn't
+	// empty, deals are only made with allowed providers.
+	SetProviderAccess(sp int64, access ProviderAccess) error
+}
+
+type ProviderAccess string
+
+const (
+	ProviderAccessDefault ProviderAccess = ""
+	ProviderAccessAllow   ProviderAccess = "allow"
+	ProviderAccessDeny    ProviderAccess = "deny"
+)
+
+// DefaultPolicy is the name of the policy derived from DealConfig
+const DefaultPolicy = "default"
+
+// ReplicationPolicy is a named class of durability requirements
+type ReplicationPolicy struct {
+	Name string
+
+	// deals are made until there are TargetReplicas non-failed deals, local
+	// data is offloaded once MinimumReplicas deals are retrievable, and
+	// offloaded groups are repaired when fewer than RepairBelow deals are
+	// retrievable
+	TargetReplicas, MinimumReplicas, RepairBelow int
+
+	Verification DealVerification
+
+	// price in attoFIL/GiB/epoch, nil to use DealConfig prices
+	MaxPrice, MaxVerifPrice *float64
+
+	// deal duration in epochs, 0 for the default duration
+	DealDuration abi.ChainEpoch
+
+	// only make deals with providers serving retrievals over http / bitswap
+	RequireHTTP, RequireBitswap bool
+
+	// max replicas with providers in a single region / organization, 0 for
+	// no limit. Providers without region / org labels aren't used when set
+	MaxPerRegion, MaxPerOrg int
+
+	// don't extend verified claims of deals of groups with this policy, such
+	// deals are renewed with new deals before they end instead
+	NoClaimExtension bool
+
+	// make verified deals through direct data onboarding: datacap is
+	// allocated to providers in the verified registry, without market deals.
+	// Unverified deals are always market deals. Only applies with the
+	// DealConfig ExperimentalDirectDeals flag set.
+	DirectDeals bool
+}
+
+type DealVerification string
+
+const (
+	// DealVerificationAuto makes verified deals when the wallet has datacap
+	DealVerificationAuto       DealVerification = ""
+	DealVerificationVerified   DealVerification = "verified"
+	DealVerificationUnverified DealVerification = "unverified"
+)
+
+// Duration is a time.Duration encoded as a string, e.g. "1h30m"
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
 }
 
 type WalletInfo struct {
 	Addr, IDAddr string
 
+	Role    WalletRole
+	Default bool
+
 	DataCap string
 
+	// nil if the wallet isn't a verified client
+	DataCapDetailed *abi.StoragePower
+
 	Balance       string
 	MarketBalance string
 	MarketLocked  string
 
+	BalanceDetailed       abi.TokenAmount
 	MarketBalanceDetailed api.MarketBalance
 }
 
+// WalletRole limits what deals a client wallet is used for
+type WalletRole string
+
+const (
+	// verified deals when the wallet has enough DataCap, unverified deals
+	// when it isn't a verified client
+	WalletRoleAny WalletRole = "any"
+
+	WalletRoleVerified   WalletRole = "verified"
+	WalletRoleUnverified WalletRole = "unverified"
+
+	// no new deals or escrow top-ups; claims of earlier deals are still
+	// extended
+	WalletRoleDisabled WalletRole = "disabled"
+)
+
+// BudgetStatus is spend committed to live (not failed or expired) deals, in
+// attoFIL
+type BudgetStatus struct {
+	Head abi.ChainEpoch
+
+	// caps from DealConfig, zero when not set
+	MonthlyBudget, TotalBudget abi.TokenAmount
+
+	LiveDeals int64
+
+	// total price of live deals
+	Committed abi.TokenAmount
+
+	// payments of live deals still to be made from escrow
+	Remaining abi.TokenAmount
+
+	// payments of live deals due in the next 30 days
+	ProjectedMonthly abi.TokenAmount
+}
+
+// LedgerEntry records FIL spent, locked or moved by ribs
+type LedgerEntry struct {
+	ID   int64
+	Time int64 // unix seconds
+
+	Kind   LedgerKind
+	Amount abi.TokenAmount // attoFIL
+
+	// purpose of the message for message entries
+	Note string
+
+	MsgCid   string
+	Group    GroupKey // 0 if not about a group
+	Provider int64
+	DealUUID string
+}
+
+type LedgerKind string
+
+const (
+	// gas paid for a sent message
+	LedgerGas LedgerKind = "gas"
+
+	// funds moved by sent messages
+	LedgerMarketAdd      LedgerKind = "market_add"
+	LedgerMarketWithdraw LedgerKind = "market_withdraw"
+	LedgerWithdraw       LedgerKind = "withdraw"
+
+	// escrow locked for the whole price of a published deal, and returned
+	// for the unpaid part when the deal fails
+	LedgerDealLock   LedgerKind = "deal_lock"
+	LedgerDealUnlock LedgerKind = "deal_unlock"
+
+	// deal payments from escrow to the provider, accrued monthly
+	LedgerDealPayment LedgerKind = "deal_payment"
+)
+
+type LedgerGrouping string
+
+const (
+	LedgerByGroup    LedgerGrouping = "group"
+	LedgerByProvider LedgerGrouping = "provider"
+	LedgerByMonth    LedgerGrouping = "month"
+)
+
+// LedgerSummary sums ledger entries by kind for one group, provider or month
+type LedgerSummary struct {
+	// group id, provider id, or month as 2006-01; empty for entries not
+	// related to a group or provider
+	Key string
+
+	Amounts map[LedgerKind]abi.TokenAmount
+
+	// gas and deal payments
+	Cost abi.TokenAmount
+}
+
+// MessageInfo is a message sent by ribs, tracked until it lands on chain
+type MessageInfo struct {
+	ID      int64
+	From    string
+	Nonce   uint64
+	Purpose string
+	Amount  abi.TokenAmount // attoFIL moved by the message
+
+	// cid of the most recently pushed version
+	Cid string
+
+	SentAt, PushedAt int64 // unix seconds
+	Replaced         int   // times replaced with higher fees
+
+	State MessageState
+
+	// set when landed
+	ExecCid    string
+	ExecHeight abi.ChainEpoch
+	ExitCode   int64
+	GasUsed    int64
+	GasCost    abi.TokenAmount
+
+	Error string
+}
+
+type MessageState string
+
+const (
+	MessagePending MessageState = "pending"
+	MessageLanded  MessageState = "landed"
+	MessageFailed  MessageState = "failed" // landed with a non-zero exit code
+	MessageDropped MessageState = "dropped"
+)
+
+// ClaimExtender plans and runs extension of verified claims of ribs deals
+type ClaimExtender interface {
+	// Plan returns extensions the next cycle would make, without sending
+	// any messages
+	Plan(ctx context.Context) (ClaimExtendPlan, error)
+
+	// Run runs a claim extension cycle now
+	Run(ctx context.Context) (ClaimExtendRun, error)
+
+	// Runs returns up to limit most recent cycles, newest first
+	Runs(limit int) ([]ClaimExtendRun, error)
+}
+
+// ClaimExtension is a planned extension of a claim term
+type ClaimExtension struct {
+	Provider, Client int64
+	ClaimID          uint64
+
+	// group of the deal, UndefGroupKey if the claim piece isn't known
+	Group  GroupKey
+	Sector uint64
+
+	TermStart, TermMax abi.ChainEpoch
+	NewTermMax         abi.ChainEpoch
+}
+
+// ClaimExtendBatch is one ExtendClaimTerms message
+type ClaimExtendBatch struct {
+	Client   string
+	Claims   int
+	GasLimit int64
+	Fee      abi.TokenAmount // max fee of the message
+
+	// set once sent
+	Message string
+}
+
+type ClaimExtendPlan struct {
+	Extend []ClaimExtension
+
+	// claims already at the max term, of groups with extension disabled by
+	// their policy, and ones over batching limits left for the next cycle
+	AtMaxTerm, Disabled, Deferred int
+
+	Batches  []ClaimExtendBatch
+	GasLimit int64
+	Fee      abi.TokenAmount
+}
+
+// ClaimExtendRun is a record of a claim extension cycle
+type ClaimExtendRun struct {
+	ID                int64
+	Started, Finished int64 // unix seconds
+
+	// false for dry runs, where messages were only planned
+	Sent bool
+
+	Claims, AtMaxTerm, Disabled, Deferred int
+
+	Batches  []ClaimExtendBatch
+	GasLimit int64
+	Fee      abi.TokenAmount
+
+	Error string
+}
+
 type CrawlState struct {
 	State string
 
@@ -168,9 +598,31 @@ type DealSummary struct {
 
 type ProviderInfo struct {
 	Meta        ProviderMeta
+	Score       ProviderScore
 	RecentDeals []DealMeta
 }
 
+// ProviderScore is a provider reputation score in [0, 1], providers are
+// picked for deals with probability proportional to it
+type ProviderScore struct {
+	Score      float64
+	Components []ScoreComponent
+
+	// unix seconds, 0 if the provider wasn't scored yet
+	UpdatedAt int64
+}
+
+type ScoreComponent struct {
+	Name string
+
+	// component value in [0, 1] and its weight in the score
+	Value, Weight float64
+
+	// decayed number of samples behind Value, values with few samples are
+	// pulled towards 0.5
+	Samples float64
+}
+
 type ProviderMeta struct {
 	ID     int64
 	PingOk bool
@@ -197,4 +649,53 @@ type ProviderMeta struct {
 	AskMaxPieceSize float64
 
 	RetrievDeals, UnretrievDeals int64
+
+	Score float64
+}
+
+// DealAdmin lets operators intervene in dealmaking. Actions are validated
+// against the group and deal state, and recorded in an audit log.
+type DealAdmin interface {
+	// MakeDeal makes a deal for a group with a given provider, bypassing
+	// provider selection. The group data must be local.
+	MakeDeal(ctx context.Context, group GroupKey, provider int64) error
+
+	// CancelDeal marks an in-flight deal as failed, so that it stops
+	// counting towards the group replica target and the provider can't fetch
+	// its data anymore. Deals published on chain can't be cancelled.
+	CancelDeal(ctx context.Context, dealUUID string, reason string) error
+
+	// QueueRepair queues an offloaded group for repair, or moves it to the
+	// front of the repair queue if already queued
+	QueueRepair(ctx context.Context, group GroupKey) error
+
+	// CheckRetrieval runs a retrieval check of a sealed deal now
+	CheckRetrieval(ctx context.Context, dealUUID string) (RetrievalCheck, error)
+
+	// AuditLog returns up to limit admin actions with ids below before (0
+	// for the most recent), newest first
+	AuditLog(before int64, limit int) ([]AuditEntry, error)
+}
+
+// RetrievalCheck is the result of a retrieval check of a deal
+type RetrievalCheck struct {
+	Success bool
+	Error   string
+
+	DurationMs, TTFBMs int64
+}
+
+// AuditEntry is a recorded admin action
+type AuditEntry struct {
+	ID   int64
+	Time int64 // unix seconds
+
+	Action   string
+	Group    GroupKey // UndefGroupKey if not about a group
+	Provider int64
+	DealUUID string
+	Reason   string
+
+	// set when the action failed
+	Error string
 }
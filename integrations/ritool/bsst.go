@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/lotus-web3/ribs/bsst"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+var bsstCmd = &cli.Command{
+	Name:  "bsst",
+	Usage: "BSST index (index.bsst / fil.bsst) commands",
+	Subcommands: []*cli.Command{
+		bsstInfoCmd,
+		bsstVerifyCmd,
+		bsstConvertCmd,
+	},
+}
+
+var bsstInfoCmd = &cli.Command{
+	Name:      "info",
+	Usage:     "print bsst header information",
+	ArgsUsage: "[bsst file]",
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return cli.Exit("Invalid number of arguments", 1)
+		}
+
+		bs, err := bsst.Open(c.Args().First())
+		if err != nil {
+			return xerrors.Errorf("open bsst: %w", err)
+		}
+		defer bs.Close()
+
+		h := bs.Header()
+
+		fmt.Printf("Version: %d\n", bs.Version())
+		fmt.Printf("Entries: %d\n", h.Entries)
+		fmt.Printf("L0Buckets: %d\n", h.L0Buckets)
+		fmt.Printf("Levels: %d\n", h.Levels)
+		fmt.Printf("LevelFactor: %d\n", h.LevelFactor)
+		fmt.Printf("Finalized: %t\n", h.Finalized)
+
+		return nil
+	},
+}
+
+var bsstVerifyCmd = &cli.Command{
+	Name:      "verify",
+	Usage:     "check bucket checksums (v2) and entry placement in all levels",
+	ArgsUsage: "[bsst file...]",
+	Action: func(c *cli.Context) error {
+		if c.NArg() < 1 {
+			return cli.Exit("Invalid number of arguments", 1)
+		}
+
+		var failed int
+		for _, path := range c.Args().Slice() {
+			bs, err := bsst.Open(path)
+			if err != nil {
+				return xerrors.Errorf("open bsst %s: %w", path, err)
+			}
+
+			err = bs.Verify()
+			if cerr := bs.Close(); cerr != nil {
+				return xerrors.Errorf("close bsst %s: %w", path, cerr)
+			}
+
+			if err != nil {
+				fmt.Printf("%s: FAILED (v%d): %s\n", path, bs.Version(), err)
+				failed++
+				continue
+			}
+
+			fmt.Printf("%s: OK (v%d)\n", path, bs.Version())
+		}
+
+		if failed > 0 {
+			return cli.Exit(fmt.Sprintf("%d indexes failed verification", failed), 1)
+		}
+
+		return nil
+	},
+}
+
+var bsstConvertCmd = &cli.Command{
+	Name:      "convert",
+	Usage:     "rewrite a bsst index in the latest (checksummed) format",
+	ArgsUsage: "[bsst file]",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "out",
+			Usage: "output path, by default the input file is replaced",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return cli.Exit("Invalid number of arguments", 1)
+		}
+
+		path := c.Args().First()
+		out := c.String("out")
+		replace := out == ""
+		if replace {
+			out = path + ".convert"
+		}
+
+		src, err := bsst.Open(path)
+		if err != nil {
+			return xerrors.Errorf("open bsst: %w", err)
+		}
+		defer src.Close()
+
+		if src.Version() == bsst.VersionV2 && replace {
+			fmt.Printf("%s: already v%d\n", path, src.Version())
+			return nil
+		}
+
+		if err := src.Verify(); err != nil {
+			return xerrors.Errorf("source index failed verification, not converting: %w", err)
+		}
+
+		dst, err := bsst.Convert(src, out)
+		if err != nil {
+			return xerrors.Errorf("convert: %w", err)
+		}
+
+		err = dst.Verify()
+		if cerr := dst.Close(); cerr != nil {
+			return xerrors.Errorf("close converted bsst: %w", cerr)
+		}
+		if err != nil {
+			return xerrors.Errorf("converted index failed verification: %w", err)
+		}
+
+		if replace {
+			if err := os.Rename(out, path); err != nil {
+				return xerrors.Errorf("replacing index: %w", err)
+			}
+		}
+
+		fmt.Printf("%s: converted v%d -> v%d\n", path, src.Version(), bsst.VersionV2)
+
+		return nil
+	},
+}
@@ -3,71 +3,61 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"os"
+	"text/tabwriter"
+
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
-	"github.com/filecoin-project/go-state-types/big"
-	verifregtypes13 "github.com/filecoin-project/go-state-types/builtin/v13/verifreg"
-	"github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
 	"github.com/filecoin-project/lotus/build"
-	"github.com/filecoin-project/lotus/chain/actors"
-	verifreg2 "github.com/filecoin-project/lotus/chain/actors/builtin/verifreg"
 	"github.com/filecoin-project/lotus/chain/types"
 	cliutil "github.com/filecoin-project/lotus/cli/util"
-	"github.com/filecoin-project/lotus/lib/must"
+	"github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/rbdeal"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/xerrors"
-	"strings"
 )
 
 var claimsExtendCmd = &cli.Command{
 	Name:      "claims-to-extend",
-	Usage:     "Extend claims",
+	Usage:     "Plan extension of claims of a client (dry run)",
 	ArgsUsage: "[ribs db]",
 	Flags: []cli.Flag{
 		&cli.Int64Flag{
 			Name:     "client-id",
 			Required: true,
 		},
+		&cli.IntFlag{
+			Name:  "batch-size",
+			Usage: "max claims extended in one message",
+			Value: 1000,
+		},
+		&cli.IntFlag{
+			Name:  "max-messages",
+			Usage: "max messages in the plan, 0 for no limit",
+		},
+		&cli.BoolFlag{
+			Name:  "list",
+			Usage: "list claims to extend",
+		},
 	},
 	Action: func(c *cli.Context) error {
-		rdb, err := sql.Open("sqlite3", (c.Args().First()))
+		if c.Args().Len() != 1 {
+			return xerrors.Errorf("expected 1 argument")
+		}
+
+		rdb, err := sql.Open("sqlite3", "file:"+c.Args().First()+"?mode=ro")
 		if err != nil {
 			return xerrors.Errorf("open db: %w", err)
 		}
+		defer rdb.Close()
 
 		client := abi.ActorID(c.Int64("client-id"))
-
-		must.One(rdb.Exec("PRAGMA journal_mode=WAL;"))
-		must.One(rdb.Exec("PRAGMA synchronous = normal"))
-
-		var provs []address.Address
-
-		{
-			// SELECT DISTINCT provider_addr FROM deals WHERE sealed=1
-			rows, err := rdb.Query("SELECT DISTINCT provider_addr FROM deals WHERE sealed=1")
-			if err != nil {
-				return xerrors.Errorf("query: %w", err)
-			}
-			defer rows.Close()
-
-			for rows.Next() {
-				var prov uint64
-				if err := rows.Scan(&prov); err != nil {
-					return xerrors.Errorf("scan: %w", err)
-				}
-				provs = append(provs, must.One(address.NewIDAddress(prov)))
-			}
-			if err := rows.Err(); err != nil {
-				return xerrors.Errorf("rows: %w", err)
-			}
-			if err := rows.Close(); err != nil {
-				return xerrors.Errorf("close: %w", err)
-			}
+		clientAddr, err := address.NewIDAddress(uint64(client))
+		if err != nil {
+			return err
 		}
 
-		fmt.Printf("Getting claims for %d providers\n", len(provs))
-
 		chain, closer, err := cliutil.GetGatewayAPI(c)
 		if err != nil {
 			return xerrors.Errorf("getting gateway api: %w", err)
@@ -76,129 +66,44 @@ var claimsExtendCmd = &cli.Command{
 
 		ctx := cliutil.ReqContext(c)
 
-		claimOurs := func(claim verifreg.Claim) bool {
-			return claim.Client == client
+		planner := &rbdeal.ClaimPlanner{
+			DB:          rdb,
+			Chain:       chain,
+			Clients:     map[abi.ActorID]address.Address{client: clientAddr},
+			BatchSize:   c.Int("batch-size"),
+			MaxMessages: c.Int("max-messages"),
 		}
 
-		var nclaims int
-		claims := map[address.Address]map[verifreg.ClaimId]verifreg.Claim{}
-
-		for n, prov := range provs {
-			fmt.Printf("Getting claims for %s (%d/%d)\n", prov, n, len(provs))
-			allProvClaims, err := chain.StateGetClaims(ctx, prov, types.EmptyTSK)
-			if err != nil {
-				return xerrors.Errorf("getting claims: %w", err)
-			}
-
-			for claimID, claim := range allProvClaims {
-				if !claimOurs(claim) {
-					continue
-				}
-
-				if _, ok := claims[prov]; !ok {
-					claims[prov] = map[verifreg.ClaimId]verifreg.Claim{}
-				}
-				claims[prov][claimID] = claim
-				nclaims++
-			}
+		plan, err := planner.Plan(ctx)
+		if err != nil {
+			return err
 		}
 
-		fmt.Printf("Got %d claims, creating messages\n", nclaims)
-
-		tmax := abi.ChainEpoch(verifregtypes13.MaximumVerifiedAllocationTerm)
-		params := verifreg.ExtendClaimTermsParams{}
-
-		var totalGas int64
-		totalFee := big.Zero()
-
-		var mkMessage func(params verifreg.ExtendClaimTermsParams) (*types.Message, error)
-		mkMessage = func(params verifreg.ExtendClaimTermsParams) (*types.Message, error) {
-			clientAddr, err := address.NewIDAddress(uint64(client))
-			if err != nil {
-				return nil, err
-			}
-
-			enc, err := actors.SerializeParams(&params)
-			if err != nil {
-				return nil, err
-			}
-
-			m := &types.Message{
-				To:     verifreg2.Address,
-				From:   clientAddr,
-				Method: verifreg2.Methods.ExtendClaimTerms,
-				Params: enc,
-				Value:  types.NewInt(0),
-			}
-
-			m, err = chain.GasEstimateMessageGas(ctx, m, nil, types.EmptyTSK)
-
-			if (err != nil && strings.Contains(err.Error(), "call ran out of gas")) || m.GasLimit >= build.BlockGasLimit*4/5 {
-				// estimate two messages
-				p1 := params
-				p2 := params
-
-				p1.Terms = p1.Terms[:len(p1.Terms)/2]
-				p2.Terms = p2.Terms[len(p2.Terms)/2:]
-
-				_, err := mkMessage(p1)
-				if err != nil {
-					return nil, err
-				}
-				_, err = mkMessage(p2)
-				if err != nil {
-					return nil, err
+		if c.Bool("list") {
+			tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "Provider\tClaim\tGroup\tSector\tTermStart\tTermMax\tNewTermMax")
+			for _, e := range plan.Extend {
+				group := fmt.Sprint(e.Group)
+				if e.Group == ribs.UndefGroupKey {
+					group = "-"
 				}
-				return nil, nil
+				fmt.Fprintf(tw, "f0%d\t%d\t%s\t%d\t%d\t%d\t%d\n", e.Provider, e.ClaimID, group, e.Sector, e.TermStart, e.TermMax, e.NewTermMax)
 			}
-
-			if err != nil {
-				return nil, err
-			}
-
-			fmt.Printf("Estimate: %d Exts GasLimit=%d (%02d%% blk lim), GasFeeCap=%s, GasPremium=%s, Fee=%s\n", len(params.Terms),
-				m.GasLimit, m.GasLimit*100/build.BlockGasLimit, m.GasFeeCap, m.GasPremium, types.FIL(m.RequiredFunds()))
-
-			totalGas += m.GasLimit
-			totalFee = types.BigAdd(totalFee, m.RequiredFunds())
-
-			return m, nil
-		}
-
-		for provider, cls := range claims {
-			mid, err := address.IDFromAddress(provider)
-			if err != nil {
-				return xerrors.Errorf("getting provider id: %w", err)
-			}
-
-			for claimId, claim := range cls {
-				if claim.TermMax == tmax {
-					continue
-				}
-
-				params.Terms = append(params.Terms, verifreg.ClaimTerm{
-					Provider: abi.ActorID(mid),
-					ClaimId:  claimId,
-					TermMax:  tmax,
-				})
-
-				if len(params.Terms) >= 1000 {
-					if _, err := mkMessage(params); err != nil {
-						return err
-					}
-					params.Terms = nil
-				}
+			if err := tw.Flush(); err != nil {
+				return err
 			}
+			fmt.Println()
 		}
 
-		if len(params.Terms) > 0 {
-			if _, err := mkMessage(params); err != nil {
-				return err
-			}
+		for _, b := range plan.Batches {
+			fmt.Printf("Estimate: %d Exts GasLimit=%d (%02d%% blk lim), Fee=%s\n", b.Claims,
+				b.GasLimit, b.GasLimit*100/build.BlockGasLimit, types.FIL(b.Fee))
 		}
 
-		fmt.Printf("Total gas: %d (%.2f blks)\n", totalGas, float64(totalGas)/float64(build.BlockGasLimit))
-		fmt.Printf("Total fee: %s\n", types.FIL(totalFee))
+		fmt.Printf("Claims to extend: %d (at max term: %d, disabled by policy: %d, deferred: %d)\n",
+			len(plan.Extend), plan.AtMaxTerm, plan.Disabled, plan.Deferred)
+		fmt.Printf("Total gas: %d (%.2f blks)\n", plan.GasLimit, float64(plan.GasLimit)/float64(build.BlockGasLimit))
+		fmt.Printf("Total fee: %s\n", types.FIL(plan.Fee))
 
 		return nil
 	},
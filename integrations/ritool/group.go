@@ -2,8 +2,14 @@ package main
 
 import (
 	"fmt"
-	"github.com/urfave/cli/v2"
+	"os"
+	"path/filepath"
 	"strconv"
+
+	"github.com/lotus-web3/ribs/carlog"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
 )
 
 var groupCmd = &cli.Command{
@@ -11,6 +17,7 @@ var groupCmd = &cli.Command{
 	Usage: "Group utils",
 	Subcommands: []*cli.Command{
 		groupNumToIdCmd,
+		groupExportCarCmd,
 	},
 }
 
@@ -33,3 +40,63 @@ var groupNumToIdCmd = &cli.Command{
 		return nil
 	},
 }
+
+var groupExportCarCmd = &cli.Command{
+	Name:      "export-car",
+	Usage:     "Export a finalized group as a CARv2 with an embedded index",
+	ArgsUsage: "[group dir] [output file]",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "v1",
+			Usage: "write a plain CARv1 without the index",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 2 {
+			return cli.Exit("Invalid number of arguments", 1)
+		}
+
+		groupDir := c.Args().First()
+
+		jb, err := carlog.Open(nil, filepath.Join(groupDir, "blklog.meta"), groupDir, func(to int64, h []mh.Multihash) error {
+			return xerrors.Errorf("carlog needs truncating to %d, refusing to modify group", to)
+		})
+		if err != nil {
+			return xerrors.Errorf("open carlog: %w", err)
+		}
+		defer jb.Close()
+
+		out, err := os.Create(c.Args().Get(1))
+		if err != nil {
+			return xerrors.Errorf("create output file: %w", err)
+		}
+
+		if c.Bool("v1") {
+			n, r, err := jb.WriteCar(out)
+			if err != nil {
+				_ = out.Close()
+				return xerrors.Errorf("write car: %w", err)
+			}
+			fmt.Printf("wrote %d bytes, root %s\n", n, r)
+		} else {
+			carSize, err := jb.CarSize()
+			if err != nil {
+				_ = out.Close()
+				return xerrors.Errorf("get car size: %w", err)
+			}
+
+			n, r, err := jb.WriteCarV2(out, carSize)
+			if err != nil {
+				_ = out.Close()
+				return xerrors.Errorf("write carv2: %w", err)
+			}
+			fmt.Printf("wrote %d bytes (payload %d), root %s\n", n, carSize, r)
+		}
+
+		if err := out.Close(); err != nil {
+			return xerrors.Errorf("close output file: %w", err)
+		}
+
+		return nil
+	},
+}
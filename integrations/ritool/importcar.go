@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/rbstor"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+var importCarCmd = &cli.Command{
+	Name:      "import-car",
+	Usage:     "Import a CARv1/CARv2 file into a (stopped) ribs repo",
+	ArgsUsage: "[ribs data dir] [car file]",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "preserve-roots",
+			Usage: "record car roots as group roots",
+			Value: true,
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 2 {
+			return cli.Exit("Invalid number of arguments", 1)
+		}
+
+		f, err := os.Open(c.Args().Get(1))
+		if err != nil {
+			return xerrors.Errorf("open car: %w", err)
+		}
+		defer f.Close()
+
+		rbs, err := rbstor.Open(c.Args().First())
+		if err != nil {
+			return xerrors.Errorf("open rbs: %w", err)
+		}
+		if err := rbs.Start(); err != nil {
+			return xerrors.Errorf("start rbs: %w", err)
+		}
+
+		opts := ribs.ImportCarOpts{
+			PreserveRoots: c.Bool("preserve-roots"),
+		}
+
+		res, err := rbs.Storage().ImportCar(c.Context, f, opts, func(p ribs.ImportProgress) {
+			fmt.Printf("\rblocks: %d (%d bytes), duplicate: %d, groups: %d", p.Blocks, p.Bytes, p.DuplicateBlocks, len(p.Groups))
+		})
+		fmt.Println()
+		if cerr := rbs.Close(); cerr != nil && err == nil {
+			err = xerrors.Errorf("close rbs: %w", cerr)
+		}
+		if err != nil {
+			return xerrors.Errorf("import car: %w", err)
+		}
+
+		fmt.Printf("imported %d blocks (%d new) into groups %v, roots %v\n", res.Blocks, res.Blocks-res.DuplicateBlocks, res.Groups, res.Roots)
+		return nil
+	},
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/rbdeal"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+var ledgerReportCmd = &cli.Command{
+	Name:      "ledger-report",
+	Usage:     "Summarize FIL spent on gas and deals",
+	ArgsUsage: "[ribs db]",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "by",
+			Usage: "group, provider or month",
+			Value: string(ribs.LedgerByMonth),
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "table, csv or json",
+			Value: "table",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.Args().Len() != 1 {
+			return xerrors.Errorf("expected 1 argument")
+		}
+
+		rdb, err := sql.Open("sqlite3", "file:"+c.Args().First()+"?mode=ro")
+		if err != nil {
+			return xerrors.Errorf("open db: %w", err)
+		}
+		defer rdb.Close()
+
+		sums, err := rbdeal.LedgerSummary(rdb, ribs.LedgerGrouping(c.String("by")))
+		if err != nil {
+			return err
+		}
+
+		switch c.String("format") {
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(sums)
+		case "csv":
+			kinds := ledgerKinds(sums)
+
+			w := csv.NewWriter(os.Stdout)
+			header := []string{c.String("by")}
+			for _, k := range kinds {
+				header = append(header, string(k))
+			}
+			if err := w.Write(append(header, "cost")); err != nil {
+				return err
+			}
+
+			for _, s := range sums {
+				row := []string{s.Key}
+				for _, k := range kinds {
+					a, ok := s.Amounts[k]
+					if !ok {
+						a = types.NewInt(0)
+					}
+					row = append(row, a.String())
+				}
+				if err := w.Write(append(row, s.Cost.String())); err != nil {
+					return err
+				}
+			}
+
+			w.Flush()
+			return w.Error()
+		case "table":
+			kinds := ledgerKinds(sums)
+
+			tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+			fmt.Fprint(tw, c.String("by"))
+			for _, k := range kinds {
+				fmt.Fprintf(tw, "\t%s", k)
+			}
+			fmt.Fprintln(tw, "\tcost")
+
+			for _, s := range sums {
+				fmt.Fprint(tw, s.Key)
+				for _, k := range kinds {
+					a, ok := s.Amounts[k]
+					if !ok {
+						a = types.NewInt(0)
+					}
+					fmt.Fprintf(tw, "\t%s", types.FIL(a).Short())
+				}
+				fmt.Fprintf(tw, "\t%s\n", types.FIL(s.Cost).Short())
+			}
+
+			return tw.Flush()
+		default:
+			return xerrors.Errorf("unknown format %q", c.String("format"))
+		}
+	},
+}
+
+// ledgerKinds returns entry kinds present in any summary, sorted
+func ledgerKinds(sums []ribs.LedgerSummary) []ribs.LedgerKind {
+	seen := map[ribs.LedgerKind]struct{}{}
+	for _, s := range sums {
+		for k := range s.Amounts {
+			seen[k] = struct{}{}
+		}
+	}
+
+	out := make([]ribs.LedgerKind, 0, len(seen))
+	for k := range seen {
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+
+	return out
+}
@@ -16,7 +16,11 @@ func main() {
 			idxLevelCmd,
 			ldbcidCmd,
 			groupCmd,
+			importCarCmd,
 			claimsExtendCmd,
+			bsstCmd,
+			ledgerReportCmd,
+			walletCmd,
 		},
 	}
 
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/lotus-web3/ribs/ributil"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+)
+
+var walletCmd = &cli.Command{
+	Name:  "wallet",
+	Usage: "Local wallet commands",
+	Subcommands: []*cli.Command{
+		walletEncryptCmd,
+	},
+}
+
+var walletEncryptCmd = &cli.Command{
+	Name:      "encrypt",
+	Usage:     "Encrypt an unencrypted wallet directory with a passphrase",
+	ArgsUsage: "[wallet path]",
+	Description: `The passphrase is taken from RIBS_WALLET_PASSPHRASE or
+RIBS_WALLET_PASSPHRASE_FILE, or prompted for. RIBS must be stopped while the
+wallet is migrated.`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "keep-backup",
+			Usage: "keep the unencrypted wallet directory",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.Args().Len() > 1 {
+			return xerrors.Errorf("expected at most 1 argument")
+		}
+
+		path := "~/.ribswallet"
+		if c.Args().Len() == 1 {
+			path = c.Args().First()
+		}
+
+		pass := ributil.PassphraseFromEnv()
+		if pass == nil {
+			pass = ributil.PromptPassphrase
+		}
+
+		p, err := pass(true)
+		if err != nil {
+			return err
+		}
+
+		backup, err := ributil.MigrateKeystore(path, p, c.Bool("keep-backup"))
+		if err != nil {
+			return xerrors.Errorf("encrypting wallet: %w", err)
+		}
+
+		fmt.Println("Wallet encrypted")
+		if backup != "" {
+			fmt.Printf("Unencrypted wallet kept at %s, remove it once RIBS starts with the encrypted wallet\n", backup)
+		}
+
+		return nil
+	},
+}
@@ -43,6 +43,11 @@ class RibsRPC {
         }
     }
 
+    // callOnce doesn't retry, for actions which shouldn't be repeated
+    static async callOnce(method, params) {
+        return await RibsRPC.get().call('RIBS.' + method, params);
+    }
+
     static async callFil(method, params) {
         const maxRetries = 5;
         let delay = 1000; // 1 second in milliseconds
@@ -3,7 +3,7 @@ import RibsRPC from "../helpers/rpc";
 import { formatBytesBinary, formatNum, epochToDate, epochToDuration } from "../helpers/fmt";
 import "./Groups.css";
 import "./Deal.css";
-import {Deal, GroupStateWritable, GroupStateOffloaded, groupStateText} from "./Groups";
+import {Deal, GroupStateWritable, GroupStateLocalReadyForDeals, GroupStateOffloaded, groupStateText} from "./Groups";
 import {useParams} from "react-router-dom";
 
 export default function Group() {
@@ -65,6 +65,48 @@ export default function Group() {
         };
     }, [groupKey]);
 
+    const [dealProvider, setDealProvider] = useState("");
+
+    const adminAction = async (what, method, params) => {
+        try {
+            return { result: await RibsRPC.callOnce(method, params) };
+        } catch (error) {
+            console.error(`Error ${what}:`, error);
+            alert(`Error ${what}: ${error.message || error}`);
+            return null;
+        }
+    };
+
+    const makeDeal = async () => {
+        const provider = parseInt(dealProvider.replace(/^f0/, ""));
+        if (isNaN(provider) || provider <= 0) {
+            alert("Invalid provider ID");
+            return;
+        }
+
+        if (await adminAction("making deal", "AdminMakeDeal", [groupKey, provider])) {
+            setDealProvider("");
+        }
+    };
+
+    const queueRepair = async () => {
+        if (!window.confirm(`Queue group ${groupKey} for repair?`)) return;
+        await adminAction("queueing repair", "AdminQueueRepair", [groupKey]);
+    };
+
+    const cancelDeal = async (deal) => {
+        const reason = window.prompt(`Cancel deal ${deal.UUID} with f0${deal.Provider}? Reason:`);
+        if (reason === null) return;
+        await adminAction("cancelling deal", "AdminCancelDeal", [deal.UUID, reason]);
+    };
+
+    const checkRetrieval = async (deal) => {
+        const res = (await adminAction("checking retrieval", "AdminCheckRetrieval", [deal.UUID]))?.result;
+        if (res) {
+            alert(res.Success ? `Retrieval OK in ${res.DurationMs}ms (TTFB ${res.TTFBMs}ms)` : `Retrieval failed: ${res.Error}`);
+        }
+    };
+
     const renderProgressBar = (bytes, maxBytes) => {
         const percentage = (bytes / maxBytes) * 100;
         return (
@@ -113,12 +155,24 @@ export default function Group() {
                 </div>
                 <div>PieceCID: {group.PieceCID} <a target="_blank" href={`https://filecoin.tools/${group.PieceCID}`}>[filecoin.tools]</a></div>
                 <div>RootCID: {group.RootCID}</div>
+                <div>
+                    {group.State === GroupStateLocalReadyForDeals && <>
+                        <input type="text" placeholder="f0..." value={dealProvider} onChange={(e) => setDealProvider(e.target.value)} />
+                        <button className="button-sm" onClick={makeDeal}>Make Deal</button>
+                    </>}
+                    {group.State === GroupStateOffloaded && <button className="button-sm" onClick={queueRepair}>Queue Repair</button>}
+                </div>
             </div>
             <div className="group" >
                     {dealsToDisplay.length > 0 && (
                         <>
                             {dealsToDisplay.map((deal) => (
-                                <Deal key={deal.UUID} deal={deal} headHeight={headHeight} pieceCid={group.PieceCID} dataCid={group.RootCID} />
+                                <Deal key={deal.UUID} deal={deal} headHeight={headHeight} pieceCid={group.PieceCID} dataCid={group.RootCID}>
+                                    <span>
+                                        {!deal.Failed && !deal.Sealed && !deal.PubCid && <button className="button-sm" onClick={() => cancelDeal(deal)}>Cancel</button>}
+                                        {!deal.Failed && deal.Sealed && <button className="button-sm" onClick={() => checkRetrieval(deal)}>Check Retrieval</button>}
+                                    </span>
+                                </Deal>
                             ))}
                         </>
                     )}
@@ -5,7 +5,7 @@ import "./Groups.css";
 import "./Deal.css";
 import {Link} from "react-router-dom";
 
-export function Deal({ deal, headHeight, pieceCid, dataCid }) {
+export function Deal({ deal, headHeight, pieceCid, dataCid, children }) {
     const {
         UUID,
         Provider,
@@ -69,6 +69,7 @@ export function Deal({ deal, headHeight, pieceCid, dataCid }) {
                         (<span>Error ({Status}) <abbr title={Error} className="deal-err">{errorMessage}</abbr></span>)}
                 </>
             )}
+            {children}
         </div>
     );
 }
@@ -87,6 +88,7 @@ export const groupStateText = [
 ];
 
 export const GroupStateWritable = 0;
+export const GroupStateLocalReadyForDeals = 3;
 export const GroupStateOffloaded = 4;
 
 export function Group({ groupKey, headHeight, showCid }) {
@@ -131,6 +131,30 @@ function Provider() {
                         </tbody>
                     </table>
 
+                    <h4>Score: {provider.Score.Score.toFixed(3)}</h4>
+
+                    <table className="compact-table provider-meta-table">
+                        <thead>
+                        <tr>
+                            <th>Component</th>
+                            <th>Value</th>
+                            <th>Weight</th>
+                            <th>Samples</th>
+                        </tr>
+                        </thead>
+                        <tbody>
+                        {provider.Score.Components && provider.Score.Components.map((c) => (
+                            <tr key={c.Name}>
+                                <td>{c.Name}</td>
+                                <td>{c.Value.toFixed(3)}</td>
+                                <td>{c.Weight}</td>
+                                <td>{c.Samples.toFixed(1)}</td>
+                            </tr>
+                        ))}
+                        </tbody>
+                    </table>
+                    {provider.Score.UpdatedAt > 0 && <div>Updated {formatTimestamp(provider.Score.UpdatedAt)}</div>}
+
                     <h4>Recent Deals</h4>
 
                     <table className="compact-table providers-table">
@@ -2,7 +2,7 @@ import './Status.css';
 import React, { useState, useEffect, useRef } from "react";
 import RibsRPC from "../helpers/rpc";
 import { CopyToClipboard } from 'react-copy-to-clipboard';
-import {formatBytesBinary, formatBitsBinary, formatNum, formatNum6, calcEMA} from "../helpers/fmt";
+import {formatBytesBinary, formatBitsBinary, formatNum, formatNum6, formatFil, calcEMA} from "../helpers/fmt";
 import content from "./Content";
 import { BarChart, Bar, XAxis, YAxis, Tooltip, CartesianGrid, Legend, ResponsiveContainer } from 'recharts';
 
@@ -103,6 +103,203 @@ function WalletInfoTile({ walletInfo }) {
     );
 }
 
+function WalletsTile() {
+    const [wallets, setWallets] = useState(null);
+
+    const fetchWallets = async () => {
+        try {
+            const wallets = await RibsRPC.call("Wallets");
+            setWallets(wallets);
+        } catch (error) {
+            console.error("Error fetching wallets:", error);
+        }
+    };
+
+    useEffect(() => {
+        fetchWallets();
+        const intervalId = setInterval(fetchWallets, 10000);
+
+        return () => {
+            clearInterval(intervalId);
+        };
+    }, []);
+
+    const setRole = async (addr, role) => {
+        try {
+            await RibsRPC.call("WalletSetRole", [addr, role]);
+            await fetchWallets();
+        } catch (error) {
+            console.error("Error setting wallet role:", error);
+            alert('Error setting wallet role. Please try again.');
+        }
+    };
+
+    const newWallet = async () => {
+        try {
+            const addr = await RibsRPC.call("WalletNew");
+            alert(`Created wallet ${addr}`);
+            await fetchWallets();
+        } catch (error) {
+            console.error("Error creating wallet:", error);
+            alert('Error creating wallet. Please try again.');
+        }
+    };
+
+    return (
+        <div>
+            <h2>Client Wallets</h2>
+            {wallets && (
+                <table className="compact-table">
+                    <thead>
+                    <tr>
+                        <th>Address</th>
+                        <th>Role</th>
+                        <th>Balance</th>
+                        <th>Market</th>
+                        <th>DataCap</th>
+                    </tr>
+                    </thead>
+                    <tbody>
+                    {wallets.map((w) => (
+                        <tr key={w.Addr}>
+                            <td><abbr title={w.Addr}>{w.Addr.slice(0, 10)}...</abbr>{w.Default && <> (default)</>}</td>
+                            <td>
+                                <select value={w.Role} onChange={(e) => setRole(w.Addr, e.target.value)}>
+                                    <option value="any">any</option>
+                                    <option value="verified">verified</option>
+                                    <option value="unverified">unverified</option>
+                                    <option value="disabled">disabled</option>
+                                </select>
+                            </td>
+                            <td>{w.Balance}</td>
+                            <td>{w.MarketBalance} ({w.MarketLocked} locked)</td>
+                            <td>{w.DataCap || '-'}</td>
+                        </tr>
+                    ))}
+                    <tr>
+                        <td colSpan={5} style={{textAlign: 'center'}}>
+                            <button className="button-sm" onClick={newWallet}>New Wallet</button>
+                        </td>
+                    </tr>
+                    </tbody>
+                </table>
+            )}
+        </div>
+    );
+}
+
+function BudgetTile() {
+    const [budget, setBudget] = useState(null);
+
+    const fetchBudget = async () => {
+        try {
+            const budget = await RibsRPC.call("Budget");
+            setBudget(budget);
+        } catch (error) {
+            console.error("Error fetching budget:", error);
+        }
+    };
+
+    useEffect(() => {
+        fetchBudget();
+        const intervalId = setInterval(fetchBudget, 10000);
+
+        return () => {
+            clearInterval(intervalId);
+        };
+    }, []);
+
+    const cap = (v) => (v === "0" ? "none" : formatFil(Number(v)));
+
+    return (
+        <div>
+            <h2>Budget</h2>
+            {budget && (
+                <table className="compact-table">
+                    <tbody>
+                    <tr>
+                        <td>Live Deals:</td>
+                        <td>{budget.LiveDeals}</td>
+                    </tr>
+                    <tr>
+                        <td>Next 30 Days:</td>
+                        <td className="important-metric">{formatFil(Number(budget.ProjectedMonthly))} / {cap(budget.MonthlyBudget)}</td>
+                    </tr>
+                    <tr>
+                        <td>Committed:</td>
+                        <td className="important-metric">{formatFil(Number(budget.Committed))} / {cap(budget.TotalBudget)}</td>
+                    </tr>
+                    <tr>
+                        <td>Remaining Payments:</td>
+                        <td>{formatFil(Number(budget.Remaining))}</td>
+                    </tr>
+                    </tbody>
+                </table>
+            )}
+        </div>
+    );
+}
+
+function MessagesTile() {
+    const [messages, setMessages] = useState(null);
+
+    const fetchMessages = async () => {
+        try {
+            const messages = await RibsRPC.call("Messages", [0, 10]);
+            setMessages(messages);
+        } catch (error) {
+            console.error("Error fetching messages:", error);
+        }
+    };
+
+    useEffect(() => {
+        fetchMessages();
+        const intervalId = setInterval(fetchMessages, 10000);
+
+        return () => {
+            clearInterval(intervalId);
+        };
+    }, []);
+
+    const stateColor = {
+        pending: '#f2f3ff',
+        landed: '#caffcd',
+        failed: '#f5c4c4',
+        dropped: '#fff7cc',
+    };
+
+    return (
+        <div>
+            <h2>Messages</h2>
+            {messages && (
+                <table className="compact-table">
+                    <thead>
+                    <tr>
+                        <th>Purpose</th>
+                        <th>State</th>
+                        <th>Message</th>
+                        <th>Gas</th>
+                    </tr>
+                    </thead>
+                    <tbody>
+                    {messages.map((m) => (
+                        <tr key={m.ID} style={{background: stateColor[m.State]}}>
+                            <td>{m.Purpose}</td>
+                            <td>
+                                <abbr title={m.Error || (m.State === 'failed' ? `exit code ${m.ExitCode}` : '')}>{m.State}</abbr>
+                                {m.Replaced > 0 && <> (replaced {m.Replaced}x)</>}
+                            </td>
+                            <td><a href={`https://filfox.info/en/message/${m.ExecCid || m.Cid}`} target="_blank" rel="noopener noreferrer">bafy..{(m.ExecCid || m.Cid).substr(-16)}</a></td>
+                            <td>{m.ExecCid && formatFil(Number(m.GasCost))}</td>
+                        </tr>
+                    ))}
+                    </tbody>
+                </table>
+            )}
+        </div>
+    );
+}
+
 function GroupsTile() {
     const [groupStats, setGroupStats] = useState(null);
 
@@ -1107,6 +1304,9 @@ function Status() {
                     <CarUploadStatsTile carUploadStats={carUploadStats} />
                     <CrawlStateTile crawlState={crawlState} />
                     <WalletInfoTile walletInfo={walletInfo} />
+                    <WalletsTile />
+                    <BudgetTile />
+                    <MessagesTile />
                 </div>
 
                 <h1>External Storage</h1>
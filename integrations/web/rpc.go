@@ -2,6 +2,7 @@ package web
 
 import (
 	"context"
+	"os"
 	"runtime"
 
 	"github.com/filecoin-project/go-address"
@@ -20,6 +21,18 @@ func (rc *RIBSRpc) WalletInfo(ctx context.Context) (ribs.WalletInfo, error) {
 	return rc.ribs.Wallet().WalletInfo()
 }
 
+func (rc *RIBSRpc) Wallets(ctx context.Context) ([]ribs.WalletInfo, error) {
+	return rc.ribs.Wallet().Wallets()
+}
+
+func (rc *RIBSRpc) WalletNew(ctx context.Context) (address.Address, error) {
+	return rc.ribs.Wallet().NewWallet(ctx)
+}
+
+func (rc *RIBSRpc) WalletSetRole(ctx context.Context, addr address.Address, role ribs.WalletRole) error {
+	return rc.ribs.Wallet().SetWalletRole(addr, role)
+}
+
 func (rc *RIBSRpc) WalletMarketAdd(ctx context.Context, amt abi.TokenAmount) (cid.Cid, error) {
 	return rc.ribs.Wallet().MarketAdd(ctx, amt)
 }
@@ -32,6 +45,94 @@ func (rc *RIBSRpc) WalletWithdraw(ctx context.Context, amt abi.TokenAmount, to a
 	return rc.ribs.Wallet().Withdraw(ctx, amt, to)
 }
 
+func (rc *RIBSRpc) Budget(ctx context.Context) (ribs.BudgetStatus, error) {
+	return rc.ribs.Wallet().Budget(ctx)
+}
+
+func (rc *RIBSRpc) LedgerEntries(ctx context.Context, before int64, limit int) ([]ribs.LedgerEntry, error) {
+	return rc.ribs.Wallet().LedgerEntries(before, limit)
+}
+
+func (rc *RIBSRpc) LedgerSummary(ctx context.Context, by ribs.LedgerGrouping) ([]ribs.LedgerSummary, error) {
+	return rc.ribs.Wallet().LedgerSummary(by)
+}
+
+func (rc *RIBSRpc) Messages(ctx context.Context, before int64, limit int) ([]ribs.MessageInfo, error) {
+	return rc.ribs.Wallet().Messages(before, limit)
+}
+
+func (rc *RIBSRpc) DealConfig(ctx context.Context) (ribs.DealConfig, error) {
+	return rc.ribs.DealConfig().Get(), nil
+}
+
+func (rc *RIBSRpc) SetDealConfig(ctx context.Context, cfg ribs.DealConfig) error {
+	return rc.ribs.DealConfig().Set(cfg)
+}
+
+func (rc *RIBSRpc) Policies(ctx context.Context) ([]ribs.ReplicationPolicy, error) {
+	return rc.ribs.Policies().Policies()
+}
+
+func (rc *RIBSRpc) SetPolicy(ctx context.Context, p ribs.ReplicationPolicy) error {
+	return rc.ribs.Policies().SetPolicy(p)
+}
+
+func (rc *RIBSRpc) RemovePolicy(ctx context.Context, name string) error {
+	return rc.ribs.Policies().RemovePolicy(name)
+}
+
+func (rc *RIBSRpc) GroupPolicy(ctx context.Context, group ribs.GroupKey) (ribs.ReplicationPolicy, error) {
+	return rc.ribs.Policies().GroupPolicy(group)
+}
+
+func (rc *RIBSRpc) SetGroupPolicy(ctx context.Context, group ribs.GroupKey, policy string) error {
+	return rc.ribs.Policies().SetGroupPolicy(group, policy)
+}
+
+func (rc *RIBSRpc) SetProviderLabels(ctx context.Context, sp int64, region, org string) error {
+	return rc.ribs.Policies().SetProviderLabels(sp, region, org)
+}
+
+func (rc *RIBSRpc) ProviderAccess(ctx context.Context) (map[int64]ribs.ProviderAccess, error) {
+	return rc.ribs.Policies().ProviderAccess()
+}
+
+func (rc *RIBSRpc) SetProviderAccess(ctx context.Context, sp int64, access ribs.ProviderAccess) error {
+	return rc.ribs.Policies().SetProviderAccess(sp, access)
+}
+
+func (rc *RIBSRpc) ClaimExtendPlan(ctx context.Context) (ribs.ClaimExtendPlan, error) {
+	return rc.ribs.Claims().Plan(ctx)
+}
+
+func (rc *RIBSRpc) ClaimExtendRun(ctx context.Context) (ribs.ClaimExtendRun, error) {
+	return rc.ribs.Claims().Run(ctx)
+}
+
+func (rc *RIBSRpc) ClaimExtendRuns(ctx context.Context, limit int) ([]ribs.ClaimExtendRun, error) {
+	return rc.ribs.Claims().Runs(limit)
+}
+
+func (rc *RIBSRpc) AdminMakeDeal(ctx context.Context, group ribs.GroupKey, provider int64) error {
+	return rc.ribs.Admin().MakeDeal(ctx, group, provider)
+}
+
+func (rc *RIBSRpc) AdminCancelDeal(ctx context.Context, dealUUID string, reason string) error {
+	return rc.ribs.Admin().CancelDeal(ctx, dealUUID, reason)
+}
+
+func (rc *RIBSRpc) AdminQueueRepair(ctx context.Context, group ribs.GroupKey) error {
+	return rc.ribs.Admin().QueueRepair(ctx, group)
+}
+
+func (rc *RIBSRpc) AdminCheckRetrieval(ctx context.Context, dealUUID string) (ribs.RetrievalCheck, error) {
+	return rc.ribs.Admin().CheckRetrieval(ctx, dealUUID)
+}
+
+func (rc *RIBSRpc) AuditLog(ctx context.Context, before int64, limit int) ([]ribs.AuditEntry, error) {
+	return rc.ribs.Admin().AuditLog(before, limit)
+}
+
 func (rc *RIBSRpc) Groups(ctx context.Context) ([]ribs.GroupKey, error) {
 	return rc.ribs.StorageDiag().Groups()
 }
@@ -122,6 +223,38 @@ func (rc *RIBSRpc) RepairStats() (map[int]ribs.RepairJob, error) {
 	return rc.ribs.DealDiag().RepairStats()
 }
 
+// ImportCar imports a CAR file from a path on the RIBS node, streaming progress
+func (rc *RIBSRpc) ImportCar(ctx context.Context, path string, opts ribs.ImportCarOpts) (<-chan ribs.ImportProgress, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan ribs.ImportProgress, 1)
+
+	send := func(p ribs.ImportProgress) {
+		select {
+		case out <- p:
+		case <-ctx.Done():
+		}
+	}
+
+	go func() {
+		defer close(out)
+		defer f.Close()
+
+		res, err := rc.ribs.Storage().ImportCar(ctx, f, opts, send)
+		if err != nil {
+			log.Errorw("car import failed", "path", path, "error", err)
+
+			res.Error = err.Error()
+			send(res)
+		}
+	}()
+
+	return out, nil
+}
+
 func MakeRPCServer(ctx context.Context, ribs ribs.RIBS) (*jsonrpc.RPCServer, jsonrpc.ClientCloser, error) {
 	hnd := &RIBSRpc{ribs: ribs}
 
@@ -0,0 +1,265 @@
+package rbdeal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+const (
+	auditMakeDeal       = "make-deal"
+	auditCancelDeal     = "cancel-deal"
+	auditQueueRepair    = "queue-repair"
+	auditCheckRetrieval = "check-retrieval"
+)
+
+type dealAdmin struct {
+	r *ribs
+}
+
+func (r *ribs) Admin() iface.DealAdmin {
+	return &dealAdmin{r: r}
+}
+
+func (a *dealAdmin) MakeDeal(ctx context.Context, group iface.GroupKey, provider int64) error {
+	err := a.makeDeal(ctx, group, provider)
+	a.audit(iface.AuditEntry{Action: auditMakeDeal, Group: group, Provider: provider}, err)
+	return err
+}
+
+func (a *dealAdmin) makeDeal(ctx context.Context, group iface.GroupKey, provider int64) error {
+	if provider <= 0 {
+		return xerrors.Errorf("invalid provider id %d", provider)
+	}
+
+	gm, err := a.r.StorageDiag().GroupMeta(group)
+	if err != nil {
+		return xerrors.Errorf("getting group meta: %w", err)
+	}
+	if gm.State != iface.GroupStateLocalReadyForDeals {
+		return xerrors.Errorf("group %d is not ready for deals (state %d)", group, gm.State)
+	}
+
+	return a.r.makeGroupDeals(ctx, group, a.r.host, a.r.wallet, provider)
+}
+
+func (a *dealAdmin) CancelDeal(ctx context.Context, dealUUID string, reason string) error {
+	entry := iface.AuditEntry{Action: auditCancelDeal, Group: iface.UndefGroupKey, DealUUID: dealUUID, Reason: reason}
+
+	group, provider, err := a.r.db.CancelDeal(dealUUID, reason)
+	if err == nil {
+		entry.Group, entry.Provider = group, provider
+	}
+
+	a.audit(entry, err)
+	return err
+}
+
+func (a *dealAdmin) QueueRepair(ctx context.Context, group iface.GroupKey) error {
+	err := a.queueRepair(group)
+	a.audit(iface.AuditEntry{Action: auditQueueRepair, Group: group}, err)
+	return err
+}
+
+func (a *dealAdmin) queueRepair(group iface.GroupKey) error {
+	gm, err := a.r.StorageDiag().GroupMeta(group)
+	if err != nil {
+		return xerrors.Errorf("getting group meta: %w", err)
+	}
+	if gm.State != iface.GroupStateOffloaded {
+		// local groups are served from local data, nothing to repair
+		return xerrors.Errorf("group %d is not offloaded (state %d)", group, gm.State)
+	}
+
+	return a.r.db.QueueRepair(group)
+}
+
+func (a *dealAdmin) CheckRetrieval(ctx context.Context, dealUUID string) (iface.RetrievalCheck, error) {
+	res, err := a.r.checkDealRetrieval(ctx, dealUUID)
+	a.audit(iface.AuditEntry{Action: auditCheckRetrieval, Group: iface.UndefGroupKey, DealUUID: dealUUID}, err)
+	return res, err
+}
+
+func (a *dealAdmin) AuditLog(before int64, limit int) ([]iface.AuditEntry, error) {
+	return a.r.db.AuditLog(before, limit)
+}
+
+// audit records an admin action, and its error if it failed
+func (a *dealAdmin) audit(e iface.AuditEntry, err error) {
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	log.Infow("admin action", "action", e.Action, "group", e.Group, "provider", e.Provider, "deal", e.DealUUID, "reason", e.Reason, "error", err)
+
+	if rerr := a.r.db.RecordAudit(e); rerr != nil {
+		log.Errorw("recording admin action", "action", e.Action, "error", rerr)
+	}
+}
+
+// ManualDealProvider returns a provider picked by the operator for a deal of
+// a group. Unlike SelectDealProviders it ignores provider scores and recent
+// failures, but the provider must still take deals of the piece at the price,
+// be allowed by the access lists and stay under the per-provider replica cap.
+func (r *ribsDB) ManualDealProvider(group iface.GroupKey, sp int64, pieceSize int64, verified bool, maxPrice float64, horizon abi.ChainEpoch) (dealProvider, error) {
+	p := dealProvider{id: sp, score: neutralScore}
+
+	var boostDeals, askOk bool
+	var minSize, maxSize int64
+	err := r.db.QueryRow(`select boost_deals, ask_ok, ask_price, ask_verif_price, ask_min_piece_size, ask_max_piece_size from providers where id = ?`, sp).
+		Scan(&boostDeals, &askOk, &p.ask_price, &p.ask_verif_price, &minSize, &maxSize)
+	if errors.Is(err, sql.ErrNoRows) {
+		return dealProvider{}, xerrors.Errorf("unknown provider f0%d", sp)
+	}
+	if err != nil {
+		return dealProvider{}, xerrors.Errorf("querying provider: %w", err)
+	}
+
+	if !boostDeals || !askOk {
+		return dealProvider{}, xerrors.Errorf("provider f0%d doesn't accept boost deals, or its ask can't be queried", sp)
+	}
+	if pieceSize < minSize || pieceSize > maxSize {
+		return dealProvider{}, xerrors.Errorf("provider f0%d doesn't accept pieces of %d bytes (min %d, max %d)", sp, pieceSize, minSize, maxSize)
+	}
+
+	price := p.ask_price
+	if verified {
+		price = p.ask_verif_price
+	}
+	if price > maxPrice {
+		return dealProvider{}, xerrors.Errorf("provider f0%d ask price %f is above max price %f", sp, price, maxPrice)
+	}
+
+	var allowed bool
+	err = r.db.QueryRow(`select ? NOT IN (SELECT sp_id FROM provider_access WHERE access = 'deny')
+		AND (NOT EXISTS (SELECT 1 FROM provider_access WHERE access = 'allow')
+			OR ? IN (SELECT sp_id FROM provider_access WHERE access = 'allow'))`, sp, sp).Scan(&allowed)
+	if err != nil {
+		return dealProvider{}, xerrors.Errorf("checking provider access: %w", err)
+	}
+	if !allowed {
+		return dealProvider{}, xerrors.Errorf("provider f0%d is not allowed by the provider access lists", sp)
+	}
+
+	var alive int
+	err = r.db.QueryRow(`select count(*) from deals where provider_addr = ? and `+dealsOfGroup+` and `+dealAliveAt(r.dealCfg.get(), ""), sp, group, group, horizon).Scan(&alive)
+	if err != nil {
+		return dealProvider{}, xerrors.Errorf("counting provider deals: %w", err)
+	}
+	if max := r.dealCfg.get().MaxReplicasPerSP; alive >= max {
+		return dealProvider{}, xerrors.Errorf("provider f0%d already has %d live deals for group %d (max %d)", sp, alive, group, max)
+	}
+
+	return p, nil
+}
+
+// CancelDeal fails an in-flight deal, returning its group and provider. Deals
+// with chain state, published or allocated, can't be cancelled.
+func (r *ribsDB) CancelDeal(dealUUID string, reason string) (iface.GroupKey, int64, error) {
+	var group, provider int64
+	var failed, published, sealed, publishing, allocated bool
+	err := r.db.QueryRow(`select group_id, provider_addr, failed, published, sealed, sp_pub_msg_cid is not null, allocation_id is not null
+		from deals where uuid = ?`, dealUUID).Scan(&group, &provider, &failed, &published, &sealed, &publishing, &allocated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, xerrors.Errorf("unknown deal %s", dealUUID)
+	}
+	if err != nil {
+		return 0, 0, xerrors.Errorf("querying deal: %w", err)
+	}
+
+	switch {
+	case failed:
+		return 0, 0, xerrors.Errorf("deal %s already failed", dealUUID)
+	case published || sealed || publishing:
+		return 0, 0, xerrors.Errorf("deal %s is published on chain", dealUUID)
+	case allocated:
+		return 0, 0, xerrors.Errorf("deal %s has a datacap allocation on chain", dealUUID)
+	}
+
+	msg := "cancelled by operator"
+	if reason != "" {
+		msg += ": " + reason
+	}
+
+	_, err = r.db.Exec(`update deals set failed = 1, sp_status = 'Cancelled', error_msg = ? where uuid = ? and failed = 0`, msg, dealUUID)
+	if err != nil {
+		return 0, 0, xerrors.Errorf("marking deal as cancelled: %w", err)
+	}
+
+	return group, provider, nil
+}
+
+// DealCancelled returns whether a deal was cancelled by the operator, as
+// marked on the deal row by CancelDeal
+func (r *ribsDB) DealCancelled(dealUUID string) (bool, error) {
+	var cancelled bool
+	err := r.db.QueryRow(`select exists (select 1 from deals where uuid = ? and failed = 1 and sp_status = 'Cancelled')`, dealUUID).Scan(&cancelled)
+	if err != nil {
+		return false, xerrors.Errorf("checking deal cancellation: %w", err)
+	}
+
+	return cancelled, nil
+}
+
+// QueueRepair queues a group for repair, moving it to the front of the queue
+// if it was already queued
+func (r *ribsDB) QueueRepair(group iface.GroupKey) error {
+	_, err := r.db.Exec(`insert into repairs (group_id, retrievable_deals) values (?, 0)
+		on conflict (group_id) do update set last_attempt = 0, retrievable_deals = 0`, group)
+	if err != nil {
+		return xerrors.Errorf("queueing group for repair: %w", err)
+	}
+
+	return nil
+}
+
+func (r *ribsDB) RecordAudit(e iface.AuditEntry) error {
+	var group, provider *int64
+	if e.Group != iface.UndefGroupKey {
+		group = &e.Group
+	}
+	if e.Provider != 0 {
+		provider = &e.Provider
+	}
+
+	var dealUUID, auditErr *string
+	if e.DealUUID != "" {
+		dealUUID = &e.DealUUID
+	}
+	if e.Error != "" {
+		auditErr = &e.Error
+	}
+
+	_, err := r.db.Exec(`insert into admin_audit (action, group_id, provider, deal_uuid, reason, error) values (?, ?, ?, ?, ?, ?)`,
+		e.Action, group, provider, dealUUID, e.Reason, auditErr)
+	if err != nil {
+		return xerrors.Errorf("inserting audit entry: %w", err)
+	}
+
+	return nil
+}
+
+func (r *ribsDB) AuditLog(before int64, limit int) ([]iface.AuditEntry, error) {
+	rows, err := r.db.Query(`select id, at, action, coalesce(group_id, ?), coalesce(provider, 0), coalesce(deal_uuid, ''), reason, coalesce(error, '')
+		from admin_audit where ? = 0 or id < ? order by id desc limit ?`, iface.UndefGroupKey, before, before, limit)
+	if err != nil {
+		return nil, xerrors.Errorf("querying audit log: %w", err)
+	}
+	defer rows.Close()
+
+	var out []iface.AuditEntry
+	for rows.Next() {
+		var e iface.AuditEntry
+		if err := rows.Scan(&e.ID, &e.Time, &e.Action, &e.Group, &e.Provider, &e.DealUUID, &e.Reason, &e.Error); err != nil {
+			return nil, xerrors.Errorf("scanning audit entry: %w", err)
+		}
+
+		out = append(out, e)
+	}
+
+	return out, rows.Err()
+}
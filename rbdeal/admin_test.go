@@ -0,0 +1,142 @@
+package rbdeal
+
+import (
+	"testing"
+
+	iface "github.com/lotus-web3/ribs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManualDealProvider(t *testing.T) {
+	db := openFixtureDB(t, []fixtureProvider{{id: 1000}, {id: 1001}})
+
+	p, err := db.ManualDealProvider(1, 1000, 32<<30, false, 1, 0)
+	require.NoError(t, err)
+	require.EqualValues(t, 1000, p.id)
+
+	// unknown provider
+	_, err = db.ManualDealProvider(1, 2000, 32<<30, false, 1, 0)
+	require.ErrorContains(t, err, "unknown provider")
+
+	// piece size and price
+	_, err = db.ManualDealProvider(1, 1000, 128<<30, false, 1, 0)
+	require.Error(t, err)
+
+	_, err = db.db.Exec(`update providers set ask_verif_price = 10 where id = 1000`)
+	require.NoError(t, err)
+	_, err = db.ManualDealProvider(1, 1000, 32<<30, true, 1, 0)
+	require.ErrorContains(t, err, "above max price")
+
+	// access lists
+	require.NoError(t, db.SetProviderAccess(1001, iface.ProviderAccessDeny))
+	_, err = db.ManualDealProvider(1, 1001, 32<<30, false, 1, 0)
+	require.ErrorContains(t, err, "access lists")
+
+	// replica cap
+	addFixtureDeal(t, db, "d1", 1, 1000)
+	_, err = db.ManualDealProvider(1, 1000, 32<<30, false, 1, 0)
+	require.ErrorContains(t, err, "live deals")
+
+	_, err = db.ManualDealProvider(2, 1000, 32<<30, false, 1, 0)
+	require.NoError(t, err)
+}
+
+func TestCancelDeal(t *testing.T) {
+	db := openFixtureDB(t, nil)
+
+	for _, uuid := range []string{"proposed", "published", "allocated"} {
+		addFixtureDeal(t, db, uuid, 1, 1000)
+	}
+	_, err := db.db.Exec(`update deals set published = 1, sp_pub_msg_cid = 'bafy' where uuid = 'published'`)
+	require.NoError(t, err)
+	require.NoError(t, db.SetDealAllocation("allocated", 7))
+
+	_, _, err = db.CancelDeal("unknown", "")
+	require.ErrorContains(t, err, "unknown deal")
+
+	_, _, err = db.CancelDeal("published", "")
+	require.ErrorContains(t, err, "published")
+
+	_, _, err = db.CancelDeal("allocated", "")
+	require.ErrorContains(t, err, "allocation")
+
+	group, prov, err := db.CancelDeal("proposed", "stuck")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, group)
+	require.EqualValues(t, 1000, prov)
+
+	var failed bool
+	var msg string
+	require.NoError(t, db.db.QueryRow(`select failed, error_msg from deals where uuid = 'proposed'`).Scan(&failed, &msg))
+	require.True(t, failed)
+	require.Equal(t, "cancelled by operator: stuck", msg)
+
+	_, _, err = db.CancelDeal("proposed", "")
+	require.ErrorContains(t, err, "already failed")
+
+	// transfers are refused once the deal is cancelled, whether or not the
+	// audit entry was recorded
+	cancelled, err := db.DealCancelled("proposed")
+	require.NoError(t, err)
+	require.True(t, cancelled)
+
+	cancelled, err = db.DealCancelled("published")
+	require.NoError(t, err)
+	require.False(t, cancelled)
+
+	// deals failed for other reasons weren't cancelled
+	require.NoError(t, db.StoreRejectedDeal("allocated", "rejected", 0))
+
+	cancelled, err = db.DealCancelled("allocated")
+	require.NoError(t, err)
+	require.False(t, cancelled)
+}
+
+func TestQueueRepair(t *testing.T) {
+	db := openFixtureDB(t, nil)
+
+	_, err := db.db.Exec(`insert into repairs (group_id, retrievable_deals, last_attempt) values (1, 2, 100)`)
+	require.NoError(t, err)
+
+	require.NoError(t, db.QueueRepair(1))
+	require.NoError(t, db.QueueRepair(2))
+
+	var lastAttempt int64
+	require.NoError(t, db.db.QueryRow(`select last_attempt from repairs where group_id = 1`).Scan(&lastAttempt))
+	require.Zero(t, lastAttempt)
+
+	stats, err := db.GetRepairStats()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, stats.Total)
+}
+
+func TestAuditLog(t *testing.T) {
+	db := openFixtureDB(t, nil)
+
+	require.NoError(t, db.RecordAudit(iface.AuditEntry{Action: auditMakeDeal, Group: 1, Provider: 1000}))
+	require.NoError(t, db.RecordAudit(iface.AuditEntry{Action: auditCheckRetrieval, Group: iface.UndefGroupKey, DealUUID: "d1", Error: "retrieval checker is not running"}))
+	require.NoError(t, db.RecordAudit(iface.AuditEntry{Action: auditQueueRepair, Group: 2}))
+
+	entries, err := db.AuditLog(0, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	require.Equal(t, auditQueueRepair, entries[0].Action)
+	require.EqualValues(t, 2, entries[0].Group)
+
+	require.Equal(t, auditCheckRetrieval, entries[1].Action)
+	require.Equal(t, iface.UndefGroupKey, entries[1].Group)
+	require.Equal(t, "d1", entries[1].DealUUID)
+	require.Equal(t, "retrieval checker is not running", entries[1].Error)
+
+	require.Equal(t, auditMakeDeal, entries[2].Action)
+	require.EqualValues(t, 1000, entries[2].Provider)
+	require.Empty(t, entries[2].Error)
+	require.NotZero(t, entries[2].Time)
+
+	// paging
+	entries, err = db.AuditLog(entries[1].ID, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, auditMakeDeal, entries[0].Action)
+}
@@ -0,0 +1,428 @@
+package rbdeal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"sort"
+	"time"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/storage/sealer/fr32"
+	"github.com/ipfs/go-cid"
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+/*
+Piece aggregation
+
+Groups with pieces smaller than MinPieceSize can be packed into a single deal
+piece following FRC-0058 (verifiable data aggregation). Each group CAR is placed
+at an offset aligned to its (padded) piece size, and a data segment index
+describing all sub-pieces is stored at the end of the deal:
+
+[group CAR | 0-pad][group CAR | 0-pad]...[0-pad][index entries | 0-pad]
+                                                ^ aggIndexStart(dealSize)
+
+Each index entry is two fr32 nodes: the sub-piece commP, followed by the padded
+offset and size (le64), and a truncated sha256 checksum of the above.
+
+Because sub-pieces are aligned, the aggregate commP can be computed from the
+group commPs and the index without reading any group data.
+
+Aggregate deals are made with data of all groups in the aggregate, so when any
+of them was offloaded, all offloaded groups are queued for reloading with
+repair workers, and deals are made once the last one is local again.
+*/
+
+const aggEntrySize = 64
+
+type aggPiece struct {
+	Group     iface.GroupKey
+	PieceCid  cid.Cid
+	PieceSize abi.PaddedPieceSize
+	CarSize   int64
+
+	// Offset of the sub-piece in the aggregate, set by planAggregate
+	Offset abi.PaddedPieceSize
+}
+
+type aggregate struct {
+	ID int64
+
+	PieceCid cid.Cid
+	DealSize abi.PaddedPieceSize
+
+	// Pieces ordered by offset
+	Pieces []aggPiece
+}
+
+// aggMaxIndexEntries returns the number of index entries reserved in a deal
+func aggMaxIndexEntries(dealSize abi.PaddedPieceSize) uint64 {
+	n := uint64(dealSize) / 2048 / aggEntrySize
+	if n <= 4 {
+		return 4
+	}
+	return 1 << bits.Len64(n-1)
+}
+
+// aggIndexStart returns the padded offset of the data segment index in a deal
+func aggIndexStart(dealSize abi.PaddedPieceSize) abi.PaddedPieceSize {
+	return dealSize - abi.PaddedPieceSize(aggMaxIndexEntries(dealSize)*aggEntrySize)
+}
+
+// planAggregate lays out pieces in an aggregate of at least minDealSize, and
+// computes the aggregate piece commitment
+func planAggregate(pieces []aggPiece, minDealSize abi.PaddedPieceSize) (*aggregate, error) {
+	if len(pieces) == 0 {
+		return nil, xerrors.Errorf("no pieces to aggregate")
+	}
+
+	out := &aggregate{
+		Pieces: append([]aggPiece{}, pieces...),
+	}
+
+	// place largest pieces first, which keeps alignment padding minimal
+	sort.SliceStable(out.Pieces, func(i, j int) bool {
+		return out.Pieces[i].PieceSize > out.Pieces[j].PieceSize
+	})
+
+	var dataEnd abi.PaddedPieceSize
+	for i, p := range out.Pieces {
+		if err := p.PieceSize.Validate(); err != nil {
+			return nil, xerrors.Errorf("group %d piece size: %w", p.Group, err)
+		}
+
+		// align to piece size
+		dataEnd = (dataEnd + p.PieceSize - 1) / p.PieceSize * p.PieceSize
+		out.Pieces[i].Offset = dataEnd
+		dataEnd += p.PieceSize
+	}
+
+	out.DealSize = abi.PaddedPieceSize(1) << bits.Len64(uint64(dataEnd-1))
+	if out.DealSize < minDealSize {
+		out.DealSize = minDealSize
+	}
+	for aggIndexStart(out.DealSize) < dataEnd || aggMaxIndexEntries(out.DealSize) < uint64(len(out.Pieces)) {
+		out.DealSize *= 2
+	}
+
+	root, err := out.commP()
+	if err != nil {
+		return nil, err
+	}
+
+	out.PieceCid, err = commcid.PieceCommitmentV1ToCID(root[:])
+	if err != nil {
+		return nil, xerrors.Errorf("aggregate piece cid: %w", err)
+	}
+
+	return out, nil
+}
+
+// Lead returns the group under which deals for the aggregate are tracked
+func (a *aggregate) Lead() iface.GroupKey {
+	return a.Pieces[0].Group
+}
+
+func (a *aggregate) Piece(group iface.GroupKey) (aggPiece, bool) {
+	for _, p := range a.Pieces {
+		if p.Group == group {
+			return p, true
+		}
+	}
+	return aggPiece{}, false
+}
+
+// indexEntries returns fr32 nodes of used data segment index entries
+func (a *aggregate) indexEntries() ([]byte, error) {
+	out := make([]byte, 0, len(a.Pieces)*aggEntrySize)
+
+	for _, p := range a.Pieces {
+		commP, err := commcid.CIDToPieceCommitmentV1(p.PieceCid)
+		if err != nil {
+			return nil, xerrors.Errorf("group %d piece commitment: %w", p.Group, err)
+		}
+
+		var e [aggEntrySize]byte
+		copy(e[:32], commP)
+		binary.LittleEndian.PutUint64(e[32:], uint64(p.Offset))
+		binary.LittleEndian.PutUint64(e[40:], uint64(p.PieceSize))
+
+		sum := sha256.Sum256(e[:48])
+		copy(e[48:], sum[:16])
+		e[63] &= 0x3f
+
+		out = append(out, e[:]...)
+	}
+
+	return out, nil
+}
+
+type aggNode struct {
+	off, size uint64
+	comm      [32]byte
+}
+
+func (a *aggregate) commP() ([32]byte, error) {
+	nodes := make([]aggNode, 0, len(a.Pieces)*2)
+
+	for _, p := range a.Pieces {
+		commP, err := commcid.CIDToPieceCommitmentV1(p.PieceCid)
+		if err != nil {
+			return [32]byte{}, xerrors.Errorf("group %d piece commitment: %w", p.Group, err)
+		}
+
+		n := aggNode{off: uint64(p.Offset), size: uint64(p.PieceSize)}
+		copy(n.comm[:], commP)
+		nodes = append(nodes, n)
+	}
+
+	entries, err := a.indexEntries()
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	idxStart := uint64(aggIndexStart(a.DealSize))
+	for i := 0; i < len(entries); i += aggEntrySize {
+		nodes = append(nodes, aggNode{
+			off:  idxStart + uint64(i),
+			size: aggEntrySize,
+			comm: aggHash(entries[i:i+32], entries[i+32:i+64]),
+		})
+	}
+
+	return aggTreeRoot(nodes, 0, uint64(a.DealSize)), nil
+}
+
+// aggTreeRoot computes the root of the piece tree over [off, off+size), given
+// aligned, non-overlapping, offset-ordered subtree commitments; everything
+// else is zero
+func aggTreeRoot(nodes []aggNode, off, size uint64) [32]byte {
+	if len(nodes) == 0 {
+		return aggZeroComms[bits.TrailingZeros64(size/32)]
+	}
+	if len(nodes) == 1 && nodes[0].off == off && nodes[0].size == size {
+		return nodes[0].comm
+	}
+
+	half := size / 2
+	split := sort.Search(len(nodes), func(i int) bool {
+		return nodes[i].off >= off+half
+	})
+
+	l := aggTreeRoot(nodes[:split], off, half)
+	r := aggTreeRoot(nodes[split:], off+half, half)
+	return aggHash(l[:], r[:])
+}
+
+func aggHash(l, r []byte) [32]byte {
+	h := sha256.New()
+	_, _ = h.Write(l)
+	_, _ = h.Write(r)
+
+	var out [32]byte
+	h.Sum(out[:0])
+	out[31] &= 0x3f
+	return out
+}
+
+// aggZeroComms[i] is the commitment of 32<<i zero bytes
+var aggZeroComms = func() (out [64][32]byte) {
+	for i := 1; i < len(out); i++ {
+		out[i] = aggHash(out[i-1][:], out[i-1][:])
+	}
+	return
+}()
+
+// DataSize returns the size of unpadded aggregate data, as transferred to providers
+func (a *aggregate) DataSize() int64 {
+	return int64(a.DealSize.Unpadded())
+}
+
+// WriteData writes unpadded aggregate data to w, with group CARs written by writeCar
+func (a *aggregate) WriteData(ctx context.Context, w io.Writer, writeCar func(ctx context.Context, group iface.GroupKey, w io.Writer) error) error {
+	var at int64
+
+	for _, p := range a.Pieces {
+		start := int64(p.Offset.Unpadded())
+		if err := writeZeros(w, start-at); err != nil {
+			return xerrors.Errorf("writing padding: %w", err)
+		}
+
+		cw := &aggCountWriter{w: w}
+		if err := writeCar(ctx, p.Group, cw); err != nil {
+			return xerrors.Errorf("writing group %d car: %w", p.Group, err)
+		}
+		if cw.n != p.CarSize {
+			return xerrors.Errorf("group %d car size %d doesn't match expected %d", p.Group, cw.n, p.CarSize)
+		}
+
+		at = start + cw.n
+	}
+
+	idxStart := aggIndexStart(a.DealSize)
+	if err := writeZeros(w, int64(idxStart.Unpadded())-at); err != nil {
+		return xerrors.Errorf("writing padding: %w", err)
+	}
+
+	// index entries are stored as fr32 nodes, unpad them into piece data
+	entries, err := a.indexEntries()
+	if err != nil {
+		return err
+	}
+	padded := make([]byte, (len(entries)+127)/128*128)
+	copy(padded, entries)
+	unpadded := make([]byte, abi.PaddedPieceSize(len(padded)).Unpadded())
+	fr32.Unpad(padded, unpadded)
+
+	if _, err := w.Write(unpadded); err != nil {
+		return xerrors.Errorf("writing index: %w", err)
+	}
+
+	return writeZeros(w, a.DataSize()-int64(idxStart.Unpadded())-int64(len(unpadded)))
+}
+
+type aggCountWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *aggCountWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+var zeroBuf = make([]byte, 1<<20)
+
+func writeZeros(w io.Writer, n int64) error {
+	if n < 0 {
+		return xerrors.Errorf("negative padding %d", n)
+	}
+
+	for n > 0 {
+		toWrite := int64(len(zeroBuf))
+		if toWrite > n {
+			toWrite = n
+		}
+		if _, err := w.Write(zeroBuf[:toWrite]); err != nil {
+			return err
+		}
+		n -= toWrite
+	}
+	return nil
+}
+
+// dealParams returns parameters of deals for the aggregate piece
+func (a *aggregate) dealParams() (dealParams, error) {
+	commP, err := commcid.CIDToPieceCommitmentV1(a.PieceCid)
+	if err != nil {
+		return dealParams{}, xerrors.Errorf("aggregate piece commitment: %w", err)
+	}
+
+	return dealParams{
+		CommP:     commP,
+		Root:      a.PieceCid,
+		PieceSize: int64(a.DealSize),
+		CarSize:   a.DataSize(),
+	}, nil
+}
+
+// maybeAggregate queues a group for aggregation if its piece is too small to be
+// dealt on its own, and creates an aggregate if enough data is waiting. Returns
+// true if the group is now waiting for aggregation
+func (r *ribs) maybeAggregate(ctx context.Context, group iface.GroupKey) (bool, error) {
+	dealInfo, err := r.db.GetDealParams(ctx, group)
+	if err != nil {
+		return false, xerrors.Errorf("get deal params: %w", err)
+	}
+
+	if dealInfo.PieceSize >= r.dealCfg.get().MinPieceSize {
+		return false, nil
+	}
+
+	deals, err := r.db.GetNonFailedDealCount(group)
+	if err != nil {
+		return false, xerrors.Errorf("getting non-failed deal count: %w", err)
+	}
+	if deals > 0 {
+		// already dealt on its own
+		return false, nil
+	}
+
+	if err := r.db.QueueForAggregation(group); err != nil {
+		return false, err
+	}
+
+	return true, r.tryAggregate(ctx)
+}
+
+// tryAggregate packs queued groups, oldest first, into an aggregate once they
+// fill a MinPieceSize deal, or once the oldest waited for AggregateMaxWait
+func (r *ribs) tryAggregate(ctx context.Context) error {
+	r.aggregateLk.Lock()
+	defer r.aggregateLk.Unlock()
+
+	cfg := r.dealCfg.get()
+
+	queue, err := r.db.AggregationQueue()
+	if err != nil {
+		return xerrors.Errorf("get aggregation queue: %w", err)
+	}
+
+	var pieces []aggPiece
+	var oldest time.Time
+	var full bool
+
+	for _, q := range queue {
+		plan, err := planAggregate(append(pieces, q.aggPiece), 0)
+		if err != nil {
+			return xerrors.Errorf("planning aggregate: %w", err)
+		}
+		if plan.DealSize > abi.PaddedPieceSize(cfg.MaxPieceSize) {
+			full = true
+			break
+		}
+
+		pieces = append(pieces, q.aggPiece)
+		if oldest.IsZero() || q.QueuedAt.Before(oldest) {
+			oldest = q.QueuedAt
+		}
+		full = plan.DealSize >= abi.PaddedPieceSize(cfg.MinPieceSize)
+	}
+
+	if len(pieces) == 0 || (!full && time.Since(oldest) < time.Duration(cfg.AggregateMaxWait)) {
+		return nil
+	}
+
+	agg, err := planAggregate(pieces, abi.PaddedPieceSize(cfg.MinPieceSize))
+	if err != nil {
+		return xerrors.Errorf("planning aggregate: %w", err)
+	}
+
+	if err := r.db.CreateAggregate(agg); err != nil {
+		return xerrors.Errorf("creating aggregate: %w", err)
+	}
+
+	log.Infow("created aggregate", "aggregate", agg.ID, "piece", agg.PieceCid, "size", agg.DealSize, "groups", len(agg.Pieces))
+
+	// deals are made in the background, and must not be cancelled together
+	// with the request which happened to fill the aggregate
+	dealCtx := context.WithoutCancel(ctx)
+	go func() {
+		if err := r.makeMoreDeals(dealCtx, agg.Lead(), r.host, r.wallet); err != nil {
+			log.Errorf("starting new aggregate deals: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+func (r *ribs) writeGroupCar(ctx context.Context, group iface.GroupKey, w io.Writer) error {
+	return r.RBS.Storage().ReadCar(ctx, group, func(int64) {}, w)
+}
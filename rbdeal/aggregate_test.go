@@ -0,0 +1,325 @@
+package rbdeal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/bits"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-commp-utils/zerocomm"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/storage/sealer/fr32"
+	"github.com/ipfs/go-cid"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregateIndexSize(t *testing.T) {
+	for dealSize, entries := range map[abi.PaddedPieceSize]uint64{
+		2 << 10:   4,
+		512 << 10: 4,
+		1 << 20:   8,
+		32 << 30:  1 << 18,
+		64 << 30:  1 << 19,
+	} {
+		require.Equal(t, entries, aggMaxIndexEntries(dealSize), "deal size %d", dealSize)
+		require.Equal(t, dealSize-abi.PaddedPieceSize(entries*aggEntrySize), aggIndexStart(dealSize))
+	}
+}
+
+func TestPlanAggregate(t *testing.T) {
+	_, err := planAggregate(nil, 0)
+	require.Error(t, err)
+
+	_, err = planAggregate([]aggPiece{{Group: 1, PieceCid: testPieceCid(t, 1), PieceSize: 3 << 10}}, 0)
+	require.ErrorContains(t, err, "group 1 piece size")
+
+	var pieces []aggPiece
+	for i, size := range []abi.PaddedPieceSize{2 << 10, 128 << 10, 8 << 10, 2 << 10, 32 << 10} {
+		pieces = append(pieces, aggPiece{Group: iface.GroupKey(i + 1), PieceCid: testPieceCid(t, byte(i)), PieceSize: size})
+	}
+
+	for _, minSize := range []abi.PaddedPieceSize{0, 1 << 20} {
+		agg, err := planAggregate(pieces, minSize)
+		require.NoError(t, err)
+
+		require.Equal(t, 1, bits.OnesCount64(uint64(agg.DealSize)), "deal size must be a power of two")
+		require.GreaterOrEqual(t, agg.DealSize, minSize)
+		require.LessOrEqual(t, uint64(len(agg.Pieces)), aggMaxIndexEntries(agg.DealSize))
+		require.Len(t, agg.Pieces, len(pieces))
+
+		// largest first, aligned, not overlapping each other or the index
+		var end abi.PaddedPieceSize
+		for i, p := range agg.Pieces {
+			if i > 0 {
+				require.LessOrEqual(t, p.PieceSize, agg.Pieces[i-1].PieceSize)
+			}
+			require.Zero(t, p.Offset%p.PieceSize, "group %d", p.Group)
+			require.GreaterOrEqual(t, p.Offset, end)
+			end = p.Offset + p.PieceSize
+		}
+		require.LessOrEqual(t, end, aggIndexStart(agg.DealSize))
+
+		require.Equal(t, agg.Pieces[0].Group, agg.Lead())
+		p, ok := agg.Piece(3)
+		require.True(t, ok)
+		require.Equal(t, abi.PaddedPieceSize(8<<10), p.PieceSize)
+		_, ok = agg.Piece(6)
+		require.False(t, ok)
+	}
+
+	// the index doesn't fit after pieces filling a power of two
+	agg, err := planAggregate(pieces[:1], 0)
+	require.NoError(t, err)
+	require.Equal(t, abi.PaddedPieceSize(4<<10), agg.DealSize)
+}
+
+func TestAggregateZeroComms(t *testing.T) {
+	for i := 2; i < 36; i++ {
+		c, err := commcid.CIDToPieceCommitmentV1(zerocomm.ZeroPieceCommitment(abi.PaddedPieceSize(32 << i).Unpadded()))
+		require.NoError(t, err)
+		require.Equal(t, c, aggZeroComms[i][:], "size %d", 32<<i)
+	}
+}
+
+func TestAggregateData(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	cars := map[iface.GroupKey][]byte{}
+	var pieces []aggPiece
+	for i, size := range []int{5_000, 300_000, 1_000, 100_000, 5_000} {
+		group := iface.GroupKey(i + 1)
+		cars[group] = make([]byte, size)
+		rng.Read(cars[group])
+
+		dc := commPOf(t, cars[group])
+		pieces = append(pieces, aggPiece{Group: group, PieceCid: dc.PieceCID, PieceSize: dc.PieceSize, CarSize: int64(size)})
+	}
+
+	writeCar := func(ctx context.Context, group iface.GroupKey, w io.Writer) error {
+		_, err := w.Write(cars[group])
+		return err
+	}
+
+	// commP of aggregates below 16MiB is a single leaf, 32MiB ones take
+	// several
+	for _, minSize := range []abi.PaddedPieceSize{0, 32 << 20} {
+		agg, err := planAggregate(pieces, minSize)
+		require.NoError(t, err)
+
+		var out bytes.Buffer
+		require.NoError(t, agg.WriteData(context.Background(), &out, writeCar))
+		require.EqualValues(t, agg.DataSize(), out.Len())
+
+		dc := commPOf(t, out.Bytes())
+		require.Equal(t, agg.DealSize, dc.PieceSize)
+		require.Equal(t, agg.PieceCid, dc.PieceCID)
+
+		// group CARs at their piece offsets, the index at aggIndexStart, zeros
+		// everywhere else
+		expect := make([]byte, agg.DataSize())
+		for _, p := range agg.Pieces {
+			copy(expect[p.Offset.Unpadded():], cars[p.Group])
+		}
+
+		entries, err := agg.indexEntries()
+		require.NoError(t, err)
+		require.Len(t, entries, len(pieces)*aggEntrySize)
+
+		padded := make([]byte, (len(entries)+127)/128*128)
+		copy(padded, entries)
+		unpadded := make([]byte, abi.PaddedPieceSize(len(padded)).Unpadded())
+		fr32.Unpad(padded, unpadded)
+		copy(expect[aggIndexStart(agg.DealSize).Unpadded():], unpadded)
+
+		require.True(t, bytes.Equal(expect, out.Bytes()))
+
+		// index entries survive fr32 padding in the sealed piece
+		repadded := make([]byte, len(padded))
+		fr32.Pad(unpadded, repadded)
+		require.Equal(t, entries, repadded[:len(entries)])
+
+		dp, err := agg.dealParams()
+		require.NoError(t, err)
+		require.EqualValues(t, agg.DealSize, dp.PieceSize)
+		require.Equal(t, agg.DataSize(), dp.CarSize)
+	}
+
+	agg, err := planAggregate(pieces, 0)
+	require.NoError(t, err)
+
+	cars[2] = cars[2][:1000]
+	err = agg.WriteData(context.Background(), io.Discard, writeCar)
+	require.ErrorContains(t, err, "group 2 car size 1000 doesn't match expected 300000")
+}
+
+func TestAggregateDB(t *testing.T) {
+	const minPiece = 1 << 20
+
+	db := openFixtureDB(t, nil, func(cfg *iface.DealConfig) {
+		cfg.MinPieceSize = minPiece
+		cfg.AggregateMaxWait = iface.Duration(time.Hour)
+	})
+	r := &ribs{db: db, dealCfg: db.dealCfg, moreDealsLocks: map[iface.GroupKey]struct{}{}}
+	ctx := context.Background()
+
+	// groups 1-4 need aggregation, 4 128KiB pieces fill a 1MiB aggregate with
+	// its index; group 5 is dealt on its own
+	var pieces []aggPiece
+	for group := iface.GroupKey(1); group <= 5; group++ {
+		p := aggPiece{Group: group, PieceCid: testPieceCid(t, byte(group)), PieceSize: 128 << 10, CarSize: 120 << 10}
+		if group == 5 {
+			p.PieceSize = minPiece
+		}
+
+		commP, err := commcid.CIDToPieceCommitmentV1(p.PieceCid)
+		require.NoError(t, err)
+
+		_, err = db.db.Exec(`insert into groups (id, blocks, bytes, g_state, jb_recorded_head, commp, piece_size, car_size, root) values (?, 0, 0, ?, 0, ?, ?, ?, ?)`,
+			group, iface.GroupStateLocalReadyForDeals, commP, p.PieceSize, p.CarSize, p.PieceCid.Bytes())
+		require.NoError(t, err)
+
+		if group < 5 {
+			pieces = append(pieces, p)
+		}
+	}
+
+	waiting, err := r.maybeAggregate(ctx, 5)
+	require.NoError(t, err)
+	require.False(t, waiting)
+
+	for group := iface.GroupKey(1); group <= 3; group++ {
+		waiting, err := r.maybeAggregate(ctx, group)
+		require.NoError(t, err)
+		require.True(t, waiting)
+	}
+
+	queue, err := db.AggregationQueue()
+	require.NoError(t, err)
+	require.Len(t, queue, 3)
+
+	agg, err := db.GroupAggregate(1)
+	require.NoError(t, err)
+	require.Nil(t, agg)
+
+	// group 3 got offloaded while waiting, deals for the aggregate need it
+	// reloaded first
+	_, err = db.db.Exec(`update groups set g_state = ? where id = 3`, iface.GroupStateOffloaded)
+	require.NoError(t, err)
+
+	// the last group fills the aggregate
+	waiting, err = r.maybeAggregate(ctx, 4)
+	require.NoError(t, err)
+	require.True(t, waiting)
+
+	queue, err = db.AggregationQueue()
+	require.NoError(t, err)
+	require.Empty(t, queue)
+
+	expect, err := planAggregate(pieces, minPiece)
+	require.NoError(t, err)
+
+	for group := iface.GroupKey(1); group <= 4; group++ {
+		agg, err := db.GroupAggregate(group)
+		require.NoError(t, err)
+		require.NotNil(t, agg)
+
+		expect.ID = agg.ID
+		require.Equal(t, expect, agg)
+	}
+
+	agg, err = db.GroupAggregate(5)
+	require.NoError(t, err)
+	require.Nil(t, agg)
+
+	agg, err = db.GroupAggregate(1)
+	require.NoError(t, err)
+
+	// the aggregate deal goroutine queues the offloaded group for reloading
+	require.Eventually(t, func() bool {
+		r.dealsLk.Lock()
+		defer r.dealsLk.Unlock()
+
+		var queued []iface.GroupKey
+		rows, err := db.db.Query(`select group_id from repairs`)
+		if err != nil {
+			return false
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var g iface.GroupKey
+			if err := rows.Scan(&g); err != nil {
+				return false
+			}
+			queued = append(queued, g)
+		}
+
+		return rows.Err() == nil && len(r.moreDealsLocks) == 0 && len(queued) == 1 && queued[0] == 3
+	}, 10*time.Second, 10*time.Millisecond)
+
+	local, err := db.AggregateLocal(agg.ID)
+	require.NoError(t, err)
+	require.False(t, local)
+
+	// queued already, and the remaining groups are local
+	n, err := db.QueueAggregateReload(agg.ID)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	_, err = db.db.Exec(`update groups set g_state = ? where id = 3`, iface.GroupStateLocalReadyForDeals)
+	require.NoError(t, err)
+
+	local, err = db.AggregateLocal(agg.ID)
+	require.NoError(t, err)
+	require.True(t, local)
+
+	// aggregate deals are tracked under the lead group, and count for all
+	// aggregated groups
+	addFixtureDeal(t, db, "agg", agg.Lead(), 1000)
+	_, err = db.db.Exec(`update deals set aggregate_id = ? where uuid = 'agg'`, agg.ID)
+	require.NoError(t, err)
+	addFixtureDeal(t, db, "own", 5, 1001)
+
+	for group, expect := range map[iface.GroupKey][]string{1: {"agg"}, 2: {"agg"}, 3: {"agg"}, 4: {"agg"}, 5: {"own"}, 6: nil} {
+		var uuids []string
+		rows, err := db.db.Query(`select uuid from deals where `+dealsOfGroup, group, group)
+		require.NoError(t, err)
+		for rows.Next() {
+			var u string
+			require.NoError(t, rows.Scan(&u))
+			uuids = append(uuids, u)
+		}
+		require.NoError(t, rows.Err())
+		require.NoError(t, rows.Close())
+
+		require.Equal(t, expect, uuids, "group %d", group)
+
+		deals, err := db.GroupDeals(group)
+		require.NoError(t, err)
+		require.Len(t, deals, len(expect), "group %d", group)
+	}
+}
+
+func testPieceCid(t *testing.T, seed byte) cid.Cid {
+	commP := bytes.Repeat([]byte{seed}, 32)
+	commP[31] &= 0x3f
+
+	c, err := commcid.PieceCommitmentV1ToCID(commP)
+	require.NoError(t, err)
+	return c
+}
+
+func commPOf(t *testing.T, data []byte) ributil.DataCIDSize {
+	cc := new(ributil.DataCidWriter)
+	_, err := cc.Write(data)
+	require.NoError(t, err)
+
+	dc, err := cc.Sum()
+	require.NoError(t, err)
+	return dc
+}
@@ -0,0 +1,160 @@
+package rbdeal
+
+import (
+	"context"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/lotus/api/client"
+	"github.com/filecoin-project/lotus/chain/types"
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+// epochs of projected monthly spend
+const budgetMonthEpochs = 30 * builtin.EpochsInDay
+
+var errOverBudget = xerrors.New("over spend budget")
+
+// liveDeal is the payment schedule of a deal
+type liveDeal struct {
+	// price of the deal per epoch, for the whole piece
+	epochPrice abi.TokenAmount
+
+	start, end abi.ChainEpoch
+}
+
+// dealEpochPrice returns the per-epoch price of a deal of pieceSize priced
+// per GiB, as set in the deal proposal
+func dealEpochPrice(pricePerGiB abi.TokenAmount, pieceSize int64) abi.TokenAmount {
+	return big.Div(big.Mul(big.NewInt(pieceSize), pricePerGiB), big.NewInt(1<<30))
+}
+
+type spendCommitments struct {
+	deals int64
+
+	committed, remaining, monthly abi.TokenAmount
+}
+
+func newSpendCommitments() spendCommitments {
+	return spendCommitments{
+		committed: big.Zero(),
+		remaining: big.Zero(),
+		monthly:   big.Zero(),
+	}
+}
+
+// add returns commitments with deal d added, at chain head
+func (c spendCommitments) add(head abi.ChainEpoch, d liveDeal) spendCommitments {
+	epochs := func(from, to abi.ChainEpoch) big.Int {
+		if from < d.start {
+			from = d.start
+		}
+		if to > d.end {
+			to = d.end
+		}
+		if to <= from {
+			return big.Zero()
+		}
+		return big.NewInt(int64(to - from))
+	}
+
+	return spendCommitments{
+		deals:     c.deals + 1,
+		committed: big.Add(c.committed, big.Mul(d.epochPrice, epochs(d.start, d.end))),
+		remaining: big.Add(c.remaining, big.Mul(d.epochPrice, epochs(head, d.end))),
+		monthly:   big.Add(c.monthly, big.Mul(d.epochPrice, epochs(head, head+budgetMonthEpochs))),
+	}
+}
+
+// checkBudget returns errOverBudget if commitments exceed caps in cfg
+func checkBudget(cfg iface.DealConfig, c spendCommitments) error {
+	if !cfg.TotalBudget.IsZero() && c.committed.GreaterThan(cfg.TotalBudget) {
+		return xerrors.Errorf("committed spend %s over total budget %s: %w", types.FIL(c.committed), types.FIL(cfg.TotalBudget), errOverBudget)
+	}
+	if !cfg.MonthlyBudget.IsZero() && c.monthly.GreaterThan(cfg.MonthlyBudget) {
+		return xerrors.Errorf("projected monthly spend %s over monthly budget %s: %w", types.FIL(c.monthly), types.FIL(cfg.MonthlyBudget), errOverBudget)
+	}
+	return nil
+}
+
+// budgetTopUp limits a market top-up so that escrow doesn't hold more than
+// what remaining payments of live deals and the unused total budget need
+func budgetTopUp(cfg iface.DealConfig, c spendCommitments, escrow, toAdd abi.TokenAmount) abi.TokenAmount {
+	if cfg.TotalBudget.IsZero() {
+		return toAdd
+	}
+
+	unused := big.Sub(cfg.TotalBudget, c.committed)
+	if unused.LessThan(big.Zero()) {
+		unused = big.Zero()
+	}
+
+	maxAdd := big.Sub(big.Add(c.remaining, unused), escrow)
+	if maxAdd.LessThan(big.Zero()) {
+		return big.Zero()
+	}
+
+	return big.Min(toAdd, maxAdd)
+}
+
+func (r *ribs) spendCommitments(ctx context.Context) (spendCommitments, abi.ChainEpoch, error) {
+	gw, closer, err := client.NewGatewayRPCV1(ctx, r.lotusRPCAddr, nil)
+	if err != nil {
+		return spendCommitments{}, 0, xerrors.Errorf("creating gateway rpc client: %w", err)
+	}
+	defer closer()
+
+	head, err := gw.ChainHead(ctx)
+	if err != nil {
+		return spendCommitments{}, 0, xerrors.Errorf("getting chain head: %w", err)
+	}
+
+	c, err := r.db.SpendCommitments(head.Height())
+	if err != nil {
+		return spendCommitments{}, 0, err
+	}
+
+	return c, head.Height(), nil
+}
+
+func (r *ribs) Budget(ctx context.Context) (iface.BudgetStatus, error) {
+	c, head, err := r.spendCommitments(ctx)
+	if err != nil {
+		return iface.BudgetStatus{}, err
+	}
+
+	cfg := r.dealCfg.get()
+
+	return iface.BudgetStatus{
+		Head:             head,
+		MonthlyBudget:    cfg.MonthlyBudget,
+		TotalBudget:      cfg.TotalBudget,
+		LiveDeals:        c.deals,
+		Committed:        c.committed,
+		Remaining:        c.remaining,
+		ProjectedMonthly: c.monthly,
+	}, nil
+}
+
+// withinBudget calls store if a new deal d fits in the budget. Live deals
+// include stored proposals, so checking and storing is serialized.
+func (r *ribs) withinBudget(head abi.ChainEpoch, d liveDeal, store func() error) error {
+	r.budgetLk.Lock()
+	defer r.budgetLk.Unlock()
+
+	c, err := r.db.SpendCommitments(head)
+	if err != nil {
+		return xerrors.Errorf("getting spend commitments: %w", err)
+	}
+
+	// free deals always fit
+	if !d.epochPrice.IsZero() {
+		if err := checkBudget(r.dealCfg.get(), c.add(head, d)); err != nil {
+			return err
+		}
+	}
+
+	return store()
+}
@@ -0,0 +1,70 @@
+package rbdeal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpendCommitments(t *testing.T) {
+	db := openFixtureDB(t, nil)
+
+	// 2GiB aggregate piece at 10 attoFIL/GiB/epoch -> 20 attoFIL/epoch
+	_, err := db.db.Exec(`insert into aggregates (id, piece_cid, piece_size) values (1, x'00', ?)`, int64(2<<30))
+	require.NoError(t, err)
+
+	addDeal := func(uuid string, start, end int64, failed bool) {
+		_, err := db.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, price_afil_gib_epoch, verified, keep_unsealed,
+			start_epoch, end_epoch, signed_proposal_bytes, aggregate_id, failed) values (?, 'f01', 1000, 1, 10, 0, 1, ?, ?, x'', 1, ?)`,
+			uuid, start, end, failed)
+		require.NoError(t, err)
+	}
+
+	head := abi.ChainEpoch(1000)
+	addDeal("live", 500, 1000+budgetMonthEpochs*2, false)
+	addDeal("pending", 2000, 2000+budgetMonthEpochs, false)
+	addDeal("failed", 500, 1000+budgetMonthEpochs, true)
+	addDeal("expired", 0, 1000, false)
+
+	c, err := db.SpendCommitments(head)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, c.deals)
+
+	rate := big.NewInt(20)
+	mul := func(epochs int64) abi.TokenAmount { return big.Mul(rate, big.NewInt(epochs)) }
+
+	require.Equal(t, mul(500+budgetMonthEpochs*2+budgetMonthEpochs), c.committed)
+	require.Equal(t, mul(budgetMonthEpochs*2+budgetMonthEpochs), c.remaining)
+	require.Equal(t, mul(budgetMonthEpochs+(budgetMonthEpochs-1000)), c.monthly)
+
+	cfg := defaultDealConfig()
+	require.NoError(t, checkBudget(cfg, c))
+
+	cfg.MonthlyBudget = big.Sub(c.monthly, big.NewInt(1))
+	require.True(t, errors.Is(checkBudget(cfg, c), errOverBudget))
+
+	cfg.MonthlyBudget = big.Zero()
+	cfg.TotalBudget = c.committed
+	require.NoError(t, checkBudget(cfg, c))
+	require.True(t, errors.Is(checkBudget(cfg, c.add(head, liveDeal{epochPrice: rate, start: 3000, end: 4000})), errOverBudget))
+}
+
+func TestBudgetTopUp(t *testing.T) {
+	c := spendCommitments{
+		committed: big.NewInt(800),
+		remaining: big.NewInt(300),
+		monthly:   big.NewInt(100),
+	}
+
+	cfg := defaultDealConfig()
+	require.Equal(t, big.NewInt(1000), budgetTopUp(cfg, c, big.NewInt(100), big.NewInt(1000)))
+
+	// escrow can hold remaining payments and the unused 200
+	cfg.TotalBudget = big.NewInt(1000)
+	require.Equal(t, big.NewInt(400), budgetTopUp(cfg, c, big.NewInt(100), big.NewInt(1000)))
+	require.Equal(t, big.NewInt(50), budgetTopUp(cfg, c, big.NewInt(100), big.NewInt(50)))
+	require.Equal(t, big.Zero(), budgetTopUp(cfg, c, big.NewInt(600), big.NewInt(50)))
+}
@@ -140,6 +140,10 @@ type carRequestToken struct {
 	Timeout int64
 	CarSize int64
 
+	// Aggregate is set for transfers of aggregate pieces, Group is then the
+	// aggregate lead group
+	Aggregate int64 `json:",omitempty"`
+
 	DealUUID uuid.UUID
 }
 
@@ -156,12 +160,13 @@ func (r *ribs) verify(ctx context.Context, token string) (carRequestToken, error
 	return payload, nil
 }
 
-func (r *ribs) makeCarRequestToken(ctx context.Context, group int64, timeout time.Duration, carSize int64, deal uuid.UUID) ([]byte, error) {
+func (r *ribs) makeCarRequestToken(ctx context.Context, group int64, aggregate int64, timeout time.Duration, carSize int64, deal uuid.UUID) ([]byte, error) {
 	p := carRequestToken{
-		Group:    group,
-		Timeout:  time.Now().Add(timeout).Unix(),
-		CarSize:  carSize,
-		DealUUID: deal,
+		Group:     group,
+		Timeout:   time.Now().Add(timeout).Unix(),
+		CarSize:   carSize,
+		Aggregate: aggregate,
+		DealUUID:  deal,
 	}
 
 	return jwt.Sign(&p, jwtKey)
@@ -181,6 +186,18 @@ func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	cancelled, err := r.db.DealCancelled(reqToken.DealUUID.String())
+	if err != nil {
+		log.Errorw("car request: checking deal cancellation", "error", err, "url", req.URL)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if cancelled {
+		log.Warnw("car request for cancelled deal", "deal", reqToken.DealUUID, "url", req.URL)
+		http.Error(w, "deal cancelled", http.StatusForbidden)
+		return
+	}
+
 	pid, err := peer.Decode(req.RemoteAddr)
 	if err != nil {
 		log.Infow("data transfer request failed: parsing remote address as peer ID",
@@ -236,35 +253,58 @@ func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	gm, err := r.RBS.StorageDiag().GroupMeta(reqToken.Group)
-	if err != nil {
-		log.Errorw("car request: group meta", "error", err, "url", req.URL)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if gm.DealCarSize == nil {
-		log.Errorw("car request: no deal car size", "url", req.URL)
-		http.Error(w, "no deal car size", http.StatusInternalServerError)
-		return
-	}
+	var carSize int64
+	var writeCar func(w io.Writer) error
 
-	// todo run more checks here?
+	if reqToken.Aggregate != 0 {
+		// aggregate pieces are assembled from local group data
+		agg, err := r.db.GetAggregate(reqToken.Aggregate)
+		if err != nil {
+			log.Errorw("car request: get aggregate", "error", err, "url", req.URL)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-	s3u, err := r.maybeGetS3URL(reqToken.Group)
-	if err != nil {
-		log.Errorw("car request: s3 url", "error", err, "url", req.URL)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+		carSize = agg.DataSize()
+		writeCar = func(w io.Writer) error {
+			return agg.WriteData(req.Context(), w, r.writeGroupCar)
+		}
+	} else {
+		gm, err := r.RBS.StorageDiag().GroupMeta(reqToken.Group)
+		if err != nil {
+			log.Errorw("car request: group meta", "error", err, "url", req.URL)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if gm.DealCarSize == nil {
+			log.Errorw("car request: no deal car size", "url", req.URL)
+			http.Error(w, "no deal car size", http.StatusInternalServerError)
+			return
+		}
 
-	if s3u != "" {
-		// in s3, redirect
-		log.Errorw("car request: redir to s3 url", "error", err, "url", s3u)
+		// todo run more checks here?
 
-		r.s3Redirects.Add(1)
+		s3u, err := r.maybeGetS3URL(reqToken.Group)
+		if err != nil {
+			log.Errorw("car request: s3 url", "error", err, "url", req.URL)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-		http.Redirect(w, req, s3u, http.StatusFound)
-		return
+		if s3u != "" {
+			// in s3, redirect
+			log.Errorw("car request: redir to s3 url", "error", err, "url", s3u)
+
+			r.s3Redirects.Add(1)
+
+			http.Redirect(w, req, s3u, http.StatusFound)
+			return
+		}
+
+		carSize = *gm.DealCarSize
+		writeCar = func(w io.Writer) error {
+			return r.writeGroupCar(req.Context(), reqToken.Group, w)
+		}
 	}
 
 	// this is a local transfer, track stats
@@ -311,7 +351,10 @@ func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if transferInfo.CarTransferAttempts >= maxTransferRetries {
+	dealCfg := r.dealCfg.get()
+	transferIdleTimeout := time.Duration(dealCfg.TransferIdleTimeout)
+
+	if transferInfo.CarTransferAttempts >= dealCfg.MaxTransferRetries {
 		if err := r.db.UpdateTransferStats(reqToken.DealUUID, sw.wrote, xerrors.Errorf("transfer has been retried too much")); err != nil {
 			log.Errorw("car request: update transfer stats", "error", err, "url", req.URL)
 			return
@@ -339,7 +382,7 @@ func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
 		transferredBytes := DerefOr(transferInfo.CarTransferLastBytes, 0)
 		transferSpeedMbps := float64(transferredBytes*8) / 1e6 / elapsedTime.Seconds()
 
-		if transferSpeedMbps < float64(minTransferMbps) {
+		if transferSpeedMbps < float64(dealCfg.MinTransferMbps) {
 			log.Errorw("car request: transfer speed too slow", "url", req.URL, "speed", transferSpeedMbps, "deal", reqToken.DealUUID, "group", reqToken.Group)
 			http.Error(w, "transfer speed too slow", http.StatusGone)
 			return
@@ -350,7 +393,7 @@ func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
 	rateWriter := ributil.NewRateEnforcingWriter(sw, rc, transferIdleTimeout)
 	defer rateWriter.Done()
 
-	respLen := *gm.DealCarSize - toDiscard
+	respLen := carSize - toDiscard
 	if toLimit != -1 {
 		respLen = toLimit - toDiscard + 1
 	}
@@ -370,7 +413,7 @@ func (r *ribs) handleCarRequest(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	err = r.RBS.Storage().ReadCar(req.Context(), reqToken.Group, func(int64) {}, writerToUse)
+	err = writeCar(writerToUse)
 
 	defer func() {
 		if err := r.db.UpdateTransferStats(reqToken.DealUUID, sw.wrote, rateWriter.WriteError()); err != nil {
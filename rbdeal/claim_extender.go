@@ -2,270 +2,246 @@ package rbdeal
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
+	"time"
+
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
-	verifregtypes13 "github.com/filecoin-project/go-state-types/builtin/v13/verifreg"
-	"github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
 	"github.com/filecoin-project/lotus/api"
 	aclient "github.com/filecoin-project/lotus/api/client"
-	"github.com/filecoin-project/lotus/build"
-	"github.com/filecoin-project/lotus/chain/actors"
-	verifreg2 "github.com/filecoin-project/lotus/chain/actors/builtin/verifreg"
 	"github.com/filecoin-project/lotus/chain/types"
-	"github.com/filecoin-project/lotus/lib/must"
+	iface "github.com/lotus-web3/ribs"
 	"golang.org/x/xerrors"
-	"os"
-	"strings"
-	"time"
 )
 
+type claimExtender struct {
+	r *ribs
+}
+
+func (r *ribs) Claims() iface.ClaimExtender {
+	return &claimExtender{r: r}
+}
+
+func (ce *claimExtender) Plan(ctx context.Context) (iface.ClaimExtendPlan, error) {
+	gw, closer, err := aclient.NewGatewayRPCV1(ctx, ce.r.lotusRPCAddr, nil)
+	if err != nil {
+		return iface.ClaimExtendPlan{}, xerrors.Errorf("creating gateway rpc client: %w", err)
+	}
+	defer closer()
+
+	p, err := ce.r.claimPlanner(ctx, gw)
+	if err != nil {
+		return iface.ClaimExtendPlan{}, err
+	}
+
+	plan, err := p.Plan(ctx)
+	if err != nil {
+		return iface.ClaimExtendPlan{}, err
+	}
+
+	return plan.ClaimExtendPlan, nil
+}
+
+func (ce *claimExtender) Run(ctx context.Context) (iface.ClaimExtendRun, error) {
+	return ce.r.claimExtendCycle(ctx)
+}
+
+func (ce *claimExtender) Runs(limit int) ([]iface.ClaimExtendRun, error) {
+	return ce.r.db.ClaimExtendRuns(limit)
+}
+
 func (r *ribs) claimChecker() {
+	select {
+	case <-r.close:
+		return
+	case <-time.After(3 * time.Minute): // don't start immediately
+	}
+
 	for {
-		select {
-		case <-r.close:
-			return
-		case <-time.After(3 * time.Minute): // don't start immediately
-			if err := r.claimExtendCycle(context.Background()); err != nil {
-				log.Errorw("claim extend cycle failed", "error", err)
-				return
-			}
+		if _, err := r.claimExtendCycle(context.Background()); err != nil {
+			log.Errorw("claim extend cycle failed", "error", err)
 		}
 
 		select {
 		case <-r.close:
 			return
-		case <-time.After(24 * time.Hour):
-			// daily
+		case <-time.After(time.Duration(r.dealCfg.get().ClaimExtendInterval)):
 		}
 	}
 }
 
-func (r *ribs) claimExtendCycle(ctx context.Context) error {
-	var provs []address.Address
+// claimPlanner returns a planner extending claims of all client wallets
+func (r *ribs) claimPlanner(ctx context.Context, gw api.Gateway) (*ClaimPlanner, error) {
+	wallets, err := r.wallet.WalletList(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("listing wallets: %w", err)
+	}
 
-	{
-		// SELECT DISTINCT provider_addr FROM deals WHERE sealed=1
-		rows, err := r.db.db.Query("SELECT DISTINCT provider_addr FROM deals WHERE sealed=1")
+	// claims can only be extended by their client
+	clients := map[abi.ActorID]address.Address{}
+	for _, w := range wallets {
+		idAddr, err := gw.StateLookupID(ctx, w, types.EmptyTSK)
 		if err != nil {
-			return xerrors.Errorf("query: %w", err)
-		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var prov uint64
-			if err := rows.Scan(&prov); err != nil {
-				return xerrors.Errorf("scan: %w", err)
-			}
-			provs = append(provs, must.One(address.NewIDAddress(prov)))
+			log.Debugw("claim ext: wallet not on chain", "wallet", w, "error", err)
+			continue
 		}
-		if err := rows.Err(); err != nil {
-			return xerrors.Errorf("rows: %w", err)
-		}
-		if err := rows.Close(); err != nil {
-			return xerrors.Errorf("close: %w", err)
+
+		id, err := address.IDFromAddress(idAddr)
+		if err != nil {
+			return nil, xerrors.Errorf("getting client id: %w", err)
 		}
+
+		clients[abi.ActorID(id)] = w
 	}
 
-	fmt.Printf("(claim ext) Getting claims for %d providers\n", len(provs))
+	cfg := r.dealCfg.get()
 
-	chain, closer, err := aclient.NewGatewayRPCV1(ctx, r.lotusRPCAddr, nil)
-	if err != nil {
-		panic(err)
-	}
-	defer closer()
+	return &ClaimPlanner{
+		DB:          r.db.db,
+		Chain:       gw,
+		Clients:     clients,
+		BatchSize:   cfg.ClaimExtendBatchSize,
+		MaxMessages: cfg.ClaimExtendMaxMessages,
+	}, nil
+}
 
-	clkey, err := r.wallet.GetDefault()
-	if err != nil {
-		return xerrors.Errorf("getting default wallet: %w", err)
+// claimExtendCycle plans claim extensions, sends them if SendClaimExtensions
+// is set, and records the run
+func (r *ribs) claimExtendCycle(ctx context.Context) (iface.ClaimExtendRun, error) {
+	r.claimExtendLk.Lock()
+	defer r.claimExtendLk.Unlock()
+
+	run := iface.ClaimExtendRun{
+		Started: time.Now().Unix(),
+		Sent:    r.dealCfg.get().SendClaimExtensions,
+		Fee:     big.Zero(),
 	}
 
-	clientAddr, err := chain.StateLookupID(ctx, clkey, types.EmptyTSK)
+	err := r.runClaimExtend(ctx, &run)
 	if err != nil {
-		return xerrors.Errorf("looking up client address: %w", err)
+		run.Error = err.Error()
 	}
+	run.Finished = time.Now().Unix()
 
-	client, err := address.IDFromAddress(clientAddr)
-	if err != nil {
-		return xerrors.Errorf("getting client id: %w", err)
+	id, rerr := r.db.RecordClaimExtendRun(run)
+	if rerr != nil {
+		log.Errorw("recording claim extend run", "error", rerr)
 	}
+	run.ID = id
 
-	r.msgSendLk.Lock()
-	defer r.msgSendLk.Unlock()
+	log.Infow("claim extend cycle", "claims", run.Claims, "atMax", run.AtMaxTerm, "disabled", run.Disabled, "deferred", run.Deferred,
+		"messages", len(run.Batches), "fee", types.FIL(run.Fee), "sent", run.Sent, "error", err)
 
-	nonce, err := chain.MpoolGetNonce(ctx, clkey)
+	return run, err
+}
+
+func (r *ribs) runClaimExtend(ctx context.Context, run *iface.ClaimExtendRun) error {
+	gw, closer, err := aclient.NewGatewayRPCV1(ctx, r.lotusRPCAddr, nil)
 	if err != nil {
-		return xerrors.Errorf("getting nonce: %w", err)
+		return xerrors.Errorf("creating gateway rpc client: %w", err)
 	}
+	defer closer()
 
-	claimOurs := func(claim verifreg.Claim) bool {
-		return claim.Client == abi.ActorID(client)
+	p, err := r.claimPlanner(ctx, gw)
+	if err != nil {
+		return err
 	}
 
-	var nclaims int
-	claims := map[address.Address]map[verifreg.ClaimId]verifreg.Claim{}
-
-	for n, prov := range provs {
-		fmt.Printf("(claim ext) Getting claims for %s (%d/%d)\n", prov, n, len(provs))
-		allProvClaims, err := chain.StateGetClaims(ctx, prov, types.EmptyTSK)
-		if err != nil {
-			return xerrors.Errorf("getting claims: %w", err)
-		}
-
-		for claimID, claim := range allProvClaims {
-			if !claimOurs(claim) {
-				continue
-			}
-
-			if _, ok := claims[prov]; !ok {
-				claims[prov] = map[verifreg.ClaimId]verifreg.Claim{}
-			}
-			claims[prov][claimID] = claim
-			nclaims++
-		}
+	plan, err := p.Plan(ctx)
+	if err != nil {
+		return xerrors.Errorf("planning claim extensions: %w", err)
 	}
 
-	fmt.Printf("(claim ext) Got %d claims, creating messages\n", nclaims)
+	run.Claims = len(plan.Extend)
+	run.AtMaxTerm, run.Disabled, run.Deferred = plan.AtMaxTerm, plan.Disabled, plan.Deferred
+	run.Batches, run.GasLimit, run.Fee = plan.Batches, plan.GasLimit, plan.Fee
 
-	tmax := abi.ChainEpoch(verifregtypes13.MaximumVerifiedAllocationTerm)
-	params := verifreg.ExtendClaimTermsParams{}
-
-	var totalGas int64
-	totalFee := big.Zero()
+	if !run.Sent {
+		return nil
+	}
 
-	var mkMessage func(params verifreg.ExtendClaimTermsParams) (*types.Message, error)
-	mkMessage = func(params verifreg.ExtendClaimTermsParams) (*types.Message, error) {
-		clientAddr, err := address.NewIDAddress(client)
-		if err != nil {
-			return nil, err
-		}
+	r.msgSendLk.Lock()
+	defer r.msgSendLk.Unlock()
 
-		enc, err := actors.SerializeParams(&params)
+	for i, b := range plan.params {
+		m, err := b.message()
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		gwNonce, err := chain.MpoolGetNonce(ctx, clientAddr)
+		m, err = r.estimateMessage(ctx, gw, m)
 		if err != nil {
-			return nil, xerrors.Errorf("getting nonce: %w", err)
-		}
-		if gwNonce > nonce {
-			nonce = gwNonce
-		}
-
-		m := &types.Message{
-			To:     verifreg2.Address,
-			From:   clkey,
-			Method: verifreg2.Methods.ExtendClaimTerms,
-			Params: enc,
-			Value:  types.NewInt(0),
-			Nonce:  nonce,
-		}
-
-		m, err = chain.GasEstimateMessageGas(ctx, m, nil, types.EmptyTSK)
-
-		if (err != nil && strings.Contains(err.Error(), "call ran out of gas")) || m.GasLimit >= build.BlockGasLimit*4/5 {
-			// estimate two messages
-			p1 := params
-			p2 := params
-
-			p1.Terms = p1.Terms[:len(p1.Terms)/2]
-			p2.Terms = p2.Terms[len(p2.Terms)/2:]
-
-			_, err := mkMessage(p1)
-			if err != nil {
-				return nil, err
-			}
-			_, err = mkMessage(p2)
-			if err != nil {
-				return nil, err
-			}
-			return nil, nil
+			return xerrors.Errorf("estimating extend message: %w", err)
 		}
 
 		// overestimate a little more
 		m.GasLimit = m.GasLimit * 10 / 9
 
+		c, err := r.pushMessage(ctx, gw, m, msgPurposeClaimExtend, big.Zero())
 		if err != nil {
-			return nil, err
+			return xerrors.Errorf("push: %w", err)
 		}
 
-		fmt.Printf("(claim ext) Message: %d Exts GasLimit=%d (%02d%% blk lim), GasFeeCap=%s, GasPremium=%s, Fee=%s\n", len(params.Terms),
-			m.GasLimit, m.GasLimit*100/build.BlockGasLimit, m.GasFeeCap, m.GasPremium, types.FIL(m.RequiredFunds()))
+		run.Batches[i].Message = c.String()
 
-		totalGas += m.GasLimit
-		totalFee = types.BigAdd(totalFee, m.RequiredFunds())
+		log.Infow("claim ext: pushed extend message", "cid", c, "claims", len(b.params.Terms), "from", b.from)
+	}
 
-		if os.Getenv("RIBS_SEND_EXTENDS") == "1" {
-			sig, err := r.wallet.WalletSign(ctx, clkey, m.Cid().Bytes(), api.MsgMeta{
-				Type: api.MTChainMsg,
-			})
-			if err != nil {
-				return nil, xerrors.Errorf("signing message: %w", err)
-			}
+	return nil
+}
 
-			sm := &types.SignedMessage{
-				Message:   *m,
-				Signature: *sig,
-			}
+func (r *ribsDB) RecordClaimExtendRun(run iface.ClaimExtendRun) (int64, error) {
+	batches, err := json.Marshal(run.Batches)
+	if err != nil {
+		return 0, xerrors.Errorf("encoding batches: %w", err)
+	}
 
-			c, aerr := chain.MpoolPush(ctx, sm)
-			if aerr != nil {
-				return nil, xerrors.Errorf("push: %w", aerr)
-			}
+	var runErr *string
+	if run.Error != "" {
+		runErr = &run.Error
+	}
 
-			fmt.Printf("(claim ext) Pushed EXTEND message: %s\n", c)
+	var id int64
+	err = r.db.QueryRow(`insert into claim_extend_runs (started_at, finished_at, sent, claims, at_max_term, disabled, deferred,
+		gas_limit, fee, batches, error) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) returning id`,
+		run.Started, run.Finished, run.Sent, run.Claims, run.AtMaxTerm, run.Disabled, run.Deferred,
+		run.GasLimit, run.Fee.String(), string(batches), runErr).Scan(&id)
+	if err != nil {
+		return 0, xerrors.Errorf("inserting claim extend run: %w", err)
+	}
 
-			nonce++
+	return id, nil
+}
 
-			rec, err := chain.StateWaitMsg(ctx, c, 1, api.LookbackNoLimit, true)
-			if err != nil {
-				return nil, xerrors.Errorf("waiting for message: %w", err)
-			}
+func (r *ribsDB) ClaimExtendRuns(limit int) ([]iface.ClaimExtendRun, error) {
+	rows, err := r.db.Query(`select id, started_at, finished_at, sent, claims, at_max_term, disabled, deferred,
+		gas_limit, fee, batches, coalesce(error, '') from claim_extend_runs order by id desc limit ?`, limit)
+	if err != nil {
+		return nil, xerrors.Errorf("querying claim extend runs: %w", err)
+	}
+	defer rows.Close()
 
-			if rec.Receipt.ExitCode != 0 {
-				return nil, xerrors.Errorf("message failed: %d", rec.Receipt.ExitCode)
-			}
-		}
+	var out []iface.ClaimExtendRun
+	for rows.Next() {
+		var run iface.ClaimExtendRun
+		var fee, batches string
 
-		return m, nil
-	}
+		if err := rows.Scan(&run.ID, &run.Started, &run.Finished, &run.Sent, &run.Claims, &run.AtMaxTerm, &run.Disabled, &run.Deferred,
+			&run.GasLimit, &fee, &batches, &run.Error); err != nil {
+			return nil, xerrors.Errorf("scanning claim extend run: %w", err)
+		}
 
-	for provider, cls := range claims {
-		mid, err := address.IDFromAddress(provider)
+		run.Fee, err = big.FromString(fee)
 		if err != nil {
-			return xerrors.Errorf("getting provider id: %w", err)
+			return nil, xerrors.Errorf("parsing fee: %w", err)
 		}
-
-		for claimId, claim := range cls {
-			if claim.TermMax == tmax {
-				continue
-			}
-
-			params.Terms = append(params.Terms, verifreg.ClaimTerm{
-				Provider: abi.ActorID(mid),
-				ClaimId:  claimId,
-				TermMax:  tmax,
-			})
-
-			if len(params.Terms) >= 1000 {
-				if _, err := mkMessage(params); err != nil {
-					return err
-				}
-				params.Terms = nil
-			}
+		if err := json.Unmarshal([]byte(batches), &run.Batches); err != nil {
+			return nil, xerrors.Errorf("decoding batches: %w", err)
 		}
-	}
 
-	if len(params.Terms) > 0 {
-		if _, err := mkMessage(params); err != nil {
-			return err
-		}
+		out = append(out, run)
 	}
 
-	fmt.Printf("(claim ext) Total gas: %d (%.2f blks)\n", totalGas, float64(totalGas)/float64(build.BlockGasLimit))
-	fmt.Printf("(claim ext) Total fee: %s\n", types.FIL(totalFee))
-
-	return nil
+	return out, rows.Err()
 }
@@ -0,0 +1,314 @@
+package rbdeal
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	verifregtypes13 "github.com/filecoin-project/go-state-types/builtin/v13/verifreg"
+	"github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/build"
+	"github.com/filecoin-project/lotus/chain/actors"
+	verifreg2 "github.com/filecoin-project/lotus/chain/actors/builtin/verifreg"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+// ClaimPlanner plans extension of verified claims made for ribs deals to the
+// max claim term. It's used by the claim extension cycle, and by ritool.
+type ClaimPlanner struct {
+	DB    Querier
+	Chain api.Gateway
+
+	// clients whose claims are extended, with addresses sending the
+	// extension messages
+	Clients map[abi.ActorID]address.Address
+
+	// max claims in a message, and max messages in a plan (0 for no limit)
+	BatchSize, MaxMessages int
+}
+
+// ClaimPlan is a claim extension plan, with messages ready to be sent
+type ClaimPlan struct {
+	iface.ClaimExtendPlan
+
+	// parallel to ClaimExtendPlan.Batches
+	params []claimBatch
+}
+
+type claimBatch struct {
+	from   address.Address
+	params verifreg.ExtendClaimTermsParams
+}
+
+// message returns the ExtendClaimTerms message of a batch, without gas params
+func (b claimBatch) message() (*types.Message, error) {
+	enc, err := actors.SerializeParams(&b.params)
+	if err != nil {
+		return nil, xerrors.Errorf("serializing params: %w", err)
+	}
+
+	return &types.Message{
+		To:     verifreg2.Address,
+		From:   b.from,
+		Method: verifreg2.Methods.ExtendClaimTerms,
+		Params: enc,
+		Value:  types.NewInt(0),
+	}, nil
+}
+
+func (p *ClaimPlanner) Plan(ctx context.Context) (*ClaimPlan, error) {
+	provs, err := claimProviders(p.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	pieces, err := claimPieceGroups(p.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	disabled, err := noClaimExtensionGroupSet(p.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infow("claim ext: getting claims", "providers", len(provs))
+
+	tmax := abi.ChainEpoch(verifregtypes13.MaximumVerifiedAllocationTerm)
+
+	plan := &ClaimPlan{
+		ClaimExtendPlan: iface.ClaimExtendPlan{
+			Fee: big.Zero(),
+		},
+	}
+
+	var exts []iface.ClaimExtension
+
+	for n, prov := range provs {
+		maddr, err := address.NewIDAddress(uint64(prov))
+		if err != nil {
+			return nil, xerrors.Errorf("provider address: %w", err)
+		}
+
+		claims, err := p.Chain.StateGetClaims(ctx, maddr, types.EmptyTSK)
+		if err != nil {
+			return nil, xerrors.Errorf("getting claims of %s: %w", maddr, err)
+		}
+
+		log.Debugw("claim ext: got provider claims", "provider", maddr, "claims", len(claims), "n", n, "of", len(provs))
+
+		for claimID, claim := range claims {
+			if _, ours := p.Clients[claim.Client]; !ours {
+				continue
+			}
+
+			group, ok := pieces[claim.Data]
+			if !ok {
+				group = iface.UndefGroupKey
+			}
+
+			switch {
+			case claim.TermMax >= tmax:
+				plan.AtMaxTerm++
+				continue
+			case disabled[group]:
+				plan.Disabled++
+				continue
+			}
+
+			exts = append(exts, iface.ClaimExtension{
+				Provider:   prov,
+				Client:     int64(claim.Client),
+				ClaimID:    uint64(claimID),
+				Group:      group,
+				Sector:     uint64(claim.Sector),
+				TermStart:  claim.TermStart,
+				TermMax:    claim.TermMax,
+				NewTermMax: tmax,
+			})
+		}
+	}
+
+	sort.Slice(exts, func(i, j int) bool {
+		a, b := exts[i], exts[j]
+		if a.Client != b.Client {
+			return a.Client < b.Client
+		}
+		if a.Provider != b.Provider {
+			return a.Provider < b.Provider
+		}
+		return a.ClaimID < b.ClaimID
+	})
+
+	// batch per client, in order
+	for len(exts) > 0 {
+		n := 1
+		for n < len(exts) && n < p.BatchSize && exts[n].Client == exts[0].Client {
+			n++
+		}
+
+		if err := p.planBatch(ctx, plan, exts[:n]); err != nil {
+			return nil, err
+		}
+		exts = exts[n:]
+	}
+
+	return plan, nil
+}
+
+// planBatch estimates gas of a message extending claims, splitting it in two
+// when it's too big for a block. Claims over the message limit are deferred.
+func (p *ClaimPlanner) planBatch(ctx context.Context, plan *ClaimPlan, exts []iface.ClaimExtension) error {
+	if p.MaxMessages > 0 && len(plan.Batches) >= p.MaxMessages {
+		plan.Deferred += len(exts)
+		return nil
+	}
+
+	b := claimBatch{
+		from: p.Clients[abi.ActorID(exts[0].Client)],
+	}
+	for _, e := range exts {
+		b.params.Terms = append(b.params.Terms, verifreg.ClaimTerm{
+			Provider: abi.ActorID(e.Provider),
+			ClaimId:  verifreg.ClaimId(e.ClaimID),
+			TermMax:  e.NewTermMax,
+		})
+	}
+
+	m, err := b.message()
+	if err != nil {
+		return err
+	}
+
+	m, err = p.Chain.GasEstimateMessageGas(ctx, m, nil, types.EmptyTSK)
+	if (err != nil && strings.Contains(err.Error(), "call ran out of gas")) || (err == nil && m.GasLimit >= build.BlockGasLimit*4/5) {
+		if len(exts) == 1 {
+			return xerrors.Errorf("extending claim %d of f0%d doesn't fit in a message", exts[0].ClaimID, exts[0].Provider)
+		}
+
+		// estimate two messages
+		if err := p.planBatch(ctx, plan, exts[:len(exts)/2]); err != nil {
+			return err
+		}
+		return p.planBatch(ctx, plan, exts[len(exts)/2:])
+	}
+	if err != nil {
+		return xerrors.Errorf("estimating message gas: %w", err)
+	}
+
+	// overestimate a little more
+	m.GasLimit = m.GasLimit * 10 / 9
+
+	plan.Extend = append(plan.Extend, exts...)
+	plan.params = append(plan.params, b)
+	plan.Batches = append(plan.Batches, iface.ClaimExtendBatch{
+		Client:   b.from.String(),
+		Claims:   len(exts),
+		GasLimit: m.GasLimit,
+		Fee:      m.RequiredFunds(),
+	})
+	plan.GasLimit += m.GasLimit
+	plan.Fee = big.Add(plan.Fee, m.RequiredFunds())
+
+	return nil
+}
+
+// claimProviders returns providers with sealed verified deals
+func claimProviders(db Querier) ([]int64, error) {
+	rows, err := db.Query(`select distinct provider_addr from deals where sealed = 1 and verified = 1 order by provider_addr`)
+	if err != nil {
+		return nil, xerrors.Errorf("querying deal providers: %w", err)
+	}
+	defer rows.Close()
+
+	var out []int64
+	for rows.Next() {
+		var prov int64
+		if err := rows.Scan(&prov); err != nil {
+			return nil, xerrors.Errorf("scanning provider: %w", err)
+		}
+		out = append(out, prov)
+	}
+
+	return out, rows.Err()
+}
+
+// claimPieceGroups maps deal pieces to groups, aggregate pieces map to the
+// aggregate lead group
+func claimPieceGroups(db Querier) (map[cid.Cid]iface.GroupKey, error) {
+	out := map[cid.Cid]iface.GroupKey{}
+
+	rows, err := db.Query(`select id, commp from groups where commp is not null`)
+	if err != nil {
+		return nil, xerrors.Errorf("querying group pieces: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var group iface.GroupKey
+		var commp []byte
+		if err := rows.Scan(&group, &commp); err != nil {
+			return nil, xerrors.Errorf("scanning group piece: %w", err)
+		}
+
+		pc, err := commcid.PieceCommitmentV1ToCID(commp)
+		if err != nil {
+			continue
+		}
+		out[pc] = group
+	}
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating group pieces: %w", err)
+	}
+
+	rows, err = db.Query(`select a.piece_cid, ag.group_id from aggregates a
+		join aggregate_groups ag on ag.aggregate_id = a.id
+		where ag.piece_offset = (select min(piece_offset) from aggregate_groups where aggregate_id = a.id)`)
+	if err != nil {
+		return nil, xerrors.Errorf("querying aggregate pieces: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pcb []byte
+		var lead iface.GroupKey
+		if err := rows.Scan(&pcb, &lead); err != nil {
+			return nil, xerrors.Errorf("scanning aggregate piece: %w", err)
+		}
+
+		_, pc, err := cid.CidFromBytes(pcb)
+		if err != nil {
+			continue
+		}
+		out[pc] = lead
+	}
+
+	return out, rows.Err()
+}
+
+func noClaimExtensionGroupSet(db Querier) (map[iface.GroupKey]bool, error) {
+	rows, err := db.Query(noClaimExtensionGroups)
+	if err != nil {
+		return nil, xerrors.Errorf("querying group policies: %w", err)
+	}
+	defer rows.Close()
+
+	out := map[iface.GroupKey]bool{}
+	for rows.Next() {
+		var group iface.GroupKey
+		if err := rows.Scan(&group); err != nil {
+			return nil, xerrors.Errorf("scanning group: %w", err)
+		}
+		out[group] = true
+	}
+
+	return out, rows.Err()
+}
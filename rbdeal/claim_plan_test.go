@@ -0,0 +1,116 @@
+package rbdeal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	verifregtypes13 "github.com/filecoin-project/go-state-types/builtin/v13/verifreg"
+	"github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/stretchr/testify/require"
+)
+
+type claimsGateway struct {
+	api.Gateway
+
+	claims map[address.Address]map[verifreg.ClaimId]verifreg.Claim
+}
+
+func (g *claimsGateway) StateGetClaims(ctx context.Context, prov address.Address, tsk types.TipSetKey) (map[verifreg.ClaimId]verifreg.Claim, error) {
+	return g.claims[prov], nil
+}
+
+func (g *claimsGateway) GasEstimateMessageGas(ctx context.Context, msg *types.Message, spec *api.MessageSendSpec, tsk types.TipSetKey) (*types.Message, error) {
+	m := *msg
+	m.GasLimit = 9_000_000
+	m.GasFeeCap = big.NewInt(100)
+	m.GasPremium = big.NewInt(10)
+	return &m, nil
+}
+
+func TestClaimPlanner(t *testing.T) {
+	db := openFixtureDB(t, nil)
+
+	commp := make([]byte, 32)
+	commp[0] = 1
+	piece, err := commcid.PieceCommitmentV1ToCID(commp)
+	require.NoError(t, err)
+
+	for g := 1; g <= 2; g++ {
+		_, err := db.db.Exec(`insert into groups (id, blocks, bytes, g_state, jb_recorded_head, commp) values (?, 0, 0, ?, 0, ?)`,
+			g, iface.GroupStateOffloaded, append([]byte{byte(g)}, commp[1:]...))
+		require.NoError(t, err)
+	}
+
+	_, err = db.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, price_afil_gib_epoch, verified, keep_unsealed,
+		start_epoch, end_epoch, signed_proposal_bytes, sealed) values ('d1', 'f0100', 1000, 1, 0, 1, 1, 0, 1, x'', 1)`)
+	require.NoError(t, err)
+
+	// group 2 opts out of claim extension
+	require.NoError(t, db.SetReplicationPolicy(iface.ReplicationPolicy{Name: "short", TargetReplicas: 1, MinimumReplicas: 1, NoClaimExtension: true}))
+	require.NoError(t, db.SetGroupPolicy(2, "short"))
+
+	commp2 := append([]byte{2}, commp[1:]...)
+	piece2, err := commcid.PieceCommitmentV1ToCID(commp2)
+	require.NoError(t, err)
+
+	tmax := abi.ChainEpoch(verifregtypes13.MaximumVerifiedAllocationTerm)
+	prov, _ := address.NewIDAddress(1000)
+
+	claims := map[verifreg.ClaimId]verifreg.Claim{
+		1: {Provider: 1000, Client: 100, Data: piece, TermMax: 1000, TermStart: 10, Sector: 5},
+		2: {Provider: 1000, Client: 100, Data: piece, TermMax: 1000, TermStart: 10, Sector: 5},
+		3: {Provider: 1000, Client: 100, Data: piece, TermMax: 1000, TermStart: 10, Sector: 5},
+		4: {Provider: 1000, Client: 100, Data: piece, TermMax: tmax},
+		5: {Provider: 1000, Client: 100, Data: piece2, TermMax: 1000},
+		6: {Provider: 1000, Client: 200, Data: piece, TermMax: 1000}, // not ours
+	}
+
+	client, _ := address.NewIDAddress(100)
+
+	p := &ClaimPlanner{
+		DB:          db.db,
+		Chain:       &claimsGateway{claims: map[address.Address]map[verifreg.ClaimId]verifreg.Claim{prov: claims}},
+		Clients:     map[abi.ActorID]address.Address{100: client},
+		BatchSize:   2,
+		MaxMessages: 1,
+	}
+
+	plan, err := p.Plan(context.Background())
+	require.NoError(t, err)
+
+	require.Equal(t, 1, plan.AtMaxTerm)
+	require.Equal(t, 1, plan.Disabled)
+	require.Equal(t, 1, plan.Deferred)
+
+	require.Len(t, plan.Extend, 2)
+	require.Equal(t, iface.ClaimExtension{Provider: 1000, Client: 100, ClaimID: 1, Group: 1, Sector: 5, TermStart: 10, TermMax: 1000, NewTermMax: tmax}, plan.Extend[0])
+	require.EqualValues(t, 2, plan.Extend[1].ClaimID)
+
+	require.Len(t, plan.Batches, 1)
+	require.Len(t, plan.params, 1)
+	require.Equal(t, 2, plan.Batches[0].Claims)
+	require.Equal(t, client.String(), plan.Batches[0].Client)
+	require.EqualValues(t, 10_000_000, plan.Batches[0].GasLimit)
+	require.Equal(t, big.NewInt(1_000_000_000), plan.Fee)
+
+	// runs are recorded
+	run := iface.ClaimExtendRun{Started: 1, Finished: 2, Claims: len(plan.Extend), Batches: plan.Batches, GasLimit: plan.GasLimit, Fee: plan.Fee}
+	_, err = db.RecordClaimExtendRun(run)
+	require.NoError(t, err)
+	run.Error = "failed"
+	id, err := db.RecordClaimExtendRun(run)
+	require.NoError(t, err)
+
+	runs, err := db.ClaimExtendRuns(10)
+	require.NoError(t, err)
+	require.Len(t, runs, 2)
+	run.ID = id
+	require.Equal(t, run, runs[0])
+}
@@ -0,0 +1,303 @@
+package rbdeal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil"
+	"golang.org/x/xerrors"
+)
+
+// DealConfigFile is the name of the deal config file in the RIBS root
+const DealConfigFile = "deal_config.json"
+
+// dealConfig holds the current deal policy. Loops read it with get on each
+// iteration, so changes made with Set apply without a restart.
+type dealConfig struct {
+	path string
+
+	setLk sync.Mutex
+	file  iface.DealConfig // defaults and the config file, without env overrides
+	cur   atomic.Pointer[iface.DealConfig]
+}
+
+// loadDealConfig builds the deal config from defaults, the config file in
+// root, RIBS_* env overrides and open options, in that order
+func loadDealConfig(root string, opts []func(*iface.DealConfig)) (*dealConfig, error) {
+	dc := &dealConfig{
+		path: filepath.Join(root, DealConfigFile),
+	}
+
+	cfg := defaultDealConfig()
+
+	f, err := os.ReadFile(dc.path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, xerrors.Errorf("reading deal config: %w", err)
+	default:
+		if err := json.Unmarshal(f, &cfg); err != nil {
+			return nil, xerrors.Errorf("parsing deal config %s: %w", dc.path, err)
+		}
+	}
+
+	dc.file = cfg
+
+	if err := dealConfigFromEnv(&cfg); err != nil {
+		return nil, err
+	}
+
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	if err := validateDealConfig(cfg); err != nil {
+		return nil, xerrors.Errorf("invalid deal config: %w", err)
+	}
+
+	dc.cur.Store(&cfg)
+	return dc, nil
+}
+
+func (dc *dealConfig) get() iface.DealConfig {
+	return *dc.cur.Load()
+}
+
+func (dc *dealConfig) Get() iface.DealConfig {
+	return dc.get()
+}
+
+// Set validates cfg, writes it to the config file and makes it current.
+// Fields overridden by RIBS_* env variables keep their env value, and their
+// value from the file is persisted, so that env overrides don't end up in the
+// file.
+func (dc *dealConfig) Set(cfg iface.DealConfig) error {
+	dc.setLk.Lock()
+	defer dc.setLk.Unlock()
+
+	file := cfg
+	for _, e := range dealConfigEnv {
+		if os.Getenv(e.name) == "" {
+			continue
+		}
+		reflect.ValueOf(e.field(&file)).Elem().Set(reflect.ValueOf(e.field(&dc.file)).Elem())
+	}
+
+	cur := file
+	if err := dealConfigFromEnv(&cur); err != nil {
+		return err
+	}
+
+	for _, e := range dealConfigEnv {
+		if os.Getenv(e.name) != "" && !reflect.DeepEqual(e.field(&cfg), e.field(&cur)) {
+			log.Warnw("deal config field change ignored, overridden by env", "env", e.name)
+		}
+	}
+
+	if err := validateDealConfig(file); err != nil {
+		return xerrors.Errorf("invalid deal config: %w", err)
+	}
+	if err := validateDealConfig(cur); err != nil {
+		return xerrors.Errorf("invalid deal config with env overrides: %w", err)
+	}
+
+	b, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return xerrors.Errorf("marshaling deal config: %w", err)
+	}
+
+	tmp := dc.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return xerrors.Errorf("writing deal config: %w", err)
+	}
+	if err := os.Rename(tmp, dc.path); err != nil {
+		return xerrors.Errorf("replacing deal config: %w", err)
+	}
+
+	dc.file = file
+	old := dc.cur.Swap(&cur)
+	log.Infow("deal config updated", "old", *old, "new", cur)
+
+	return nil
+}
+
+// transferRate returns a transfer rate check using current transfer speed
+// settings, with the link speed divided by linkShare
+func (dc *dealConfig) transferRate(linkShare int) ributil.RateFunc {
+	return func(transferRateMbps float64, peerTransfers, totalTransfers int64) error {
+		cfg := dc.get()
+		rf := ributil.MinAvgGlobalLogPeerRate(float64(cfg.MinTransferMbps), float64(cfg.LinkSpeedMbps/linkShare))
+		return rf(transferRateMbps, peerTransfers, totalTransfers)
+	}
+}
+
+func validateDealConfig(cfg iface.DealConfig) error {
+	isPow2 := func(v int64) bool { return v > 0 && v&(v-1) == 0 }
+
+	switch {
+	case cfg.MaxPrice < 0 || cfg.MaxVerifPrice < 0:
+		return xerrors.Errorf("max prices can't be negative")
+	case !isPow2(cfg.MinPieceSize) || !isPow2(cfg.MaxPieceSize):
+		return xerrors.Errorf("piece sizes must be powers of two (min %d, max %d)", cfg.MinPieceSize, cfg.MaxPieceSize)
+	case cfg.MinPieceSize > cfg.MaxPieceSize:
+		return xerrors.Errorf("min piece size %d greater than max %d", cfg.MinPieceSize, cfg.MaxPieceSize)
+	case cfg.AggregateMaxWait < 0:
+		return xerrors.Errorf("aggregate max wait can't be negative")
+	case cfg.DealStartTime <= dealPublishFinality:
+		return xerrors.Errorf("deal start time %d must be more than publish finality (%d epochs)", cfg.DealStartTime, dealPublishFinality)
+	case cfg.RenewBefore <= cfg.DealStartTime:
+		return xerrors.Errorf("renewal lead time %d must be more than deal start time (%d epochs)", cfg.RenewBefore, cfg.DealStartTime)
+	case cfg.RenewBefore >= minDealDuration:
+		return xerrors.Errorf("renewal lead time %d must be less than min deal duration (%d epochs)", cfg.RenewBefore, minDealDuration)
+	case cfg.MinimumReplicaCount < 1:
+		return xerrors.Errorf("minimum replica count must be at least 1")
+	case cfg.TargetReplicaCount < cfg.MinimumReplicaCount:
+		return xerrors.Errorf("target replica count %d less than minimum %d", cfg.TargetReplicaCount, cfg.MinimumReplicaCount)
+	case cfg.MinDatacap.Int == nil || cfg.MinDatacap.LessThan(big.Zero()):
+		return xerrors.Errorf("min datacap must be set and not negative")
+	case cfg.MinTransferMbps <= 0 || cfg.LinkSpeedMbps <= 0:
+		return xerrors.Errorf("transfer speeds must be positive")
+	case cfg.MinTransferMbps > cfg.LinkSpeedMbps:
+		return xerrors.Errorf("min transfer speed %d greater than link speed %d", cfg.MinTransferMbps, cfg.LinkSpeedMbps)
+	case cfg.MaxTransferRetries < 1:
+		return xerrors.Errorf("max transfer retries must be at least 1")
+	case cfg.TransferIdleTimeout <= 0:
+		return xerrors.Errorf("transfer idle timeout must be positive")
+	case cfg.MinMarketBalance.Int == nil || cfg.AutoMarketBalance.Int == nil:
+		return xerrors.Errorf("market balance thresholds must be set")
+	case cfg.MinMarketBalance.LessThan(big.Zero()):
+		return xerrors.Errorf("min market balance can't be negative")
+	case cfg.AutoMarketBalance.LessThan(cfg.MinMarketBalance):
+		return xerrors.Errorf("auto market balance %s less than min %s", cfg.AutoMarketBalance, cfg.MinMarketBalance)
+	case cfg.MaxLocalGroupCount < 1:
+		return xerrors.Errorf("max local group count must be at least 1")
+	case cfg.MaxReplicasPerSP < 1:
+		return xerrors.Errorf("max replicas per provider must be at least 1")
+	case cfg.MaxReplicasPerOwner < 0:
+		return xerrors.Errorf("max replicas per owner can't be negative")
+	case cfg.ScoreHalfLife <= 0:
+		return xerrors.Errorf("score half-life must be positive")
+	case cfg.MonthlyBudget.Int == nil || cfg.TotalBudget.Int == nil:
+		return xerrors.Errorf("budgets must be set")
+	case cfg.MonthlyBudget.LessThan(big.Zero()) || cfg.TotalBudget.LessThan(big.Zero()):
+		return xerrors.Errorf("budgets can't be negative")
+	case cfg.MessageReplaceAfter <= 0:
+		return xerrors.Errorf("message replace timeout must be positive")
+	case cfg.MaxMessageFee.Int == nil || !cfg.MaxMessageFee.GreaterThan(big.Zero()):
+		return xerrors.Errorf("max message fee must be positive")
+	case cfg.ClaimExtendInterval <= 0:
+		return xerrors.Errorf("claim extend interval must be positive")
+	case cfg.ClaimExtendBatchSize < 1:
+		return xerrors.Errorf("claim extend batch size must be at least 1")
+	case cfg.ClaimExtendMaxMessages < 0:
+		return xerrors.Errorf("claim extend max messages can't be negative")
+	case cfg.DirectDeals && !cfg.ExperimentalDirectDeals:
+		return xerrors.Errorf("direct deals are experimental, ExperimentalDirectDeals must be set")
+	}
+
+	w := cfg.ScoreWeights
+	for _, v := range []float64{w.DealSuccess, w.Acceptance, w.SealTime, w.Retrieval, w.TTFB, w.Price} {
+		if v < 0 {
+			return xerrors.Errorf("score weights can't be negative")
+		}
+	}
+	if w.DealSuccess+w.Acceptance+w.SealTime+w.Retrieval+w.TTFB+w.Price == 0 {
+		return xerrors.Errorf("at least one score weight must be set")
+	}
+
+	return nil
+}
+
+// dealConfigEnv lists RIBS_* environment overrides, with the config field
+// each of them sets
+var dealConfigEnv = []struct {
+	name  string
+	field func(cfg *iface.DealConfig) any
+}{
+	{"RIBS_MAX_PRICE", func(c *iface.DealConfig) any { return &c.MaxPrice }},
+	{"RIBS_MAX_VERIF_PRICE", func(c *iface.DealConfig) any { return &c.MaxVerifPrice }},
+	{"RIBS_MIN_PIECE_SIZE", func(c *iface.DealConfig) any { return &c.MinPieceSize }},
+	{"RIBS_MAX_PIECE_SIZE", func(c *iface.DealConfig) any { return &c.MaxPieceSize }},
+	{"RIBS_AGGREGATE_MAX_WAIT", func(c *iface.DealConfig) any { return &c.AggregateMaxWait }},
+	{"RIBS_DEAL_START_EPOCHS", func(c *iface.DealConfig) any { return &c.DealStartTime }},
+	{"RIBS_RENEW_BEFORE_EPOCHS", func(c *iface.DealConfig) any { return &c.RenewBefore }},
+	{"RIBS_MIN_REPLICAS", func(c *iface.DealConfig) any { return &c.MinimumReplicaCount }},
+	{"RIBS_TARGET_REPLICAS", func(c *iface.DealConfig) any { return &c.TargetReplicaCount }},
+	{"RIBS_MIN_DATACAP", func(c *iface.DealConfig) any { return &c.MinDatacap }},
+	{"RIBS_MIN_TRANSFER_MBPS", func(c *iface.DealConfig) any { return &c.MinTransferMbps }},
+	{"RIBS_LINK_SPEED_MBPS", func(c *iface.DealConfig) any { return &c.LinkSpeedMbps }},
+	{"RIBS_MAX_TRANSFER_RETRIES", func(c *iface.DealConfig) any { return &c.MaxTransferRetries }},
+	{"RIBS_TRANSFER_IDLE_TIMEOUT", func(c *iface.DealConfig) any { return &c.TransferIdleTimeout }},
+	{"RIBS_MIN_MARKET_BALANCE", func(c *iface.DealConfig) any { return &c.MinMarketBalance }},
+	{"RIBS_AUTO_MARKET_BALANCE", func(c *iface.DealConfig) any { return &c.AutoMarketBalance }},
+	{"RIBS_MAX_LOCAL_GROUPS", func(c *iface.DealConfig) any { return &c.MaxLocalGroupCount }},
+	{"RIBS_MAX_REPLICAS_PER_SP", func(c *iface.DealConfig) any { return &c.MaxReplicasPerSP }},
+	{"RIBS_MAX_REPLICAS_PER_OWNER", func(c *iface.DealConfig) any { return &c.MaxReplicasPerOwner }},
+	{"RIBS_DISTINCT_PEER_IDS", func(c *iface.DealConfig) any { return &c.DistinctPeerIDs }},
+	{"RIBS_DISTINCT_IP_RANGES", func(c *iface.DealConfig) any { return &c.DistinctIPRanges }},
+	{"RIBS_SCORE_HALF_LIFE", func(c *iface.DealConfig) any { return &c.ScoreHalfLife }},
+	{"RIBS_MONTHLY_BUDGET", func(c *iface.DealConfig) any { return &c.MonthlyBudget }},
+	{"RIBS_TOTAL_BUDGET", func(c *iface.DealConfig) any { return &c.TotalBudget }},
+	{"RIBS_MESSAGE_REPLACE_AFTER", func(c *iface.DealConfig) any { return &c.MessageReplaceAfter }},
+	{"RIBS_MAX_MESSAGE_FEE", func(c *iface.DealConfig) any { return &c.MaxMessageFee }},
+	{"RIBS_CLAIM_EXTEND_INTERVAL", func(c *iface.DealConfig) any { return &c.ClaimExtendInterval }},
+	{"RIBS_CLAIM_EXTEND_BATCH", func(c *iface.DealConfig) any { return &c.ClaimExtendBatchSize }},
+	{"RIBS_CLAIM_EXTEND_MAX_MESSAGES", func(c *iface.DealConfig) any { return &c.ClaimExtendMaxMessages }},
+	{"RIBS_SEND_EXTENDS", func(c *iface.DealConfig) any { return &c.SendClaimExtensions }},
+	{"RIBS_DIRECT_DEALS", func(c *iface.DealConfig) any { return &c.DirectDeals }},
+	{"RIBS_EXPERIMENTAL_DIRECT_DEALS", func(c *iface.DealConfig) any { return &c.ExperimentalDirectDeals }},
+}
+
+// dealConfigFromEnv applies RIBS_* environment overrides
+func dealConfigFromEnv(cfg *iface.DealConfig) error {
+	for _, e := range dealConfigEnv {
+		v := os.Getenv(e.name)
+		if v == "" {
+			continue
+		}
+		if err := parseEnvValue(e.field(cfg), v); err != nil {
+			return xerrors.Errorf("parsing %s: %w", e.name, err)
+		}
+	}
+
+	return nil
+}
+
+func parseEnvValue(dst any, s string) error {
+	var err error
+
+	switch dst := dst.(type) {
+	case *int:
+		*dst, err = strconv.Atoi(s)
+	case *int64:
+		*dst, err = strconv.ParseInt(s, 10, 64)
+	case *float64:
+		*dst, err = strconv.ParseFloat(s, 64)
+	case *bool:
+		*dst, err = strconv.ParseBool(s)
+	case *abi.ChainEpoch:
+		var v int64
+		v, err = strconv.ParseInt(s, 10, 64)
+		*dst = abi.ChainEpoch(v)
+	case *iface.Duration:
+		var v time.Duration
+		v, err = time.ParseDuration(s)
+		*dst = iface.Duration(v)
+	case *big.Int:
+		*dst, err = big.FromString(s)
+	default:
+		panic(fmt.Sprintf("unsupported env value type %T", dst))
+	}
+
+	return err
+}
@@ -0,0 +1,111 @@
+package rbdeal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/big"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateDealConfig(t *testing.T) {
+	require.NoError(t, validateDealConfig(defaultDealConfig()))
+
+	cases := map[string]func(cfg *iface.DealConfig){
+		"piece sizes must be powers of two": func(cfg *iface.DealConfig) { cfg.MinPieceSize = 3 << 30 },
+		"greater than max":                  func(cfg *iface.DealConfig) { cfg.MinPieceSize, cfg.MaxPieceSize = 64<<30, 32<<30 },
+		"publish finality":                  func(cfg *iface.DealConfig) { cfg.DealStartTime = dealPublishFinality },
+		"renewal lead time":                 func(cfg *iface.DealConfig) { cfg.RenewBefore = cfg.DealStartTime },
+		"less than minimum":                 func(cfg *iface.DealConfig) { cfg.TargetReplicaCount = cfg.MinimumReplicaCount - 1 },
+		"min datacap must be set":           func(cfg *iface.DealConfig) { cfg.MinDatacap = big.Int{} },
+		"auto market balance":               func(cfg *iface.DealConfig) { cfg.AutoMarketBalance = big.Zero() },
+		"at least one score weight":         func(cfg *iface.DealConfig) { cfg.ScoreWeights = iface.ScoreWeights{} },
+		"max message fee must be positive":  func(cfg *iface.DealConfig) { cfg.MaxMessageFee = big.Zero() },
+		"direct deals are experimental":     func(cfg *iface.DealConfig) { cfg.DirectDeals = true },
+	}
+
+	for msg, mod := range cases {
+		cfg := defaultDealConfig()
+		mod(&cfg)
+		require.ErrorContains(t, validateDealConfig(cfg), msg)
+	}
+}
+
+func TestDealConfigPrecedence(t *testing.T) {
+	td := t.TempDir()
+
+	file := defaultDealConfig()
+	file.MaxPrice = 1
+	file.MaxReplicasPerSP = 2
+	file.TargetReplicaCount = 12
+
+	b, err := json.Marshal(file)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(td, DealConfigFile), b, 0644))
+
+	t.Setenv("RIBS_MAX_REPLICAS_PER_SP", "3")
+	t.Setenv("RIBS_TARGET_REPLICAS", "11")
+
+	dc, err := loadDealConfig(td, []func(*iface.DealConfig){func(cfg *iface.DealConfig) {
+		cfg.TargetReplicaCount = 13
+	}})
+	require.NoError(t, err)
+
+	cfg := dc.get()
+	require.Equal(t, 1.0, cfg.MaxPrice)          // file
+	require.Equal(t, 3, cfg.MaxReplicasPerSP)    // env over file
+	require.Equal(t, 13, cfg.TargetReplicaCount) // option over env
+	require.Equal(t, 5, cfg.MinimumReplicaCount) // default
+
+	t.Setenv("RIBS_TARGET_REPLICAS", "x")
+	_, err = loadDealConfig(td, nil)
+	require.ErrorContains(t, err, "RIBS_TARGET_REPLICAS")
+}
+
+func TestDealConfigSetKeepsEnvOut(t *testing.T) {
+	td := t.TempDir()
+
+	t.Setenv("RIBS_MAX_REPLICAS_PER_SP", "3")
+
+	dc, err := loadDealConfig(td, nil)
+	require.NoError(t, err)
+
+	cfg := dc.Get()
+	require.Equal(t, 3, cfg.MaxReplicasPerSP)
+
+	cfg.MaxPrice = 2
+	require.NoError(t, dc.Set(cfg))
+
+	// env still applies, and the file has the non-env value
+	require.Equal(t, 3, dc.get().MaxReplicasPerSP)
+	require.Equal(t, 2.0, dc.get().MaxPrice)
+
+	b, err := os.ReadFile(filepath.Join(td, DealConfigFile))
+	require.NoError(t, err)
+
+	var file iface.DealConfig
+	require.NoError(t, json.Unmarshal(b, &file))
+	require.Equal(t, 2.0, file.MaxPrice)
+	require.Equal(t, defaultDealConfig().MaxReplicasPerSP, file.MaxReplicasPerSP)
+
+	// changes to env overridden fields don't apply while env is set
+	cfg.MaxReplicasPerSP = 4
+	require.NoError(t, dc.Set(cfg))
+	require.Equal(t, 3, dc.get().MaxReplicasPerSP)
+
+	// invalid configs aren't stored
+	cfg.MinimumReplicaCount = 0
+	require.ErrorContains(t, dc.Set(cfg), "minimum replica count")
+	require.Equal(t, 2.0, dc.get().MaxPrice)
+
+	// without env the file value is used
+	os.Unsetenv("RIBS_MAX_REPLICAS_PER_SP")
+
+	dc, err = loadDealConfig(td, nil)
+	require.NoError(t, err)
+	require.Equal(t, defaultDealConfig().MaxReplicasPerSP, dc.get().MaxReplicasPerSP)
+	require.Equal(t, 2.0, dc.get().MaxPrice)
+}
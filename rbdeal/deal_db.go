@@ -13,8 +13,10 @@ import (
 	"sort"
 	"time"
 
+	commcid "github.com/filecoin-project/go-fil-commcid"
 	"github.com/filecoin-project/go-fil-markets/storagemarket"
 	"github.com/filecoin-project/go-state-types/abi"
+	verifregtypes13 "github.com/filecoin-project/go-state-types/builtin/v13/verifreg"
 	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
 	iface "github.com/lotus-web3/ribs"
@@ -25,10 +27,13 @@ import (
 type ribsDB struct {
 	db *ributil.RetryDB
 
+	dealCfg *dealConfig
+
 	dealSummaryCq *ributil.CachedQuery[iface.DealSummary]
 	reachableCq   *ributil.CachedQuery[[]iface.ProviderMeta]
 
 	lastAnalyzed time.Time
+	lastScored   time.Time
 }
 
 var pragmas = []string{
@@ -248,6 +253,173 @@ CREATE INDEX IF NOT EXISTS idx_deals_provider ON deals(provider_addr, group_id,
 CREATE INDEX IF NOT EXISTS idx_deals_group ON deals(group_id, rejected, start_time);
 CREATE INDEX IF NOT EXISTS idx_deals_retrieval ON deals(last_retrieval_check, last_retrieval_check_success);
 
+/* piece aggregation */
+create table if not exists aggregate_queue
+(
+    group_id  integer not null
+        constraint aggregate_queue_pk
+            primary key,
+    queued_at integer default (strftime('%s','now')) not null
+);
+
+create table if not exists aggregates
+(
+    id         integer not null
+        constraint aggregates_pk
+            primary key autoincrement,
+    piece_cid  blob    not null,
+    piece_size integer not null,
+    created_at integer default (strftime('%s','now')) not null
+);
+
+create table if not exists aggregate_groups
+(
+    group_id     integer not null
+        constraint aggregate_groups_pk
+            primary key,
+    aggregate_id integer not null
+        constraint aggregate_groups_aggregates_id_fk
+            references aggregates,
+    piece_offset integer not null, /* padded offset of the group piece in the aggregate */
+    piece_size   integer not null,
+    piece_cid    blob    not null,
+    car_size     integer not null
+);
+
+CREATE INDEX IF NOT EXISTS idx_aggregate_groups_aggregate ON aggregate_groups(aggregate_id, piece_offset);
+
+/* replication policy classes, assigned to groups in group_policies */
+create table if not exists replication_policies
+(
+    name             text    not null
+        constraint replication_policies_pk
+            primary key,
+    target_replicas  integer not null,
+    minimum_replicas integer not null,
+    repair_below     integer not null,
+    verification     text    not null default '',
+    max_price        real, /* null uses deal config */
+    max_verif_price  real,
+    deal_duration    integer not null default 0,
+    require_http     integer not null default 0,
+    require_bitswap  integer not null default 0,
+    max_per_region   integer not null default 0,
+    max_per_org      integer not null default 0
+);
+
+create table if not exists provider_labels
+(
+    sp_id  integer not null
+        constraint provider_labels_pk
+            primary key,
+    region text    not null default '',
+    org    text    not null default ''
+);
+
+create table if not exists provider_scores
+(
+    sp_id      integer not null
+        constraint provider_scores_pk
+            primary key,
+    score      real    not null,
+    components text    not null, -- json of []iface.ScoreComponent
+    updated_at integer not null
+);
+
+create table if not exists provider_access
+(
+    sp_id  integer not null
+        constraint provider_access_pk
+            primary key,
+    access text    not null -- 'allow' or 'deny'
+);
+
+create table if not exists wallet_roles
+(
+    addr text not null
+        constraint wallet_roles_pk
+            primary key,
+    role text not null
+);
+
+/* spend ledger */
+create table if not exists ledger
+(
+    id        integer not null
+        constraint ledger_pk
+            primary key autoincrement,
+    ts        integer default (strftime('%s','now')) not null,
+    kind      text    not null,
+    amount    text    not null, -- attoFIL
+    note      text    not null default '',
+    msg_cid   text,
+    group_id  integer,
+    provider  integer,
+    deal_uuid text
+);
+
+create index if not exists idx_ledger_ts on ledger (ts);
+
+/* messages sent by ribs, tracked until they land on chain */
+create table if not exists messages
+(
+    id          integer not null
+        constraint messages_pk
+            primary key autoincrement,
+    from_addr   text    not null,
+    nonce       integer not null,
+    purpose     text    not null,
+    amount      text    not null, -- attoFIL moved by the message
+    msg_cid     text    not null, -- most recently pushed version
+    signed_msg  blob    not null,
+    sent_at     integer default (strftime('%s','now')) not null,
+    pushed_at   integer default (strftime('%s','now')) not null,
+    replaced    integer not null default 0,
+    state       integer not null default 0, -- 0 pending, 1 landed, 2 dropped
+    exec_cid    text,
+    exec_height integer,
+    exit_code   integer,
+    gas_used    integer,
+    gas_cost    text,
+    error       text
+);
+
+create index if not exists idx_messages_state on messages (state);
+
+/* claim extension cycles */
+create table if not exists claim_extend_runs
+(
+    id          integer not null
+        constraint claim_extend_runs_pk
+            primary key autoincrement,
+    started_at  integer not null,
+    finished_at integer not null,
+    sent        integer not null,
+    claims      integer not null,
+    at_max_term integer not null,
+    disabled    integer not null,
+    deferred    integer not null,
+    gas_limit   integer not null,
+    fee         text    not null,
+    batches     text    not null, -- json list of message batches
+    error       text
+);
+
+/* operator actions */
+create table if not exists admin_audit
+(
+    id        integer not null
+        constraint admin_audit_pk
+            primary key autoincrement,
+    at        integer not null default (strftime('%s','now')),
+    action    text    not null,
+    group_id  integer,
+    provider  integer,
+    deal_uuid text,
+    reason    text    not null default '',
+    error     text
+);
+
 CREATE TABLE IF NOT EXISTS schema_version (
     version_number INTEGER PRIMARY KEY,
     description TEXT,
@@ -266,9 +438,69 @@ var schemas = []schema{
 		VersionNumber: 2,
 		Description:   "Add sector_number to deals table",
 		Schema:        `ALTER TABLE deals ADD COLUMN sector_number INTEGER;`,
+	},
+	{
+		VersionNumber: 3,
+		Description:   "Add aggregate_id to deals table",
+		Schema: `ALTER TABLE deals ADD COLUMN aggregate_id INTEGER;
+				 CREATE INDEX IF NOT EXISTS idx_deals_aggregate ON deals(aggregate_id);`,
+	},
+	{
+		VersionNumber: 4,
+		Description:   "Add owner_id and peer_id to providers table",
+		Schema: `ALTER TABLE providers ADD COLUMN owner_id INTEGER;
+				 ALTER TABLE providers ADD COLUMN peer_id TEXT;`,
+	},
+	{
+		VersionNumber: 5,
+		Description:   "Add ledger accounting state to deals table",
+		Schema: `ALTER TABLE deals ADD COLUMN ledger_locked INTEGER NOT NULL DEFAULT 0;
+				 ALTER TABLE deals ADD COLUMN ledger_unlocked INTEGER NOT NULL DEFAULT 0;
+				 ALTER TABLE deals ADD COLUMN ledger_paid_epoch INTEGER NOT NULL DEFAULT 0;`,
+	},
+	{
+		VersionNumber: 6,
+		Description:   "Replace ledger_messages with the messages table",
+		Schema:        `DROP TABLE IF EXISTS ledger_messages;`,
+	},
+	{
+		VersionNumber: 7,
+		Description:   "Add no_claim_extension to replication_policies table",
+		Schema:        `ALTER TABLE replication_policies ADD COLUMN no_claim_extension INTEGER NOT NULL DEFAULT 0;`,
+	},
+	{
+		VersionNumber: 8,
+		Description:   "Add direct deal allocations to deals table, and direct_deals to replication_policies table",
+		Schema: `ALTER TABLE deals ADD COLUMN direct INTEGER NOT NULL DEFAULT 0;
+				 ALTER TABLE deals ADD COLUMN allocation_id INTEGER;
+				 ALTER TABLE replication_policies ADD COLUMN direct_deals INTEGER NOT NULL DEFAULT 0;`,
 	}}
 
-func openRibsDB(root string) (*ribsDB, error) {
+// dealsOfGroup matches deals made for a group, directly or through an aggregate
+// containing it. Takes the group id twice.
+const dealsOfGroup = `(group_id = ? OR aggregate_id IN (SELECT aggregate_id FROM aggregate_groups WHERE group_id = ?))`
+
+// dealAliveAt returns a condition matching non-failed deals which will still
+// hold data at an epoch, taking the epoch as its only argument. Deals ending
+// before it are replaced by renewal. When claim extensions are sent, sealed
+// verified deals stay alive past their end, up to the max claim term from
+// sector activation, unless extension is disabled by the group policy.
+// Columns are prefixed with p.
+func dealAliveAt(cfg iface.DealConfig, p string) string {
+	until := p + "end_epoch"
+	if cfg.SendClaimExtensions {
+		until = fmt.Sprintf(`(CASE WHEN %[1]sverified = 1 AND %[1]ssealed = 1 AND %[1]ssector_start_epoch IS NOT NULL AND %[1]sgroup_id NOT IN (%[2]s)
+			THEN max(%[1]send_epoch, %[1]ssector_start_epoch + %[3]d) ELSE %[1]send_epoch END)`, p, noClaimExtensionGroups, verifregtypes13.MaximumVerifiedAllocationTerm)
+	}
+
+	return fmt.Sprintf(`(%sfailed = 0 AND %s > ?)`, p, until)
+}
+
+// noClaimExtensionGroups selects groups with claim extension disabled by their
+// replication policy
+const noClaimExtensionGroups = `SELECT gp.group_id FROM group_policies gp JOIN replication_policies rp ON rp.name = gp.policy WHERE rp.no_claim_extension = 1`
+
+func openRibsDB(root string, dealCfg *dealConfig) (*ribsDB, error) {
 	rdb, err := sql.Open("sqlite3", filepath.Join(root, "store.db"))
 	if err != nil {
 		return nil, xerrors.Errorf("open db: %w", err)
@@ -286,6 +518,8 @@ func openRibsDB(root string) (*ribsDB, error) {
 	rd := &ribsDB{
 		db: db,
 
+		dealCfg: dealCfg,
+
 		lastAnalyzed: time.Now(),
 	}
 
@@ -331,9 +565,13 @@ func (r *ribsDB) startDB() error {
 	if err := timeDBOp("refresh_sp_retr_stats", r.db, refreshViewTable("sp_retr_stats")); err != nil {
 		return err
 	}
-	if err := timeDBOp("refresh_good_providers", r.db, refreshGoodProviders()); err != nil {
+	if err := timeDBOp("refresh_good_providers", r.db, refreshGoodProviders(r.dealCfg.get())); err != nil {
+		return err
+	}
+	if err := timeDBOp("refresh_provider_scores", r.db, refreshProviderScores(r.dealCfg.get())); err != nil {
 		return err
 	}
+	r.lastScored = time.Now()
 
 	go func() {
 		for {
@@ -347,10 +585,15 @@ func (r *ribsDB) startDB() error {
 			if err := timeDBOp("refresh_sp_retr_stats", r.db, refreshViewTable("sp_retr_stats")); err != nil {
 				continue
 			}
-			if err := timeDBOp("refresh_good_providers", r.db, refreshGoodProviders()); err != nil {
+			if err := timeDBOp("refresh_good_providers", r.db, refreshGoodProviders(r.dealCfg.get())); err != nil {
 				continue
 			}
 
+			if time.Since(r.lastScored) > scoreRefreshInterval {
+				_ = timeDBOp("refresh_provider_scores", r.db, refreshProviderScores(r.dealCfg.get()))
+				r.lastScored = time.Now()
+			}
+
 			if time.Since(r.lastAnalyzed) > analyzeInterval {
 				_ = timeDBOp("analyze", r.db, func(db *ributil.RetryDB) error {
 					_, err := db.Exec("ANALYZE")
@@ -387,7 +630,7 @@ func refreshViewTable(name string) func(db *ributil.RetryDB) error {
 	}
 }
 
-func refreshGoodProviders() func(db *ributil.RetryDB) error {
+func refreshGoodProviders(cfg iface.DealConfig) func(db *ributil.RetryDB) error {
 	return func(db *ributil.RetryDB) error {
 		_, err := db.Exec(fmt.Sprintf(`
 	CREATE TEMP TABLE good_providers_tmp_imm1 AS SELECT p.* FROM providers p
@@ -418,13 +661,13 @@ func refreshGoodProviders() func(db *ributil.RetryDB) error {
 
 		DELETE FROM good_providers;
 		INSERT INTO good_providers SELECT * FROM good_providers_tmp;
-		DROP TABLE good_providers_tmp;`, maxPieceSize, minPieceSize))
+		DROP TABLE good_providers_tmp;`, cfg.MaxPieceSize, cfg.MinPieceSize))
 
 		return err
 	}
 }
 
-func refreshGoodProviders5(db *ributil.RetryDB) error {
+func refreshGoodProviders5(db *ributil.RetryDB, cfg iface.DealConfig) error {
 	// Query to populate good_providers table
 	q := `
     INSERT INTO good_providers
@@ -457,7 +700,7 @@ func refreshGoodProviders5(db *ributil.RetryDB) error {
 	}
 
 	// Insert refreshed data
-	if _, err := db.Exec(fmt.Sprintf(q, maxPieceSize, minPieceSize)); err != nil {
+	if _, err := db.Exec(fmt.Sprintf(q, cfg.MaxPieceSize, cfg.MinPieceSize)); err != nil {
 		return err
 	}
 
@@ -471,134 +714,169 @@ type dealProvider struct {
 	id              int64
 	ask_price       float64
 	ask_verif_price float64
+
+	score float64
 }
 
-func (r *ribsDB) SelectDealProviders(group iface.GroupKey, pieceSize int64, verified bool, maxPrice float64) ([]dealProvider, error) {
-	// only reachable, with boost_deals, only ones that don't have deals for this group
-	// 6 at random
-	// 2 of them with booster_http
-	// 2 of them with booster_bitswap
+// SelectDealProviders picks providers for new deals of a group. Deals ending
+// before horizon don't count towards replica caps, so that renewal deals can
+// be made with the same providers.
+func (r *ribsDB) SelectDealProviders(group iface.GroupKey, pieceSize int64, verified bool, maxPrice float64, pol iface.ReplicationPolicy, horizon abi.ChainEpoch) ([]dealProvider, error) {
+	// only reachable, with boost_deals, allowed by the access lists, only ones
+	// without recent failures or too many deals for this group
+	// 15 at random
+	// 7 of them with booster_http
+	// 7 of them with booster_bitswap
+	// picked with probability proportional to provider score
+	// then replica caps and diversity limits apply, and the result is trimmed to 9
+
+	cfg := r.dealCfg.get()
 
-	var withHttp []dealProvider
-	var withBitswap []dealProvider
-	var random []dealProvider
+	filter := `WHERE id NOT IN (
+					SELECT provider_addr FROM deals WHERE group_id = ? AND failed = 1
+					  AND (rejected = 0 OR (rejected = 1 AND start_time >= strftime('%s', 'now', '-24 hours')))
+					  AND (failed = 0 OR (rejected = 0 AND failed = 1 AND  start_time >= strftime('%s', 'now', '-100 hours')))
+				) AND id NOT IN (
+					SELECT provider_addr FROM deals WHERE group_id = ? AND ` + dealAliveAt(cfg, "") + `
+					GROUP BY provider_addr HAVING count(*) >= ?
+				) AND id NOT IN (SELECT sp_id FROM provider_access WHERE access = 'deny')
+				  AND (NOT EXISTS (SELECT 1 FROM provider_access WHERE access = 'allow')
+					OR id IN (SELECT sp_id FROM provider_access WHERE access = 'allow'))
+				  AND ask_min_piece_size <= ? and ask_max_piece_size >= ?`
+	args := []any{group, group, horizon, cfg.MaxReplicasPerSP, pieceSize, pieceSize}
+
+	if pol.RequireHTTP {
+		filter += " and booster_http = 1"
+	}
+	if pol.RequireBitswap {
+		filter += " and booster_bitswap = 1"
+	}
 
-	res, err := r.db.Query(`select id, ask_price, ask_verif_price from good_providers
-									WHERE id NOT IN (
-										SELECT provider_addr FROM deals	WHERE group_id = ?
-										  AND (rejected = 0 OR (rejected = 1 AND start_time >= strftime('%s', 'now', '-24 hours')))
-										  AND (failed = 0 OR (rejected = 0 AND failed = 1 AND  start_time >= strftime('%s', 'now', '-100 hours')))
-									) and ask_min_piece_size <= ? and ask_max_piece_size >= ? order by random() limit 15`,
-		group, pieceSize, pieceSize)
+	all, err := r.queryDealProviders(neutralScore, filter, args...)
 	if err != nil {
-		return nil, xerrors.Errorf("querying providers: %w", err)
+		return nil, err
 	}
-	defer res.Close()
 
-	for res.Next() {
-		var id dealProvider
-		err := res.Scan(&id.id, &id.ask_price, &id.ask_verif_price)
-		if err != nil {
-			return nil, xerrors.Errorf("scanning provider: %w", err)
-		}
+	withHttp, err := r.queryDealProviders(neutralScore, filter+` and booster_http = 1`, args...)
+	if err != nil {
+		return nil, err
+	}
 
-		if verified && id.ask_verif_price > maxPrice {
+	withBitswap, err := r.queryDealProviders(neutralScore, filter+` and booster_bitswap = 1`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	random := weightedSample(all, 15)
+	withHttp = weightedSample(withHttp, 7)
+	withBitswap = weightedSample(withBitswap, 7)
+
+	out := make([]dealProvider, 0, 14)
+	out = append(out, withHttp...)
+	out = append(out, withBitswap...)
+	for _, p := range random {
+		if verified && p.ask_verif_price > maxPrice {
 			continue
-		} else if !verified && id.ask_price > maxPrice {
+		} else if !verified && p.ask_price > maxPrice {
 			continue
 		}
 
-		random = append(random, id)
+		out = append(out, p)
 	}
 
-	if err := res.Err(); err != nil {
-		return nil, xerrors.Errorf("iterating providers: %w", err)
+	// dedup
+	seen := make(map[int64]dealProvider)
+	for _, p := range out {
+		if _, ok := seen[p.id]; ok {
+			continue
+		}
+		seen[p.id] = p
 	}
 
-	if err := res.Close(); err != nil {
-		return nil, xerrors.Errorf("closing providers: %w", err)
+	out = make([]dealProvider, 0, len(seen))
+	for _, p := range seen {
+		out = append(out, p)
 	}
+	out = weightedSample(out, len(out))
+
+	out, err = r.filterProviderSpread(group, out, selectLimitsOf(cfg, pol), horizon)
+	if err != nil {
+		return nil, err
+	}
+
+	// trim to 9
+	if len(out) > 9 {
+		out = out[:9]
+	}
+
+	return out, nil
+}
 
-	res, err = r.db.Query(`select id, ask_price, ask_verif_price from good_providers
-									WHERE id NOT IN (
-										SELECT provider_addr FROM deals	WHERE group_id = ?
-										  AND (rejected = 0 OR (rejected = 1 AND start_time >= strftime('%s', 'now', '-24 hours')))
-										  AND (failed = 0 OR (rejected = 0 AND failed = 1 AND  start_time >= strftime('%s', 'now', '-100 hours')))
-									) and booster_http = 1 and ask_min_piece_size <= ? and ask_max_piece_size >= ? order by random() limit 7`, group, pieceSize, pieceSize)
+// queryDealProviders returns good providers matching filter with their scores,
+// defaultScore for ones not scored yet
+func (r *ribsDB) queryDealProviders(defaultScore float64, filter string, args ...any) ([]dealProvider, error) {
+	res, err := r.db.Query(`select id, ask_price, ask_verif_price, coalesce(ps.score, ?) from good_providers
+		left join provider_scores ps on ps.sp_id = good_providers.id `+filter, append([]any{defaultScore}, args...)...)
 	if err != nil {
 		return nil, xerrors.Errorf("querying providers: %w", err)
 	}
+	defer res.Close()
 
+	var out []dealProvider
 	for res.Next() {
 		var id dealProvider
-		err := res.Scan(&id.id, &id.ask_price, &id.ask_verif_price)
+		err := res.Scan(&id.id, &id.ask_price, &id.ask_verif_price, &id.score)
 		if err != nil {
 			return nil, xerrors.Errorf("scanning provider: %w", err)
 		}
 
-		withHttp = append(withHttp, id)
+		out = append(out, id)
 	}
 
 	if err := res.Err(); err != nil {
 		return nil, xerrors.Errorf("iterating providers: %w", err)
 	}
 
-	if err := res.Close(); err != nil {
-		return nil, xerrors.Errorf("closing providers: %w", err)
-	}
+	return out, nil
+}
 
-	res, err = r.db.Query(`select id, ask_price, ask_verif_price from good_providers
-									WHERE id NOT IN (
-										SELECT provider_addr FROM deals	WHERE group_id = ?
-										  AND (rejected = 0 OR (rejected = 1 AND start_time >= strftime('%s', 'now', '-24 hours')))
-										  AND (failed = 0 OR (rejected = 0 AND failed = 1 AND  start_time >= strftime('%s', 'now', '-100 hours')))
-									) and booster_bitswap = 1 and ask_min_piece_size <= ? and ask_max_piece_size >= ? order by random() limit 7`, group, pieceSize, pieceSize)
+// filterProviderSpread drops candidates which would break replica caps or
+// diversity limits given the providers already holding the group
+func (r *ribsDB) filterProviderSpread(group iface.GroupKey, candidates []dealProvider, lim selectLimits, horizon abi.ChainEpoch) ([]dealProvider, error) {
+	rows, err := r.db.Query(`select provider_addr from deals where `+dealsOfGroup+` and `+dealAliveAt(r.dealCfg.get(), ""), group, group, horizon)
 	if err != nil {
-		return nil, xerrors.Errorf("querying providers: %w", err)
+		return nil, xerrors.Errorf("querying group deal providers: %w", err)
 	}
+	defer rows.Close()
 
-	for res.Next() {
-		var id dealProvider
-		err := res.Scan(&id.id, &id.ask_price, &id.ask_verif_price)
-		if err != nil {
-			return nil, xerrors.Errorf("scanning provider: %w", err)
+	var holders []int64
+	for rows.Next() {
+		var sp int64
+		if err := rows.Scan(&sp); err != nil {
+			return nil, xerrors.Errorf("scanning deal provider: %w", err)
 		}
-
-		withBitswap = append(withBitswap, id)
+		holders = append(holders, sp)
 	}
-
-	if err := res.Err(); err != nil {
-		return nil, xerrors.Errorf("iterating providers: %w", err)
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating deal providers: %w", err)
 	}
 
-	if err := res.Close(); err != nil {
-		return nil, xerrors.Errorf("closing providers: %w", err)
+	sps := append([]int64{}, holders...)
+	for _, p := range candidates {
+		sps = append(sps, p.id)
 	}
 
-	out := make([]dealProvider, 0, 14)
-	out = append(out, withHttp...)
-	out = append(out, withBitswap...)
-	out = append(out, random...)
-
-	// dedup
-	seen := make(map[int64]dealProvider)
-	for _, p := range out {
-		if _, ok := seen[p.id]; ok {
-			continue
-		}
-		seen[p.id] = p
+	traits, err := r.providerTraits(sps)
+	if err != nil {
+		return nil, err
 	}
 
-	out = make([]dealProvider, 0, 9)
-	for _, p := range seen {
-		out = append(out, p)
-		// trim to 9
-		if len(out) == 9 {
-			break
-		}
+	spread := newReplicaSpread()
+	for _, sp := range holders {
+		spread.add(traits[sp])
 	}
 
-	return out, nil
+	return spread.filter(candidates, traits, lim), nil
 }
 
 func (r *ribsDB) ReachableProviders() []iface.ProviderMeta {
@@ -613,8 +891,8 @@ func (r *ribsDB) ReachableProviders() []iface.ProviderMeta {
 func (r *ribsDB) reachableProviders() ([]iface.ProviderMeta, error) {
 	res, err := r.db.Query(`select id, ping_ok, boost_deals, booster_http, booster_bitswap,
        indexed_success, indexed_fail,
-       ask_price, ask_verif_price, ask_min_piece_size, ask_max_piece_size
-    from providers where in_market=1 and ping_ok=1`)
+       ask_price, ask_verif_price, ask_min_piece_size, ask_max_piece_size, coalesce(ps.score, ?)
+    from providers left join provider_scores ps on ps.sp_id = providers.id where in_market=1 and ping_ok=1`, neutralScore)
 
 	if err != nil {
 		log.Errorw("querying providers", "error", err)
@@ -627,7 +905,7 @@ func (r *ribsDB) reachableProviders() ([]iface.ProviderMeta, error) {
 		var pm iface.ProviderMeta
 		err := res.Scan(&pm.ID, &pm.PingOk, &pm.BoostDeals, &pm.BoosterHttp, &pm.BoosterBitswap,
 			&pm.IndexedSuccess, &pm.IndexedFail, // &pm.DealAttempts, &pm.DealSuccess, &pm.DealFail,
-			&pm.AskPrice, &pm.AskVerifiedPrice, &pm.AskMinPieceSize, &pm.AskMaxPieceSize)
+			&pm.AskPrice, &pm.AskVerifiedPrice, &pm.AskMinPieceSize, &pm.AskMaxPieceSize, &pm.Score)
 		if err != nil {
 			log.Errorw("scanning provider", "error", err)
 			return nil, err
@@ -749,6 +1027,18 @@ func (r *ribsDB) GetNonFailedDealCount(group iface.GroupKey) (int, error) {
 	return count, nil
 }
 
+// GetLiveDealCount counts deals of a group which will still be alive at horizon,
+// excluding unretrievable ones like GetNonFailedDealCount
+func (r *ribsDB) GetLiveDealCount(group iface.GroupKey, horizon abi.ChainEpoch) (int, error) {
+	var count int
+	err := r.db.QueryRow(`select count(*) from deals where group_id = ? and `+dealAliveAt(r.dealCfg.get(), "")+` and case when last_retrieval_check > 0 then last_retrieval_check < (last_retrieval_check_success + 3600*24) else 1 end = 1`, group, horizon).Scan(&count)
+	if err != nil {
+		return 0, xerrors.Errorf("querying deal count: %w", err)
+	}
+
+	return count, nil
+}
+
 type dbDealInfo struct {
 	DealUUID string
 	GroupID  iface.GroupKey
@@ -764,11 +1054,22 @@ type dbDealInfo struct {
 	EndEpoch   abi.ChainEpoch
 
 	SignedProposalBytes []byte
+
+	// AggregateID is set for deals for aggregate pieces, GroupID is then the
+	// aggregate lead group
+	AggregateID *int64
+
+	// Direct deals have no market proposal, SignedProposalBytes is empty
+	Direct bool
 }
 
 func (r *ribsDB) StoreDealProposal(d dbDealInfo) error {
-	_, err := r.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, price_afil_gib_epoch, verified, keep_unsealed, start_epoch, end_epoch, signed_proposal_bytes) values
-                                   (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, d.DealUUID, d.ClientAddr, d.ProviderAddr, d.GroupID, d.PricePerEpoch, d.Verified, d.KeepUnsealed, d.StartEpoch, d.EndEpoch, d.SignedProposalBytes)
+	if d.SignedProposalBytes == nil {
+		d.SignedProposalBytes = []byte{} // direct deals
+	}
+
+	_, err := r.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, price_afil_gib_epoch, verified, keep_unsealed, start_epoch, end_epoch, signed_proposal_bytes, aggregate_id, direct) values
+                                   (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, d.DealUUID, d.ClientAddr, d.ProviderAddr, d.GroupID, d.PricePerEpoch, d.Verified, d.KeepUnsealed, d.StartEpoch, d.EndEpoch, d.SignedProposalBytes, d.AggregateID, d.Direct)
 	if err != nil {
 		return xerrors.Errorf("inserting deal: %w", err)
 	}
@@ -869,10 +1170,11 @@ func (r *ribsDB) UpdateSPDealState(id uuid.UUID, stresp *types.DealStatusRespons
 type inactiveDealMeta struct {
 	DealUUID     string
 	ProviderAddr int64
+	ClientAddr   string
 }
 
 func (r *ribsDB) InactiveDealsToCheck() ([]inactiveDealMeta, error) {
-	res, err := r.db.Query(`select uuid, provider_addr from deals where sealed = 0 and failed = 0`) // todo any reason to re-check failed/rejected deals?
+	res, err := r.db.Query(`select uuid, provider_addr, client_addr from deals where sealed = 0 and failed = 0 and direct = 0`) // todo any reason to re-check failed/rejected deals?
 	if err != nil {
 		return nil, xerrors.Errorf("querying deals: %w", err)
 	}
@@ -882,7 +1184,7 @@ func (r *ribsDB) InactiveDealsToCheck() ([]inactiveDealMeta, error) {
 
 	for res.Next() {
 		var dm inactiveDealMeta
-		err := res.Scan(&dm.DealUUID, &dm.ProviderAddr)
+		err := res.Scan(&dm.DealUUID, &dm.ProviderAddr, &dm.ClientAddr)
 		if err != nil {
 			return nil, xerrors.Errorf("scanning deal: %w", err)
 		}
@@ -972,6 +1274,57 @@ func (r *ribsDB) UpdateActivatedDeal(id string, sectorStart abi.ChainEpoch) erro
 	return nil
 }
 
+// SetDealAllocation records the verified registry allocation made for a direct deal
+func (r *ribsDB) SetDealAllocation(id string, allocation uint64) error {
+	_, err := r.db.Exec(`update deals set allocation_id = ? where uuid = ?`, allocation, id)
+	if err != nil {
+		return xerrors.Errorf("update deal allocation: %w", err)
+	}
+
+	return nil
+}
+
+type directDealMeta struct {
+	DealUUID     string
+	ProviderAddr int64
+	AllocationID uint64
+}
+
+// AllocatedDeals returns proposed direct deals waiting for their allocation
+// to be claimed
+func (r *ribsDB) AllocatedDeals() ([]directDealMeta, error) {
+	res, err := r.db.Query(`select uuid, provider_addr, allocation_id from deals
+		where direct = 1 and proposed = 1 and sealed = 0 and failed = 0 and allocation_id is not null`)
+	if err != nil {
+		return nil, xerrors.Errorf("querying deals: %w", err)
+	}
+	defer res.Close()
+
+	out := make([]directDealMeta, 0)
+
+	for res.Next() {
+		var dm directDealMeta
+		if err := res.Scan(&dm.DealUUID, &dm.ProviderAddr, &dm.AllocationID); err != nil {
+			return nil, xerrors.Errorf("scanning deal: %w", err)
+		}
+
+		out = append(out, dm)
+	}
+
+	return out, res.Err()
+}
+
+// UpdateClaimedDeal marks a direct deal as sealed once the provider has
+// claimed its allocation
+func (r *ribsDB) UpdateClaimedDeal(id string, termStart abi.ChainEpoch, sector abi.SectorNumber) error {
+	_, err := r.db.Exec(`update deals set sector_start_epoch = ?, sector_number = ?, sealed = 1 where uuid = ?`, termStart, sector, id)
+	if err != nil {
+		return xerrors.Errorf("update claimed deal: %w", err)
+	}
+
+	return nil
+}
+
 func (r *ribsDB) MarkExpiredDeals(currentEpoch int64) error {
 	query := `
 		UPDATE deals
@@ -998,6 +1351,19 @@ func (r *ribsDB) MarkExpiredDeals(currentEpoch int64) error {
 	return nil
 }
 
+// MarkEndedDeals marks sealed deals which aren't alive anymore (see
+// dealAliveAt) as expired, once the spend ledger has accounted for all their
+// payments
+func (r *ribsDB) MarkEndedDeals(head abi.ChainEpoch) (int64, error) {
+	res, err := r.db.Exec(`update deals set failed = 1, failed_expired = 1
+		where sealed = 1 and failed = 0 and not `+dealAliveAt(r.dealCfg.get(), "")+` and ledger_paid_epoch >= end_epoch`, head)
+	if err != nil {
+		return 0, xerrors.Errorf("marking ended deals: %w", err)
+	}
+
+	return res.RowsAffected()
+}
+
 func (r *ribsDB) GetDealStartEpoch(uuid string) (abi.ChainEpoch, error) {
 	var startEpoch abi.ChainEpoch
 	err := r.db.QueryRow(`SELECT start_epoch FROM deals WHERE uuid = ?`, uuid).Scan(&startEpoch)
@@ -1086,6 +1452,12 @@ func (r *ribsDB) ProviderInfo(providerID int64) (iface.ProviderInfo, error) {
 		return pInfo, xerrors.Errorf("querying provider metadata: %w", err)
 	}
 
+	pInfo.Score, err = r.ProviderScore(providerID)
+	if err != nil {
+		return pInfo, err
+	}
+	pInfo.Meta.Score = pInfo.Score.Score
+
 	res, err := r.db.Query("select uuid, provider_addr, sealed, failed, rejected, deal_id, sp_status, sp_sealing_status, error_msg, sp_recv_bytes, sp_txsize, sp_pub_msg_cid, start_epoch, end_epoch, start_time from deals where provider_addr = ? ORDER BY start_time DESC LIMIT 100", providerID)
 	if err != nil {
 		return pInfo, xerrors.Errorf("getting group meta: %w", err)
@@ -1139,6 +1511,36 @@ func (r *ribsDB) ProviderInfo(providerID int64) (iface.ProviderInfo, error) {
 	return pInfo, nil
 }
 
+// SpendCommitments returns payment commitments of live deals - not failed and
+// not expired at head
+func (r *ribsDB) SpendCommitments(head abi.ChainEpoch) (spendCommitments, error) {
+	rows, err := r.db.Query(`select d.price_afil_gib_epoch, d.start_epoch, d.end_epoch, coalesce(a.piece_size, g.piece_size, 0) from deals d
+		left join aggregates a on a.id = d.aggregate_id
+		left join groups g on g.id = d.group_id
+		where d.failed = 0 and d.end_epoch > ?`, head)
+	if err != nil {
+		return spendCommitments{}, xerrors.Errorf("querying live deals: %w", err)
+	}
+	defer rows.Close()
+
+	c := newSpendCommitments()
+	for rows.Next() {
+		var price, pieceSize int64
+		var d liveDeal
+		if err := rows.Scan(&price, &d.start, &d.end, &pieceSize); err != nil {
+			return spendCommitments{}, xerrors.Errorf("scanning live deal: %w", err)
+		}
+
+		d.epochPrice = dealEpochPrice(abi.NewTokenAmount(price), pieceSize)
+		c = c.add(head, d)
+	}
+	if err := rows.Err(); err != nil {
+		return spendCommitments{}, xerrors.Errorf("iterating live deals: %w", err)
+	}
+
+	return c, nil
+}
+
 type dealParams struct {
 	CommP     []byte
 	Root      cid.Cid
@@ -1263,8 +1665,10 @@ func (r *ribsDB) UpdateProviderProtocols(provider int64, pres providerResult) er
 	}
 
 	_, err := r.db.Exec(`
-	update providers set ping_ok = ?, boost_deals = ?, booster_http = ?, booster_bitswap = ?, addr_info_graphsync = ?, addr_info_bitswap = ?, addr_info_http = ? where id = ?;
+	update providers set ping_ok = ?, boost_deals = ?, booster_http = ?, booster_bitswap = ?, addr_info_graphsync = ?, addr_info_bitswap = ?, addr_info_http = ?,
+		owner_id = coalesce(?, owner_id), peer_id = coalesce(?, peer_id) where id = ?;
 	`, pres.PingOk, pres.BoostDeals, pres.BoosterHttp, pres.BoosterBitswap, LibP2PMaddrsJson, BitswapMaddrsJson, HttpMaddrsJson,
+		sql.NullInt64{Int64: pres.Owner, Valid: pres.Owner != 0}, sql.NullString{String: pres.PeerID, Valid: pres.PeerID != ""},
 		provider)
 	if err != nil {
 		return xerrors.Errorf("update provider: %w", err)
@@ -1290,8 +1694,9 @@ func (r *ribsDB) GroupDeals(gk iface.GroupKey) ([]iface.DealMeta, error) {
 	res, err := r.db.Query(`select uuid, provider_addr, sealed, failed, rejected, deal_id,
 										sp_status, sp_sealing_status, error_msg, sp_recv_bytes, sp_txsize, sp_pub_msg_cid, start_epoch, end_epoch,
 										retrieval_probes_success, retrieval_probes_fail, retrieval_probe_prev_ttfb_ms,
-										last_retrieval_check > 0 AND last_retrieval_check > (last_retrieval_check_success + 3600*24) as no_recent_retr
-										from deals where group_id = ?`, gk)
+										last_retrieval_check > 0 AND last_retrieval_check > (last_retrieval_check_success + 3600*24) as no_recent_retr,
+										direct, allocation_id
+										from deals where `+dealsOfGroup, gk, gk)
 	if err != nil {
 		return nil, xerrors.Errorf("getting group meta: %w", err)
 	}
@@ -1313,8 +1718,10 @@ func (r *ribsDB) GroupDeals(gk iface.GroupKey) ([]iface.DealMeta, error) {
 		var retrievalProbesFail *int64
 		var retrievalProbeTTFBMS *int64
 		var noRecentRetrievalSuccess bool
+		var direct bool
+		var allocationID *int64
 
-		err := res.Scan(&dealUuid, &provider, &sealed, &failed, &rejected, &dealID, &status, &sealStatus, &errMsg, &bytesRecv, &txSize, &pubCid, &startEpoch, &endEpoch, &retrievalProbesSuccess, &retrievalProbesFail, &retrievalProbeTTFBMS, &noRecentRetrievalSuccess)
+		err := res.Scan(&dealUuid, &provider, &sealed, &failed, &rejected, &dealID, &status, &sealStatus, &errMsg, &bytesRecv, &txSize, &pubCid, &startEpoch, &endEpoch, &retrievalProbesSuccess, &retrievalProbesFail, &retrievalProbeTTFBMS, &noRecentRetrievalSuccess, &direct, &allocationID)
 		if err != nil {
 			return nil, xerrors.Errorf("scanning deal: %w", err)
 		}
@@ -1335,6 +1742,9 @@ func (r *ribsDB) GroupDeals(gk iface.GroupKey) ([]iface.DealMeta, error) {
 			TxSize:     DerefOr(txSize, 0),
 			PubCid:     DerefOr(pubCid, ""),
 
+			Direct:       direct,
+			AllocationID: DerefOr(allocationID, 0),
+
 			RetrTTFBMs:  DerefOr(retrievalProbeTTFBMS, 0),
 			RetrSuccess: DerefOr(retrievalProbesSuccess, 0),
 			RetrFail:    DerefOr(retrievalProbesFail, 0),
@@ -1402,9 +1812,15 @@ type GroupDealStats struct {
 	RejectedDeals  int64
 	Retrievable    int64
 	Unretrievable  int64
+
+	// non-failed deals which won't be alive at the horizon, not counting
+	// unretrievable ones
+	Expiring int64
 }
 
-func (r *ribsDB) GetGroupDealStats() (map[int64]GroupDealStats, error) {
+// GetGroupDealStats returns deal counts of all groups, deals not alive at
+// horizon are counted as expiring
+func (r *ribsDB) GetGroupDealStats(horizon abi.ChainEpoch) (map[int64]GroupDealStats, error) {
 	query := `
         SELECT
     g.id AS group_id,
@@ -1415,15 +1831,17 @@ func (r *ribsDB) GetGroupDealStats() (map[int64]GroupDealStats, error) {
     COUNT(CASE WHEN d.failed = 1 THEN 1 ELSE NULL END) AS failed_deals,
     COUNT(CASE WHEN d.rejected = 1 THEN 1 ELSE NULL END) AS rejected_deals,
     COUNT(CASE WHEN d.failed = 0 AND d.last_retrieval_check > 0 AND d.last_retrieval_check < (d.last_retrieval_check_success + 3600*24) THEN 1 ELSE NULL END) AS retrievable_deals,
-    COUNT(CASE WHEN d.failed = 0 AND d.last_retrieval_check > 0 AND d.last_retrieval_check > (d.last_retrieval_check_success + 3600*24) THEN 1 ELSE NULL END) AS unretrievable_deals
+    COUNT(CASE WHEN d.failed = 0 AND d.last_retrieval_check > 0 AND d.last_retrieval_check > (d.last_retrieval_check_success + 3600*24) THEN 1 ELSE NULL END) AS unretrievable_deals,
+    COUNT(CASE WHEN d.failed = 0 AND NOT ` + dealAliveAt(r.dealCfg.get(), "d.") + `
+        AND NOT (d.last_retrieval_check > 0 AND d.last_retrieval_check > (d.last_retrieval_check_success + 3600*24)) THEN 1 ELSE NULL END) AS expiring_deals
 FROM
     groups g
         LEFT JOIN
-    deals d ON g.id = d.group_id
+    deals d ON g.id = d.group_id OR d.aggregate_id = (SELECT ag.aggregate_id FROM aggregate_groups ag WHERE ag.group_id = g.id)
 GROUP BY
     g.id;`
 
-	rows, err := r.db.Query(query)
+	rows, err := r.db.Query(query, horizon)
 	if err != nil {
 		return nil, xerrors.Errorf("fetch group deal stats: %w", err)
 	}
@@ -1432,7 +1850,7 @@ GROUP BY
 	stats := make(map[int64]GroupDealStats)
 	for rows.Next() {
 		var s GroupDealStats
-		err := rows.Scan(&s.GroupID, &s.State, &s.TotalDeals, &s.PublishedDeals, &s.SealedDeals, &s.FailedDeals, &s.RejectedDeals, &s.Retrievable, &s.Unretrievable)
+		err := rows.Scan(&s.GroupID, &s.State, &s.TotalDeals, &s.PublishedDeals, &s.SealedDeals, &s.FailedDeals, &s.RejectedDeals, &s.Retrievable, &s.Unretrievable, &s.Expiring)
 		if err != nil {
 			return nil, xerrors.Errorf("scan group deal stats: %w", err)
 		}
@@ -1502,6 +1920,17 @@ type RetrCheckCandidate struct {
 	Group    int64
 	Verified bool
 	FastRetr bool
+
+	// AggregatePiece is the deal piece cid for aggregate deals, cid.Undef otherwise
+	AggregatePiece cid.Cid
+}
+
+// PieceCid returns the cid of the piece holding the group in the candidate deal
+func (c RetrCheckCandidate) PieceCid(groupPiece cid.Cid) cid.Cid {
+	if c.AggregatePiece.Defined() {
+		return c.AggregatePiece
+	}
+	return groupPiece
 }
 
 func (r *ribsDB) GetRetrievalCheckCandidates() ([]RetrCheckCandidate, error) {
@@ -1509,7 +1938,7 @@ func (r *ribsDB) GetRetrievalCheckCandidates() ([]RetrCheckCandidate, error) {
 	now := time.Now().Unix()
 
 	rows, err := r.db.Query(`
-		SELECT uuid, provider_addr, group_id, verified, keep_unsealed FROM deals 
+		SELECT uuid, provider_addr, group_id, verified, keep_unsealed, (SELECT piece_cid FROM aggregates WHERE id = aggregate_id) FROM deals 
 		WHERE sealed = 1 
 		AND failed = 0 
 		AND last_retrieval_check <= ?`,
@@ -1522,11 +1951,18 @@ func (r *ribsDB) GetRetrievalCheckCandidates() ([]RetrCheckCandidate, error) {
 	var deals []RetrCheckCandidate
 	for rows.Next() {
 		var deal RetrCheckCandidate
+		var aggPiece []byte
 		// Assuming Deal is a struct that can scan all columns from the deals table
-		err := rows.Scan(&deal.DealID, &deal.Provider, &deal.Group, &deal.Verified, &deal.FastRetr)
+		err := rows.Scan(&deal.DealID, &deal.Provider, &deal.Group, &deal.Verified, &deal.FastRetr, &aggPiece)
 		if err != nil {
 			return nil, xerrors.Errorf("scanning deal: %w", err)
 		}
+		if aggPiece != nil {
+			_, deal.AggregatePiece, err = cid.CidFromBytes(aggPiece)
+			if err != nil {
+				return nil, xerrors.Errorf("parsing aggregate piece cid: %w", err)
+			}
+		}
 		deals = append(deals, deal)
 	}
 
@@ -1537,6 +1973,55 @@ func (r *ribsDB) GetRetrievalCheckCandidates() ([]RetrCheckCandidate, error) {
 	return deals, nil
 }
 
+// RetrievalCheckCandidate returns a sealed deal for a retrieval check
+func (r *ribsDB) RetrievalCheckCandidate(dealUUID string) (RetrCheckCandidate, error) {
+	var deal RetrCheckCandidate
+	var sealed, failed bool
+	var aggPiece []byte
+
+	err := r.db.QueryRow(`SELECT uuid, provider_addr, group_id, verified, keep_unsealed, sealed, failed,
+		(SELECT piece_cid FROM aggregates WHERE id = aggregate_id) FROM deals WHERE uuid = ?`, dealUUID).
+		Scan(&deal.DealID, &deal.Provider, &deal.Group, &deal.Verified, &deal.FastRetr, &sealed, &failed, &aggPiece)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RetrCheckCandidate{}, xerrors.Errorf("unknown deal %s", dealUUID)
+	}
+	if err != nil {
+		return RetrCheckCandidate{}, xerrors.Errorf("getting deal: %w", err)
+	}
+
+	if failed {
+		return RetrCheckCandidate{}, xerrors.Errorf("deal %s failed", dealUUID)
+	}
+	if !sealed {
+		return RetrCheckCandidate{}, xerrors.Errorf("deal %s is not sealed yet", dealUUID)
+	}
+
+	if aggPiece != nil {
+		_, deal.AggregatePiece, err = cid.CidFromBytes(aggPiece)
+		if err != nil {
+			return RetrCheckCandidate{}, xerrors.Errorf("parsing aggregate piece cid: %w", err)
+		}
+	}
+
+	return deal, nil
+}
+
+// LastRetrievalCheck returns the result of the last retrieval check of a deal
+func (r *ribsDB) LastRetrievalCheck(dealUUID string) (iface.RetrievalCheck, error) {
+	var out iface.RetrievalCheck
+	var last, lastSuccess int64
+
+	err := r.db.QueryRow(`SELECT last_retrieval_check, last_retrieval_check_success, coalesce(retrieval_probe_prev_error, ''),
+		coalesce(retrieval_probe_prev_ms, 0), coalesce(retrieval_probe_prev_ttfb_ms, 0) FROM deals WHERE uuid = ?`, dealUUID).
+		Scan(&last, &lastSuccess, &out.Error, &out.DurationMs, &out.TTFBMs)
+	if err != nil {
+		return iface.RetrievalCheck{}, xerrors.Errorf("getting retrieval check result: %w", err)
+	}
+
+	out.Success = last > 0 && last == lastSuccess
+	return out, nil
+}
+
 type RetrievalResult struct {
 	Success bool
 	Error   string
@@ -1587,13 +2072,25 @@ type RetrCandidate struct {
 	Verified                  bool
 	FastRetr                  bool
 	LastRetrievalCheckSuccess int64
+
+	// AggregatePiece is the deal piece cid when the group was dealt in an
+	// aggregate, cid.Undef otherwise
+	AggregatePiece cid.Cid
+}
+
+// PieceCid returns the cid of the piece holding the group in the candidate deal
+func (c RetrCandidate) PieceCid(groupPiece cid.Cid) cid.Cid {
+	if c.AggregatePiece.Defined() {
+		return c.AggregatePiece
+	}
+	return groupPiece
 }
 
 func (r *ribsDB) GetRetrievalCandidates(group iface.GroupKey) ([]RetrCandidate, error) {
 	rows, err := r.db.Query(`
-		SELECT uuid, provider_addr, verified, keep_unsealed, last_retrieval_check_success FROM deals 
-		WHERE group_id = ? AND sealed = 1 AND failed = 0 order by retrieval_probe_prev_ttfb_ms asc, last_retrieval_check_success desc, keep_unsealed desc`,
-		group)
+		SELECT uuid, provider_addr, verified, keep_unsealed, last_retrieval_check_success, (SELECT piece_cid FROM aggregates WHERE id = aggregate_id) FROM deals 
+		WHERE `+dealsOfGroup+` AND sealed = 1 AND failed = 0 order by retrieval_probe_prev_ttfb_ms asc, last_retrieval_check_success desc, keep_unsealed desc`,
+		group, group)
 	if err != nil {
 		return nil, xerrors.Errorf("getting retrieval candidates: %w", err)
 	}
@@ -1602,11 +2099,18 @@ func (r *ribsDB) GetRetrievalCandidates(group iface.GroupKey) ([]RetrCandidate,
 	var deals []RetrCandidate
 	for rows.Next() {
 		var deal RetrCandidate
+		var aggPiece []byte
 		// Assuming Deal is a struct that can scan all columns from the deals table
-		err := rows.Scan(&deal.DealID, &deal.Provider, &deal.Verified, &deal.FastRetr, &deal.LastRetrievalCheckSuccess)
+		err := rows.Scan(&deal.DealID, &deal.Provider, &deal.Verified, &deal.FastRetr, &deal.LastRetrievalCheckSuccess, &aggPiece)
 		if err != nil {
 			return nil, xerrors.Errorf("scanning deal: %w", err)
 		}
+		if aggPiece != nil {
+			_, deal.AggregatePiece, err = cid.CidFromBytes(aggPiece)
+			if err != nil {
+				return nil, xerrors.Errorf("parsing aggregate piece cid: %w", err)
+			}
+		}
 		deals = append(deals, deal)
 	}
 
@@ -1840,27 +2344,50 @@ ORDER BY
 	return stats, nil
 }
 
-func (r *ribsDB) AddRepairsForLowRetrievableDeals() error {
+// AddRepairsForLowRetrievableDeals queues offloaded groups with fewer
+// retrievable deals than the repair threshold of their policy, or
+// repairBelow for groups without one
+func (r *ribsDB) AddRepairsForLowRetrievableDeals(repairBelow int) error {
 	query := `
         INSERT INTO repairs (group_id, retrievable_deals)
 			SELECT
 				all_groups.group_id,
 				COALESCE(COUNT(d.group_id), 0)
 			FROM
-				(SELECT DISTINCT d.group_id FROM deals d JOIN groups g ON d.group_id = g.id WHERE g.g_state = 4) AS all_groups
+				(SELECT DISTINCT g.id AS group_id FROM groups g
+					LEFT JOIN aggregate_groups ag ON ag.group_id = g.id
+					JOIN deals d ON d.group_id = g.id OR d.aggregate_id = ag.aggregate_id
+					WHERE g.g_state = 4) AS all_groups
 			LEFT JOIN
-				deals d ON all_groups.group_id = d.group_id AND d.last_retrieval_check > 0 AND d.last_retrieval_check < (d.last_retrieval_check_success + 3600*24)
+				aggregate_groups ag ON ag.group_id = all_groups.group_id
+			LEFT JOIN
+				deals d ON (all_groups.group_id = d.group_id OR d.aggregate_id = ag.aggregate_id) AND d.last_retrieval_check > 0 AND d.last_retrieval_check < (d.last_retrieval_check_success + 3600*24)
+			LEFT JOIN
+				group_policies gp ON gp.group_id = all_groups.group_id
+			LEFT JOIN
+				replication_policies rp ON rp.name = gp.policy
 			GROUP BY
 				all_groups.group_id
 			HAVING
-				COALESCE(COUNT(d.group_id), 0) < 3
+				COALESCE(COUNT(d.group_id), 0) < COALESCE(MAX(rp.repair_below), ?)
 		ON CONFLICT (group_id) DO UPDATE
 		SET retrievable_deals = EXCLUDED.retrievable_deals;
     `
-	_, err := r.db.Exec(query)
+	_, err := r.db.Exec(query, repairBelow)
 	return err
 }
 
+// QueueRenewal queues an offloaded group for reloading, so that renewal deals
+// can be made with its data
+func (r *ribsDB) QueueRenewal(group iface.GroupKey, retrievable int64) error {
+	_, err := r.db.Exec(`insert into repairs (group_id, retrievable_deals) values (?, ?) on conflict (group_id) do nothing`, group, retrievable)
+	if err != nil {
+		return xerrors.Errorf("queueing group for renewal: %w", err)
+	}
+
+	return nil
+}
+
 func (r *ribsDB) AssignRepairToWorker(workerID int) (*iface.GroupKey, error) {
 	query := `
         UPDATE repairs
@@ -1948,3 +2475,379 @@ func (r *ribsDB) UpdateRepairOnStepNotDone(workerID int) error {
 
 	return nil
 }
+
+type aggQueued struct {
+	aggPiece
+	QueuedAt time.Time
+}
+
+// QueueForAggregation adds a group to the set of groups waiting to be packed
+// into an aggregate piece
+func (r *ribsDB) QueueForAggregation(group iface.GroupKey) error {
+	_, err := r.db.Exec(`insert into aggregate_queue (group_id) values (?) on conflict (group_id) do nothing`, group)
+	if err != nil {
+		return xerrors.Errorf("queueing group %d for aggregation: %w", group, err)
+	}
+
+	return nil
+}
+
+// AggregationQueue returns groups waiting for aggregation, oldest first
+func (r *ribsDB) AggregationQueue() ([]aggQueued, error) {
+	rows, err := r.db.Query(`select q.group_id, q.queued_at, g.commp, g.piece_size, g.car_size from aggregate_queue q
+    	join groups g on g.id = q.group_id order by q.group_id`)
+	if err != nil {
+		return nil, xerrors.Errorf("querying aggregation queue: %w", err)
+	}
+	defer rows.Close()
+
+	var out []aggQueued
+	for rows.Next() {
+		var q aggQueued
+		var queuedAt int64
+		var commP []byte
+
+		if err := rows.Scan(&q.Group, &queuedAt, &commP, &q.PieceSize, &q.CarSize); err != nil {
+			return nil, xerrors.Errorf("scanning queued group: %w", err)
+		}
+
+		q.QueuedAt = time.Unix(queuedAt, 0)
+		q.PieceCid, err = commcid.PieceCommitmentV1ToCID(commP)
+		if err != nil {
+			return nil, xerrors.Errorf("group %d commp: %w", q.Group, err)
+		}
+
+		out = append(out, q)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating aggregation queue: %w", err)
+	}
+
+	return out, nil
+}
+
+// CreateAggregate records an aggregate and membership of its groups, removing
+// them from the aggregation queue. Sets agg.ID
+func (r *ribsDB) CreateAggregate(agg *aggregate) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return xerrors.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	err = tx.QueryRow(`insert into aggregates (piece_cid, piece_size) values (?, ?) returning id`, agg.PieceCid.Bytes(), agg.DealSize).Scan(&agg.ID)
+	if err != nil {
+		return xerrors.Errorf("inserting aggregate: %w", err)
+	}
+
+	for _, p := range agg.Pieces {
+		_, err := tx.Exec(`insert into aggregate_groups (group_id, aggregate_id, piece_offset, piece_size, piece_cid, car_size) values (?, ?, ?, ?, ?, ?)`,
+			p.Group, agg.ID, p.Offset, p.PieceSize, p.PieceCid.Bytes(), p.CarSize)
+		if err != nil {
+			return xerrors.Errorf("inserting aggregate group %d: %w", p.Group, err)
+		}
+
+		if _, err := tx.Exec(`delete from aggregate_queue where group_id = ?`, p.Group); err != nil {
+			return xerrors.Errorf("removing group %d from aggregation queue: %w", p.Group, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return xerrors.Errorf("commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// GroupAggregate returns the aggregate containing a group, or nil if the group
+// wasn't aggregated
+func (r *ribsDB) GroupAggregate(group iface.GroupKey) (*aggregate, error) {
+	var aggID int64
+	err := r.db.QueryRow(`select aggregate_id from aggregate_groups where group_id = ?`, group).Scan(&aggID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, nil
+	case err != nil:
+		return nil, xerrors.Errorf("querying group %d aggregate: %w", group, err)
+	}
+
+	return r.GetAggregate(aggID)
+}
+
+func (r *ribsDB) GetAggregate(aggID int64) (*aggregate, error) {
+	agg := &aggregate{ID: aggID}
+
+	var pieceCid []byte
+	err := r.db.QueryRow(`select piece_cid, piece_size from aggregates where id = ?`, aggID).Scan(&pieceCid, &agg.DealSize)
+	if err != nil {
+		return nil, xerrors.Errorf("querying aggregate %d: %w", aggID, err)
+	}
+
+	_, agg.PieceCid, err = cid.CidFromBytes(pieceCid)
+	if err != nil {
+		return nil, xerrors.Errorf("parsing aggregate %d piece cid: %w", aggID, err)
+	}
+
+	rows, err := r.db.Query(`select group_id, piece_offset, piece_size, piece_cid, car_size from aggregate_groups where aggregate_id = ? order by piece_offset`, aggID)
+	if err != nil {
+		return nil, xerrors.Errorf("querying aggregate %d groups: %w", aggID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p aggPiece
+		var pc []byte
+
+		if err := rows.Scan(&p.Group, &p.Offset, &p.PieceSize, &pc, &p.CarSize); err != nil {
+			return nil, xerrors.Errorf("scanning aggregate group: %w", err)
+		}
+
+		_, p.PieceCid, err = cid.CidFromBytes(pc)
+		if err != nil {
+			return nil, xerrors.Errorf("parsing group %d piece cid: %w", p.Group, err)
+		}
+
+		agg.Pieces = append(agg.Pieces, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating aggregate groups: %w", err)
+	}
+	if len(agg.Pieces) == 0 {
+		return nil, xerrors.Errorf("aggregate %d has no groups", aggID)
+	}
+
+	return agg, nil
+}
+
+// AggregateLocal returns true if data of all aggregate groups is stored locally
+func (r *ribsDB) AggregateLocal(aggID int64) (bool, error) {
+	var notLocal int
+	err := r.db.QueryRow(`select count(*) from aggregate_groups ag join groups g on g.id = ag.group_id
+		where ag.aggregate_id = ? and g.g_state != ?`, aggID, iface.GroupStateLocalReadyForDeals).Scan(&notLocal)
+	if err != nil {
+		return false, xerrors.Errorf("querying aggregate %d group states: %w", aggID, err)
+	}
+
+	return notLocal == 0, nil
+}
+
+// QueueAggregateReload queues offloaded groups of an aggregate for reloading
+// with repair workers, so that deals for the aggregate piece can be made again
+// once all of them are local. Returns the number of newly queued groups
+func (r *ribsDB) QueueAggregateReload(aggID int64) (int64, error) {
+	res, err := r.db.Exec(`insert into repairs (group_id, retrievable_deals)
+		select ag.group_id, (select count(*) from deals d where d.aggregate_id = ag.aggregate_id
+			and d.last_retrieval_check > 0 and d.last_retrieval_check < (d.last_retrieval_check_success + 3600*24))
+		from aggregate_groups ag join groups g on g.id = ag.group_id
+		where ag.aggregate_id = ? and g.g_state = ?
+		on conflict (group_id) do nothing`, aggID, iface.GroupStateOffloaded)
+	if err != nil {
+		return 0, xerrors.Errorf("queueing aggregate %d groups for reload: %w", aggID, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, xerrors.Errorf("getting queued groups: %w", err)
+	}
+
+	return n, nil
+}
+
+func (r *ribsDB) ReplicationPolicies() (map[string]iface.ReplicationPolicy, error) {
+	rows, err := r.db.Query(`select name, target_replicas, minimum_replicas, repair_below, verification,
+		max_price, max_verif_price, deal_duration, require_http, require_bitswap, max_per_region, max_per_org, no_claim_extension,
+		direct_deals from replication_policies`)
+	if err != nil {
+		return nil, xerrors.Errorf("querying replication policies: %w", err)
+	}
+	defer rows.Close()
+
+	out := map[string]iface.ReplicationPolicy{}
+	for rows.Next() {
+		var p iface.ReplicationPolicy
+		var maxPrice, maxVerifPrice sql.NullFloat64
+
+		err := rows.Scan(&p.Name, &p.TargetReplicas, &p.MinimumReplicas, &p.RepairBelow, &p.Verification,
+			&maxPrice, &maxVerifPrice, &p.DealDuration, &p.RequireHTTP, &p.RequireBitswap, &p.MaxPerRegion, &p.MaxPerOrg, &p.NoClaimExtension,
+			&p.DirectDeals)
+		if err != nil {
+			return nil, xerrors.Errorf("scanning replication policy: %w", err)
+		}
+		if maxPrice.Valid {
+			p.MaxPrice = &maxPrice.Float64
+		}
+		if maxVerifPrice.Valid {
+			p.MaxVerifPrice = &maxVerifPrice.Float64
+		}
+
+		out[p.Name] = p
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating replication policies: %w", err)
+	}
+
+	return out, nil
+}
+
+func (r *ribsDB) SetReplicationPolicy(p iface.ReplicationPolicy) error {
+	_, err := r.db.Exec(`insert into replication_policies (name, target_replicas, minimum_replicas, repair_below, verification,
+		max_price, max_verif_price, deal_duration, require_http, require_bitswap, max_per_region, max_per_org, no_claim_extension,
+		direct_deals) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		on conflict (name) do update set target_replicas = excluded.target_replicas, minimum_replicas = excluded.minimum_replicas,
+			repair_below = excluded.repair_below, verification = excluded.verification, max_price = excluded.max_price,
+			max_verif_price = excluded.max_verif_price, deal_duration = excluded.deal_duration, require_http = excluded.require_http,
+			require_bitswap = excluded.require_bitswap, max_per_region = excluded.max_per_region, max_per_org = excluded.max_per_org,
+			no_claim_extension = excluded.no_claim_extension, direct_deals = excluded.direct_deals`,
+		p.Name, p.TargetReplicas, p.MinimumReplicas, p.RepairBelow, p.Verification,
+		p.MaxPrice, p.MaxVerifPrice, p.DealDuration, p.RequireHTTP, p.RequireBitswap, p.MaxPerRegion, p.MaxPerOrg, p.NoClaimExtension,
+		p.DirectDeals)
+	if err != nil {
+		return xerrors.Errorf("storing replication policy: %w", err)
+	}
+	return nil
+}
+
+func (r *ribsDB) RemoveReplicationPolicy(name string) error {
+	res, err := r.db.Exec(`delete from replication_policies where name = ?`, name)
+	if err != nil {
+		return xerrors.Errorf("removing replication policy: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return xerrors.Errorf("getting affected rows: %w", err)
+	}
+	if n == 0 {
+		return xerrors.Errorf("replication policy %s not found", name)
+	}
+	return nil
+}
+
+// GroupPolicyNames returns policy names of groups with a policy assigned
+func (r *ribsDB) GroupPolicyNames() (map[iface.GroupKey]string, error) {
+	rows, err := r.db.Query(`select group_id, policy from group_policies`)
+	if err != nil {
+		return nil, xerrors.Errorf("querying group policies: %w", err)
+	}
+	defer rows.Close()
+
+	out := map[iface.GroupKey]string{}
+	for rows.Next() {
+		var g iface.GroupKey
+		var name string
+		if err := rows.Scan(&g, &name); err != nil {
+			return nil, xerrors.Errorf("scanning group policy: %w", err)
+		}
+		out[g] = name
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating group policies: %w", err)
+	}
+
+	return out, nil
+}
+
+// GroupPolicyName returns the policy name assigned to a group, or an empty
+// string if the group has no policy
+func (r *ribsDB) GroupPolicyName(group iface.GroupKey) (string, error) {
+	var name string
+	err := r.db.QueryRow(`select policy from group_policies where group_id = ?`, group).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", xerrors.Errorf("querying group policy: %w", err)
+	}
+	return name, nil
+}
+
+func (r *ribsDB) SetGroupPolicy(group iface.GroupKey, policy string) error {
+	_, err := r.db.Exec(`insert into group_policies (group_id, policy) values (?, ?)
+		on conflict (group_id) do update set policy = excluded.policy`, group, policy)
+	if err != nil {
+		return xerrors.Errorf("setting group policy: %w", err)
+	}
+	return nil
+}
+
+func (r *ribsDB) SetProviderLabels(sp int64, region, org string) error {
+	_, err := r.db.Exec(`insert into provider_labels (sp_id, region, org) values (?, ?, ?)
+		on conflict (sp_id) do update set region = excluded.region, org = excluded.org`, sp, region, org)
+	if err != nil {
+		return xerrors.Errorf("setting provider labels: %w", err)
+	}
+	return nil
+}
+
+// providerTraits returns selection traits of the given providers
+func (r *ribsDB) providerTraits(sps []int64) (map[int64]providerTraits, error) {
+	out := make(map[int64]providerTraits, len(sps))
+	for _, sp := range sps {
+		if _, ok := out[sp]; ok {
+			continue
+		}
+
+		t := providerTraits{sp: sp}
+		var gsAddrs, bsAddrs, httpAddrs string
+
+		err := r.db.QueryRow(`select coalesce(p.owner_id, 0), coalesce(p.peer_id, ''),
+				coalesce(p.addr_info_graphsync, ''), coalesce(p.addr_info_bitswap, ''), coalesce(p.addr_info_http, ''),
+				coalesce(pl.region, ''), coalesce(pl.org, '')
+			from providers p left join provider_labels pl on pl.sp_id = p.id where p.id = ?`, sp).
+			Scan(&t.owner, &t.peerID, &gsAddrs, &bsAddrs, &httpAddrs, &t.region, &t.org)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			return nil, xerrors.Errorf("querying provider %d: %w", sp, err)
+		default:
+			t.ipRanges, err = addrIPRanges(gsAddrs, bsAddrs, httpAddrs)
+			if err != nil {
+				return nil, xerrors.Errorf("provider %d addrs: %w", sp, err)
+			}
+		}
+
+		out[sp] = t
+	}
+
+	return out, nil
+}
+
+func (r *ribsDB) ProviderAccess() (map[int64]iface.ProviderAccess, error) {
+	rows, err := r.db.Query(`select sp_id, access from provider_access`)
+	if err != nil {
+		return nil, xerrors.Errorf("querying provider access: %w", err)
+	}
+	defer rows.Close()
+
+	out := map[int64]iface.ProviderAccess{}
+	for rows.Next() {
+		var sp int64
+		var access string
+		if err := rows.Scan(&sp, &access); err != nil {
+			return nil, xerrors.Errorf("scanning provider access: %w", err)
+		}
+		out[sp] = iface.ProviderAccess(access)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating provider access: %w", err)
+	}
+
+	return out, nil
+}
+
+func (r *ribsDB) SetProviderAccess(sp int64, access iface.ProviderAccess) error {
+	var err error
+	if access == iface.ProviderAccessDefault {
+		_, err = r.db.Exec(`delete from provider_access where sp_id = ?`, sp)
+	} else {
+		_, err = r.db.Exec(`insert into provider_access (sp_id, access) values (?, ?)
+			on conflict (sp_id) do update set access = excluded.access`, sp, string(access))
+	}
+	if err != nil {
+		return xerrors.Errorf("setting provider access: %w", err)
+	}
+	return nil
+}
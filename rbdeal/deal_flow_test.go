@@ -0,0 +1,241 @@
+package rbdeal
+
+import (
+	"context"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/api/client"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/google/uuid"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/rbstor"
+	"github.com/lotus-web3/ribs/ributil"
+	"github.com/stretchr/testify/require"
+)
+
+// openSimRibs opens ribs against the simChain gateway, with small groups and
+// without the background deal making loops, which tests drive by hand
+func openSimRibs(t *testing.T, chain *simChain, cfgOpts ...func(*iface.DealConfig)) *ribs {
+	td := t.TempDir()
+
+	dc, err := loadDealConfig(td, cfgOpts)
+	require.NoError(t, err)
+
+	db, err := openRibsDB(td, dc)
+	require.NoError(t, err)
+
+	rbs, err := rbstor.Open(td, rbstor.WithDB(db.db), rbstor.WithGroupLimits(64<<10, 1000))
+	require.NoError(t, err)
+
+	require.NoError(t, db.startDB())
+
+	w, err := ributil.OpenWallet(filepath.Join(td, "wallet"))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	addr, err := w.WalletNew(ctx, types.KTSecp256k1)
+	require.NoError(t, err)
+	require.NoError(t, w.SetDefault(addr))
+
+	_, err = chain.addAccount(addr, big.NewInt(1e18))
+	require.NoError(t, err)
+
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+
+	r := &ribs{
+		RBS: rbs,
+		db:  db,
+
+		dealCfg: dc,
+
+		host:   h,
+		wallet: w,
+
+		lotusRPCAddr: chain.url,
+
+		uploadStats:     map[iface.GroupKey]*iface.GroupUploadStats{},
+		uploadStatsSnap: map[iface.GroupKey]*iface.GroupUploadStats{},
+		activeUploads:   map[uuid.UUID]struct{}{},
+		rateCounters:    ributil.NewRateCounters[peer.ID](dc.transferRate(1)),
+
+		s3Uploads: map[iface.GroupKey]struct{}{},
+
+		close: make(chan struct{}),
+
+		moreDealsLocks: map[iface.GroupKey]struct{}{},
+	}
+
+	require.NoError(t, rbs.Start())
+
+	srvCtx, cancel := context.WithCancel(ctx)
+	require.NoError(t, r.setupCarServer(srvCtx, h))
+
+	t.Cleanup(func() {
+		close(r.close)
+		cancel()
+		require.NoError(t, h.Close())
+		require.NoError(t, rbs.Close())
+	})
+
+	return r
+}
+
+// fillGroup writes blocks until the first group is full, and waits for it to
+// be ready for deals
+func fillGroup(t *testing.T, r *ribs) iface.GroupKey {
+	ctx := context.Background()
+
+	const group = iface.GroupKey(1)
+
+	wb := r.Session(ctx).Batch(ctx)
+	for i := 0; i < 100; i++ {
+		data := make([]byte, 1<<10)
+		_, _ = rand.Read(data)
+
+		require.NoError(t, wb.Put(ctx, []blocks.Block{blocks.NewBlock(data)}))
+	}
+	require.NoError(t, wb.Flush(ctx))
+
+	require.Eventually(t, func() bool {
+		gm, err := r.StorageDiag().GroupMeta(group)
+		return err == nil && gm.State == iface.GroupStateLocalReadyForDeals
+	}, 30*time.Second, 50*time.Millisecond)
+
+	return group
+}
+
+func TestDealFlow(t *testing.T) {
+	ctx := context.Background()
+
+	chain := newSimChain(t)
+	sp := newSimProvider(t, chain, 1000)
+
+	r := openSimRibs(t, chain, func(cfg *iface.DealConfig) {
+		cfg.MinPieceSize = 256
+		cfg.TargetReplicaCount = 1
+		cfg.MinimumReplicaCount = 1
+	})
+
+	group := fillGroup(t, r)
+
+	// crawl finds the provider in the market actor, and gets its ask
+	gw, closer, err := client.NewGatewayRPCV1(ctx, chain.url, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	crawlHost, err := libp2p.New()
+	require.NoError(t, err)
+	defer crawlHost.Close()
+
+	require.NoError(t, r.spCrawlLoop(ctx, gw, crawlHost))
+	require.NoError(t, refreshGoodProviders(r.dealCfg.get())(r.db.db))
+
+	// the provider accepts the deal, fetches the data and publishes the deal
+	require.NoError(t, r.makeMoreDeals(ctx, group, r.host, r.wallet))
+
+	deals, err := r.db.GroupDeals(group)
+	require.NoError(t, err)
+	require.Len(t, deals, 1)
+	require.EqualValues(t, 1000, deals[0].Provider)
+
+	dealUUID := uuid.MustParse(deals[0].UUID)
+	require.Eventually(t, func() bool {
+		return sp.dealStates()[dealUUID] == simDealPublished
+	}, 30*time.Second, 50*time.Millisecond, "deal state: %s", sp.dealStates()[dealUUID])
+
+	// the deal tracker gets the publish message from the deal status
+	require.NoError(t, r.runDealCheckLoop(ctx))
+
+	deals, err = r.db.GroupDeals(group)
+	require.NoError(t, err)
+	require.Equal(t, simDealPublished, deals[0].Status)
+	require.NotEmpty(t, deals[0].PubCid)
+	require.Zero(t, deals[0].DealID)
+	require.NotZero(t, deals[0].TxSize)
+	require.Equal(t, deals[0].TxSize, deals[0].BytesRecv)
+
+	// published once the message is final
+	chain.advance(dealPublishFinality + 1)
+	require.NoError(t, r.runDealCheckLoop(ctx))
+
+	deals, err = r.db.GroupDeals(group)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, deals[0].DealID)
+	require.False(t, deals[0].Sealed)
+
+	// sealed with the sector number once the deal is active
+	require.NoError(t, sp.seal())
+	chain.advance(1)
+	require.NoError(t, r.runDealCheckLoop(ctx))
+
+	deals, err = r.db.GroupDeals(group)
+	require.NoError(t, err)
+	require.True(t, deals[0].Sealed)
+	require.False(t, deals[0].Failed)
+
+	var sector int64
+	require.NoError(t, r.db.db.QueryRow(`select sector_number from deals where uuid = ?`, dealUUID.String()).Scan(&sector))
+	require.EqualValues(t, 1, sector)
+}
+
+func TestDealFlowBadData(t *testing.T) {
+	ctx := context.Background()
+
+	chain := newSimChain(t)
+	sp := newSimProvider(t, chain, 1000)
+
+	r := openSimRibs(t, chain, func(cfg *iface.DealConfig) {
+		cfg.MinPieceSize = 256
+		cfg.TargetReplicaCount = 1
+		cfg.MinimumReplicaCount = 1
+	})
+
+	group := fillGroup(t, r)
+
+	gw, closer, err := client.NewGatewayRPCV1(ctx, chain.url, nil)
+	require.NoError(t, err)
+	defer closer()
+
+	require.NoError(t, r.spCrawlLoop(ctx, gw, r.host))
+	require.NoError(t, refreshGoodProviders(r.dealCfg.get())(r.db.db))
+
+	// the provider checks the data against the proposal piece
+	_, err = r.db.db.Exec(`update groups set commp = ? where id = ?`, make([]byte, 32), group)
+	require.NoError(t, err)
+
+	require.NoError(t, r.makeMoreDeals(ctx, group, r.host, r.wallet))
+
+	deals, err := r.db.GroupDeals(group)
+	require.NoError(t, err)
+	require.Len(t, deals, 1)
+
+	dealUUID := uuid.MustParse(deals[0].UUID)
+	require.Eventually(t, func() bool {
+		return sp.dealStates()[dealUUID] != simDealAccepted
+	}, 30*time.Second, 50*time.Millisecond)
+	require.Contains(t, sp.dealStates()[dealUUID], "commP mismatch")
+
+	sp.lk.Lock()
+	require.Nil(t, sp.deals[dealUUID].publishCid)
+	sp.lk.Unlock()
+
+	// only query the deal status, the full check loop would look for another
+	// provider in the background
+	inactive, err := r.db.InactiveDealsToCheck()
+	require.NoError(t, err)
+	require.Len(t, inactive, 1)
+	require.NoError(t, r.runDealCheckQuery(ctx, gw, inactive[0]))
+
+	deals, err = r.db.GroupDeals(group)
+	require.NoError(t, err)
+	require.True(t, deals[0].Failed)
+	require.Contains(t, deals[0].Error, "commP mismatch")
+}
@@ -6,56 +6,85 @@ import (
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/builtin"
 	"github.com/filecoin-project/lotus/chain/types"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/rbstor"
 )
 
 const mFil = 1_000_000_000_000_000
 
-var (
-	maxVerifPrice float64 = 0
+// defaultDealConfig returns deal policy used when not overridden in the config
+// file, environment or open options, see deal_config.go
+func defaultDealConfig() iface.DealConfig {
+	return iface.DealConfig{
+		MaxVerifPrice: 0,
 
-	// 2 mFil/gib/mo is roughly cloud cost currently
-	maxPrice float64 = (1 * mFil) / 2 / 60 / 24 / 30.436875
+		// 2 mFil/gib/mo is roughly cloud cost currently
+		MaxPrice: (1 * mFil) / 2 / 60 / 24 / 30.436875,
 
-	// piece size range ribs is aiming for
-	minPieceSize = 32 << 30
-	maxPieceSize = 64 << 30
+		MinPieceSize: 32 << 30,
+		MaxPieceSize: 64 << 30,
 
-	dealPublishFinality abi.ChainEpoch = 60
+		AggregateMaxWait: iface.Duration(24 * time.Hour),
 
-	dealStartTime = abi.ChainEpoch(builtin.EpochsInDay * 4) // 4 days
-)
+		DealStartTime: abi.ChainEpoch(builtin.EpochsInDay * 4), // 4 days
+		RenewBefore:   abi.ChainEpoch(builtin.EpochsInDay * 30),
 
-// deal checker
-const clientReadDeadline = 10 * time.Second
-const clientWriteDeadline = 10 * time.Second
+		MinimumReplicaCount: 5,
+		TargetReplicaCount:  10,
 
-var DealCheckInterval = 10 * time.Second
-var ParallelDealChecks = 10
+		MinDatacap: types.NewInt(192 << 30),
 
-var minDatacap = types.NewInt(192 << 30)
+		MinTransferMbps:    8,    // at 10 Mbps, a 32 GiB piece takes ~7 hours to transfer
+		LinkSpeedMbps:      1000, // 1 Gbps
+		MaxTransferRetries: 10,
 
-var (
-	minimumReplicaCount = 5
-	targetReplicaCount  = 10
-)
+		TransferIdleTimeout: iface.Duration(5 * time.Minute),
 
-// market wallet management
-var walletUpgradeInterval = time.Minute
+		MinMarketBalance:  types.NewInt(100_000_000_000_000_000),   // 100 mFIL
+		AutoMarketBalance: types.NewInt(1_000_000_000_000_000_000), // 1 FIL
+
+		MaxLocalGroupCount: rbstor.DefaultMaxLocalGroupCount,
+
+		MaxReplicasPerSP: 1,
+		DistinctPeerIDs:  true,
 
-var minMarketBalance = types.NewInt(100_000_000_000_000_000)    // 100 mFIL
-var autoMarketBalance = types.NewInt(1_000_000_000_000_000_000) // 1 FIL
+		ScoreHalfLife: iface.Duration(14 * 24 * time.Hour),
+		ScoreWeights: iface.ScoreWeights{
+			DealSuccess: 3,
+			Acceptance:  1,
+			SealTime:    1,
+			Retrieval:   3,
+			TTFB:        1,
+			Price:       1,
+		},
 
-// deal transfers
+		MonthlyBudget: types.NewInt(0),
+		TotalBudget:   types.NewInt(0),
 
-// todo this definitely needs to be configurable by the user
-var minTransferMbps = 8  // at 10 Mbps, a 32 GiB piece takes ~7 hours to transfer
-var linkSpeedMbps = 1000 // 1 Gbps
+		MessageReplaceAfter: iface.Duration(20 * time.Minute),
+		MaxMessageFee:       types.NewInt(100_000_000_000_000_000), // 100 mFIL
 
-//lint:ignore U1000 To be revisited in the context of S3 offloading.
-var maxTransfers = linkSpeedMbps / minTransferMbps * 8 / 10 // 80% for safety margin
+		ClaimExtendInterval:    iface.Duration(24 * time.Hour),
+		ClaimExtendBatchSize:   1000,
+		ClaimExtendMaxMessages: 10,
+	}
+}
 
-// time the sp has to start the first transfer, and for data to not be flowing
-// also transfer rate check interval
-var transferIdleTimeout = 5 * time.Minute
+var dealPublishFinality abi.ChainEpoch = 60
 
-var maxTransferRetries = 10
+// offloaded groups with fewer retrievable deals are repaired, unless their
+// replication policy sets a different threshold
+const defaultRepairBelow = 3
+
+// default deal duration, unless set by the replication policy
+var defaultDealDuration = abi.ChainEpoch(530 * builtin.EpochsInDay)
+
+// deal checker
+const clientReadDeadline = 10 * time.Second
+const clientWriteDeadline = 10 * time.Second
+
+var DealCheckInterval = 10 * time.Second
+var ParallelDealChecks = 10
+
+// market wallet management
+var walletUpgradeInterval = time.Minute
@@ -0,0 +1,103 @@
+package rbdeal
+
+import (
+	"context"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api/client"
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+/*
+Deal renewal:
+
+Deals are counted towards the replica target of their group only while they
+will still be alive at the renewal horizon, RenewBefore epochs from the chain
+head. Once deals get close to their end epoch, groups drop below the target
+and get replacement deals, possibly with the same providers.
+
+Groups with data kept locally get the new deals from the deal tracker like
+any group below target. Offloaded groups are queued for reloading with repair
+workers first; the renewal planner below does that, and marks deals past their
+end epoch as expired.
+*/
+
+var renewalCheckInterval = time.Hour
+
+// renewalHorizon is the epoch at which deals must still be alive to count
+// towards the replica target
+func renewalHorizon(cfg iface.DealConfig, head abi.ChainEpoch) abi.ChainEpoch {
+	return head + cfg.RenewBefore
+}
+
+func (r *ribs) renewalPlanner() {
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-time.After(renewalCheckInterval):
+		}
+
+		if err := r.renewalCycle(context.TODO()); err != nil {
+			log.Errorw("renewal cycle failed", "error", err)
+		}
+	}
+}
+
+func (r *ribs) renewalCycle(ctx context.Context) error {
+	gw, closer, err := client.NewGatewayRPCV1(ctx, r.lotusRPCAddr, nil)
+	if err != nil {
+		return xerrors.Errorf("creating gateway rpc client: %w", err)
+	}
+	defer closer()
+
+	head, err := gw.ChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("getting chain head: %w", err)
+	}
+
+	ended, err := r.db.MarkEndedDeals(head.Height())
+	if err != nil {
+		return err
+	}
+	if ended > 0 {
+		log.Infow("marked ended deals", "deals", ended)
+	}
+
+	stats, err := r.db.GetGroupDealStats(renewalHorizon(r.dealCfg.get(), head.Height()))
+	if err != nil {
+		return xerrors.Errorf("getting group deal stats: %w", err)
+	}
+
+	groupPolicy, err := r.groupPolicies()
+	if err != nil {
+		return xerrors.Errorf("getting group policies: %w", err)
+	}
+
+	var queued int
+	for gid, gs := range stats {
+		if gs.State != iface.GroupStateOffloaded || gs.Expiring == 0 {
+			continue
+		}
+
+		live := gs.TotalDeals - gs.FailedDeals - gs.Unretrievable - gs.Expiring
+		if live >= int64(groupPolicy(gid).TargetReplicas) {
+			continue
+		}
+
+		if err := r.db.QueueRenewal(gid, gs.Retrievable); err != nil {
+			return err
+		}
+		queued++
+
+		log.Infow("queued group for renewal", "group", gid, "live", live, "expiring", gs.Expiring)
+	}
+
+	if queued > 0 {
+		log.Infow("renewal cycle", "queued", queued, "head", head.Height())
+	}
+
+	return nil
+}
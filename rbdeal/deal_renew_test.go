@@ -0,0 +1,132 @@
+package rbdeal
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	verifregtypes13 "github.com/filecoin-project/go-state-types/builtin/v13/verifreg"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/stretchr/testify/require"
+)
+
+// openRenewalFixture opens a db with an offloaded group holding sealed deals
+// activated at epoch 0: unverified "ending" with f01001 and verified
+// "verified" with f01002, both ending at 1000, and unverified "long" with
+// f01003 ending at 5000
+func openRenewalFixture(t *testing.T, cfgOpts ...func(*iface.DealConfig)) *ribsDB {
+	db := openFixtureDB(t, []fixtureProvider{
+		{id: 1001, peerID: "peer1"},
+		{id: 1002, peerID: "peer2"},
+		{id: 1003, peerID: "peer3"},
+	}, cfgOpts...)
+
+	_, err := db.db.Exec(`insert into groups (id, blocks, bytes, g_state, jb_recorded_head) values (1, 0, 0, ?, 0)`, iface.GroupStateOffloaded)
+	require.NoError(t, err)
+
+	addDeal := func(uuid string, sp int64, end abi.ChainEpoch, verified bool) {
+		_, err := db.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, price_afil_gib_epoch, verified, keep_unsealed,
+			start_epoch, end_epoch, signed_proposal_bytes, sealed, sector_start_epoch) values (?, 'f01', ?, 1, 0, ?, 1, 0, ?, x'', 1, 0)`, uuid, sp, verified, end)
+		require.NoError(t, err)
+	}
+
+	addDeal("ending", 1001, 1000, false)
+	addDeal("verified", 1002, 1000, true)
+	addDeal("long", 1003, 5000, false)
+
+	return db
+}
+
+func TestDealRenewal(t *testing.T) {
+	db := openRenewalFixture(t, func(cfg *iface.DealConfig) {
+		cfg.SendClaimExtensions = true
+	})
+
+	live, err := db.GetLiveDealCount(1, 500)
+	require.NoError(t, err)
+	require.Equal(t, 3, live)
+
+	// the unverified deal ending before the horizon doesn't count anymore,
+	// verified ones are kept alive by claim extension
+	live, err = db.GetLiveDealCount(1, 2000)
+	require.NoError(t, err)
+	require.Equal(t, 2, live)
+
+	// claims can't be extended past the max term
+	live, err = db.GetLiveDealCount(1, verifregtypes13.MaximumVerifiedAllocationTerm+1)
+	require.NoError(t, err)
+	require.Equal(t, 0, live)
+
+	// verified deals end too in groups with claim extension disabled
+	require.NoError(t, db.SetReplicationPolicy(iface.ReplicationPolicy{Name: "noext", TargetReplicas: 1, MinimumReplicas: 1, NoClaimExtension: true}))
+	require.NoError(t, db.SetGroupPolicy(1, "noext"))
+
+	live, err = db.GetLiveDealCount(1, 2000)
+	require.NoError(t, err)
+	require.Equal(t, 1, live)
+
+	stats, err := db.GetGroupDealStats(2000)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, stats[1].Expiring)
+
+	require.NoError(t, db.SetGroupPolicy(1, iface.DefaultPolicy))
+
+	stats, err = db.GetGroupDealStats(2000)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, stats[1].Expiring)
+	require.EqualValues(t, 3, stats[1].TotalDeals)
+
+	// providers with deals ending before the horizon can get a renewal deal
+	require.Equal(t, []int64{}, selectedIDsAt(t, db, 1, 500))
+	require.Equal(t, []int64{1001}, selectedIDsAt(t, db, 1, 2000))
+
+	require.NoError(t, db.QueueRenewal(1, stats[1].Retrievable))
+	require.NoError(t, db.QueueRenewal(1, stats[1].Retrievable))
+	rs, err := db.GetRepairStats()
+	require.NoError(t, err)
+	require.Equal(t, 1, rs.Total)
+
+	// ended deals are marked expired only once fully paid in the ledger
+	n, err := db.MarkEndedDeals(1500)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, n)
+
+	_, err = db.db.Exec(`update deals set ledger_paid_epoch = end_epoch`)
+	require.NoError(t, err)
+
+	n, err = db.MarkEndedDeals(1500)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, n)
+
+	stats, err = db.GetGroupDealStats(2000)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, stats[1].FailedDeals)
+	require.EqualValues(t, 0, stats[1].Expiring)
+}
+
+func TestDealRenewalNoExtensions(t *testing.T) {
+	// claim extensions aren't sent by default
+	db := openRenewalFixture(t)
+
+	// verified deals end like unverified ones
+	live, err := db.GetLiveDealCount(1, 2000)
+	require.NoError(t, err)
+	require.Equal(t, 1, live)
+
+	stats, err := db.GetGroupDealStats(2000)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, stats[1].Expiring)
+
+	require.Equal(t, []int64{1001, 1002}, selectedIDsAt(t, db, 1, 2000))
+
+	_, err = db.db.Exec(`update deals set ledger_paid_epoch = end_epoch`)
+	require.NoError(t, err)
+
+	n, err := db.MarkEndedDeals(1500)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, n)
+
+	stats, err = db.GetGroupDealStats(2000)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, stats[1].FailedDeals)
+	require.EqualValues(t, 0, stats[1].Expiring)
+}
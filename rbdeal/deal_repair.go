@@ -68,7 +68,7 @@ func (r *ribs) repairStep(ctx context.Context, workerID int) error {
 	var assigned *ribs2.GroupKey
 
 	if len(assignedGroups) == 0 {
-		if err := r.db.AddRepairsForLowRetrievableDeals(); err != nil {
+		if err := r.db.AddRepairsForLowRetrievableDeals(defaultRepairBelow); err != nil {
 			return xerrors.Errorf("AddRepairsForLowRetrievableDeals: %w", err)
 		}
 
@@ -181,9 +181,22 @@ func (r *ribs) fetchGroupHttp(ctx context.Context, workerID int, group ribs2.Gro
 		r.FetchSize = gm.CarSize
 	})
 
+	// aggregated groups are fetched as a range of the aggregate piece
+	agg, err := r.db.GroupAggregate(group)
+	if err != nil {
+		return xerrors.Errorf("failed to get group aggregate: %w", err)
+	}
+
+	var aggOffset int64
+	if agg != nil {
+		p, _ := agg.Piece(group)
+		aggOffset = int64(p.Offset.Unpadded())
+	}
+
 	type retrievalSource struct {
 		provider string
 		reqUrl   url.URL
+		offset   int64
 	}
 
 	var sources []retrievalSource
@@ -223,13 +236,19 @@ func (r *ribs) fetchGroupHttp(ctx context.Context, workerID int, group ribs2.Gro
 			continue
 		}
 
+		var offset int64
+		if candidate.AggregatePiece.Defined() {
+			offset = aggOffset
+		}
+
 		// start fetch into the file
 		reqUrl := *u
-		reqUrl.Path = path.Join(reqUrl.Path, "piece", gm.PieceCid.String())
+		reqUrl.Path = path.Join(reqUrl.Path, "piece", candidate.PieceCid(gm.PieceCid).String())
 
 		sources = append(sources, retrievalSource{
 			provider: fmt.Sprint(candidate.Provider),
 			reqUrl:   reqUrl,
+			offset:   offset,
 		})
 	}
 
@@ -244,7 +263,7 @@ func (r *ribs) fetchGroupHttp(ctx context.Context, workerID int, group ribs2.Gro
 
 		// make the request!!
 
-		robustReqReader := ributil.RobustGet(reqUrl.String(), gm.CarSize, func() *ributil.RateCounter {
+		robustReqReader := ributil.RobustGetRange(reqUrl.String(), candidate.offset, gm.CarSize, func() *ributil.RateCounter {
 			return r.repairFetchCounters.Get(group)
 		})
 
@@ -108,6 +108,13 @@ func (r *ribs) runDealCheckLoop(ctx context.Context) error {
 		}
 	}
 
+	/* DIRECT DEAL CHECKS */
+	/* Wait for allocations of direct deals to be claimed */
+
+	if err := r.checkClaimedDeals(ctx, gw); err != nil {
+		return err
+	}
+
 	/* PUBLISHING DEAL CHECKS */
 	/* Wait for publish at "good-enough" finality */
 
@@ -160,11 +167,6 @@ func (r *ribs) runDealCheckLoop(ctx context.Context) error {
 	/* PROPOSED DEAL CHECKS */
 	/* Mainly waiting to get publish deal cid */
 
-	walletAddr, err := r.wallet.GetDefault()
-	if err != nil {
-		return xerrors.Errorf("get wallet address: %w", err)
-	}
-
 	{
 		toCheck, err := r.db.InactiveDealsToCheck()
 		if err != nil {
@@ -187,7 +189,7 @@ func (r *ribs) runDealCheckLoop(ctx context.Context) error {
 				}()
 
 				ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
-				err := r.runDealCheckQuery(ctx, gw, walletAddr, deal)
+				err := r.runDealCheckQuery(ctx, gw, deal)
 				cancel()
 				if err != nil {
 					log.Warnw("deal check failed", "deal", deal.DealUUID, "provider", fmt.Sprintf("f0%d", deal.ProviderAddr), "error", err)
@@ -274,26 +276,46 @@ func (r *ribs) runDealCheckLoop(ctx context.Context) error {
 
 	/* deal count checks */
 
-	gs, err := r.db.GetGroupDealStats() // todo swap for GetNonFailedDealCount?
+	head, err := gw.ChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("get chain head: %w", err)
+	}
+
+	gs, err := r.db.GetGroupDealStats(renewalHorizon(r.dealCfg.get(), head.Height())) // todo swap for GetNonFailedDealCount?
 	if err != nil {
 		return xerrors.Errorf("getting storage groups: %w", err)
 	}
 
+	groupPolicy, err := r.groupPolicies()
+	if err != nil {
+		return xerrors.Errorf("getting group policies: %w", err)
+	}
+
 	for gid, gs := range gs {
 		if gs.State != ribs2.GroupStateLocalReadyForDeals {
 			continue
 		}
 
-		if gs.TotalDeals-gs.FailedDeals-gs.Unretrievable < int64(targetReplicaCount) {
+		if gs.TotalDeals-gs.FailedDeals-gs.Unretrievable-gs.Expiring < int64(groupPolicy(gid).TargetReplicas) {
 			go func(gid ribs2.GroupKey) {
 				err := r.makeMoreDeals(context.TODO(), gid, r.host, r.wallet)
 				if err != nil {
 					log.Errorf("starting new deals: %s", err)
 				}
 			}(gid)
-		} else if gs.Retrievable >= int64(minimumReplicaCount) {
+		} else if gs.Retrievable >= int64(groupPolicy(gid).MinimumReplicas) {
+			// aggregate transfers are tracked under the aggregate lead group
+			uploadGroup := gid
+			agg, err := r.db.GroupAggregate(gid)
+			if err != nil {
+				return xerrors.Errorf("get group aggregate: %w", err)
+			}
+			if agg != nil {
+				uploadGroup = agg.Lead()
+			}
+
 			upStat := r.CarUploadStats().ByGroup
-			if upStat[gid] == nil {
+			if upStat[uploadGroup] == nil {
 				log.Errorw("OFFLOAD GROUP", "group", gid)
 
 				if err := r.Storage().Offload(ctx, gid); err != nil {
@@ -305,7 +327,7 @@ func (r *ribs) runDealCheckLoop(ctx context.Context) error {
 					return xerrors.Errorf("cleaning up S3 offload: %w", err)
 				}
 			} else {
-				log.Errorw("NOT OFFLOADING GROUP yet", "group", gid, "retrievable", gs.Retrievable, "uploads", upStat[gid].ActiveRequests)
+				log.Errorw("NOT OFFLOADING GROUP yet", "group", gid, "retrievable", gs.Retrievable, "uploads", upStat[uploadGroup].ActiveRequests)
 			}
 		}
 	}
@@ -313,7 +335,13 @@ func (r *ribs) runDealCheckLoop(ctx context.Context) error {
 	return nil
 }
 
-func (r *ribs) runDealCheckQuery(ctx context.Context, gw api.Gateway, walletAddr address.Address, deal inactiveDealMeta) error {
+func (r *ribs) runDealCheckQuery(ctx context.Context, gw api.Gateway, deal inactiveDealMeta) error {
+	// status requests are signed by the client which made the deal
+	walletAddr, err := address.NewFromString(deal.ClientAddr)
+	if err != nil {
+		return xerrors.Errorf("parse client address: %w", err)
+	}
+
 	maddr, err := address.NewIDAddress(uint64(deal.ProviderAddr))
 	if err != nil {
 		return xerrors.Errorf("new id address: %w", err)
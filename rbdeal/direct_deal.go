@@ -0,0 +1,177 @@
+package rbdeal
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	datacaptypes "github.com/filecoin-project/go-state-types/builtin/v13/datacap"
+	markettypes "github.com/filecoin-project/go-state-types/builtin/v13/market"
+	verifregtypes "github.com/filecoin-project/go-state-types/builtin/v13/verifreg"
+	"github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/build"
+	"github.com/filecoin-project/lotus/chain/actors"
+	"github.com/filecoin-project/lotus/chain/actors/builtin/datacap"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+/*
+Direct deals:
+
+EXPERIMENTAL. With ExperimentalDirectDeals set in the deal config, verified
+deals of groups with a DirectDeals policy are made through direct data
+onboarding, without the market actor. The client wallet transfers datacap to
+the verified registry, creating an allocation of the group piece to the
+provider, and sends the provider a DirectDealParams proposal with the
+allocation id and the usual transfer params over DirectDealProtocolv100. The
+provider fetches the data, and claims the allocation when it commits the
+piece to a sector, which the deal tracker picks up as the deal being sealed.
+
+DirectDealProtocolv100 is a ribs protocol, not a boost one. No mainstream
+storage provider serves it: boost only onboards direct data offline, with
+boostd import-direct, so online direct deals only work with providers running
+a handler for this protocol. Providers not serving it are skipped like
+providers not serving DealProtocolv120.
+
+Direct deals are stored in the deals table with direct = 1 and the
+allocation id. start_epoch is the allocation expiration, deals with
+allocations not claimed by then fail like unsealed market deals.
+*/
+
+// DirectDealProtocolv100 is the experimental ribs direct deal protocol. No
+// mainstream storage provider serves it, see the direct deals notes above.
+const DirectDealProtocolv100 = "/fil/storage/direct/1.0.0"
+
+// allocationRequest returns the verified registry allocation of a piece to a
+// provider for a direct deal, claimable until expiration
+func allocationRequest(prov abi.ActorID, piece cid.Cid, size abi.PaddedPieceSize, expiration abi.ChainEpoch, duration abi.ChainEpoch) verifregtypes.AllocationRequest {
+	return verifregtypes.AllocationRequest{
+		Provider:   prov,
+		Data:       piece,
+		Size:       size,
+		TermMin:    duration,
+		TermMax:    duration + markettypes.MarketDefaultAllocationTermBuffer, // same as allocations of verified market deals
+		Expiration: expiration,
+	}
+}
+
+// allocationMessage returns the datacap transfer message creating allocations
+func allocationMessage(client address.Address, reqs ...verifregtypes.AllocationRequest) (*types.Message, error) {
+	dcap := big.Zero()
+	for _, req := range reqs {
+		dcap = big.Add(dcap, big.NewInt(int64(req.Size)))
+	}
+
+	ops, err := actors.SerializeParams(&verifregtypes.AllocationRequests{
+		Allocations: reqs,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("serializing allocation requests: %w", err)
+	}
+
+	params, err := actors.SerializeParams(&datacaptypes.TransferParams{
+		To:           builtin.VerifiedRegistryActorAddr,
+		Amount:       big.Mul(dcap, builtin.TokenPrecision),
+		OperatorData: ops,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("serializing transfer params: %w", err)
+	}
+
+	return &types.Message{
+		To:     builtin.DatacapActorAddr,
+		From:   client,
+		Method: datacap.Methods.TransferExported,
+		Params: params,
+		Value:  big.Zero(),
+	}, nil
+}
+
+// allocationIDs decodes ids of allocations created by a datacap transfer
+func allocationIDs(ret []byte) ([]verifregtypes.AllocationId, error) {
+	var tr datacaptypes.TransferReturn
+	if err := tr.UnmarshalCBOR(bytes.NewReader(ret)); err != nil {
+		return nil, xerrors.Errorf("decoding transfer return: %w", err)
+	}
+
+	var ar verifregtypes.AllocationsResponse
+	if err := ar.UnmarshalCBOR(bytes.NewReader(tr.RecipientData)); err != nil {
+		return nil, xerrors.Errorf("decoding allocations response: %w", err)
+	}
+
+	return ar.NewAllocations, nil
+}
+
+// allocate creates a verified registry allocation from the client wallet, and
+// waits for it to land on chain
+func (r *ribs) allocate(ctx context.Context, gw api.Gateway, client address.Address, req verifregtypes.AllocationRequest) (verifregtypes.AllocationId, error) {
+	m, err := allocationMessage(client, req)
+	if err != nil {
+		return 0, err
+	}
+
+	c, err := r.sendMessage(ctx, gw, m, msgPurposeAllocate, big.Zero())
+	if err != nil {
+		return 0, xerrors.Errorf("sending allocation message: %w", err)
+	}
+
+	log.Infow("sent allocation message", "cid", c, "provider", req.Provider, "piece", req.Data)
+
+	lookup, err := gw.StateWaitMsg(ctx, c, build.MessageConfidence, api.LookbackNoLimit, true)
+	if err != nil {
+		return 0, xerrors.Errorf("waiting for allocation message %s: %w", c, err)
+	}
+	if lookup.Receipt.ExitCode != exitcode.Ok {
+		return 0, xerrors.Errorf("allocation message %s failed: exit %s", c, lookup.Receipt.ExitCode)
+	}
+
+	ids, err := allocationIDs(lookup.Receipt.Return)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) != 1 {
+		return 0, xerrors.Errorf("expected 1 new allocation, got %d", len(ids))
+	}
+
+	return ids[0], nil
+}
+
+// checkClaimedDeals marks direct deals with claimed allocations as sealed.
+// Claims have the id of the allocation they were made from.
+func (r *ribs) checkClaimedDeals(ctx context.Context, gw api.Gateway) error {
+	toCheck, err := r.db.AllocatedDeals()
+	if err != nil {
+		return xerrors.Errorf("get allocated deals: %w", err)
+	}
+
+	for _, deal := range toCheck {
+		maddr, err := address.NewIDAddress(uint64(deal.ProviderAddr))
+		if err != nil {
+			return xerrors.Errorf("new id address: %w", err)
+		}
+
+		claim, err := gw.StateGetClaim(ctx, maddr, verifreg.ClaimId(deal.AllocationID), types.EmptyTSK)
+		if err != nil {
+			log.Warnw("get claim", "error", err, "allocation", deal.AllocationID, "deal", deal.DealUUID)
+			continue
+		}
+		if claim == nil {
+			// not claimed yet, unclaimed deals expire with MarkExpiredDeals
+			continue
+		}
+
+		if err := r.db.UpdateClaimedDeal(deal.DealUUID, claim.TermStart, claim.Sector); err != nil {
+			return xerrors.Errorf("marking deal as claimed: %w", err)
+		}
+		log.Infow("direct deal claimed", "deal", deal.DealUUID, "allocation", deal.AllocationID, "sector", claim.Sector, "termstart", claim.TermStart)
+	}
+
+	return nil
+}
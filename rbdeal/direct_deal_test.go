@@ -0,0 +1,160 @@
+package rbdeal
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	datacaptypes "github.com/filecoin-project/go-state-types/builtin/v13/datacap"
+	verifregtypes "github.com/filecoin-project/go-state-types/builtin/v13/verifreg"
+	"github.com/filecoin-project/go-state-types/builtin/v9/verifreg"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/actors"
+	"github.com/filecoin-project/lotus/chain/types"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/stretchr/testify/require"
+)
+
+type claimGateway struct {
+	api.Gateway
+
+	claims map[verifreg.ClaimId]*verifreg.Claim
+}
+
+func (g *claimGateway) StateGetClaim(ctx context.Context, prov address.Address, id verifreg.ClaimId, tsk types.TipSetKey) (*verifreg.Claim, error) {
+	return g.claims[id], nil
+}
+
+func TestAllocationMessage(t *testing.T) {
+	piece, err := commcid.PieceCommitmentV1ToCID(make([]byte, 32))
+	require.NoError(t, err)
+
+	client, _ := address.NewIDAddress(100)
+	req := allocationRequest(1000, piece, 32<<30, 5000, minDealDuration)
+
+	m, err := allocationMessage(client, req)
+	require.NoError(t, err)
+	require.Equal(t, builtin.DatacapActorAddr, m.To)
+
+	var tp datacaptypes.TransferParams
+	require.NoError(t, tp.UnmarshalCBOR(bytes.NewReader(m.Params)))
+	require.Equal(t, builtin.VerifiedRegistryActorAddr, tp.To)
+	require.Equal(t, big.Mul(big.NewInt(32<<30), builtin.TokenPrecision), tp.Amount)
+
+	var reqs verifregtypes.AllocationRequests
+	require.NoError(t, reqs.UnmarshalCBOR(bytes.NewReader(tp.OperatorData)))
+	require.Equal(t, []verifregtypes.AllocationRequest{req}, reqs.Allocations)
+	require.Equal(t, minDealDuration, req.TermMin)
+	require.Greater(t, req.TermMax, req.TermMin)
+
+	// allocation ids come back in the verifreg response inside the transfer return
+	ar, err := actors.SerializeParams(&verifregtypes.AllocationsResponse{
+		AllocationResults: verifregtypes.BatchReturn{SuccessCount: 1},
+		NewAllocations:    []verifregtypes.AllocationId{7},
+	})
+	require.NoError(t, err)
+
+	ret, err := actors.SerializeParams(&datacaptypes.TransferReturn{
+		FromBalance:   big.Zero(),
+		ToBalance:     big.Zero(),
+		RecipientData: ar,
+	})
+	require.NoError(t, err)
+
+	ids, err := allocationIDs(ret)
+	require.NoError(t, err)
+	require.Equal(t, []verifregtypes.AllocationId{7}, ids)
+}
+
+func TestDirectDealTracking(t *testing.T) {
+	db := openFixtureDB(t, nil)
+
+	_, err := db.db.Exec(`insert into groups (id, blocks, bytes, g_state, jb_recorded_head) values (1, 0, 0, ?, 0)`, iface.GroupStateLocalReadyForDeals)
+	require.NoError(t, err)
+
+	for _, d := range []dbDealInfo{
+		{DealUUID: "market", GroupID: 1, ClientAddr: "f0100", ProviderAddr: 1000, Verified: true, StartEpoch: 100, EndEpoch: 1000},
+		{DealUUID: "direct", GroupID: 1, ClientAddr: "f0100", ProviderAddr: 1000, Verified: true, StartEpoch: 100, EndEpoch: 1000, Direct: true},
+	} {
+		require.NoError(t, db.StoreDealProposal(d))
+		require.NoError(t, db.StoreSuccessfullyProposedDeal(d))
+	}
+
+	// direct deals aren't queried with the boost deal status protocol
+	inactive, err := db.InactiveDealsToCheck()
+	require.NoError(t, err)
+	require.Len(t, inactive, 1)
+	require.Equal(t, "market", inactive[0].DealUUID)
+
+	// not tracked until the allocation is made
+	allocated, err := db.AllocatedDeals()
+	require.NoError(t, err)
+	require.Empty(t, allocated)
+
+	require.NoError(t, db.SetDealAllocation("direct", 7))
+
+	allocated, err = db.AllocatedDeals()
+	require.NoError(t, err)
+	require.Equal(t, []directDealMeta{{DealUUID: "direct", ProviderAddr: 1000, AllocationID: 7}}, allocated)
+
+	r := &ribs{db: db, dealCfg: db.dealCfg}
+	gw := &claimGateway{claims: map[verifreg.ClaimId]*verifreg.Claim{}}
+
+	// not claimed yet
+	require.NoError(t, r.checkClaimedDeals(context.Background(), gw))
+
+	allocated, err = db.AllocatedDeals()
+	require.NoError(t, err)
+	require.Len(t, allocated, 1)
+
+	gw.claims[7] = &verifreg.Claim{Provider: 1000, Client: 100, TermStart: 150, Sector: 42}
+	require.NoError(t, r.checkClaimedDeals(context.Background(), gw))
+
+	allocated, err = db.AllocatedDeals()
+	require.NoError(t, err)
+	require.Empty(t, allocated)
+
+	deals, err := db.GroupDeals(1)
+	require.NoError(t, err)
+	require.Len(t, deals, 2)
+
+	for _, d := range deals {
+		switch d.UUID {
+		case "direct":
+			require.True(t, d.Direct)
+			require.True(t, d.Sealed)
+			require.EqualValues(t, 7, d.AllocationID)
+		case "market":
+			require.False(t, d.Direct)
+			require.False(t, d.Sealed)
+		}
+	}
+
+	var sector abi.SectorNumber
+	var termStart abi.ChainEpoch
+	require.NoError(t, db.db.QueryRow(`select sector_number, sector_start_epoch from deals where uuid = 'direct'`).Scan(&sector, &termStart))
+	require.EqualValues(t, 42, sector)
+	require.EqualValues(t, 150, termStart)
+
+	// direct deals are configured per policy
+	require.NoError(t, db.SetReplicationPolicy(iface.ReplicationPolicy{Name: "ddo", TargetReplicas: 1, MinimumReplicas: 1, DirectDeals: true}))
+	pols, err := db.ReplicationPolicies()
+	require.NoError(t, err)
+	require.True(t, pols["ddo"].DirectDeals)
+
+	require.Error(t, validatePolicy(iface.ReplicationPolicy{Name: "x", TargetReplicas: 1, MinimumReplicas: 1, DirectDeals: true, Verification: iface.DealVerificationUnverified}))
+
+	// direct deal policies can only be set with the experimental flag
+	ddo := iface.ReplicationPolicy{Name: "ddo2", TargetReplicas: 1, MinimumReplicas: 1, DirectDeals: true}
+	require.ErrorContains(t, r.Policies().SetPolicy(ddo), "ExperimentalDirectDeals")
+
+	cfg := db.dealCfg.get()
+	cfg.ExperimentalDirectDeals = true
+	db.dealCfg.cur.Store(&cfg)
+	require.NoError(t, r.Policies().SetPolicy(ddo))
+}
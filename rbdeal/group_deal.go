@@ -16,11 +16,11 @@ import (
 	"github.com/filecoin-project/go-state-types/builtin/v9/market"
 	"github.com/filecoin-project/lotus/api"
 	"github.com/filecoin-project/lotus/api/client"
-	"github.com/filecoin-project/lotus/chain/actors/builtin"
 	ctypes "github.com/filecoin-project/lotus/chain/types"
 	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	iface "github.com/lotus-web3/ribs"
 	"github.com/lotus-web3/ribs/ributil"
 	types "github.com/lotus-web3/ribs/ributil/boosttypes"
@@ -37,12 +37,46 @@ func (e ErrRejected) Error() string {
 	return fmt.Sprintf("deal proposal rejected: %s", e.Reason)
 }
 
-func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, h host.Host, w *ributil.LocalWallet) error {
+func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, h host.Host, w ributil.Signer) error {
+	return r.makeGroupDeals(ctx, id, h, w, 0)
+}
+
+// makeGroupDeals makes deals for a group until it has enough live deals. When
+// provider is set, one deal is made with that provider regardless of the
+// replica target, and errors are returned instead of logged.
+func (r *ribs) makeGroupDeals(ctx context.Context, id iface.GroupKey, h host.Host, w ributil.Signer, provider int64) error {
+	manual := provider != 0
+
+	// groups packed into an aggregate piece get deals for the aggregate, which
+	// are tracked under the aggregate lead group
+	agg, err := r.db.GroupAggregate(id)
+	if err != nil {
+		return xerrors.Errorf("get group aggregate: %w", err)
+	}
+	if agg == nil && r.aggregatePieces {
+		waiting, err := r.maybeAggregate(ctx, id)
+		if err != nil {
+			return xerrors.Errorf("aggregating group: %w", err)
+		}
+		if waiting {
+			if manual {
+				return xerrors.Errorf("group %d is waiting for aggregation", id)
+			}
+			return nil
+		}
+	}
+	if agg != nil {
+		id = agg.Lead()
+	}
+
 	r.dealsLk.Lock()
 	if _, ok := r.moreDealsLocks[id]; ok {
 		r.dealsLk.Unlock()
 
 		// another goroutine is already making deals for this group
+		if manual {
+			return xerrors.Errorf("deals are already being made for group %d, retry later", id)
+		}
 		return nil
 	}
 	r.moreDealsLocks[id] = struct{}{}
@@ -54,57 +88,117 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, h host.Host
 		r.dealsLk.Unlock()
 	}()
 
-	if err := r.maybeEnsureS3Offload(id); err != nil {
-		return xerrors.Errorf("attempting s3 offload: %w", err)
+	cfg := r.dealCfg.get()
+
+	pol, err := r.groupPolicy(id)
+	if err != nil {
+		return xerrors.Errorf("get group policy: %w", err)
+	}
+
+	var dealInfo dealParams
+	var aggID *int64
+
+	if agg != nil {
+		// aggregates are always served from local group data
+		local, err := r.db.AggregateLocal(agg.ID)
+		if err != nil {
+			return xerrors.Errorf("checking aggregate data: %w", err)
+		}
+		if !local {
+			// the aggregate piece can only be rebuilt with data of all its
+			// groups, so reload every offloaded one, not just the group
+			// which needed deals
+			queued, err := r.db.QueueAggregateReload(agg.ID)
+			if err != nil {
+				return xerrors.Errorf("queueing aggregate groups for reload: %w", err)
+			}
+			if manual {
+				return xerrors.Errorf("some groups of aggregate %d were offloaded, queued %d for reloading", agg.ID, queued)
+			}
+			log.Warnw("not making aggregate deals, some groups were offloaded", "aggregate", agg.ID, "queuedReloads", queued)
+			return nil
+		}
+
+		dealInfo, err = agg.dealParams()
+		if err != nil {
+			return xerrors.Errorf("get aggregate deal params: %w", err)
+		}
+		aggID = &agg.ID
+	} else {
+		if err := r.maybeEnsureS3Offload(id); err != nil {
+			return xerrors.Errorf("attempting s3 offload: %w", err)
+		}
+
+		dealInfo, err = r.db.GetDealParams(ctx, id)
+		if err != nil {
+			return xerrors.Errorf("get deal params: %w", err)
+		}
 	}
 
-	dealInfo, err := r.db.GetDealParams(ctx, id)
+	gw, closer, err := client.NewGatewayRPCV1(ctx, r.lotusRPCAddr, nil)
 	if err != nil {
-		return xerrors.Errorf("get deal params: %w", err)
+		return xerrors.Errorf("creating gateway rpc client: %w", err)
+	}
+	defer closer()
+
+	head, err := gw.ChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("getting chain head: %w", err)
 	}
 
-	notFailed, err := r.db.GetNonFailedDealCount(id)
+	// deals ending soon are being replaced, don't count them
+	horizon := renewalHorizon(cfg, head.Height())
+
+	notFailed, err := r.db.GetLiveDealCount(id, horizon)
 	if err != nil {
 		log.Errorf("getting non-failed deal count: %s", err)
 		return xerrors.Errorf("getting non-failed deal count: %w", err)
 	}
 
-	if notFailed >= targetReplicaCount {
+	if notFailed >= pol.TargetReplicas && !manual {
 		// occasionally in some racy cases we can end up here
 		return nil
 	}
 
-	gw, closer, err := client.NewGatewayRPCV1(ctx, r.lotusRPCAddr, nil)
+	wallets, err := r.Wallets()
 	if err != nil {
-		return xerrors.Errorf("creating gateway rpc client: %w", err)
+		return xerrors.Errorf("getting client wallets: %w", err)
 	}
-	defer closer()
 
-	walletAddr, err := w.GetDefault()
+	client, verified, err := selectClientWallet(wallets, pol.Verification, cfg.MinDatacap)
 	if err != nil {
-		return xerrors.Errorf("get wallet address: %w", err)
+		return xerrors.Errorf("not starting deals with policy %s: %w", pol.Name, err)
 	}
 
-	vc, err := gw.StateVerifiedClientStatus(ctx, walletAddr, ctypes.EmptyTSK)
+	walletAddr, err := address.NewFromString(client.Addr)
 	if err != nil {
-		return xerrors.Errorf("getting verified client status: %w", err)
+		return xerrors.Errorf("parsing client address: %w", err)
 	}
 
-	verified := false
-	maxToPay := maxPrice
+	maxToPay := cfg.MaxPrice
+	if pol.MaxPrice != nil {
+		maxToPay = *pol.MaxPrice
+	}
 
-	if vc != nil {
-		if vc.LessThan(minDatacap) {
-			return xerrors.Errorf("not starting additional verified deals: datacap too low (%s, min %s)", ctypes.SizeStr(*vc), ctypes.SizeStr(minDatacap))
+	if verified {
+		maxToPay = cfg.MaxVerifPrice
+		if pol.MaxVerifPrice != nil {
+			maxToPay = *pol.MaxVerifPrice
 		}
-
-		maxToPay = maxVerifPrice
-		verified = true
 	}
 
-	provs, err := r.db.SelectDealProviders(id, dealInfo.PieceSize, verified, maxToPay)
-	if err != nil {
-		return xerrors.Errorf("select deal providers: %w", err)
+	var provs []dealProvider
+	if manual {
+		prov, err := r.db.ManualDealProvider(id, provider, dealInfo.PieceSize, verified, maxToPay, horizon)
+		if err != nil {
+			return err
+		}
+		provs = []dealProvider{prov}
+	} else {
+		provs, err = r.db.SelectDealProviders(id, dealInfo.PieceSize, verified, maxToPay, pol, horizon)
+		if err != nil {
+			return xerrors.Errorf("select deal providers: %w", err)
+		}
 	}
 
 	pieceCid, err := commcid.PieceCommitmentV1ToCID(dealInfo.CommP)
@@ -112,6 +206,13 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, h host.Host
 		return fmt.Errorf("failed to convert commP to cid: %w", err)
 	}
 
+	// direct deals only exist for verified data, and are made only while
+	// the experimental direct deal protocol is enabled
+	direct := verified && pol.DirectDeals && cfg.ExperimentalDirectDeals
+	if verified && pol.DirectDeals && !direct {
+		log.Warnw("policy wants direct deals, but ExperimentalDirectDeals is off; making market deals", "group", id, "policy", pol.Name)
+	}
+
 	makeDealWith := func(prov dealProvider) error {
 		// check proposal params
 		maddr, err := address.NewIDAddress(uint64(prov.id))
@@ -124,25 +225,20 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, h host.Host
 			return xerrors.Errorf("get addr info: %w", err)
 		}
 
-		var providerCollateral abi.TokenAmount
-
-		bounds, err := gw.StateDealProviderCollateralBounds(ctx, abi.PaddedPieceSize(dealInfo.PieceSize), verified, ctypes.EmptyTSK)
-		if err != nil {
-			return fmt.Errorf("node error getting collateral bounds: %w", err)
-		}
-		providerCollateral = big.Div(big.Mul(bounds.Min, big.NewInt(6)), big.NewInt(5)) // add 20%
-
 		head, err := gw.ChainHead(ctx)
 		if err != nil {
 			return fmt.Errorf("getting chain head: %w", err)
 		}
 
-		startEpoch := head.Height() + dealStartTime
+		startEpoch := head.Height() + cfg.DealStartTime
 
 		// generate proposal
 		dealUuid := uuid.New()
 
-		duration := 530 * builtin.EpochsInDay
+		duration := int(defaultDealDuration)
+		if pol.DealDuration != 0 {
+			duration = int(pol.DealDuration)
+		}
 
 		pricef := gobig.NewFloat(prov.ask_price)
 		if verified {
@@ -150,20 +246,38 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, h host.Host
 		}
 
 		price := big.Zero()
-		pricef.Int(price.Int)
-
-		dealProposal, err := dealProposal(ctx, w, walletAddr, dealInfo.Root, abi.PaddedPieceSize(dealInfo.PieceSize), pieceCid, maddr, startEpoch, duration, verified, providerCollateral, price)
-		if err != nil {
-			return fmt.Errorf("failed to create a deal proposal: %w", err)
+		if !direct {
+			// direct deals aren't paid through the market
+			pricef.Int(price.Int)
 		}
 
+		var proposal *market.ClientDealProposal
 		var proposalBuf bytes.Buffer
-		if err := dealProposal.MarshalCBOR(&proposalBuf); err != nil {
-			return fmt.Errorf("failed to marshal deal proposal: %w", err)
+
+		if !direct {
+			bounds, err := gw.StateDealProviderCollateralBounds(ctx, abi.PaddedPieceSize(dealInfo.PieceSize), verified, ctypes.EmptyTSK)
+			if err != nil {
+				return fmt.Errorf("node error getting collateral bounds: %w", err)
+			}
+			providerCollateral := big.Div(big.Mul(bounds.Min, big.NewInt(6)), big.NewInt(5)) // add 20%
+
+			proposal, err = dealProposal(ctx, w, walletAddr, dealInfo.Root, abi.PaddedPieceSize(dealInfo.PieceSize), pieceCid, maddr, startEpoch, duration, verified, providerCollateral, price)
+			if err != nil {
+				return fmt.Errorf("failed to create a deal proposal: %w", err)
+			}
+
+			if err := proposal.MarshalCBOR(&proposalBuf); err != nil {
+				return fmt.Errorf("failed to marshal deal proposal: %w", err)
+			}
 		}
 
 		// generate transfer token
-		reqToken, err := r.makeCarRequestToken(context.TODO(), id, time.Hour*36, dealInfo.CarSize, dealUuid)
+		var tokenAgg int64
+		if aggID != nil {
+			tokenAgg = *aggID
+		}
+
+		reqToken, err := r.makeCarRequestToken(context.TODO(), id, tokenAgg, time.Hour*36, dealInfo.CarSize, dealUuid)
 		if err != nil {
 			return xerrors.Errorf("make car request token: %w", err)
 		}
@@ -184,14 +298,6 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, h host.Host
 			Size:   uint64(dealInfo.CarSize),
 		}
 
-		dealParams := types.DealParams{
-			DealUUID:           dealUuid,
-			ClientDealProposal: *dealProposal,
-			DealDataRoot:       dealInfo.Root,
-			IsOffline:          false,
-			Transfer:           transfer,
-		}
-
 		di := dbDealInfo{
 			DealUUID:            dealUuid.String(),
 			GroupID:             id,
@@ -203,9 +309,17 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, h host.Host
 			StartEpoch:          startEpoch,
 			EndEpoch:            startEpoch + abi.ChainEpoch(duration),
 			SignedProposalBytes: proposalBuf.Bytes(),
+			AggregateID:         aggID,
+			Direct:              direct,
 		}
 
-		err = r.db.StoreDealProposal(di)
+		err = r.withinBudget(head.Height(), liveDeal{
+			epochPrice: dealEpochPrice(price, dealInfo.PieceSize),
+			start:      di.StartEpoch,
+			end:        di.EndEpoch,
+		}, func() error {
+			return r.db.StoreDealProposal(di)
+		})
 		if err != nil {
 			return fmt.Errorf("saving deal info: %w", err)
 		}
@@ -229,7 +343,12 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, h host.Host
 			return xerrors.Errorf("connect to miner: %w", err)
 		}
 
-		x, err := h.Peerstore().FirstSupportedProtocol(addrInfo.ID, DealProtocolv120)
+		proto := protocol.ID(DealProtocolv120)
+		if direct {
+			proto = DirectDealProtocolv100
+		}
+
+		x, err := h.Peerstore().FirstSupportedProtocol(addrInfo.ID, proto)
 		if err != nil {
 			err = r.db.StoreRejectedDeal(di.DealUUID, fmt.Sprintf("failed to connect to miner: %s", err), 0)
 			if err != nil {
@@ -240,7 +359,7 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, h host.Host
 		}
 
 		if len(x) == 0 {
-			err := fmt.Errorf("boost client cannot make a deal with storage provider %s because it does not support protocol version 1.2.0", maddr)
+			err := fmt.Errorf("boost client cannot make a deal with storage provider %s because it does not support protocol %s", maddr, proto)
 
 			if err := r.db.StoreRejectedDeal(di.DealUUID, err.Error(), 0); err != nil {
 				return fmt.Errorf("saving rejected deal info: %w", err)
@@ -249,9 +368,47 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, h host.Host
 			return err
 		}
 
+		var req interface{}
+		if direct {
+			// the provider can only claim an existing allocation. Datacap of
+			// allocations of rejected deals can be reclaimed once they expire.
+			alloc, err := r.allocate(ctx, gw, walletAddr, allocationRequest(abi.ActorID(prov.id), pieceCid, abi.PaddedPieceSize(dealInfo.PieceSize), startEpoch, abi.ChainEpoch(duration)))
+			if err != nil {
+				if err := r.db.StoreRejectedDeal(di.DealUUID, xerrors.Errorf("allocating datacap: %w", err).Error(), 0); err != nil {
+					return fmt.Errorf("saving rejected deal info: %w", err)
+				}
+
+				return xerrors.Errorf("allocating datacap: %w", err)
+			}
+
+			if err := r.db.SetDealAllocation(di.DealUUID, uint64(alloc)); err != nil {
+				return err
+			}
+
+			req = &types.DirectDealParams{
+				DealUUID:     dealUuid,
+				AllocationID: uint64(alloc),
+				PieceCid:     pieceCid,
+				ClientAddr:   walletAddr,
+				StartEpoch:   di.StartEpoch,
+				EndEpoch:     di.EndEpoch,
+				PieceSize:    abi.PaddedPieceSize(dealInfo.PieceSize),
+				DealDataRoot: dealInfo.Root,
+				Transfer:     transfer,
+			}
+		} else {
+			req = &types.DealParams{
+				DealUUID:           dealUuid,
+				ClientDealProposal: *proposal,
+				DealDataRoot:       dealInfo.Root,
+				IsOffline:          false,
+				Transfer:           transfer,
+			}
+		}
+
 		// MAKE THE DEAL
 
-		s, err := h.NewStream(ctx, addrInfo.ID, DealProtocolv120)
+		s, err := h.NewStream(ctx, addrInfo.ID, proto)
 		if err != nil {
 			err = r.db.StoreRejectedDeal(di.DealUUID, xerrors.Errorf("opening deal proposal stream: %w", err).Error(), 0)
 			if err != nil {
@@ -263,7 +420,7 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, h host.Host
 		defer s.Close()
 
 		var resp types.DealResponse
-		if err := doRpc(ctx, s, &dealParams, &resp); err != nil {
+		if err := doRpc(ctx, s, req, &resp); err != nil {
 			err = r.db.StoreRejectedDeal(di.DealUUID, xerrors.Errorf("sending deal proposal rpc: %w", err).Error(), 0)
 			if err != nil {
 				return fmt.Errorf("saving rejected deal info: %w", err)
@@ -285,18 +442,22 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, h host.Host
 			return xerrors.Errorf("marking deal as successfully proposed: %w", err)
 		}
 
-		log.Warnf("Deal %s with %s accepted for group %d!!!", dealUuid, maddr, id)
+		log.Warnf("Deal %s with %s accepted for group %d!!! (direct: %t)", dealUuid, maddr, id, direct)
 
 		return nil
 	}
 
+	if manual {
+		return makeDealWith(provs[0])
+	}
+
 	// make deals with candidates
 	for _, prov := range provs {
 		err := makeDealWith(prov)
 		if err == nil {
 			notFailed++
 
-			if notFailed >= targetReplicaCount {
+			if notFailed >= pol.TargetReplicas {
 				// enough
 				break
 			}
@@ -315,7 +476,7 @@ func (r *ribs) makeMoreDeals(ctx context.Context, id iface.GroupKey, h host.Host
 	return nil
 }
 
-func dealProposal(ctx context.Context, w *ributil.LocalWallet, clientAddr address.Address, rootCid cid.Cid, pieceSize abi.PaddedPieceSize, pieceCid cid.Cid, minerAddr address.Address, startEpoch abi.ChainEpoch, duration int, verified bool, providerCollateral abi.TokenAmount, storagePrice abi.TokenAmount) (*market.ClientDealProposal, error) {
+func dealProposal(ctx context.Context, w ributil.Signer, clientAddr address.Address, rootCid cid.Cid, pieceSize abi.PaddedPieceSize, pieceCid cid.Cid, minerAddr address.Address, startEpoch abi.ChainEpoch, duration int, verified bool, providerCollateral abi.TokenAmount, storagePrice abi.TokenAmount) (*market.ClientDealProposal, error) {
 	endEpoch := startEpoch + abi.ChainEpoch(duration)
 	// deal proposal expects total storage price for deal per epoch, therefore we
 	// multiply pieceSize * storagePrice (which is set per epoch per GiB) and divide by 2^30
@@ -0,0 +1,289 @@
+package rbdeal
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/api/client"
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+var ledgerInterval = 10 * time.Minute
+
+// deal payments are accrued in chunks of this many epochs, matching how often
+// the market actor settles them
+const ledgerPaymentEpochs = budgetMonthEpochs
+
+func (r *ribs) ledgerWatcher() {
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-time.After(ledgerInterval):
+		}
+
+		if err := r.ledgerCycle(context.TODO()); err != nil {
+			log.Errorw("ledger cycle failed", "error", err)
+		}
+	}
+}
+
+func (r *ribs) ledgerCycle(ctx context.Context) error {
+	gw, closer, err := client.NewGatewayRPCV1(ctx, r.lotusRPCAddr, nil)
+	if err != nil {
+		return xerrors.Errorf("creating gateway rpc client: %w", err)
+	}
+	defer closer()
+
+	head, err := gw.ChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("getting chain head: %w", err)
+	}
+
+	if err := r.db.LedgerDeals(head.Height()); err != nil {
+		return xerrors.Errorf("recording deals: %w", err)
+	}
+
+	return nil
+}
+
+// ledgerDeal is the ledger accounting state of a deal
+type ledgerDeal struct {
+	uuid     string
+	group    iface.GroupKey
+	provider int64
+
+	epochPrice abi.TokenAmount
+	start, end abi.ChainEpoch
+
+	published, sealed, failed bool
+
+	locked, unlocked bool
+	paidEpoch        abi.ChainEpoch
+}
+
+type ledgerDealEntry struct {
+	kind   iface.LedgerKind
+	amount abi.TokenAmount
+}
+
+// ledgerDealUpdate returns ledger entries due for a deal at head, and its
+// updated accounting state
+func ledgerDealUpdate(head abi.ChainEpoch, d ledgerDeal) ([]ledgerDealEntry, ledgerDeal) {
+	var out []ledgerDealEntry
+	price := func(from, to abi.ChainEpoch) abi.TokenAmount {
+		return big.Mul(d.epochPrice, big.NewInt(int64(to-from)))
+	}
+
+	if d.published && !d.locked {
+		out = append(out, ledgerDealEntry{kind: iface.LedgerDealLock, amount: price(d.start, d.end)})
+		d.locked = true
+	}
+	if !d.locked {
+		return out, d
+	}
+
+	paidFrom := d.start
+	if d.paidEpoch > paidFrom {
+		paidFrom = d.paidEpoch
+	}
+
+	switch {
+	case d.failed && !d.unlocked:
+		if paidFrom < d.end {
+			out = append(out, ledgerDealEntry{kind: iface.LedgerDealUnlock, amount: price(paidFrom, d.end)})
+		}
+		d.unlocked = true
+	case d.sealed && !d.failed:
+		upTo := head
+		if upTo > d.end {
+			upTo = d.end
+		}
+		if upTo > paidFrom && (upTo-paidFrom >= ledgerPaymentEpochs || upTo == d.end) {
+			out = append(out, ledgerDealEntry{kind: iface.LedgerDealPayment, amount: price(paidFrom, upTo)})
+			d.paidEpoch = upTo
+		}
+	}
+
+	return out, d
+}
+
+// LedgerDeals records escrow locks, unlocks and payments of deals due at head
+func (r *ribsDB) LedgerDeals(head abi.ChainEpoch) error {
+	rows, err := r.db.Query(`select d.uuid, d.group_id, d.provider_addr, d.price_afil_gib_epoch, d.start_epoch, d.end_epoch,
+			coalesce(a.piece_size, g.piece_size, 0), d.published, d.sealed, d.failed, d.ledger_locked, d.ledger_unlocked, d.ledger_paid_epoch
+		from deals d
+		left join aggregates a on a.id = d.aggregate_id
+		left join groups g on g.id = d.group_id
+		where (d.published = 1 and d.ledger_locked = 0)
+		   or (d.ledger_locked = 1 and d.failed = 1 and d.ledger_unlocked = 0)
+		   or (d.ledger_locked = 1 and d.sealed = 1 and d.failed = 0 and d.ledger_paid_epoch < d.end_epoch)`)
+	if err != nil {
+		return xerrors.Errorf("querying deals: %w", err)
+	}
+
+	var deals []ledgerDeal
+	for rows.Next() {
+		var d ledgerDeal
+		var price, pieceSize int64
+		if err := rows.Scan(&d.uuid, &d.group, &d.provider, &price, &d.start, &d.end, &pieceSize,
+			&d.published, &d.sealed, &d.failed, &d.locked, &d.unlocked, &d.paidEpoch); err != nil {
+			_ = rows.Close()
+			return xerrors.Errorf("scanning deal: %w", err)
+		}
+		d.epochPrice = dealEpochPrice(abi.NewTokenAmount(price), pieceSize)
+		deals = append(deals, d)
+	}
+	if err := rows.Err(); err != nil {
+		return xerrors.Errorf("iterating deals: %w", err)
+	}
+	_ = rows.Close()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return xerrors.Errorf("begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	for _, d := range deals {
+		entries, nd := ledgerDealUpdate(head, d)
+		if nd == d {
+			continue
+		}
+
+		for _, e := range entries {
+			if _, err := tx.Exec(`insert into ledger (kind, amount, group_id, provider, deal_uuid) values (?, ?, ?, ?, ?)`,
+				e.kind, e.amount.String(), d.group, d.provider, d.uuid); err != nil {
+				return xerrors.Errorf("inserting deal entry: %w", err)
+			}
+		}
+
+		if _, err := tx.Exec(`update deals set ledger_locked = ?, ledger_unlocked = ?, ledger_paid_epoch = ? where uuid = ?`,
+			nd.locked, nd.unlocked, nd.paidEpoch, d.uuid); err != nil {
+			return xerrors.Errorf("updating deal ledger state: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *ribsDB) LedgerEntries(before int64, limit int) ([]iface.LedgerEntry, error) {
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+
+	rows, err := r.db.Query(`select id, ts, kind, amount, note, coalesce(msg_cid, ''), coalesce(group_id, 0), coalesce(provider, 0), coalesce(deal_uuid, '')
+		from ledger where id < ? order by id desc limit ?`, before, limit)
+	if err != nil {
+		return nil, xerrors.Errorf("querying ledger: %w", err)
+	}
+	defer rows.Close()
+
+	var out []iface.LedgerEntry
+	for rows.Next() {
+		var e iface.LedgerEntry
+		var amt string
+		if err := rows.Scan(&e.ID, &e.Time, &e.Kind, &amt, &e.Note, &e.MsgCid, &e.Group, &e.Provider, &e.DealUUID); err != nil {
+			return nil, xerrors.Errorf("scanning ledger entry: %w", err)
+		}
+		if e.Amount, err = big.FromString(amt); err != nil {
+			return nil, xerrors.Errorf("parsing amount: %w", err)
+		}
+		out = append(out, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating ledger: %w", err)
+	}
+
+	return out, nil
+}
+
+// Querier is satisfied by *sql.DB
+type Querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// LedgerSummary sums ledger entries in a ribs db by group, provider or month
+func LedgerSummary(db Querier, by iface.LedgerGrouping) ([]iface.LedgerSummary, error) {
+	var key string
+	switch by {
+	case iface.LedgerByGroup:
+		key = `coalesce(cast(group_id as text), '')`
+	case iface.LedgerByProvider:
+		key = `coalesce(cast(provider as text), '')`
+	case iface.LedgerByMonth:
+		key = `strftime('%Y-%m', ts, 'unixepoch')`
+	default:
+		return nil, xerrors.Errorf("unknown ledger grouping %q", by)
+	}
+
+	rows, err := db.Query(`select ` + key + `, kind, amount from ledger`)
+	if err != nil {
+		return nil, xerrors.Errorf("querying ledger: %w", err)
+	}
+	defer rows.Close()
+
+	sums := map[string]*iface.LedgerSummary{}
+	for rows.Next() {
+		var k, amt string
+		var kind iface.LedgerKind
+		if err := rows.Scan(&k, &kind, &amt); err != nil {
+			return nil, xerrors.Errorf("scanning ledger entry: %w", err)
+		}
+		a, err := big.FromString(amt)
+		if err != nil {
+			return nil, xerrors.Errorf("parsing amount: %w", err)
+		}
+
+		s, ok := sums[k]
+		if !ok {
+			s = &iface.LedgerSummary{Key: k, Amounts: map[iface.LedgerKind]abi.TokenAmount{}, Cost: big.Zero()}
+			sums[k] = s
+		}
+
+		if cur, ok := s.Amounts[kind]; ok {
+			s.Amounts[kind] = big.Add(cur, a)
+		} else {
+			s.Amounts[kind] = a
+		}
+		if kind == iface.LedgerGas || kind == iface.LedgerDealPayment {
+			s.Cost = big.Add(s.Cost, a)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating ledger: %w", err)
+	}
+
+	out := make([]iface.LedgerSummary, 0, len(sums))
+	for _, s := range sums {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		// numeric keys in numeric order
+		ki, erri := strconv.ParseInt(out[i].Key, 10, 64)
+		kj, errj := strconv.ParseInt(out[j].Key, 10, 64)
+		if erri == nil && errj == nil {
+			return ki < kj
+		}
+		return out[i].Key < out[j].Key
+	})
+
+	return out, nil
+}
+
+func (r *ribs) LedgerEntries(before int64, limit int) ([]iface.LedgerEntry, error) {
+	return r.db.LedgerEntries(before, limit)
+}
+
+func (r *ribs) LedgerSummary(by iface.LedgerGrouping) ([]iface.LedgerSummary, error) {
+	return LedgerSummary(r.db.db, by)
+}
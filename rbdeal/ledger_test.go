@@ -0,0 +1,60 @@
+package rbdeal
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLedgerDeals(t *testing.T) {
+	db := openFixtureDB(t, nil)
+
+	// 1GiB aggregate piece at 10 attoFIL/GiB/epoch
+	_, err := db.db.Exec(`insert into aggregates (id, piece_cid, piece_size) values (1, x'00', ?)`, int64(1<<30))
+	require.NoError(t, err)
+
+	end := 1000 + 3*ledgerPaymentEpochs
+	addDeal := func(uuid string, provider int64) {
+		_, err := db.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, price_afil_gib_epoch, verified, keep_unsealed,
+			start_epoch, end_epoch, signed_proposal_bytes, aggregate_id, published) values (?, 'f01', ?, 1, 10, 0, 1, 1000, ?, x'', 1, 1)`,
+			uuid, provider, end)
+		require.NoError(t, err)
+	}
+	addDeal("sealed", 1000)
+	addDeal("failed", 1001)
+
+	price := func(epochs int64) abi.TokenAmount { return big.NewInt(10 * epochs) }
+
+	require.NoError(t, db.LedgerDeals(500))
+
+	_, err = db.db.Exec(`update deals set sealed = 1 where uuid = 'sealed'`)
+	require.NoError(t, err)
+	_, err = db.db.Exec(`update deals set failed = 1 where uuid = 'failed'`)
+	require.NoError(t, err)
+
+	// payments accrue in whole chunks
+	require.NoError(t, db.LedgerDeals(1000+ledgerPaymentEpochs+10))
+	require.NoError(t, db.LedgerDeals(1000+ledgerPaymentEpochs+20))
+	require.NoError(t, db.LedgerDeals(abi.ChainEpoch(end+100)))
+
+	sums, err := LedgerSummary(db.db, iface.LedgerByProvider)
+	require.NoError(t, err)
+	require.Len(t, sums, 2)
+
+	require.Equal(t, "1000", sums[0].Key)
+	require.Equal(t, price(3*ledgerPaymentEpochs), sums[0].Amounts[iface.LedgerDealLock])
+	require.Equal(t, price(3*ledgerPaymentEpochs), sums[0].Amounts[iface.LedgerDealPayment])
+	require.Equal(t, price(3*ledgerPaymentEpochs), sums[0].Cost)
+
+	require.Equal(t, "1001", sums[1].Key)
+	require.Equal(t, price(3*ledgerPaymentEpochs), sums[1].Amounts[iface.LedgerDealUnlock])
+	require.True(t, sums[1].Cost.IsZero())
+
+	entries, err := db.LedgerEntries(0, 100)
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+	require.Equal(t, iface.LedgerDealPayment, entries[0].Kind)
+}
@@ -0,0 +1,103 @@
+package rbdeal
+
+import (
+	"context"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+)
+
+// Messages are sent from the ribs wallet by one sender at a time. Callers take
+// msgSendLk, then prepare a message with a nonce and gas params with
+// estimateMessage, and sign and push it with pushMessage. sendMessage does
+// all of it for messages which don't need looking at gas estimates. Pushed
+// messages are tracked by the message watcher, which replaces them with higher
+// fees when they get stuck.
+
+// sendMessage estimates gas for, signs and pushes a message. purpose and amount
+// are recorded for the spend ledger.
+func (r *ribs) sendMessage(ctx context.Context, gw api.Gateway, m *types.Message, purpose string, amount abi.TokenAmount) (cid.Cid, error) {
+	r.msgSendLk.Lock()
+	defer r.msgSendLk.Unlock()
+
+	m, err := r.estimateMessage(ctx, gw, m)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return r.pushMessage(ctx, gw, m, purpose, amount)
+}
+
+// estimateMessage assigns the next nonce of the sender and gas params to a
+// message. msgSendLk must be held until the message is pushed.
+func (r *ribs) estimateMessage(ctx context.Context, gw api.Gateway, m *types.Message) (*types.Message, error) {
+	nonce, err := gw.MpoolGetNonce(ctx, m.From)
+	if err != nil {
+		return nil, xerrors.Errorf("getting nonce: %w", err)
+	}
+
+	// the gateway may not see our most recent messages yet
+	if next, ok := r.nextNonce[m.From]; ok && next > nonce {
+		nonce = next
+	}
+
+	m.Nonce = nonce
+
+	em, err := gw.GasEstimateMessageGas(ctx, m, nil, types.EmptyTSK)
+	if err != nil {
+		return nil, xerrors.Errorf("estimating message gas: %w", err)
+	}
+
+	return em, nil
+}
+
+// pushMessage signs and pushes a message prepared with estimateMessage, and
+// tracks it until it lands. msgSendLk must be held.
+func (r *ribs) pushMessage(ctx context.Context, gw api.Gateway, m *types.Message, purpose string, amount abi.TokenAmount) (cid.Cid, error) {
+	sm, err := r.signAndPush(ctx, gw, m)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	if r.nextNonce == nil {
+		r.nextNonce = map[address.Address]uint64{}
+	}
+	r.nextNonce[m.From] = m.Nonce + 1
+
+	if err := r.db.TrackMessage(sm, purpose, amount); err != nil {
+		log.Errorw("tracking sent message", "cid", sm.Cid(), "purpose", purpose, "error", err)
+	}
+
+	return sm.Cid(), nil
+}
+
+func (r *ribs) signAndPush(ctx context.Context, gw api.Gateway, m *types.Message) (*types.SignedMessage, error) {
+	mb, err := m.ToStorageBlock()
+	if err != nil {
+		return nil, xerrors.Errorf("serializing message: %w", err)
+	}
+
+	// remote signers check the serialized message against the signed cid
+	sig, err := r.wallet.WalletSign(ctx, m.From, mb.Cid().Bytes(), api.MsgMeta{
+		Type:  api.MTChainMsg,
+		Extra: mb.RawData(),
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("signing message: %w", err)
+	}
+
+	sm := &types.SignedMessage{
+		Message:   *m,
+		Signature: *sig,
+	}
+
+	if _, err := gw.MpoolPush(ctx, sm); err != nil {
+		return nil, xerrors.Errorf("pushing message: %w", err)
+	}
+
+	return sm, nil
+}
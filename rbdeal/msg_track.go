@@ -0,0 +1,393 @@
+package rbdeal
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"math"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/client"
+	"github.com/filecoin-project/lotus/chain/types"
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+var messageCheckInterval = time.Minute
+
+// messages not found on chain this long after first sending are dropped
+const messageDropTimeout = 7 * 24 * time.Hour
+
+// replacements must raise the gas premium by at least this many percent, the
+// lotus mpool default
+const replaceByFeePercent = 125
+
+// purposes of sent messages, besides the fund-moving ledger kinds
+const (
+	msgPurposeClaimExtend = "claim_extend"
+	msgPurposeAllocate    = "allocate"
+)
+
+const (
+	msgStatePending = iota
+	msgStateLanded
+	msgStateDropped
+)
+
+// trackedMessage is a sent message waiting to land
+type trackedMessage struct {
+	id      int64
+	purpose string
+	amount  abi.TokenAmount
+
+	sm *types.SignedMessage
+
+	sentAt, pushedAt time.Time
+	replaced         int
+}
+
+func (r *ribs) messageWatcher() {
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-time.After(messageCheckInterval):
+		}
+
+		if err := r.messageCycle(context.TODO()); err != nil {
+			log.Errorw("message cycle failed", "error", err)
+		}
+	}
+}
+
+func (r *ribs) messageCycle(ctx context.Context) error {
+	msgs, err := r.db.PendingMessages()
+	if err != nil {
+		return err
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	gw, closer, err := client.NewGatewayRPCV1(ctx, r.lotusRPCAddr, nil)
+	if err != nil {
+		return xerrors.Errorf("creating gateway rpc client: %w", err)
+	}
+	defer closer()
+
+	cfg := r.dealCfg.get()
+
+	for _, m := range msgs {
+		if err := r.checkMessage(ctx, gw, cfg, m); err != nil {
+			log.Errorw("checking sent message", "id", m.id, "cid", m.sm.Cid(), "purpose", m.purpose, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// checkMessage records a message which landed, or replaces it with higher
+// fees if it's been waiting in the mpool for too long
+func (r *ribs) checkMessage(ctx context.Context, gw api.Gateway, cfg iface.DealConfig, m trackedMessage) error {
+	// before searching, so that a message landing in between isn't dropped
+	act, err := gw.StateGetActor(ctx, m.sm.Message.From, types.EmptyTSK)
+	if err != nil {
+		return xerrors.Errorf("getting sender actor: %w", err)
+	}
+
+	lookup, err := gw.StateSearchMsg(ctx, types.EmptyTSK, m.sm.Cid(), api.LookbackNoLimit, true)
+	if err != nil {
+		return xerrors.Errorf("searching message: %w", err)
+	}
+	if lookup != nil {
+		// the landed message may be an earlier version with different gas params
+		msg, err := gw.ChainGetMessage(ctx, lookup.Message)
+		if err != nil {
+			return xerrors.Errorf("getting message %s: %w", lookup.Message, err)
+		}
+
+		ts, err := gw.ChainGetTipSet(ctx, lookup.TipSet)
+		if err != nil {
+			return xerrors.Errorf("getting execution tipset: %w", err)
+		}
+
+		gas := messageGasCost(lookup.Receipt.GasUsed, msg.GasLimit, ts.Blocks()[0].ParentBaseFee, msg.GasFeeCap, msg.GasPremium)
+
+		return r.db.LandMessage(m, lookup, gas)
+	}
+
+	if time.Since(m.sentAt) > messageDropTimeout {
+		return r.db.DropMessage(m.id, "not found on chain")
+	}
+
+	if act.Nonce > m.sm.Message.Nonce {
+		// a different message landed with our nonce
+		return r.db.DropMessage(m.id, "nonce used by another message")
+	}
+
+	if time.Since(m.pushedAt) < time.Duration(cfg.MessageReplaceAfter) {
+		return nil
+	}
+
+	old := m.sm.Message
+	nm := old
+	nm.GasFeeCap, nm.GasPremium = big.Zero(), big.Zero()
+
+	// gas limit is kept, only fee params are estimated
+	est, err := gw.GasEstimateMessageGas(ctx, &nm, nil, types.EmptyTSK)
+	if err != nil {
+		return xerrors.Errorf("estimating replacement gas: %w", err)
+	}
+
+	nm.GasPremium, nm.GasFeeCap, err = replacementGas(old, est.GasPremium, est.GasFeeCap, cfg.MaxMessageFee)
+	if err != nil {
+		return err
+	}
+
+	// not under msgSendLk: replacements keep their nonce, and senders holding
+	// the lock may be waiting for this message to land
+	sm, err := r.signAndPush(ctx, gw, &nm)
+	if err != nil {
+		return xerrors.Errorf("pushing replacement: %w", err)
+	}
+
+	log.Warnw("replaced stuck message", "old", m.sm.Cid(), "new", sm.Cid(), "purpose", m.purpose,
+		"premium", nm.GasPremium, "feecap", nm.GasFeeCap)
+
+	return r.db.ReplaceMessage(m.id, sm)
+}
+
+// replacementGas returns gas premium and fee cap for a replacement of old,
+// given estimates for the current network conditions
+func replacementGas(old types.Message, estPremium, estFeeCap, maxFee abi.TokenAmount) (premium, feeCap abi.TokenAmount, err error) {
+	minPremium := big.Add(big.Div(big.Mul(old.GasPremium, big.NewInt(replaceByFeePercent)), big.NewInt(100)), big.NewInt(1))
+
+	premium = big.Max(estPremium, minPremium)
+	feeCap = big.Max(big.Max(estFeeCap, old.GasFeeCap), premium)
+
+	if maxFeeCap := big.Div(maxFee, big.NewInt(old.GasLimit)); feeCap.GreaterThan(maxFeeCap) {
+		feeCap = maxFeeCap
+	}
+	if premium.GreaterThan(feeCap) {
+		return premium, feeCap, xerrors.Errorf("replacement would exceed max message fee %s", types.FIL(maxFee))
+	}
+
+	return premium, feeCap, nil
+}
+
+// messageGasCost returns what the sender paid for gas of an executed message:
+// base fee burn, over-estimation burn and the miner tip
+func messageGasCost(gasUsed, gasLimit int64, baseFee, feeCap, premium abi.TokenAmount) abi.TokenAmount {
+	baseFeeToPay := baseFee
+	if baseFee.GreaterThan(feeCap) {
+		baseFeeToPay = feeCap
+	}
+
+	tip := big.Min(premium, big.Sub(feeCap, baseFeeToPay))
+	if tip.LessThan(big.Zero()) {
+		tip = big.Zero()
+	}
+
+	// gas over-estimation, as in the vm
+	const overuseNum, overuseDenom = 11, 10
+	var burned int64
+	switch {
+	case gasUsed == 0:
+		burned = gasLimit
+	default:
+		over := gasLimit - (overuseNum*gasUsed)/overuseDenom
+		if over > gasUsed {
+			over = gasUsed
+		}
+		if over > 0 {
+			burned = big.Div(big.Mul(big.NewInt(gasLimit-gasUsed), big.NewInt(over)), big.NewInt(gasUsed)).Int64()
+		}
+	}
+
+	return big.Sum(
+		big.Mul(baseFeeToPay, big.NewInt(gasUsed)),
+		big.Mul(baseFeeToPay, big.NewInt(burned)),
+		big.Mul(tip, big.NewInt(gasLimit)),
+	)
+}
+
+// TrackMessage stores a pushed message to be watched until it lands. amount is
+// FIL moved by the message.
+func (r *ribsDB) TrackMessage(sm *types.SignedMessage, purpose string, amount abi.TokenAmount) error {
+	b, err := sm.Serialize()
+	if err != nil {
+		return xerrors.Errorf("serializing message: %w", err)
+	}
+
+	_, err = r.db.Exec(`insert into messages (from_addr, nonce, purpose, amount, msg_cid, signed_msg) values (?, ?, ?, ?, ?, ?)`,
+		sm.Message.From.String(), sm.Message.Nonce, purpose, amount.String(), sm.Cid().String(), b)
+	if err != nil {
+		return xerrors.Errorf("tracking message: %w", err)
+	}
+	return nil
+}
+
+func (r *ribsDB) PendingMessages() ([]trackedMessage, error) {
+	rows, err := r.db.Query(`select id, purpose, amount, signed_msg, sent_at, pushed_at, replaced from messages where state = ?`, msgStatePending)
+	if err != nil {
+		return nil, xerrors.Errorf("querying pending messages: %w", err)
+	}
+	defer rows.Close()
+
+	var out []trackedMessage
+	for rows.Next() {
+		var m trackedMessage
+		var amt string
+		var smb []byte
+		var sentAt, pushedAt int64
+		if err := rows.Scan(&m.id, &m.purpose, &amt, &smb, &sentAt, &pushedAt, &m.replaced); err != nil {
+			return nil, xerrors.Errorf("scanning pending message: %w", err)
+		}
+
+		if m.amount, err = big.FromString(amt); err != nil {
+			return nil, xerrors.Errorf("parsing message amount: %w", err)
+		}
+
+		m.sm = new(types.SignedMessage)
+		if err := m.sm.UnmarshalCBOR(bytes.NewReader(smb)); err != nil {
+			return nil, xerrors.Errorf("decoding message %d: %w", m.id, err)
+		}
+
+		m.sentAt, m.pushedAt = time.Unix(sentAt, 0), time.Unix(pushedAt, 0)
+
+		out = append(out, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating pending messages: %w", err)
+	}
+
+	return out, nil
+}
+
+// ReplaceMessage records a pushed replacement of a message
+func (r *ribsDB) ReplaceMessage(id int64, sm *types.SignedMessage) error {
+	b, err := sm.Serialize()
+	if err != nil {
+		return xerrors.Errorf("serializing message: %w", err)
+	}
+
+	_, err = r.db.Exec(`update messages set msg_cid = ?, signed_msg = ?, pushed_at = strftime('%s','now'), replaced = replaced + 1 where id = ?`,
+		sm.Cid().String(), b, id)
+	if err != nil {
+		return xerrors.Errorf("updating replaced message: %w", err)
+	}
+	return nil
+}
+
+func (r *ribsDB) DropMessage(id int64, reason string) error {
+	_, err := r.db.Exec(`update messages set state = ?, error = ? where id = ?`, msgStateDropped, reason, id)
+	if err != nil {
+		return xerrors.Errorf("dropping message: %w", err)
+	}
+	return nil
+}
+
+// LandMessage records the receipt of a message which landed, with gas it paid
+// and funds it moved in the ledger
+func (r *ribsDB) LandMessage(m trackedMessage, lookup *api.MsgLookup, gas abi.TokenAmount) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return xerrors.Errorf("begin: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.Exec(`update messages set state = ?, exec_cid = ?, exec_height = ?, exit_code = ?, gas_used = ?, gas_cost = ? where id = ?`,
+		msgStateLanded, lookup.Message.String(), lookup.Height, lookup.Receipt.ExitCode, lookup.Receipt.GasUsed, gas.String(), m.id); err != nil {
+		return xerrors.Errorf("updating message: %w", err)
+	}
+
+	if _, err := tx.Exec(`insert into ledger (kind, amount, note, msg_cid) values (?, ?, ?, ?)`,
+		iface.LedgerGas, gas.String(), m.purpose, lookup.Message.String()); err != nil {
+		return xerrors.Errorf("inserting gas entry: %w", err)
+	}
+
+	switch iface.LedgerKind(m.purpose) {
+	case iface.LedgerMarketAdd, iface.LedgerMarketWithdraw, iface.LedgerWithdraw:
+		if lookup.Receipt.ExitCode.IsSuccess() && !m.amount.IsZero() {
+			if _, err := tx.Exec(`insert into ledger (kind, amount, note, msg_cid) values (?, ?, ?, ?)`,
+				m.purpose, m.amount.String(), m.purpose, lookup.Message.String()); err != nil {
+				return xerrors.Errorf("inserting funds entry: %w", err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *ribsDB) Messages(before int64, limit int) ([]iface.MessageInfo, error) {
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+
+	rows, err := r.db.Query(`select id, from_addr, nonce, purpose, amount, msg_cid, sent_at, pushed_at, replaced, state,
+			exec_cid, exec_height, exit_code, gas_used, gas_cost, error
+		from messages where id < ? order by id desc limit ?`, before, limit)
+	if err != nil {
+		return nil, xerrors.Errorf("querying messages: %w", err)
+	}
+	defer rows.Close()
+
+	var out []iface.MessageInfo
+	for rows.Next() {
+		var m iface.MessageInfo
+		var amt string
+		var state int
+		var execCid, gasCost, errStr sql.NullString
+		var execHeight, exitCode, gasUsed sql.NullInt64
+
+		if err := rows.Scan(&m.ID, &m.From, &m.Nonce, &m.Purpose, &amt, &m.Cid, &m.SentAt, &m.PushedAt, &m.Replaced, &state,
+			&execCid, &execHeight, &exitCode, &gasUsed, &gasCost, &errStr); err != nil {
+			return nil, xerrors.Errorf("scanning message: %w", err)
+		}
+
+		if m.Amount, err = big.FromString(amt); err != nil {
+			return nil, xerrors.Errorf("parsing amount: %w", err)
+		}
+
+		switch state {
+		case msgStatePending:
+			m.State = iface.MessagePending
+		case msgStateLanded:
+			m.State = iface.MessageLanded
+			if exitCode.Int64 != 0 {
+				m.State = iface.MessageFailed
+			}
+		case msgStateDropped:
+			m.State = iface.MessageDropped
+		}
+
+		m.ExecCid = execCid.String
+		m.ExecHeight = abi.ChainEpoch(execHeight.Int64)
+		m.ExitCode = exitCode.Int64
+		m.GasUsed = gasUsed.Int64
+		m.Error = errStr.String
+
+		m.GasCost = big.Zero()
+		if gasCost.Valid {
+			if m.GasCost, err = big.FromString(gasCost.String); err != nil {
+				return nil, xerrors.Errorf("parsing gas cost: %w", err)
+			}
+		}
+
+		out = append(out, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating messages: %w", err)
+	}
+
+	return out, nil
+}
+
+func (r *ribs) Messages(before int64, limit int) ([]iface.MessageInfo, error) {
+	return r.db.Messages(before, limit)
+}
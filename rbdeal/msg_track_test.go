@@ -0,0 +1,157 @@
+package rbdeal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageGasCost(t *testing.T) {
+	// no over-estimation burn within 10% of gas used
+	require.Equal(t, big.NewInt(100*1000+10*1050), messageGasCost(1000, 1050, big.NewInt(100), big.NewInt(200), big.NewInt(10)))
+
+	// limit at twice the usage burns the over-estimated gas
+	require.Equal(t, big.NewInt(100*1000+100*900+10*2000), messageGasCost(1000, 2000, big.NewInt(100), big.NewInt(200), big.NewInt(10)))
+
+	// fee cap below the base fee pays no tip
+	require.Equal(t, big.NewInt(50*1000), messageGasCost(1000, 1000, big.NewInt(100), big.NewInt(50), big.NewInt(10)))
+}
+
+func TestReplacementGas(t *testing.T) {
+	old := types.Message{GasLimit: 1000, GasPremium: big.NewInt(100), GasFeeCap: big.NewInt(500)}
+
+	// premium bumped at least by the replace-by-fee ratio
+	premium, feeCap, err := replacementGas(old, big.NewInt(50), big.NewInt(400), big.NewInt(1_000_000))
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(126), premium)
+	require.Equal(t, big.NewInt(500), feeCap)
+
+	// or to the current estimate
+	premium, feeCap, err = replacementGas(old, big.NewInt(300), big.NewInt(800), big.NewInt(1_000_000))
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(300), premium)
+	require.Equal(t, big.NewInt(800), feeCap)
+
+	// fee cap limited by the max fee
+	premium, feeCap, err = replacementGas(old, big.NewInt(300), big.NewInt(800), big.NewInt(600_000))
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(300), premium)
+	require.Equal(t, big.NewInt(600), feeCap)
+
+	_, _, err = replacementGas(old, big.NewInt(300), big.NewInt(800), big.NewInt(200_000))
+	require.Error(t, err)
+}
+
+func TestTrackMessage(t *testing.T) {
+	db := openFixtureDB(t, nil)
+
+	from, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+
+	sm := &types.SignedMessage{
+		Message: types.Message{
+			To:         from,
+			From:       from,
+			Nonce:      7,
+			Value:      big.NewInt(5),
+			GasLimit:   1000,
+			GasFeeCap:  big.NewInt(200),
+			GasPremium: big.NewInt(10),
+		},
+		Signature: crypto.Signature{Type: crypto.SigTypeSecp256k1, Data: make([]byte, 65)},
+	}
+	require.NoError(t, db.TrackMessage(sm, string(iface.LedgerWithdraw), big.NewInt(5)))
+
+	pending, err := db.PendingMessages()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	require.Equal(t, sm.Cid(), pending[0].sm.Cid())
+
+	replacement := *sm
+	replacement.Message.GasPremium = big.NewInt(20)
+	require.NoError(t, db.ReplaceMessage(pending[0].id, &replacement))
+
+	pending, err = db.PendingMessages()
+	require.NoError(t, err)
+	require.Equal(t, replacement.Cid(), pending[0].sm.Cid())
+	require.Equal(t, 1, pending[0].replaced)
+
+	require.NoError(t, db.LandMessage(pending[0], &api.MsgLookup{
+		Message: sm.Cid(),
+		Receipt: types.MessageReceipt{ExitCode: exitcode.Ok, GasUsed: 900},
+		Height:  100,
+	}, big.NewInt(1234)))
+
+	pending, err = db.PendingMessages()
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	msgs, err := db.Messages(0, 10)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, iface.MessageLanded, msgs[0].State)
+	require.Equal(t, replacement.Cid().String(), msgs[0].Cid)
+	require.Equal(t, sm.Cid().String(), msgs[0].ExecCid)
+	require.Equal(t, big.NewInt(1234), msgs[0].GasCost)
+
+	sums, err := LedgerSummary(db.db, iface.LedgerByMonth)
+	require.NoError(t, err)
+	require.Len(t, sums, 1)
+	require.Equal(t, big.NewInt(1234), sums[0].Amounts[iface.LedgerGas])
+	require.Equal(t, big.NewInt(5), sums[0].Amounts[iface.LedgerWithdraw])
+	require.Equal(t, big.NewInt(1234), sums[0].Cost)
+}
+
+type recordingSigner struct {
+	ributil.Signer
+	meta api.MsgMeta
+}
+
+func (s *recordingSigner) WalletSign(ctx context.Context, addr address.Address, msg []byte, meta api.MsgMeta) (*crypto.Signature, error) {
+	s.meta = meta
+	return &crypto.Signature{Type: crypto.SigTypeSecp256k1, Data: msg}, nil
+}
+
+type pushGateway struct {
+	api.Gateway
+	pushed []*types.SignedMessage
+}
+
+func (g *pushGateway) MpoolPush(ctx context.Context, sm *types.SignedMessage) (cid.Cid, error) {
+	g.pushed = append(g.pushed, sm)
+	return sm.Cid(), nil
+}
+
+func TestSignAndPushMeta(t *testing.T) {
+	from, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+	to, err := address.NewIDAddress(1001)
+	require.NoError(t, err)
+
+	w := &recordingSigner{}
+	r := &ribs{wallet: w}
+	gw := &pushGateway{}
+
+	m := &types.Message{From: from, To: to, Nonce: 3, Value: big.NewInt(10), GasLimit: 1000, GasFeeCap: big.NewInt(100), GasPremium: big.NewInt(10)}
+	sm, err := r.signAndPush(context.Background(), gw, m)
+	require.NoError(t, err)
+	require.Equal(t, []*types.SignedMessage{sm}, gw.pushed)
+
+	// remote signers get the serialized message to check what they sign
+	require.EqualValues(t, api.MTChainMsg, w.meta.Type)
+
+	mb, err := m.ToStorageBlock()
+	require.NoError(t, err)
+	require.Equal(t, mb.RawData(), w.meta.Extra)
+	require.Equal(t, mb.Cid().Bytes(), sm.Signature.Data)
+}
@@ -0,0 +1,191 @@
+package rbdeal
+
+import (
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin"
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+// deal duration bounds of the market actor
+var (
+	minDealDuration = abi.ChainEpoch(180 * builtin.EpochsInDay)
+	maxDealDuration = abi.ChainEpoch(540 * builtin.EpochsInDay)
+)
+
+type policyManager struct {
+	r *ribs
+}
+
+func (r *ribs) Policies() iface.PolicyManager {
+	return &policyManager{r: r}
+}
+
+// defaultPolicy is used for groups without a policy, derived from the deal config
+func (r *ribs) defaultPolicy() iface.ReplicationPolicy {
+	cfg := r.dealCfg.get()
+
+	return iface.ReplicationPolicy{
+		Name:            iface.DefaultPolicy,
+		TargetReplicas:  cfg.TargetReplicaCount,
+		MinimumReplicas: cfg.MinimumReplicaCount,
+		RepairBelow:     defaultRepairBelow,
+		DirectDeals:     cfg.DirectDeals,
+	}
+}
+
+func (r *ribs) groupPolicy(group iface.GroupKey) (iface.ReplicationPolicy, error) {
+	name, err := r.db.GroupPolicyName(group)
+	if err != nil {
+		return iface.ReplicationPolicy{}, err
+	}
+	if name == "" || name == iface.DefaultPolicy {
+		return r.defaultPolicy(), nil
+	}
+
+	pols, err := r.db.ReplicationPolicies()
+	if err != nil {
+		return iface.ReplicationPolicy{}, err
+	}
+
+	p, ok := pols[name]
+	if !ok {
+		log.Warnw("group has unknown replication policy, using default", "group", group, "policy", name)
+		return r.defaultPolicy(), nil
+	}
+
+	return p, nil
+}
+
+// groupPolicies returns a function resolving policies of groups, for loops
+// going over many groups
+func (r *ribs) groupPolicies() (func(iface.GroupKey) iface.ReplicationPolicy, error) {
+	names, err := r.db.GroupPolicyNames()
+	if err != nil {
+		return nil, err
+	}
+
+	pols, err := r.db.ReplicationPolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	def := r.defaultPolicy()
+
+	return func(group iface.GroupKey) iface.ReplicationPolicy {
+		if p, ok := pols[names[group]]; ok {
+			return p
+		}
+		return def
+	}, nil
+}
+
+func validatePolicy(p iface.ReplicationPolicy) error {
+	switch {
+	case p.Name == "":
+		return xerrors.Errorf("policy name not set")
+	case p.Name == iface.DefaultPolicy:
+		return xerrors.Errorf("the %s policy is derived from the deal config", iface.DefaultPolicy)
+	case p.MinimumReplicas < 1:
+		return xerrors.Errorf("minimum replicas must be at least 1")
+	case p.TargetReplicas < p.MinimumReplicas:
+		return xerrors.Errorf("target replicas %d less than minimum %d", p.TargetReplicas, p.MinimumReplicas)
+	case p.RepairBelow < 0 || p.RepairBelow > p.MinimumReplicas:
+		return xerrors.Errorf("repair threshold %d must be between 0 and minimum replicas (%d)", p.RepairBelow, p.MinimumReplicas)
+	case (p.MaxPrice != nil && *p.MaxPrice < 0) || (p.MaxVerifPrice != nil && *p.MaxVerifPrice < 0):
+		return xerrors.Errorf("max prices can't be negative")
+	case p.DealDuration != 0 && (p.DealDuration < minDealDuration || p.DealDuration > maxDealDuration):
+		return xerrors.Errorf("deal duration %d outside of market bounds [%d, %d]", p.DealDuration, minDealDuration, maxDealDuration)
+	case p.MaxPerRegion < 0 || p.MaxPerOrg < 0:
+		return xerrors.Errorf("diversity limits can't be negative")
+	case p.DirectDeals && p.Verification == iface.DealVerificationUnverified:
+		return xerrors.Errorf("direct deals must be verified")
+	}
+
+	switch p.Verification {
+	case iface.DealVerificationAuto, iface.DealVerificationVerified, iface.DealVerificationUnverified:
+	default:
+		return xerrors.Errorf("unknown deal verification %q", p.Verification)
+	}
+
+	return nil
+}
+
+func (pm *policyManager) Policies() ([]iface.ReplicationPolicy, error) {
+	pols, err := pm.r.db.ReplicationPolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	out := []iface.ReplicationPolicy{pm.r.defaultPolicy()}
+	for _, p := range pols {
+		out = append(out, p)
+	}
+
+	return out, nil
+}
+
+func (pm *policyManager) SetPolicy(p iface.ReplicationPolicy) error {
+	if err := validatePolicy(p); err != nil {
+		return xerrors.Errorf("invalid policy: %w", err)
+	}
+	if p.DirectDeals && !pm.r.dealCfg.get().ExperimentalDirectDeals {
+		return xerrors.Errorf("invalid policy: direct deals are experimental, ExperimentalDirectDeals must be set in the deal config")
+	}
+
+	return pm.r.db.SetReplicationPolicy(p)
+}
+
+// RemovePolicy removes a policy, groups assigned to it use the default policy
+func (pm *policyManager) RemovePolicy(name string) error {
+	return pm.r.db.RemoveReplicationPolicy(name)
+}
+
+func (pm *policyManager) GroupPolicy(group iface.GroupKey) (iface.ReplicationPolicy, error) {
+	return pm.r.groupPolicy(group)
+}
+
+func (pm *policyManager) SetGroupPolicy(group iface.GroupKey, policy string) error {
+	if policy != iface.DefaultPolicy {
+		pols, err := pm.r.db.ReplicationPolicies()
+		if err != nil {
+			return err
+		}
+		if _, ok := pols[policy]; !ok {
+			return xerrors.Errorf("unknown replication policy %s", policy)
+		}
+	}
+
+	if err := pm.r.db.SetGroupPolicy(group, policy); err != nil {
+		return err
+	}
+
+	// the group may need more deals under the new policy
+	gm, err := pm.r.StorageDiag().GroupMeta(group)
+	if err != nil {
+		return xerrors.Errorf("getting group meta: %w", err)
+	}
+	if gm.State == iface.GroupStateLocalReadyForDeals {
+		go pm.r.onSub(group, gm.State, gm.State)
+	}
+
+	return nil
+}
+
+func (pm *policyManager) SetProviderLabels(sp int64, region, org string) error {
+	return pm.r.db.SetProviderLabels(sp, region, org)
+}
+
+func (pm *policyManager) ProviderAccess() (map[int64]iface.ProviderAccess, error) {
+	return pm.r.db.ProviderAccess()
+}
+
+func (pm *policyManager) SetProviderAccess(sp int64, access iface.ProviderAccess) error {
+	switch access {
+	case iface.ProviderAccessDefault, iface.ProviderAccessAllow, iface.ProviderAccessDeny:
+	default:
+		return xerrors.Errorf("unknown provider access %q", access)
+	}
+
+	return pm.r.db.SetProviderAccess(sp, access)
+}
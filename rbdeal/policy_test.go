@@ -0,0 +1,131 @@
+package rbdeal
+
+import (
+	"fmt"
+	"testing"
+
+	iface "github.com/lotus-web3/ribs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePolicy(t *testing.T) {
+	valid := iface.ReplicationPolicy{Name: "archive", TargetReplicas: 3, MinimumReplicas: 2, RepairBelow: 1}
+	require.NoError(t, validatePolicy(valid))
+
+	neg := -1.0
+	cases := map[string]func(p *iface.ReplicationPolicy){
+		"name not set":                 func(p *iface.ReplicationPolicy) { p.Name = "" },
+		"derived from the deal config": func(p *iface.ReplicationPolicy) { p.Name = iface.DefaultPolicy },
+		"minimum replicas":             func(p *iface.ReplicationPolicy) { p.MinimumReplicas, p.RepairBelow = 0, 0 },
+		"less than minimum":            func(p *iface.ReplicationPolicy) { p.TargetReplicas = 1 },
+		"repair threshold":             func(p *iface.ReplicationPolicy) { p.RepairBelow = 3 },
+		"prices can't be negative":     func(p *iface.ReplicationPolicy) { p.MaxVerifPrice = &neg },
+		"outside of market bounds":     func(p *iface.ReplicationPolicy) { p.DealDuration = minDealDuration - 1 },
+		"diversity limits":             func(p *iface.ReplicationPolicy) { p.MaxPerOrg = -1 },
+		"unknown deal verification":    func(p *iface.ReplicationPolicy) { p.Verification = "maybe" },
+	}
+
+	for msg, mod := range cases {
+		p := valid
+		mod(&p)
+		require.ErrorContains(t, validatePolicy(p), msg)
+	}
+}
+
+func TestGroupPolicy(t *testing.T) {
+	db := openFixtureDB(t, nil, func(cfg *iface.DealConfig) {
+		cfg.TargetReplicaCount = 7
+		cfg.MinimumReplicaCount = 4
+	})
+	r := &ribs{db: db, dealCfg: db.dealCfg}
+
+	archive := iface.ReplicationPolicy{Name: "archive", TargetReplicas: 3, MinimumReplicas: 2, RepairBelow: 1}
+	require.NoError(t, db.SetReplicationPolicy(archive))
+
+	require.NoError(t, db.SetGroupPolicy(1, "archive"))
+	require.NoError(t, db.SetGroupPolicy(2, iface.DefaultPolicy))
+	// e.g. assigned before the policy was removed
+	require.NoError(t, db.SetGroupPolicy(3, "removed"))
+
+	def := r.defaultPolicy()
+	require.Equal(t, iface.DefaultPolicy, def.Name)
+	require.Equal(t, 7, def.TargetReplicas)
+	require.Equal(t, 4, def.MinimumReplicas)
+
+	pols, err := r.groupPolicies()
+	require.NoError(t, err)
+
+	for group, expect := range map[iface.GroupKey]string{1: "archive", 2: iface.DefaultPolicy, 3: iface.DefaultPolicy, 4: iface.DefaultPolicy} {
+		p, err := r.groupPolicy(group)
+		require.NoError(t, err)
+		require.Equal(t, expect, p.Name, "group %d", group)
+
+		require.Equal(t, p, pols(group), "group %d", group)
+	}
+
+	p, err := r.groupPolicy(1)
+	require.NoError(t, err)
+	require.Equal(t, archive.TargetReplicas, p.TargetReplicas)
+
+	// unknown policies can't be assigned
+	err = r.Policies().SetGroupPolicy(4, "unknown")
+	require.ErrorContains(t, err, "unknown replication policy")
+
+	name, err := db.GroupPolicyName(4)
+	require.NoError(t, err)
+	require.Empty(t, name)
+}
+
+func TestRepairsFollowPolicy(t *testing.T) {
+	db := openFixtureDB(t, nil)
+
+	require.NoError(t, db.SetReplicationPolicy(iface.ReplicationPolicy{Name: "relaxed", TargetReplicas: 2, MinimumReplicas: 2, RepairBelow: 1}))
+	require.NoError(t, db.SetReplicationPolicy(iface.ReplicationPolicy{Name: "strict", TargetReplicas: 5, MinimumReplicas: 5, RepairBelow: 5}))
+
+	// group -> retrievable deals
+	groups := map[iface.GroupKey]int{
+		1: 2, // default policy, below repairBelow
+		2: 2, // relaxed, above its threshold
+		3: 4, // strict, below its threshold
+		4: 2, // unknown policy, repairBelow applies
+		5: 3, // default policy, at repairBelow
+	}
+
+	for group, retrievable := range groups {
+		_, err := db.db.Exec(`insert into groups (id, blocks, bytes, g_state, jb_recorded_head) values (?, 0, 0, ?, 0)`, group, iface.GroupStateOffloaded)
+		require.NoError(t, err)
+
+		for i := 0; i < retrievable; i++ {
+			addFixtureDeal(t, db, fmt.Sprintf("%d-%d", group, i), group, 1000+int64(i))
+		}
+
+		// deals failing retrieval checks don't count
+		addFixtureDeal(t, db, fmt.Sprintf("%d-bad", group), group, 2000)
+	}
+
+	_, err := db.db.Exec(`update deals set last_retrieval_check = 100000, last_retrieval_check_success = 100000 where uuid not like '%-bad'`)
+	require.NoError(t, err)
+	_, err = db.db.Exec(`update deals set last_retrieval_check = 100000, last_retrieval_check_success = 1 where uuid like '%-bad'`)
+	require.NoError(t, err)
+
+	require.NoError(t, db.SetGroupPolicy(2, "relaxed"))
+	require.NoError(t, db.SetGroupPolicy(3, "strict"))
+	require.NoError(t, db.SetGroupPolicy(4, "removed"))
+
+	require.NoError(t, db.AddRepairsForLowRetrievableDeals(defaultRepairBelow))
+
+	rows, err := db.db.Query(`select group_id, retrievable_deals from repairs order by group_id`)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	queued := map[iface.GroupKey]int{}
+	for rows.Next() {
+		var group iface.GroupKey
+		var retrievable int
+		require.NoError(t, rows.Scan(&group, &retrievable))
+		queued[group] = retrievable
+	}
+	require.NoError(t, rows.Err())
+
+	require.Equal(t, map[iface.GroupKey]int{1: 2, 3: 4, 4: 2}, queued)
+}
@@ -0,0 +1,206 @@
+package rbdeal
+
+import (
+	"encoding/json"
+	"net"
+
+	iface "github.com/lotus-web3/ribs"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"golang.org/x/xerrors"
+)
+
+// providerTraits are properties of a provider limiting how many replicas of
+// a group it can share with other providers
+type providerTraits struct {
+	sp int64
+
+	owner  int64 // owner address actor id, 0 if not crawled yet
+	peerID string
+
+	region, org string
+
+	// networks of crawled multiaddrs, see addrIPRanges
+	ipRanges []string
+}
+
+type selectLimits struct {
+	perSP, perOwner   int
+	perRegion, perOrg int
+
+	distinctPeers, distinctRanges bool
+}
+
+func selectLimitsOf(cfg iface.DealConfig, pol iface.ReplicationPolicy) selectLimits {
+	return selectLimits{
+		perSP:          cfg.MaxReplicasPerSP,
+		perOwner:       cfg.MaxReplicasPerOwner,
+		perRegion:      pol.MaxPerRegion,
+		perOrg:         pol.MaxPerOrg,
+		distinctPeers:  cfg.DistinctPeerIDs,
+		distinctRanges: cfg.DistinctIPRanges,
+	}
+}
+
+// replicaSpread counts replicas of a group held by providers with given
+// traits, and which providers use peer IDs and IP ranges
+type replicaSpread struct {
+	sps, owners   map[int64]int
+	regions, orgs map[string]int
+
+	peers, ranges map[string]map[int64]struct{}
+}
+
+func newReplicaSpread() *replicaSpread {
+	return &replicaSpread{
+		sps:     map[int64]int{},
+		owners:  map[int64]int{},
+		regions: map[string]int{},
+		orgs:    map[string]int{},
+		peers:   map[string]map[int64]struct{}{},
+		ranges:  map[string]map[int64]struct{}{},
+	}
+}
+
+// usedByOthers returns whether key is used by providers other than sp
+func usedByOthers(m map[string]map[int64]struct{}, key string, sp int64) bool {
+	for other := range m[key] {
+		if other != sp {
+			return true
+		}
+	}
+	return false
+}
+
+func useBy(m map[string]map[int64]struct{}, key string, sp int64) {
+	if m[key] == nil {
+		m[key] = map[int64]struct{}{}
+	}
+	m[key][sp] = struct{}{}
+}
+
+func (s *replicaSpread) add(t providerTraits) {
+	s.sps[t.sp]++
+	if t.owner != 0 {
+		s.owners[t.owner]++
+	}
+	if t.peerID != "" {
+		useBy(s.peers, t.peerID, t.sp)
+	}
+	s.regions[t.region]++
+	s.orgs[t.org]++
+	for _, r := range t.ipRanges {
+		useBy(s.ranges, r, t.sp)
+	}
+}
+
+// allows returns whether one more replica with a provider with traits t stays
+// within limits. Providers with unknown owner, peer ID or addresses aren't
+// limited by those, providers without labels are excluded by label limits.
+func (s *replicaSpread) allows(t providerTraits, lim selectLimits) bool {
+	if lim.perSP > 0 && s.sps[t.sp] >= lim.perSP {
+		return false
+	}
+	if lim.perOwner > 0 && t.owner != 0 && s.owners[t.owner] >= lim.perOwner {
+		return false
+	}
+	if lim.distinctPeers && t.peerID != "" && usedByOthers(s.peers, t.peerID, t.sp) {
+		return false
+	}
+	if lim.distinctRanges {
+		for _, r := range t.ipRanges {
+			if usedByOthers(s.ranges, r, t.sp) {
+				return false
+			}
+		}
+	}
+	if lim.perRegion > 0 && (t.region == "" || s.regions[t.region] >= lim.perRegion) {
+		return false
+	}
+	if lim.perOrg > 0 && (t.org == "" || s.orgs[t.org] >= lim.perOrg) {
+		return false
+	}
+	return true
+}
+
+// filter returns candidates, in order, which fit within limits together with
+// the replicas already counted and the candidates picked before them
+func (s *replicaSpread) filter(candidates []dealProvider, traits map[int64]providerTraits, lim selectLimits) []dealProvider {
+	out := make([]dealProvider, 0, len(candidates))
+	for _, p := range candidates {
+		t, ok := traits[p.id]
+		if !ok {
+			t = providerTraits{sp: p.id}
+		}
+
+		if !s.allows(t, lim) {
+			continue
+		}
+
+		s.add(t)
+		out = append(out, p)
+	}
+
+	return out
+}
+
+// addrIPRanges returns the networks of multiaddrs in json lists as stored in
+// the providers table: /24 for IPv4, /48 for IPv6, and the name itself for DNS
+// addresses. Non-public addresses (loopback, private, link-local, ...) which
+// providers often advertise next to public ones are skipped, they don't say
+// anything about where a provider is.
+//
+// Grouping providers by ASN isn't done, it would need an IP to ASN database;
+// the /24 and /48 ranges stand in for it.
+func addrIPRanges(addrLists ...string) ([]string, error) {
+	seen := map[string]struct{}{}
+	var out []string
+
+	for _, list := range addrLists {
+		if list == "" {
+			continue
+		}
+
+		var addrs []string
+		if err := json.Unmarshal([]byte(list), &addrs); err != nil {
+			return nil, xerrors.Errorf("unmarshal addrs: %w", err)
+		}
+
+		for _, a := range addrs {
+			ma, err := multiaddr.NewMultiaddr(a)
+			if err != nil {
+				return nil, xerrors.Errorf("parsing multiaddr: %w", err)
+			}
+
+			if !manet.IsPublicAddr(ma) {
+				continue
+			}
+
+			var r string
+			multiaddr.ForEach(ma, func(c multiaddr.Component) bool {
+				switch c.Protocol().Code {
+				case multiaddr.P_IP4:
+					r = net.IP(c.RawValue()).Mask(net.CIDRMask(24, 32)).String() + "/24"
+				case multiaddr.P_IP6:
+					r = net.IP(c.RawValue()).Mask(net.CIDRMask(48, 128)).String() + "/48"
+				case multiaddr.P_DNS, multiaddr.P_DNS4, multiaddr.P_DNS6, multiaddr.P_DNSADDR:
+					r = "dns:" + c.Value()
+				default:
+					return true
+				}
+				return false
+			})
+
+			if r == "" {
+				continue
+			}
+			if _, ok := seen[r]; ok {
+				continue
+			}
+			seen[r] = struct{}{}
+			out = append(out, r)
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,150 @@
+package rbdeal
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/rbstor"
+	"github.com/stretchr/testify/require"
+)
+
+type fixtureProvider struct {
+	id     int64
+	owner  int64
+	peerID string
+	addrs  string // json list of multiaddrs
+}
+
+// openFixtureDB opens a deal db in a temp dir with the given providers
+// reachable and accepting 32G pieces
+func openFixtureDB(t *testing.T, providers []fixtureProvider, cfgOpts ...func(*iface.DealConfig)) *ribsDB {
+	td := t.TempDir()
+
+	dc, err := loadDealConfig(td, cfgOpts)
+	require.NoError(t, err)
+
+	db, err := openRibsDB(td, dc)
+	require.NoError(t, err)
+
+	// group tables
+	rbs, err := rbstor.Open(td, rbstor.WithDB(db.db))
+	require.NoError(t, err)
+	require.NoError(t, rbs.Start())
+	t.Cleanup(func() {
+		require.NoError(t, rbs.Close())
+	})
+
+	require.NoError(t, db.startDB())
+
+	for _, p := range providers {
+		_, err := db.db.Exec(`insert into providers (id, in_market, ping_ok, boost_deals, ask_ok, ask_min_piece_size, ask_max_piece_size,
+			addr_info_graphsync, owner_id, peer_id) values (?, 1, 1, 1, 1, 256, ?, ?, ?, ?)`,
+			p.id, int64(64<<30), p.addrs, p.owner, p.peerID)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, refreshGoodProviders(dc.get())(db.db))
+
+	return db
+}
+
+func addFixtureDeal(t *testing.T, db *ribsDB, uuid string, group iface.GroupKey, sp int64) {
+	_, err := db.db.Exec(`insert into deals (uuid, client_addr, provider_addr, group_id, price_afil_gib_epoch, verified, keep_unsealed,
+		start_epoch, end_epoch, signed_proposal_bytes) values (?, 'f01', ?, ?, 0, 0, 1, 0, ?, x'')`, uuid, sp, group, defaultDealDuration)
+	require.NoError(t, err)
+}
+
+func selectedIDs(t *testing.T, db *ribsDB, group iface.GroupKey) []int64 {
+	return selectedIDsAt(t, db, group, 0)
+}
+
+func selectedIDsAt(t *testing.T, db *ribsDB, group iface.GroupKey, horizon abi.ChainEpoch) []int64 {
+	sel, err := db.SelectDealProviders(group, 32<<30, false, 1, iface.ReplicationPolicy{}, horizon)
+	require.NoError(t, err)
+
+	out := make([]int64, 0, len(sel))
+	for _, p := range sel {
+		out = append(out, p.id)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+func TestSelectDealProvidersAccess(t *testing.T) {
+	db := openFixtureDB(t, []fixtureProvider{
+		{id: 1001, peerID: "peer1"},
+		{id: 1002, peerID: "peer2"},
+		{id: 1003, peerID: "peer3"},
+		{id: 1004, peerID: "peer4"},
+	})
+
+	require.Equal(t, []int64{1001, 1002, 1003, 1004}, selectedIDs(t, db, 1))
+
+	require.NoError(t, db.SetProviderAccess(1002, iface.ProviderAccessDeny))
+	require.Equal(t, []int64{1001, 1003, 1004}, selectedIDs(t, db, 1))
+
+	require.NoError(t, db.SetProviderAccess(1003, iface.ProviderAccessAllow))
+	require.NoError(t, db.SetProviderAccess(1004, iface.ProviderAccessAllow))
+	require.Equal(t, []int64{1003, 1004}, selectedIDs(t, db, 1))
+
+	require.NoError(t, db.SetProviderAccess(1003, iface.ProviderAccessDefault))
+	require.NoError(t, db.SetProviderAccess(1004, iface.ProviderAccessDefault))
+	require.Equal(t, []int64{1001, 1003, 1004}, selectedIDs(t, db, 1))
+
+	acc, err := db.ProviderAccess()
+	require.NoError(t, err)
+	require.Equal(t, map[int64]iface.ProviderAccess{1002: iface.ProviderAccessDeny}, acc)
+}
+
+func TestSelectDealProvidersSpread(t *testing.T) {
+	db := openFixtureDB(t, []fixtureProvider{
+		{id: 1010, owner: 100, peerID: "peerA", addrs: `["/ip4/1.2.3.4/tcp/1234"]`},
+		{id: 1011, owner: 100, peerID: "peer11", addrs: `["/ip4/5.6.7.8/tcp/1234"]`},         // same owner as 1010
+		{id: 1012, owner: 101, peerID: "peerA", addrs: `["/ip4/9.9.9.9/tcp/1234"]`},          // same peer as 1010
+		{id: 1013, owner: 102, peerID: "peer13", addrs: `["/ip4/1.2.3.99/tcp/1234"]`},        // same /24 as 1010
+		{id: 1014, owner: 103, peerID: "peer14", addrs: `["/ip6/2a01:4f8:1::1/tcp/1234"]`},   // ok
+		{id: 1015, owner: 104, peerID: "peer15", addrs: `["/ip6/2a01:4f8:1:2::1/tcp/1234"]`}, // same /48 as 1014
+	}, func(cfg *iface.DealConfig) {
+		cfg.MaxReplicasPerOwner = 1
+		cfg.DistinctIPRanges = true
+	})
+
+	addFixtureDeal(t, db, "d1", 1, 1010)
+
+	sel := selectedIDs(t, db, 1)
+	require.Len(t, sel, 1)
+	require.Contains(t, []int64{1014, 1015}, sel[0])
+
+	// with more replicas allowed per provider and no owner cap, 1010 can hold
+	// another replica and 1011 is no longer capped by the shared owner
+	cfg := db.dealCfg.get()
+	cfg.MaxReplicasPerSP = 2
+	cfg.MaxReplicasPerOwner = 0
+	require.NoError(t, db.dealCfg.Set(cfg))
+
+	sel = selectedIDs(t, db, 1)
+	require.Len(t, sel, 3)
+	require.Equal(t, []int64{1010, 1011}, sel[:2])
+	require.Contains(t, []int64{1014, 1015}, sel[2])
+}
+
+func TestSelectDealProvidersPrivateAddrs(t *testing.T) {
+	// loopback, private and link-local addresses are shared by many providers,
+	// and don't count as a common IP range
+	db := openFixtureDB(t, []fixtureProvider{
+		{id: 1020, peerID: "peer20", addrs: `["/ip4/127.0.0.1/tcp/1234", "/ip4/10.0.0.5/tcp/1234", "/ip4/1.2.3.4/tcp/1234"]`},
+		{id: 1021, peerID: "peer21", addrs: `["/ip4/127.0.0.1/tcp/1234", "/ip4/10.0.0.6/tcp/1234", "/ip4/5.6.7.8/tcp/1234"]`},
+		{id: 1022, peerID: "peer22", addrs: `["/ip4/192.168.1.10/tcp/1234", "/ip6/fe80::1/tcp/1234"]`},
+		{id: 1023, peerID: "peer23", addrs: `["/ip4/192.168.1.11/tcp/1234", "/ip6/fe80::2/tcp/1234"]`},
+	}, func(cfg *iface.DealConfig) {
+		cfg.DistinctIPRanges = true
+	})
+
+	require.Equal(t, []int64{1020, 1021, 1022, 1023}, selectedIDs(t, db, 1))
+
+	ranges, err := addrIPRanges(`["/ip4/127.0.0.1/tcp/1", "/ip4/172.16.0.1/tcp/1", "/ip4/169.254.1.1/tcp/1", "/ip6/::1/tcp/1", "/dns4/localhost/tcp/1", "/ip4/1.2.3.4/tcp/1"]`, `["/dns4/sp.example.com/tcp/1"]`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3.0/24", "dns:sp.example.com"}, ranges)
+}
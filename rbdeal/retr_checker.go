@@ -39,6 +39,13 @@ var maxConsecutiveTimeouts = 5
 var consecutiveTimoutsForgivePeriod = 10 * time.Minute
 var parallelChecks = 30
 
+// retrievalProber holds the retrieval checker lassie instance, for running
+// checks outside of the checker loop
+type retrievalProber struct {
+	prf *ProbingRetrievalFinder
+	lsi *lassie.Lassie
+}
+
 type ProbingRetrievalFinder struct {
 	lk      sync.Mutex
 	lookups map[cid.Cid][]types.RetrievalCandidate
@@ -80,6 +87,8 @@ func (r *ribs) retrievalChecker(ctx context.Context) {
 		log.Fatalw("failed to create lassie", "error", err)
 	}
 
+	r.rckProber.Store(&retrievalProber{prf: rf, lsi: lsi})
+
 	for {
 		err := r.doRetrievalCheck(ctx, gw, rf, lsi)
 		if err != nil {
@@ -189,86 +198,14 @@ func (r *ribs) doRetrievalCheck(ctx context.Context, gw api.Gateway, prf *Probin
 
 		group := groups[candidate.Group]
 
-		addrInfo, err := r.db.GetProviderAddrs(candidate.Provider)
+		addrInfo, fixedPeer, cs, err := r.retrievalCheckTarget(candidate, cidToGet, group)
 		if err != nil {
-			log.Errorw("failed to get addr info", "error", err)
+			log.Errorw("failed to prepare retrieval check", "provider", candidate.Provider, "error", err)
 			r.rckFail.Add(1)
 			r.rckFailAll.Add(1)
 			continue
 		}
 
-		////
-
-		cs := make([]types.RetrievalCandidate, 0, len(candidates))
-		var fixedPeer []peer.AddrInfo
-		{
-			/*if len(addrInfo.HttpMaddrs) > 0 {
-				log.Errorw("candidate has http addrs", "provider", candidate.Provider)
-
-				cs = append(cs, types.RetrievalCandidate{
-					MinerPeer: peer.AddrInfo{
-						ID:    "",
-						Addrs: addrInfo.HttpMaddrs,
-					},
-					RootCid:  cidToGet,
-					Metadata: metadata.Default.New(&metadata.IpfsGatewayHttp{}),
-				})
-			}*/
-			/*if len(addrInfo.BitswapMaddrs) > 0 {
-				bsAddrInfo, err := peer.AddrInfosFromP2pAddrs(addrInfo.BitswapMaddrs...)
-				if err != nil {
-					log.Errorw("failed to bitswap parse addrinfo", "provider", candidate.Provider, "err", err)
-					r.rckFail.Add(1)
-					r.rckFailAll.Add(1)
-					continue
-				}
-
-				for _, ai := range bsAddrInfo {
-					cs = append(cs, types.RetrievalCandidate{
-						MinerPeer: ai,
-						RootCid:   cidToGet,
-						Metadata:  metadata.Default.New(&metadata.Bitswap{}),
-					})
-				}
-			}*/
-
-			gsAddrInfo, err := peer.AddrInfosFromP2pAddrs(addrInfo.LibP2PMaddrs...)
-			if err != nil {
-				log.Errorw("failed to parse addrinfo", "provider", candidate.Provider, "err", err)
-				r.rckFail.Add(1)
-				r.rckFailAll.Add(1)
-				continue
-			}
-
-			if len(gsAddrInfo) == 0 {
-				log.Errorw("no gs addrinfo", "provider", candidate.Provider)
-				r.rckFail.Add(1)
-				r.rckFailAll.Add(1)
-				continue
-			}
-
-			allMaddrs := append([]multiaddr.Multiaddr{}, addrInfo.BitswapMaddrs...)
-			allMaddrs = append(allMaddrs, addrInfo.LibP2PMaddrs...)
-
-			fixedPeer, err = peer.AddrInfosFromP2pAddrs(allMaddrs...)
-			if err != nil {
-				log.Errorw("failed to parse addrinfo", "provider", candidate.Provider, "err", err)
-				r.rckFail.Add(1)
-				r.rckFailAll.Add(1)
-				continue
-			}
-
-			cs = append(cs, types.RetrievalCandidate{
-				MinerPeer: gsAddrInfo[0],
-				RootCid:   cidToGet,
-				Metadata: metadata.Default.New(&metadata.GraphsyncFilecoinV1{
-					PieceCID:      group.PieceCid,
-					VerifiedDeal:  candidate.Verified,
-					FastRetrieval: candidate.FastRetr,
-				}),
-			})
-		}
-
 		checkThrottle <- struct{}{}
 		go func() {
 			defer func() {
@@ -288,6 +225,102 @@ func (r *ribs) doRetrievalCheck(ctx context.Context, gw api.Gateway, prf *Probin
 	return nil
 }
 
+// checkDealRetrieval runs a retrieval check of a single sealed deal with the
+// retrieval checker lassie instance, and returns the recorded result
+func (r *ribs) checkDealRetrieval(ctx context.Context, dealUUID string) (iface.RetrievalCheck, error) {
+	prober := r.rckProber.Load()
+	if prober == nil {
+		return iface.RetrievalCheck{}, xerrors.Errorf("retrieval checker is not running")
+	}
+
+	candidate, err := r.db.RetrievalCheckCandidate(dealUUID)
+	if err != nil {
+		return iface.RetrievalCheck{}, err
+	}
+
+	group, err := r.Storage().DescibeGroup(ctx, candidate.Group)
+	if err != nil {
+		return iface.RetrievalCheck{}, xerrors.Errorf("failed to get group meta: %w", err)
+	}
+
+	sample, err := r.Storage().HashSample(ctx, candidate.Group)
+	if err != nil {
+		return iface.RetrievalCheck{}, xerrors.Errorf("failed to load sample for group %d: %w", candidate.Group, err)
+	}
+	if len(sample) == 0 {
+		return iface.RetrievalCheck{}, xerrors.Errorf("no hash sample for group %d", candidate.Group)
+	}
+
+	// don't pick a cid which the checker loop is probing
+	var cidToGet cid.Cid
+	for {
+		cidToGet = cid.NewCidV1(cid.Raw, sample[rand.Intn(len(sample))])
+
+		prober.prf.lk.Lock()
+		_, busy := prober.prf.lookups[cidToGet]
+		prober.prf.lk.Unlock()
+		if !busy {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return iface.RetrievalCheck{}, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	addrInfo, fixedPeer, cs, err := r.retrievalCheckTarget(candidate, cidToGet, group)
+	if err != nil {
+		return iface.RetrievalCheck{}, err
+	}
+
+	timeouts := must.One(lru.New[int64, *timeoutEntry](1))
+	if err := r.retrievalCheckCandidate(ctx, candidate, addrInfo, cidToGet, group, fixedPeer, prober.prf, prober.lsi, timeouts, cs); err != nil {
+		return iface.RetrievalCheck{}, err
+	}
+
+	return r.db.LastRetrievalCheck(dealUUID)
+}
+
+// retrievalCheckTarget returns addresses of the candidate deal provider, and
+// lassie retrieval candidates for fetching cidToGet from it
+func (r *ribs) retrievalCheckTarget(candidate RetrCheckCandidate, cidToGet cid.Cid, group iface.GroupDesc) (ProviderAddrInfo, []peer.AddrInfo, []types.RetrievalCandidate, error) {
+	addrInfo, err := r.db.GetProviderAddrs(candidate.Provider)
+	if err != nil {
+		return addrInfo, nil, nil, xerrors.Errorf("get addr info: %w", err)
+	}
+
+	gsAddrInfo, err := peer.AddrInfosFromP2pAddrs(addrInfo.LibP2PMaddrs...)
+	if err != nil {
+		return addrInfo, nil, nil, xerrors.Errorf("parse addrinfo: %w", err)
+	}
+
+	if len(gsAddrInfo) == 0 {
+		return addrInfo, nil, nil, xerrors.Errorf("no gs addrinfo")
+	}
+
+	allMaddrs := append([]multiaddr.Multiaddr{}, addrInfo.BitswapMaddrs...)
+	allMaddrs = append(allMaddrs, addrInfo.LibP2PMaddrs...)
+
+	fixedPeer, err := peer.AddrInfosFromP2pAddrs(allMaddrs...)
+	if err != nil {
+		return addrInfo, nil, nil, xerrors.Errorf("parse addrinfo: %w", err)
+	}
+
+	cs := []types.RetrievalCandidate{{
+		MinerPeer: gsAddrInfo[0],
+		RootCid:   cidToGet,
+		Metadata: metadata.Default.New(&metadata.GraphsyncFilecoinV1{
+			PieceCID:      candidate.PieceCid(group.PieceCid),
+			VerifiedDeal:  candidate.Verified,
+			FastRetrieval: candidate.FastRetr,
+		}),
+	}}
+
+	return addrInfo, fixedPeer, cs, nil
+}
+
 func (r *ribs) retrievalCheckCandidate(ctx context.Context, candidate RetrCheckCandidate, addrInfo ProviderAddrInfo, cidToGet cid.Cid, group iface.GroupDesc, fixedPeer []peer.AddrInfo,
 	prf *ProbingRetrievalFinder, lsi *lassie.Lassie, timeoutCache *lru.Cache[int64, *timeoutEntry], cs []types.RetrievalCandidate) error {
 	//// http path, maybe
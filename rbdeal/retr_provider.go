@@ -190,7 +190,7 @@ func (r *retrievalProvider) FindCandidates(ctx context.Context, cid cid.Cid, f f
 			MinerPeer: gsAddrInfo[0],
 			RootCid:   cid,
 			Metadata: metadata.Default.New(&metadata.GraphsyncFilecoinV1{
-				PieceCID:      gm.PieceCid,
+				PieceCID:      candidate.PieceCid(gm.PieceCid),
 				VerifiedDeal:  candidate.Verified,
 				FastRetrieval: candidate.FastRetr,
 			}),
@@ -3,6 +3,7 @@ package rbdeal
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/fatih/color"
+	"github.com/filecoin-project/go-address"
 	"github.com/google/uuid"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p"
@@ -29,7 +31,10 @@ type openOptions struct {
 	hostGetter          func(...libp2p.Option) (host.Host, error)
 	localWalletOpener   func(path string) (*ributil.LocalWallet, error)
 	localWalletPath     string
+	remoteWallet        *remoteWalletOpts
 	fileCoinAPIEndpoint string
+	aggregatePieces     bool
+	dealConfig          []func(*iface.DealConfig)
 }
 
 type OpenOption func(*openOptions)
@@ -45,6 +50,8 @@ func WithHostGetter(hg func(...libp2p.Option) (host.Host, error)) OpenOption {
 // WithLocalWalletOpener sets the function used to open the local wallet path.
 // Defaults to using ributil.OpenWallet, where the wallet is instantiated if it does not exist.
 // In a case where it is auto generated, the wallet path must be backed up elsewhere.
+// The wallet is encrypted when RIBS_WALLET_PASSPHRASE, RIBS_WALLET_PASSPHRASE_FILE
+// or RIBS_WALLET_ENCRYPT=1 is set, see ributil.PassphraseFromEnv.
 //
 // See: WithLocalWalletPath.
 func WithLocalWalletOpener(wg func(path string) (*ributil.LocalWallet, error)) OpenOption {
@@ -62,6 +69,33 @@ func WithLocalWalletPath(wp string) OpenOption {
 	}
 }
 
+type remoteWalletOpts struct {
+	endpoint string
+	header   http.Header
+	def      address.Address
+}
+
+// WithRemoteWallet makes RIBS sign with keys held by a Lotus-compatible wallet
+// JSON-RPC endpoint instead of the local wallet, so that no keys are kept on
+// the node. token is sent as a bearer token if set; def is the default client
+// address, or address.Undef for the first one listed by the signer.
+// Defaults to RIBS_REMOTE_WALLET, RIBS_REMOTE_WALLET_TOKEN and
+// RIBS_REMOTE_WALLET_ADDR if set.
+func WithRemoteWallet(endpoint, token string, def address.Address) OpenOption {
+	return func(o *openOptions) {
+		header := http.Header{}
+		if token != "" {
+			header.Set("Authorization", "Bearer "+token)
+		}
+
+		o.remoteWallet = &remoteWalletOpts{
+			endpoint: endpoint,
+			header:   header,
+			def:      def,
+		}
+	}
+}
+
 // WithFileCoinApiEndpoint sets the FileCoin API endpoint used to probe the chain.
 // Defaults to "https://api.chain.love/rpc/v1".
 func WithFileCoinApiEndpoint(wp string) OpenOption {
@@ -70,19 +104,47 @@ func WithFileCoinApiEndpoint(wp string) OpenOption {
 	}
 }
 
+// WithPieceAggregation enables packing groups with pieces smaller than the
+// minimum deal piece size into aggregate pieces (FRC-0058), instead of dealing
+// them on their own.
+// Defaults to RIBS_AGGREGATE_PIECES=1 if set.
+func WithPieceAggregation(enable bool) OpenOption {
+	return func(o *openOptions) {
+		o.aggregatePieces = enable
+	}
+}
+
+// WithDealConfig modifies the deal config loaded from the config file and
+// RIBS_* env overrides, e.g. to set values from another config system.
+// Later changes made through DealConfig().Set are persisted to the file.
+func WithDealConfig(modify func(*iface.DealConfig)) OpenOption {
+	return func(o *openOptions) {
+		o.dealConfig = append(o.dealConfig, modify)
+	}
+}
+
 type ribs struct {
 	iface.RBS
 	db *ribsDB
 
+	dealCfg *dealConfig
+
 	host   host.Host
-	wallet *ributil.LocalWallet
+	wallet ributil.Signer
+
+	// closes the remote wallet connection, nil for local wallets
+	closeWallet func()
 
 	lotusRPCAddr string
 
 	msgSendLk sync.Mutex
+	nextNonce map[address.Address]uint64 // guarded by msgSendLk
+
+	// one claim extension cycle at a time
+	claimExtendLk sync.Mutex
 
 	marketFundsLk        sync.Mutex
-	cachedWalletInfo     *iface.WalletInfo
+	cachedWallets        []iface.WalletInfo
 	lastWalletInfoUpdate time.Time
 
 	//
@@ -127,6 +189,12 @@ type ribs struct {
 	dealsLk        sync.Mutex
 	moreDealsLocks map[iface.GroupKey]struct{}
 
+	aggregatePieces bool
+	aggregateLk     sync.Mutex
+
+	// held while checking the budget and storing a deal proposal
+	budgetLk sync.Mutex
+
 	/* retrieval */
 	retrHost host.Host
 	retrProv *retrievalProvider
@@ -136,6 +204,8 @@ type ribs struct {
 	/* retrieval checker */
 	rckToDo, rckStarted, rckSuccess, rckFail, rckSuccessAll, rckFailAll atomic.Int64
 
+	rckProber atomic.Pointer[retrievalProber] // set once the checker is running
+
 	/* repair */
 	repairDir     string
 	repairStats   map[int]*iface.RepairJob // workerid -> repair job
@@ -148,6 +218,10 @@ func (r *ribs) Wallet() iface.Wallet {
 	return r
 }
 
+func (r *ribs) DealConfig() iface.DealConfigurator {
+	return r.dealCfg
+}
+
 func Open(root string, opts ...OpenOption) (iface.RIBS, error) {
 	if err := os.Mkdir(root, 0755); err != nil && !os.IsExist(err) {
 		return nil, xerrors.Errorf("make root dir: %w", err)
@@ -158,22 +232,42 @@ func Open(root string, opts ...OpenOption) (iface.RIBS, error) {
 		localWalletOpener:   ributil.OpenWallet,
 		localWalletPath:     "~/.ribswallet",
 		fileCoinAPIEndpoint: "https://api.chain.love/rpc/v1",
+		aggregatePieces:     os.Getenv("RIBS_AGGREGATE_PIECES") == "1",
 	}
 
 	if os.Getenv("RIBS_FILECOIN_API_ENDPOINT") != "" {
 		opt.fileCoinAPIEndpoint = os.Getenv("RIBS_FILECOIN_API_ENDPOINT")
 	}
 
+	if ep := os.Getenv("RIBS_REMOTE_WALLET"); ep != "" {
+		def := address.Undef
+		if a := os.Getenv("RIBS_REMOTE_WALLET_ADDR"); a != "" {
+			var err error
+			if def, err = address.NewFromString(a); err != nil {
+				return nil, xerrors.Errorf("parsing RIBS_REMOTE_WALLET_ADDR: %w", err)
+			}
+		}
+
+		WithRemoteWallet(ep, os.Getenv("RIBS_REMOTE_WALLET_TOKEN"), def)(opt)
+	}
+
 	for _, o := range opts {
 		o(opt)
 	}
 
-	db, err := openRibsDB(root)
+	dealCfg, err := loadDealConfig(root, opt.dealConfig)
+	if err != nil {
+		return nil, xerrors.Errorf("load deal config: %w", err)
+	}
+
+	db, err := openRibsDB(root, dealCfg)
 	if err != nil {
 		return nil, xerrors.Errorf("open db: %w", err)
 	}
 
-	rbs, err := rbstor.Open(root, rbstor.WithDB(db.db))
+	rbs, err := rbstor.Open(root, rbstor.WithDB(db.db), rbstor.WithMaxLocalGroups(func() int {
+		return dealCfg.get().MaxLocalGroupCount
+	}))
 	if err != nil {
 		return nil, xerrors.Errorf("open RBS: %w", err)
 	}
@@ -186,12 +280,14 @@ func Open(root string, opts ...OpenOption) (iface.RIBS, error) {
 		RBS: rbs,
 		db:  db,
 
+		dealCfg: dealCfg,
+
 		lotusRPCAddr: opt.fileCoinAPIEndpoint,
 
 		uploadStats:     map[iface.GroupKey]*iface.GroupUploadStats{},
 		uploadStatsSnap: map[iface.GroupKey]*iface.GroupUploadStats{},
 		activeUploads:   map[uuid.UUID]struct{}{},
-		rateCounters:    ributil.NewRateCounters[peer.ID](ributil.MinAvgGlobalLogPeerRate(float64(minTransferMbps), float64(linkSpeedMbps))),
+		rateCounters:    ributil.NewRateCounters[peer.ID](dealCfg.transferRate(1)),
 
 		s3Uploads: map[iface.GroupKey]struct{}{},
 
@@ -203,9 +299,10 @@ func Open(root string, opts ...OpenOption) (iface.RIBS, error) {
 		spCrawlClosed:     make(chan struct{}),
 		marketWatchClosed: make(chan struct{}),
 
-		moreDealsLocks: map[iface.GroupKey]struct{}{},
+		moreDealsLocks:  map[iface.GroupKey]struct{}{},
+		aggregatePieces: opt.aggregatePieces,
 
-		repairFetchCounters: ributil.NewRateCounters[iface.GroupKey](ributil.MinAvgGlobalLogPeerRate(float64(minTransferMbps), float64(linkSpeedMbps/4))),
+		repairFetchCounters: ributil.NewRateCounters[iface.GroupKey](dealCfg.transferRate(4)),
 	}
 
 	rp, err := newRetrievalProvider(context.TODO(), r)
@@ -216,54 +313,81 @@ func Open(root string, opts ...OpenOption) (iface.RIBS, error) {
 	r.retrProv = rp
 
 	{
-		wallet, err := opt.localWalletOpener(opt.localWalletPath)
-		if err != nil {
-			return nil, xerrors.Errorf("open wallet: %w", err)
-		}
+		var wallet ributil.Signer
+		var defWallet address.Address
 
-		defWallet, err := wallet.GetDefault()
-		if err != nil {
-			wl, err := wallet.WalletList(context.TODO())
+		if ro := opt.remoteWallet; ro != nil {
+			rw, err := ributil.OpenRemoteWallet(context.TODO(), ro.endpoint, ro.header, address.Undef)
 			if err != nil {
-				return nil, xerrors.Errorf("get wallet list: %w", err)
+				return nil, xerrors.Errorf("open remote wallet: %w", err)
 			}
+			r.closeWallet = rw.Close
 
-			if len(wl) == 0 {
-				a, err := wallet.WalletNew(context.TODO(), "secp256k1")
-				if err != nil {
-					return nil, xerrors.Errorf("creating wallet: %w", err)
+			if ro.def != address.Undef {
+				if err := rw.SetDefault(ro.def); err != nil {
+					return nil, xerrors.Errorf("setting default wallet: %w", err)
 				}
-
-				color.Yellow("--------------------------------------------------------------")
-				fmt.Println("CREATED NEW RIBS WALLET")
-				fmt.Println("ADDRESS: ", color.GreenString("%s", a))
-				fmt.Println("")
-				fmt.Printf("BACKUP YOUR WALLET DIRECTORY (%s)\n", opt.localWalletPath)
-				fmt.Println("")
-				fmt.Println("Before using RIBS, you must fund your wallet with FIL.")
-				fmt.Println("You can also supply it with DataCap if you want to make")
-				fmt.Println("FIL+ deals.")
-				color.Yellow("--------------------------------------------------------------")
-
-				wl = append(wl, a)
 			}
 
-			if len(wl) != 1 {
-				return nil, xerrors.Errorf("no default wallet or more than one wallet: %#v", wl)
+			defWallet, err = rw.GetDefault()
+			if err != nil {
+				return nil, xerrors.Errorf("remote wallet at %s has no keys: %w", ro.endpoint, err)
 			}
 
-			if err := wallet.SetDefault(wl[0]); err != nil {
-				return nil, xerrors.Errorf("setting default wallet: %w", err)
+			wallet = rw
+		} else {
+			lw, err := opt.localWalletOpener(opt.localWalletPath)
+			if err != nil {
+				return nil, xerrors.Errorf("open wallet: %w", err)
 			}
+			wallet = lw
 
 			defWallet, err = wallet.GetDefault()
 			if err != nil {
-				return nil, xerrors.Errorf("getting default wallet: %w", err)
+				wl, err := wallet.WalletList(context.TODO())
+				if err != nil {
+					return nil, xerrors.Errorf("get wallet list: %w", err)
+				}
+
+				if len(wl) == 0 {
+					a, err := wallet.WalletNew(context.TODO(), "secp256k1")
+					if err != nil {
+						return nil, xerrors.Errorf("creating wallet: %w", err)
+					}
+
+					color.Yellow("--------------------------------------------------------------")
+					fmt.Println("CREATED NEW RIBS WALLET")
+					fmt.Println("ADDRESS: ", color.GreenString("%s", a))
+					fmt.Println("")
+					fmt.Printf("BACKUP YOUR WALLET DIRECTORY (%s)\n", opt.localWalletPath)
+					fmt.Println("")
+					fmt.Println("Before using RIBS, you must fund your wallet with FIL.")
+					fmt.Println("You can also supply it with DataCap if you want to make")
+					fmt.Println("FIL+ deals.")
+					color.Yellow("--------------------------------------------------------------")
+
+					wl = append(wl, a)
+				}
+
+				// with several wallets and no default, the first one becomes the
+				// default; all of them are used as deal clients
+				if err := wallet.SetDefault(wl[0]); err != nil {
+					return nil, xerrors.Errorf("setting default wallet: %w", err)
+				}
+
+				defWallet, err = wallet.GetDefault()
+				if err != nil {
+					return nil, xerrors.Errorf("getting default wallet: %w", err)
+				}
 			}
 		}
 
 		fmt.Println("RIBS Wallet: ", defWallet)
 
+		if wl, err := wallet.WalletList(context.TODO()); err == nil && len(wl) > 1 {
+			fmt.Println("RIBS Client Wallets: ", wl)
+		}
+
 		r.wallet = wallet
 
 		r.host, err = opt.hostGetter()
@@ -305,6 +429,9 @@ func Open(root string, opts ...OpenOption) (iface.RIBS, error) {
 	r.subGroupChanges()
 
 	go r.claimChecker()
+	go r.ledgerWatcher()
+	go r.messageWatcher()
+	go r.renewalPlanner()
 
 	return r, nil
 }
@@ -323,7 +450,13 @@ func (r *ribs) onSub(group iface.GroupKey, from, to iface.GroupState) {
 			return
 		}
 
-		if c >= targetReplicaCount {
+		pol, err := r.groupPolicy(group)
+		if err != nil {
+			log.Errorf("getting group policy: %s", err)
+			return
+		}
+
+		if c >= pol.TargetReplicas {
 			return
 		}
 
@@ -358,5 +491,9 @@ func (r *ribs) Close() error {
 	<-r.spCrawlClosed
 	<-r.marketWatchClosed
 
+	if r.closeWallet != nil {
+		r.closeWallet()
+	}
+
 	return r.RBS.Close()
 }
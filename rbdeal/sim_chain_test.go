@@ -0,0 +1,525 @@
+package rbdeal
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-state-types/abi"
+	actorstypes "github.com/filecoin-project/go-state-types/actors"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	market13 "github.com/filecoin-project/go-state-types/builtin/v13/market"
+	miner13 "github.com/filecoin-project/go-state-types/builtin/v13/miner"
+	"github.com/filecoin-project/go-state-types/builtin/v13/util/adt"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/go-state-types/manifest"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/blockstore"
+	"github.com/filecoin-project/lotus/chain/actors"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+)
+
+// simChain is a fake chain served as a lotus gateway over JSON-RPC. It only
+// has the state the deal flow reads: accounts, the market actor locked table,
+// miner info and sectors, publish messages and market deals. Tipsets are
+// single fake blocks, the head only moves with advance.
+type simChain struct {
+	lk sync.Mutex
+
+	head    abi.ChainEpoch
+	tipsets map[abi.ChainEpoch]*types.TipSet
+	heights map[types.TipSetKey]abi.ChainEpoch
+
+	bs    blockstore.MemBlockstore
+	store adt.Store
+
+	nextID   uint64
+	ids      map[address.Address]address.Address // key address -> id address
+	actors   map[address.Address]*types.Actor    // by id address
+	balances map[address.Address]abi.TokenAmount
+
+	miners  map[address.Address]api.MinerInfo
+	sectors map[address.Address][]miner13.SectorOnChainInfo
+
+	msgs     map[cid.Cid]*types.Message
+	lookups  map[cid.Cid]*api.MsgLookup
+	deals    map[abi.DealID]*api.MarketDeal
+	nextDeal abi.DealID
+
+	url string
+}
+
+func newSimChain(t *testing.T) *simChain {
+	bs := blockstore.NewMemory()
+
+	c := &simChain{
+		head:    1000,
+		tipsets: map[abi.ChainEpoch]*types.TipSet{},
+		heights: map[types.TipSetKey]abi.ChainEpoch{},
+
+		bs:    bs,
+		store: adt.WrapStore(context.Background(), cbor.NewCborStore(bs)),
+
+		nextID:   100,
+		ids:      map[address.Address]address.Address{},
+		actors:   map[address.Address]*types.Actor{},
+		balances: map[address.Address]abi.TokenAmount{},
+
+		miners:  map[address.Address]api.MinerInfo{},
+		sectors: map[address.Address][]miner13.SectorOnChainInfo{},
+
+		msgs:     map[cid.Cid]*types.Message{},
+		lookups:  map[cid.Cid]*api.MsgLookup{},
+		deals:    map[abi.DealID]*api.MarketDeal{},
+		nextDeal: 1,
+	}
+
+	mst, err := market13.ConstructState(c.store)
+	require.NoError(t, err)
+	require.NoError(t, c.putActor(builtin.StorageMarketActorAddr, manifest.MarketKey, mst))
+
+	rpc := jsonrpc.NewServer()
+	rpc.Register("Filecoin", c)
+
+	srv := httptest.NewServer(rpc)
+	t.Cleanup(srv.Close)
+
+	c.url = srv.URL
+
+	return c
+}
+
+// advance moves the chain head by n epochs
+func (c *simChain) advance(n abi.ChainEpoch) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.head += n
+}
+
+// addAccount creates an account actor for a key address
+func (c *simChain) addAccount(addr address.Address, balance abi.TokenAmount) (address.Address, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	id, err := c.newAccount()
+	if err != nil {
+		return address.Undef, err
+	}
+
+	c.ids[addr] = id
+	c.balances[addr] = balance
+
+	return id, nil
+}
+
+func (c *simChain) newAccount() (address.Address, error) {
+	id, err := address.NewIDAddress(c.nextID)
+	if err != nil {
+		return address.Undef, err
+	}
+	c.nextID++
+
+	code, err := actorCode(manifest.AccountKey)
+	if err != nil {
+		return address.Undef, err
+	}
+
+	// account state isn't read
+	c.actors[id] = &types.Actor{Code: code, Head: simCid("account"), Balance: big.Zero()}
+
+	return id, nil
+}
+
+// addMiner creates a miner actor reachable at addrs, with a worker account,
+// and adds it to the market locked table so that it is crawled
+func (c *simChain) addMiner(maddr address.Address, pid peer.ID, addrs []multiaddr.Multiaddr) (address.Address, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	worker, err := c.newAccount() // worker keys aren't used
+	if err != nil {
+		return address.Undef, err
+	}
+
+	mas := make([]abi.Multiaddrs, len(addrs))
+	for i, a := range addrs {
+		mas[i] = a.Bytes()
+	}
+
+	c.miners[maddr] = api.MinerInfo{
+		Owner:      worker,
+		Worker:     worker,
+		NewWorker:  address.Undef,
+		PeerId:     &pid,
+		Multiaddrs: mas,
+		SectorSize: 32 << 30,
+	}
+
+	if err := c.putMinerState(maddr); err != nil {
+		return address.Undef, err
+	}
+
+	var mst market13.State
+	if err := c.store.Get(context.Background(), c.actors[builtin.StorageMarketActorAddr].Head, &mst); err != nil {
+		return address.Undef, xerrors.Errorf("loading market state: %w", err)
+	}
+
+	locked, err := adt.AsMap(c.store, mst.LockedTable, adt.BalanceTableBitwidth)
+	if err != nil {
+		return address.Undef, err
+	}
+	collateral := big.NewInt(1)
+	if err := locked.Put(abi.AddrKey(maddr), &collateral); err != nil {
+		return address.Undef, err
+	}
+	if mst.LockedTable, err = locked.Root(); err != nil {
+		return address.Undef, err
+	}
+
+	return worker, c.putActor(builtin.StorageMarketActorAddr, manifest.MarketKey, &mst)
+}
+
+// publish includes a publish message with a single deal at the chain head
+func (c *simChain) publish(worker address.Address, prop market.ClientDealProposal) (cid.Cid, abi.DealID, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	params, aerr := actors.SerializeParams(&market.PublishStorageDealsParams{Deals: []market.ClientDealProposal{prop}})
+	if aerr != nil {
+		return cid.Undef, 0, aerr
+	}
+
+	// the worker nonce stays at the nonce of its last message, so that deal
+	// lookups find the publish message without walking back through old state
+	wact := c.actors[worker]
+
+	msg := &types.Message{
+		To:         builtin.StorageMarketActorAddr,
+		From:       worker,
+		Nonce:      wact.Nonce,
+		Value:      big.Zero(),
+		GasFeeCap:  big.Zero(),
+		GasPremium: big.Zero(),
+		Method:     builtin.MethodsMarket.PublishStorageDeals,
+		Params:     params,
+	}
+
+	id := c.nextDeal
+	c.nextDeal++
+
+	ret, aerr := actors.SerializeParams(&market13.PublishStorageDealsReturn{
+		IDs:        []abi.DealID{id},
+		ValidDeals: bitfield.NewFromSet([]uint64{0}),
+	})
+	if aerr != nil {
+		return cid.Undef, 0, aerr
+	}
+
+	ts, err := c.tipsetAt(c.head)
+	if err != nil {
+		return cid.Undef, 0, err
+	}
+
+	mc := msg.Cid()
+	c.msgs[mc] = msg
+	c.lookups[mc] = &api.MsgLookup{
+		Message: mc,
+		Receipt: types.MessageReceipt{Return: ret},
+		TipSet:  ts.Key(),
+		Height:  c.head,
+	}
+	c.deals[id] = &api.MarketDeal{
+		Proposal: prop.Proposal,
+		State: api.MarketDealState{
+			SectorStartEpoch: -1,
+			LastUpdatedEpoch: -1,
+			SlashEpoch:       -1,
+		},
+	}
+
+	return mc, id, nil
+}
+
+// seal activates a deal in a new sector of the miner
+func (c *simChain) seal(maddr address.Address, deal abi.DealID) (abi.SectorNumber, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	md, ok := c.deals[deal]
+	if !ok {
+		return 0, xerrors.Errorf("deal %d not found", deal)
+	}
+
+	num := abi.SectorNumber(len(c.sectors[maddr]) + 1)
+
+	md.State.SectorNumber = num
+	md.State.SectorStartEpoch = c.head
+	md.State.LastUpdatedEpoch = c.head
+
+	c.sectors[maddr] = append(c.sectors[maddr], miner13.SectorOnChainInfo{
+		SectorNumber:          num,
+		SealProof:             abi.RegisteredSealProof_StackedDrg32GiBV1_1,
+		SealedCID:             simCid("sealed"),
+		DealIDs:               []abi.DealID{deal},
+		Activation:            c.head,
+		Expiration:            md.Proposal.EndEpoch,
+		DealWeight:            big.Zero(),
+		VerifiedDealWeight:    big.Zero(),
+		InitialPledge:         big.Zero(),
+		ExpectedDayReward:     big.Zero(),
+		ExpectedStoragePledge: big.Zero(),
+		ReplacedDayReward:     big.Zero(),
+	})
+
+	return num, c.putMinerState(maddr)
+}
+
+func (c *simChain) putMinerState(maddr address.Address) error {
+	sectors, err := adt.MakeEmptyArray(c.store, miner13.SectorsAmtBitwidth)
+	if err != nil {
+		return err
+	}
+	for i := range c.sectors[maddr] {
+		s := c.sectors[maddr][i]
+		if err := sectors.Set(uint64(s.SectorNumber), &s); err != nil {
+			return err
+		}
+	}
+
+	root, err := sectors.Root()
+	if err != nil {
+		return err
+	}
+
+	// only sectors are read, other fields just need to encode
+	dummy := simCid("miner")
+	return c.putActor(maddr, manifest.MinerKey, &miner13.State{
+		Info:                       dummy,
+		PreCommitDeposits:          big.Zero(),
+		LockedFunds:                big.Zero(),
+		VestingFunds:               dummy,
+		FeeDebt:                    big.Zero(),
+		InitialPledge:              big.Zero(),
+		PreCommittedSectors:        dummy,
+		PreCommittedSectorsCleanUp: dummy,
+		AllocatedSectors:           dummy,
+		Sectors:                    root,
+		Deadlines:                  dummy,
+		EarlyTerminations:          bitfield.New(),
+	})
+}
+
+func (c *simChain) putActor(addr address.Address, key string, st cbg.CBORMarshaler) error {
+	code, err := actorCode(key)
+	if err != nil {
+		return err
+	}
+
+	head, err := c.store.Put(context.Background(), st)
+	if err != nil {
+		return xerrors.Errorf("storing %s state: %w", key, err)
+	}
+
+	c.actors[addr] = &types.Actor{Code: code, Head: head, Balance: big.Zero()}
+	return nil
+}
+
+func actorCode(key string) (cid.Cid, error) {
+	code, ok := actors.GetActorCodeID(actorstypes.Version13, key)
+	if !ok {
+		return cid.Undef, xerrors.Errorf("no %s actor code", key)
+	}
+	return code, nil
+}
+
+func simCid(s string) cid.Cid {
+	c, err := abi.CidBuilder.Sum([]byte(s))
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func (c *simChain) tipsetAt(h abi.ChainEpoch) (*types.TipSet, error) {
+	if ts, ok := c.tipsets[h]; ok {
+		return ts, nil
+	}
+
+	miner, err := address.NewIDAddress(1000)
+	if err != nil {
+		return nil, err
+	}
+
+	ts, err := types.NewTipSet([]*types.BlockHeader{{
+		Miner:                 miner,
+		Ticket:                &types.Ticket{VRFProof: []byte("sim")},
+		Parents:               []cid.Cid{simCid("parent")},
+		ParentWeight:          big.Zero(),
+		Height:                h,
+		ParentStateRoot:       simCid("state"),
+		ParentMessageReceipts: simCid("receipts"),
+		Messages:              simCid("messages"),
+		ParentBaseFee:         big.Zero(),
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	c.tipsets[h] = ts
+	c.heights[ts.Key()] = h
+
+	return ts, nil
+}
+
+func (c *simChain) resolve(addr address.Address) (address.Address, error) {
+	if addr.Protocol() == address.ID {
+		if _, ok := c.actors[addr]; ok {
+			return addr, nil
+		}
+	} else if id, ok := c.ids[addr]; ok {
+		return id, nil
+	}
+
+	return address.Undef, xerrors.Errorf("actor not found: %s", addr)
+}
+
+/* gateway methods */
+
+func (c *simChain) ChainHead(ctx context.Context) (*types.TipSet, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return c.tipsetAt(c.head)
+}
+
+func (c *simChain) ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if tsk == types.EmptyTSK {
+		return c.tipsetAt(c.head)
+	}
+
+	h, ok := c.heights[tsk]
+	if !ok {
+		return nil, xerrors.Errorf("tipset %s not found", tsk)
+	}
+	return c.tipsetAt(h)
+}
+
+func (c *simChain) ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (*types.TipSet, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return c.tipsetAt(h)
+}
+
+func (c *simChain) ChainReadObj(ctx context.Context, obj cid.Cid) ([]byte, error) {
+	b, err := c.bs.Get(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+	return b.RawData(), nil
+}
+
+func (c *simChain) ChainHasObj(ctx context.Context, obj cid.Cid) (bool, error) {
+	return c.bs.Has(ctx, obj)
+}
+
+func (c *simChain) ChainGetMessage(ctx context.Context, mc cid.Cid) (*types.Message, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	m, ok := c.msgs[mc]
+	if !ok {
+		return nil, xerrors.Errorf("message %s not found", mc)
+	}
+	return m, nil
+}
+
+func (c *simChain) StateSearchMsg(ctx context.Context, from types.TipSetKey, mc cid.Cid, limit abi.ChainEpoch, allowReplaced bool) (*api.MsgLookup, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return c.lookups[mc], nil
+}
+
+func (c *simChain) StateNetworkVersion(ctx context.Context, tsk types.TipSetKey) (network.Version, error) {
+	return network.Version22, nil
+}
+
+func (c *simChain) StateGetActor(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*types.Actor, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	id, err := c.resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.actors[id], nil
+}
+
+func (c *simChain) StateLookupID(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return c.resolve(addr)
+}
+
+func (c *simChain) StateMinerInfo(ctx context.Context, maddr address.Address, tsk types.TipSetKey) (api.MinerInfo, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	mi, ok := c.miners[maddr]
+	if !ok {
+		return api.MinerInfo{}, xerrors.Errorf("miner %s not found", maddr)
+	}
+	return mi, nil
+}
+
+func (c *simChain) StateMarketStorageDeal(ctx context.Context, deal abi.DealID, tsk types.TipSetKey) (*api.MarketDeal, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	md, ok := c.deals[deal]
+	if !ok {
+		return nil, xerrors.Errorf("deal %d not found", deal)
+	}
+	return md, nil
+}
+
+func (c *simChain) StateDealProviderCollateralBounds(ctx context.Context, size abi.PaddedPieceSize, verified bool, tsk types.TipSetKey) (api.DealCollateralBounds, error) {
+	return api.DealCollateralBounds{Min: big.NewInt(1000), Max: big.NewInt(100000)}, nil
+}
+
+func (c *simChain) StateMarketBalance(ctx context.Context, addr address.Address, tsk types.TipSetKey) (api.MarketBalance, error) {
+	return api.MarketBalance{Escrow: big.NewInt(1e18), Locked: big.Zero()}, nil
+}
+
+func (c *simChain) StateVerifiedClientStatus(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*abi.StoragePower, error) {
+	return nil, nil
+}
+
+func (c *simChain) WalletBalance(ctx context.Context, addr address.Address) (types.BigInt, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if b, ok := c.balances[addr]; ok {
+		return b, nil
+	}
+	return big.Zero(), nil
+}
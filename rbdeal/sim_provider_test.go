@@ -0,0 +1,386 @@
+package rbdeal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/go-fil-markets/storagemarket"
+	"github.com/filecoin-project/go-fil-markets/storagemarket/network"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/lib/sigs"
+	_ "github.com/filecoin-project/lotus/lib/sigs/secp"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p"
+	gostream "github.com/libp2p/go-libp2p-gostream"
+	"github.com/libp2p/go-libp2p/core/host"
+	inet "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/lotus-web3/ribs/ributil/boostnet"
+	types "github.com/lotus-web3/ribs/ributil/boosttypes"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+// boost deal checkpoints reported by simProvider
+const (
+	simDealAccepted    = "Accepted"
+	simDealTransferred = "Transferred"
+	simDealPublished   = "Published"
+	simDealSealed      = "AddedPiece"
+)
+
+// simProvider is a storage provider serving the boost ask, transports, deal
+// proposal and deal status protocols on a local libp2p host. Accepted deals
+// have their data fetched from the client car server; the piece commitment of
+// the data is checked against the proposal before the deal is published on
+// the simChain. Deals are sealed with seal.
+type simProvider struct {
+	chain *simChain
+
+	h      host.Host
+	maddr  address.Address
+	worker address.Address
+
+	lk    sync.Mutex
+	deals map[uuid.UUID]*simDeal
+}
+
+type simDeal struct {
+	params  types.DealParams
+	propCid cid.Cid
+
+	status   string
+	err      string
+	received uint64
+
+	publishCid *cid.Cid
+	dealID     abi.DealID
+}
+
+func newSimProvider(t *testing.T, chain *simChain, id uint64) *simProvider {
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = h.Close()
+	})
+
+	maddr, err := address.NewIDAddress(id)
+	require.NoError(t, err)
+
+	worker, err := chain.addMiner(maddr, h.ID(), h.Addrs())
+	require.NoError(t, err)
+
+	sp := &simProvider{
+		chain:  chain,
+		h:      h,
+		maddr:  maddr,
+		worker: worker,
+		deals:  map[uuid.UUID]*simDeal{},
+	}
+
+	h.SetStreamHandler(AskProtocolID, sp.handleAsk)
+	h.SetStreamHandler(DealProtocolv120, sp.handleDeal)
+	h.SetStreamHandler(DealStatusV12ProtocolID, sp.handleStatus)
+	boostnet.NewTransportsListener(h, []types.Protocol{{Name: "libp2p", Addresses: h.Addrs()}}).Start()
+
+	return sp
+}
+
+func (sp *simProvider) handleAsk(s inet.Stream) {
+	defer s.Close()
+
+	var req network.AskRequest
+	if err := cborutil.ReadCborRPC(s, &req); err != nil {
+		return
+	}
+
+	head, err := sp.chain.ChainHead(context.Background())
+	if err != nil {
+		return
+	}
+
+	resp := network.AskResponse{Ask: &storagemarket.SignedStorageAsk{Ask: &storagemarket.StorageAsk{
+		Price:         big.Zero(),
+		VerifiedPrice: big.Zero(),
+		MinPieceSize:  256,
+		MaxPieceSize:  64 << 30,
+		Miner:         sp.maddr,
+		Timestamp:     head.Height(),
+		Expiry:        head.Height() + 10000,
+	}}}
+
+	_ = cborutil.WriteCborRPC(s, &resp)
+}
+
+func (sp *simProvider) handleDeal(s inet.Stream) {
+	defer s.Close()
+
+	var p types.DealParams
+	if err := cborutil.ReadCborRPC(s, &p); err != nil {
+		return
+	}
+
+	d, err := sp.accept(p)
+
+	resp := types.DealResponse{Accepted: err == nil}
+	if err != nil {
+		resp.Message = err.Error()
+	}
+
+	if err := cborutil.WriteCborRPC(s, &resp); err != nil || d == nil {
+		return
+	}
+
+	go sp.execute(d)
+}
+
+func (sp *simProvider) accept(p types.DealParams) (*simDeal, error) {
+	prop := p.ClientDealProposal.Proposal
+
+	if prop.Provider != sp.maddr {
+		return nil, xerrors.Errorf("proposal for provider %s, this is %s", prop.Provider, sp.maddr)
+	}
+	if p.IsOffline || p.Transfer.Type != "libp2p" {
+		return nil, xerrors.Errorf("unsupported transfer type %q", p.Transfer.Type)
+	}
+
+	buf, err := cborutil.Dump(&prop)
+	if err != nil {
+		return nil, err
+	}
+	if err := sigs.Verify(&p.ClientDealProposal.ClientSignature, prop.Client, buf); err != nil {
+		return nil, xerrors.Errorf("invalid proposal signature: %w", err)
+	}
+
+	nd, err := cborutil.AsIpld(&p.ClientDealProposal)
+	if err != nil {
+		return nil, err
+	}
+
+	sp.lk.Lock()
+	defer sp.lk.Unlock()
+
+	if _, ok := sp.deals[p.DealUUID]; ok {
+		return nil, xerrors.Errorf("deal %s already proposed", p.DealUUID)
+	}
+
+	d := &simDeal{params: p, propCid: nd.Cid(), status: simDealAccepted}
+	sp.deals[p.DealUUID] = d
+
+	return d, nil
+}
+
+// execute fetches deal data, checks it and publishes the deal
+func (sp *simProvider) execute(d *simDeal) {
+	ctx := context.Background()
+	prop := d.params.ClientDealProposal.Proposal
+
+	n, piece, err := sp.fetch(ctx, d.params.Transfer, prop.PieceSize)
+	sp.update(d, func() {
+		d.received = uint64(n)
+	})
+	if err != nil {
+		sp.fail(d, xerrors.Errorf("fetching deal data: %w", err))
+		return
+	}
+	if uint64(n) != d.params.Transfer.Size {
+		sp.fail(d, xerrors.Errorf("got %d bytes of deal data, expected %d", n, d.params.Transfer.Size))
+		return
+	}
+	if !piece.Equals(prop.PieceCID) {
+		sp.fail(d, xerrors.Errorf("commP mismatch: data has %s, proposal %s", piece, prop.PieceCID))
+		return
+	}
+
+	sp.update(d, func() {
+		d.status = simDealTransferred
+	})
+
+	pc, id, err := sp.chain.publish(sp.worker, d.params.ClientDealProposal)
+	if err != nil {
+		sp.fail(d, xerrors.Errorf("publishing deal: %w", err))
+		return
+	}
+
+	sp.update(d, func() {
+		d.status = simDealPublished
+		d.publishCid = &pc
+		d.dealID = id
+	})
+}
+
+// fetch downloads deal data over the libp2p http transport, returning its
+// size and piece cid padded to pieceSize
+func (sp *simProvider) fetch(ctx context.Context, tr types.Transfer, pieceSize abi.PaddedPieceSize) (int64, cid.Cid, error) {
+	var hr types.HttpRequest
+	if err := json.Unmarshal(tr.Params, &hr); err != nil {
+		return 0, cid.Undef, xerrors.Errorf("parsing transfer params: %w", err)
+	}
+
+	ma, err := multiaddr.NewMultiaddr(strings.TrimPrefix(hr.URL, "libp2p://"))
+	if err != nil {
+		return 0, cid.Undef, xerrors.Errorf("parsing transfer url: %w", err)
+	}
+	ai, err := peer.AddrInfoFromP2pAddr(ma)
+	if err != nil {
+		return 0, cid.Undef, xerrors.Errorf("parsing transfer url: %w", err)
+	}
+	if err := sp.h.Connect(ctx, *ai); err != nil {
+		return 0, cid.Undef, xerrors.Errorf("connecting to client: %w", err)
+	}
+
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return gostream.Dial(ctx, sp.h, ai.ID, types.DataTransferProtocol)
+		},
+	}}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+ai.ID.String()+"/", nil)
+	if err != nil {
+		return 0, cid.Undef, err
+	}
+	for k, v := range hr.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return 0, cid.Undef, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return 0, cid.Undef, xerrors.Errorf("http status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	cc := new(commp.Calc)
+	n, err := io.Copy(cc, resp.Body)
+	if err != nil {
+		return n, cid.Undef, xerrors.Errorf("reading data: %w", err)
+	}
+
+	raw, size, err := cc.Digest()
+	if err != nil {
+		return n, cid.Undef, xerrors.Errorf("computing commP: %w", err)
+	}
+	if size < uint64(pieceSize) {
+		if raw, err = commp.PadCommP(raw, size, uint64(pieceSize)); err != nil {
+			return n, cid.Undef, xerrors.Errorf("padding commP: %w", err)
+		}
+	}
+
+	piece, err := commcid.PieceCommitmentV1ToCID(raw)
+	return n, piece, err
+}
+
+func (sp *simProvider) handleStatus(s inet.Stream) {
+	defer s.Close()
+
+	var req types.DealStatusRequest
+	if err := cborutil.ReadCborRPC(s, &req); err != nil {
+		return
+	}
+
+	resp := sp.status(req)
+	_ = cborutil.WriteCborRPC(s, &resp)
+}
+
+func (sp *simProvider) status(req types.DealStatusRequest) types.DealStatusResponse {
+	resp := types.DealStatusResponse{DealUUID: req.DealUUID}
+
+	sp.lk.Lock()
+	defer sp.lk.Unlock()
+
+	d, ok := sp.deals[req.DealUUID]
+	if !ok {
+		resp.Error = "deal not found"
+		return resp
+	}
+
+	// requests are signed by the deal client
+	ub, err := req.DealUUID.MarshalBinary()
+	if err == nil {
+		err = sigs.Verify(&req.Signature, d.params.ClientDealProposal.Proposal.Client, ub)
+	}
+	if err != nil {
+		resp.Error = "invalid request signature"
+		return resp
+	}
+
+	resp.TransferSize = d.params.Transfer.Size
+	resp.NBytesReceived = d.received
+	resp.DealStatus = &types.DealStatus{
+		Error:             d.err,
+		Status:            d.status,
+		Proposal:          d.params.ClientDealProposal.Proposal,
+		SignedProposalCid: d.propCid,
+		PublishCid:        d.publishCid,
+		ChainDealID:       d.dealID,
+	}
+	if d.status == simDealSealed {
+		resp.DealStatus.SealingStatus = "Proving"
+	}
+
+	return resp
+}
+
+// seal activates all published deals, each in its own sector
+func (sp *simProvider) seal() error {
+	sp.lk.Lock()
+	defer sp.lk.Unlock()
+
+	for _, d := range sp.deals {
+		if d.status != simDealPublished {
+			continue
+		}
+
+		if _, err := sp.chain.seal(sp.maddr, d.dealID); err != nil {
+			return err
+		}
+		d.status = simDealSealed
+	}
+
+	return nil
+}
+
+// dealStates returns the checkpoints of proposed deals
+func (sp *simProvider) dealStates() map[uuid.UUID]string {
+	sp.lk.Lock()
+	defer sp.lk.Unlock()
+
+	out := map[uuid.UUID]string{}
+	for id, d := range sp.deals {
+		out[id] = d.status
+		if d.err != "" {
+			out[id] = d.err
+		}
+	}
+	return out
+}
+
+func (sp *simProvider) update(d *simDeal, f func()) {
+	sp.lk.Lock()
+	defer sp.lk.Unlock()
+
+	f()
+}
+
+func (sp *simProvider) fail(d *simDeal, err error) {
+	sp.update(d, func() {
+		d.err = err.Error()
+	})
+}
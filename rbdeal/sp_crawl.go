@@ -224,7 +224,19 @@ func (r *ribs) spCrawlLoop(ctx context.Context, gw api.Gateway, pingP2P host.Hos
 			ctx, cancel := context.WithTimeout(ctx, timeout)
 			defer cancel()
 
-			libp2pPi, err := GetAddrInfo(ctx, gw, maddr)
+			minfo, err := gw.StateMinerInfo(ctx, maddr, types.EmptyTSK)
+			if err != nil {
+				return
+			}
+
+			if owner, err := address.IDFromAddress(minfo.Owner); err == nil {
+				res.Owner = int64(owner)
+			}
+			if minfo.PeerId != nil {
+				res.PeerID = minfo.PeerId.String()
+			}
+
+			libp2pPi, err := minerAddrInfo(maddr, minfo)
 			if err != nil {
 				return
 			}
@@ -431,6 +443,11 @@ type providerResult struct {
 	LibP2PMaddrs  []multiaddr.Multiaddr
 	BitswapMaddrs []multiaddr.Multiaddr
 	HttpMaddrs    []multiaddr.Multiaddr
+
+	// owner address actor id and peer ID from on-chain miner info, zero
+	// values when unknown
+	Owner  int64
+	PeerID string
 }
 
 func GetAddrInfo(ctx context.Context, api api.Gateway, maddr address.Address) (*peer.AddrInfo, error) {
@@ -438,6 +455,11 @@ func GetAddrInfo(ctx context.Context, api api.Gateway, maddr address.Address) (*
 	if err != nil {
 		return nil, err
 	}
+
+	return minerAddrInfo(maddr, minfo)
+}
+
+func minerAddrInfo(maddr address.Address, minfo api.MinerInfo) (*peer.AddrInfo, error) {
 	if minfo.PeerId == nil {
 		return nil, fmt.Errorf("storage provider %s has no peer ID set on-chain", maddr)
 	}
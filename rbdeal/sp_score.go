@@ -0,0 +1,307 @@
+package rbdeal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/ributil"
+	"golang.org/x/xerrors"
+)
+
+var scoreRefreshInterval = 15 * time.Minute
+
+const (
+	// samples of a neutral (0.5) value each score component starts with, so
+	// that providers with little history aren't scored at the extremes
+	scorePrior = 2.0
+
+	// time to first byte scored at 0.5
+	ttfbRefMs = 500.0
+
+	// deals older than this many half-lives are ignored
+	scoreHistoryHalfLives = 8
+
+	// selection weight of providers scored lower than this
+	minSelectWeight = 0.02
+
+	// score of providers which weren't scored yet, all components at the prior
+	neutralScore = 0.5
+)
+
+// scoreDeal is a deal as seen by the scoring model
+type scoreDeal struct {
+	sp int64
+
+	startTime                    int64 // unix seconds
+	sealed, failed, rejected     bool
+	startEpoch, sectorStartEpoch int64 // sectorStartEpoch 0 if not known
+
+	probesOk, probesFail int64
+	lastProbe            int64 // unix seconds
+	ttfbMs               int64 // 0 if not probed
+}
+
+// decayedMean is a mean of samples weighted by age, starting from the prior
+type decayedMean struct {
+	sum, weight float64
+}
+
+func (m *decayedMean) add(v, w float64) {
+	m.sum += v * w
+	m.weight += w
+}
+
+func (m *decayedMean) value() float64 {
+	return (m.sum + scorePrior*0.5) / (m.weight + scorePrior)
+}
+
+// scoreProviders computes scores of providers with the given asks from their
+// deal history
+func scoreProviders(now time.Time, cfg iface.DealConfig, asks map[int64]float64, deals []scoreDeal) map[int64]iface.ProviderScore {
+	halfLife := time.Duration(cfg.ScoreHalfLife).Seconds()
+	decay := func(ts int64) float64 {
+		age := float64(now.Unix() - ts)
+		if age < 0 {
+			age = 0
+		}
+		return math.Pow(0.5, age/halfLife)
+	}
+
+	type components struct {
+		success, acceptance, sealTime, retrieval, ttfb decayedMean
+	}
+	per := map[int64]*components{}
+	for sp := range asks {
+		per[sp] = &components{}
+	}
+
+	for _, d := range deals {
+		c, ok := per[d.sp]
+		if !ok {
+			c = &components{}
+			per[d.sp] = c
+		}
+
+		w := decay(d.startTime)
+
+		c.acceptance.add(b2f(!d.rejected), w)
+
+		switch {
+		case d.rejected:
+		case d.sealed && !d.failed:
+			c.success.add(1, w)
+
+			// sealing early in the window before the deal start epoch is better
+			if d.sectorStartEpoch > 0 && cfg.DealStartTime > 0 {
+				slack := float64(d.startEpoch-d.sectorStartEpoch) / float64(cfg.DealStartTime)
+				c.sealTime.add(math.Max(0, math.Min(1, slack)), w)
+			}
+		case d.failed:
+			c.success.add(0, w)
+		}
+
+		if probes := d.probesOk + d.probesFail; probes > 0 {
+			pw := decay(d.lastProbe)
+			c.retrieval.add(float64(d.probesOk)/float64(probes), pw*float64(probes))
+
+			if d.ttfbMs > 0 {
+				c.ttfb.add(ttfbRefMs/(ttfbRefMs+float64(d.ttfbMs)), pw)
+			}
+		}
+	}
+
+	wt := cfg.ScoreWeights
+	out := make(map[int64]iface.ProviderScore, len(per))
+	for sp, c := range per {
+		ask, hasAsk := asks[sp]
+
+		price := iface.ScoreComponent{Name: "price", Value: 0.5, Weight: wt.Price}
+		if hasAsk {
+			price.Samples = 1
+			switch {
+			case cfg.MaxPrice > 0:
+				price.Value = math.Max(0, 1-ask/cfg.MaxPrice)
+			case ask <= 0:
+				price.Value = 1
+			default:
+				price.Value = 0
+			}
+		}
+
+		comps := []iface.ScoreComponent{
+			{Name: "deal_success", Value: c.success.value(), Weight: wt.DealSuccess, Samples: c.success.weight},
+			{Name: "acceptance", Value: c.acceptance.value(), Weight: wt.Acceptance, Samples: c.acceptance.weight},
+			{Name: "seal_time", Value: c.sealTime.value(), Weight: wt.SealTime, Samples: c.sealTime.weight},
+			{Name: "retrieval", Value: c.retrieval.value(), Weight: wt.Retrieval, Samples: c.retrieval.weight},
+			{Name: "ttfb", Value: c.ttfb.value(), Weight: wt.TTFB, Samples: c.ttfb.weight},
+			price,
+		}
+
+		out[sp] = iface.ProviderScore{
+			Score:      weightedScore(comps),
+			Components: comps,
+			UpdatedAt:  now.Unix(),
+		}
+	}
+
+	return out
+}
+
+func weightedScore(comps []iface.ScoreComponent) float64 {
+	var sum, weight float64
+	for _, c := range comps {
+		sum += c.Value * c.Weight
+		weight += c.Weight
+	}
+	if weight == 0 {
+		return 0
+	}
+	return sum / weight
+}
+
+func b2f(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// weightedSample returns up to n providers picked at random without
+// replacement, with probability proportional to their score
+func weightedSample(ps []dealProvider, n int) []dealProvider {
+	// Efraimidis-Spirakis: take n largest u^(1/w)
+	type keyed struct {
+		p   dealProvider
+		key float64
+	}
+
+	ks := make([]keyed, len(ps))
+	for i, p := range ps {
+		w := math.Max(p.score, minSelectWeight)
+		ks[i] = keyed{p: p, key: math.Pow(rand.Float64(), 1/w)}
+	}
+
+	sort.Slice(ks, func(i, j int) bool { return ks[i].key > ks[j].key })
+
+	if n > len(ks) {
+		n = len(ks)
+	}
+	out := make([]dealProvider, n)
+	for i := range out {
+		out[i] = ks[i].p
+	}
+
+	return out
+}
+
+// refreshProviderScores recomputes and persists scores of all providers in
+// the market
+func refreshProviderScores(cfg iface.DealConfig) func(db *ributil.RetryDB) error {
+	return func(db *ributil.RetryDB) error {
+		now := time.Now()
+
+		asks := map[int64]float64{}
+		rows, err := db.Query(`select id, ask_ok, ask_price from providers where in_market = 1`)
+		if err != nil {
+			return xerrors.Errorf("querying providers: %w", err)
+		}
+		for rows.Next() {
+			var sp int64
+			var askOk bool
+			var price float64
+			if err := rows.Scan(&sp, &askOk, &price); err != nil {
+				_ = rows.Close()
+				return xerrors.Errorf("scanning provider: %w", err)
+			}
+			if askOk {
+				asks[sp] = price
+			} else {
+				asks[sp] = math.Inf(1)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return xerrors.Errorf("iterating providers: %w", err)
+		}
+		_ = rows.Close()
+
+		since := now.Add(-time.Duration(cfg.ScoreHalfLife) * scoreHistoryHalfLives).Unix()
+		rows, err = db.Query(`select provider_addr, start_time, sealed, failed, rejected, start_epoch, coalesce(sector_start_epoch, 0),
+				retrieval_probes_success, retrieval_probes_fail, last_retrieval_check, coalesce(retrieval_probe_prev_ttfb_ms, 0)
+			from deals where start_time >= ?`, since)
+		if err != nil {
+			return xerrors.Errorf("querying deals: %w", err)
+		}
+		var deals []scoreDeal
+		for rows.Next() {
+			var d scoreDeal
+			if err := rows.Scan(&d.sp, &d.startTime, &d.sealed, &d.failed, &d.rejected, &d.startEpoch, &d.sectorStartEpoch,
+				&d.probesOk, &d.probesFail, &d.lastProbe, &d.ttfbMs); err != nil {
+				_ = rows.Close()
+				return xerrors.Errorf("scanning deal: %w", err)
+			}
+			deals = append(deals, d)
+		}
+		if err := rows.Err(); err != nil {
+			return xerrors.Errorf("iterating deals: %w", err)
+		}
+		_ = rows.Close()
+
+		scores := scoreProviders(now, cfg, asks, deals)
+
+		tx, err := db.Begin()
+		if err != nil {
+			return xerrors.Errorf("begin: %w", err)
+		}
+		defer func() {
+			_ = tx.Rollback()
+		}()
+
+		if _, err := tx.Exec(`delete from provider_scores`); err != nil {
+			return xerrors.Errorf("clearing scores: %w", err)
+		}
+
+		stmt, err := tx.Prepare(`insert into provider_scores (sp_id, score, components, updated_at) values (?, ?, ?, ?)`)
+		if err != nil {
+			return xerrors.Errorf("prepare: %w", err)
+		}
+		defer stmt.Close()
+
+		for sp, s := range scores {
+			comps, err := json.Marshal(s.Components)
+			if err != nil {
+				return xerrors.Errorf("marshal score components: %w", err)
+			}
+			if _, err := stmt.Exec(sp, s.Score, string(comps), s.UpdatedAt); err != nil {
+				return xerrors.Errorf("inserting score: %w", err)
+			}
+		}
+
+		return tx.Commit()
+	}
+}
+
+// ProviderScore returns the persisted score of a provider, or a neutral score
+// if it wasn't scored yet
+func (r *ribsDB) ProviderScore(sp int64) (iface.ProviderScore, error) {
+	var s iface.ProviderScore
+	var comps string
+
+	err := r.db.QueryRow(`select score, components, updated_at from provider_scores where sp_id = ?`, sp).Scan(&s.Score, &comps, &s.UpdatedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return iface.ProviderScore{Score: neutralScore}, nil
+	case err != nil:
+		return s, xerrors.Errorf("querying provider score: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(comps), &s.Components); err != nil {
+		return s, xerrors.Errorf("unmarshal score components: %w", err)
+	}
+
+	return s, nil
+}
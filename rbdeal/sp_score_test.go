@@ -0,0 +1,70 @@
+package rbdeal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScoreProviders(t *testing.T) {
+	cfg := defaultDealConfig()
+	now := time.Now()
+	day := int64(24 * 60 * 60)
+	ts := now.Unix()
+
+	var deals []scoreDeal
+	for i := int64(0); i < 10; i++ {
+		// good: sealed half way through the start window, retrievable and fast
+		deals = append(deals, scoreDeal{sp: 1, startTime: ts - i*day, sealed: true, startEpoch: 10000, sectorStartEpoch: 10000 - int64(cfg.DealStartTime)/2,
+			probesOk: 3, lastProbe: ts, ttfbMs: 100})
+
+		// bad: failing and rejecting deals
+		deals = append(deals, scoreDeal{sp: 2, startTime: ts - i*day, failed: true, rejected: i%2 == 0})
+
+		// recovered: failed long ago, sealing recently
+		deals = append(deals, scoreDeal{sp: 3, startTime: ts - 200*day, failed: true})
+		deals = append(deals, scoreDeal{sp: 3, startTime: ts - i*day, sealed: true, startEpoch: 10000, sectorStartEpoch: 10000 - int64(cfg.DealStartTime)/2})
+	}
+
+	scores := scoreProviders(now, cfg, map[int64]float64{1: 0, 2: 0, 3: 0, 4: 0}, deals)
+	require.Len(t, scores, 4)
+
+	good, bad, recovered, fresh := scores[1], scores[2], scores[3], scores[4]
+	require.Greater(t, good.Score, recovered.Score)
+	require.Greater(t, recovered.Score, fresh.Score)
+	require.Greater(t, fresh.Score, bad.Score)
+
+	require.Len(t, good.Components, 6)
+	for _, c := range good.Components {
+		require.GreaterOrEqual(t, c.Value, 0.5, c.Name)
+		require.LessOrEqual(t, c.Value, 1.0, c.Name)
+	}
+
+	// decayed failures barely count
+	require.Equal(t, "deal_success", recovered.Components[0].Name)
+	require.Greater(t, recovered.Components[0].Value, 0.8)
+
+	// no history is neutral except for the price
+	for _, c := range fresh.Components[:5] {
+		require.Equal(t, neutralScore, c.Value, c.Name)
+		require.Zero(t, c.Samples, c.Name)
+	}
+}
+
+func TestWeightedSample(t *testing.T) {
+	ps := []dealProvider{{id: 1, score: 0.9}, {id: 2, score: 0.05}}
+
+	picked := map[int64]int{}
+	for i := 0; i < 2000; i++ {
+		s := weightedSample(ps, 1)
+		require.Len(t, s, 1)
+		picked[s[0].id]++
+	}
+
+	// expected ~95% for provider 1
+	require.Greater(t, picked[1], 1700)
+	require.Greater(t, picked[2], 0)
+
+	require.Len(t, weightedSample(ps, 5), 2)
+}
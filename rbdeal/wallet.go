@@ -5,7 +5,8 @@ import (
 	"time"
 
 	"github.com/filecoin-project/go-state-types/big"
-	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/go-state-types/builtin"
+	markettypes "github.com/filecoin-project/go-state-types/builtin/v9/market"
 	"github.com/filecoin-project/lotus/api/client"
 	"github.com/filecoin-project/lotus/chain/actors"
 	marketactor "github.com/filecoin-project/lotus/chain/actors/builtin/market"
@@ -20,115 +21,152 @@ import (
 )
 
 func (r *ribs) MarketAdd(ctx context.Context, amount abi.TokenAmount) (cid.Cid, error) {
-	r.msgSendLk.Lock()
-	defer r.msgSendLk.Unlock()
+	w, err := r.wallet.GetDefault()
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("getting default wallet: %w", err)
+	}
 
+	return r.marketAdd(ctx, w, amount)
+}
+
+// marketAdd adds funds from a client wallet to its market escrow
+func (r *ribs) marketAdd(ctx context.Context, w address.Address, amount abi.TokenAmount) (cid.Cid, error) {
 	r.marketFundsLk.Lock()
 	defer r.marketFundsLk.Unlock()
 
 	gw, closer, err := client.NewGatewayRPCV1(ctx, r.lotusRPCAddr, nil)
 	if err != nil {
-		panic(err)
+		return cid.Undef, xerrors.Errorf("creating gateway rpc client: %w", err)
 	}
 	defer closer()
 
-	w, err := r.wallet.GetDefault()
-	if err != nil {
-		return cid.Undef, xerrors.Errorf("getting default wallet: %w", err)
-	}
-
 	params, err := actors.SerializeParams(&w)
 	if err != nil {
 		return cid.Undef, err
 	}
 
-	m := &types.Message{
+	c, err := r.sendMessage(ctx, gw, &types.Message{
 		To:     marketactor.Address,
 		From:   w,
 		Value:  amount,
 		Method: marketactor.Methods.AddBalance,
 		Params: params,
+	}, string(iface.LedgerMarketAdd), amount)
+	if err != nil {
+		return cid.Undef, err
 	}
 
-	nc, err := gw.MpoolGetNonce(ctx, w)
-	if err != nil {
-		return cid.Cid{}, xerrors.Errorf("mpool get gas: %w", err)
+	log.Infow("add market balance", "cid", c, "wallet", w, "amount", amount)
+
+	return c, nil
+}
+
+func (r *ribs) MarketWithdraw(ctx context.Context, amount abi.TokenAmount) (cid.Cid, error) {
+	r.marketFundsLk.Lock()
+	defer r.marketFundsLk.Unlock()
+
+	if !amount.GreaterThan(big.Zero()) {
+		return cid.Undef, xerrors.Errorf("withdraw amount must be positive")
 	}
 
-	m.Nonce = nc
+	gw, closer, err := client.NewGatewayRPCV1(ctx, r.lotusRPCAddr, nil)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("creating gateway rpc client: %w", err)
+	}
+	defer closer()
 
-	m, err = gw.GasEstimateMessageGas(ctx, m, nil, types.EmptyTSK)
+	w, err := r.wallet.GetDefault()
 	if err != nil {
-		return cid.Cid{}, xerrors.Errorf("gas estimate message gas: %w", err)
+		return cid.Undef, xerrors.Errorf("getting default wallet: %w", err)
 	}
 
-	sig, err := r.wallet.WalletSign(ctx, w, m.Cid().Bytes(), api.MsgMeta{
-		Type: api.MTChainMsg,
-	})
+	mb, err := gw.StateMarketBalance(ctx, w, types.EmptyTSK)
 	if err != nil {
-		return cid.Cid{}, xerrors.Errorf("signing message: %w", err)
+		return cid.Undef, xerrors.Errorf("getting market balance: %w", err)
 	}
 
-	sm := &types.SignedMessage{
-		Message:   *m,
-		Signature: *sig,
+	// the market actor only releases funds not locked in deals
+	if avail := big.Sub(mb.Escrow, mb.Locked); amount.GreaterThan(avail) {
+		return cid.Undef, xerrors.Errorf("withdraw amount %s exceeds available market balance %s", types.FIL(amount), types.FIL(avail))
 	}
 
-	c, aerr := gw.MpoolPush(ctx, sm)
-	if aerr != nil {
-		return cid.Undef, aerr
+	params, err := actors.SerializeParams(&markettypes.WithdrawBalanceParams{
+		ProviderOrClientAddress: w,
+		Amount:                  amount,
+	})
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("serializing params: %w", err)
 	}
 
-	log.Infow("add market balance", "cid", c, "amount", amount)
+	c, err := r.sendMessage(ctx, gw, &types.Message{
+		To:     marketactor.Address,
+		From:   w,
+		Value:  big.Zero(),
+		Method: marketactor.Methods.WithdrawBalance,
+		Params: params,
+	}, string(iface.LedgerMarketWithdraw), amount)
+	if err != nil {
+		return cid.Undef, err
+	}
 
-	return c, nil
-}
+	log.Infow("withdraw market balance", "cid", c, "amount", amount)
 
-func (r *ribs) MarketWithdraw(ctx context.Context, amount abi.TokenAmount) (cid.Cid, error) {
-	//TODO implement me
-	panic("implement me")
+	return c, nil
 }
 
 func (r *ribs) Withdraw(ctx context.Context, amount abi.TokenAmount, to address.Address) (cid.Cid, error) {
-	//TODO implement me
-	panic("implement me")
-}
+	r.marketFundsLk.Lock()
+	defer r.marketFundsLk.Unlock()
 
-func (r *ribs) watchMarket(ctx context.Context) {
-	defer close(r.marketWatchClosed)
+	if !amount.GreaterThan(big.Zero()) {
+		return cid.Undef, xerrors.Errorf("withdraw amount must be positive")
+	}
+	if to == address.Undef {
+		return cid.Undef, xerrors.Errorf("withdraw destination address not set")
+	}
 
-	for {
-		select {
-		case <-r.close:
-			return
-		default:
-		}
+	gw, closer, err := client.NewGatewayRPCV1(ctx, r.lotusRPCAddr, nil)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("creating gateway rpc client: %w", err)
+	}
+	defer closer()
 
-		i, err := r.WalletInfo()
-		if err != nil {
-			goto cooldown
-		}
-		{
-			avail := types.BigSub(i.MarketBalanceDetailed.Escrow, i.MarketBalanceDetailed.Locked)
+	w, err := r.wallet.GetDefault()
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("getting default wallet: %w", err)
+	}
 
-			if avail.GreaterThan(minMarketBalance) {
-				goto cooldown
-			}
+	b, err := gw.WalletBalance(ctx, w)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("getting wallet balance: %w", err)
+	}
+	if amount.GreaterThan(b) {
+		return cid.Undef, xerrors.Errorf("withdraw amount %s exceeds wallet balance %s", types.FIL(amount), types.FIL(b))
+	}
+
+	c, err := r.sendMessage(ctx, gw, &types.Message{
+		To:     to,
+		From:   w,
+		Value:  amount,
+		Method: builtin.MethodSend,
+	}, string(iface.LedgerWithdraw), amount)
+	if err != nil {
+		return cid.Undef, err
+	}
 
-			log.Infow("market balance low, topping up")
+	log.Infow("withdraw from wallet", "cid", c, "amount", amount, "to", to)
 
-			toAdd := big.Sub(autoMarketBalance, avail)
+	return c, nil
+}
 
-			c, err := r.MarketAdd(ctx, toAdd)
-			if err != nil {
-				log.Errorw("error adding market funds", "error", err)
-				goto cooldown
-			}
+func (r *ribs) watchMarket(ctx context.Context) {
+	defer close(r.marketWatchClosed)
 
-			log.Errorw("AUTO-ADDED MARKET FUNDS", "amount", types.FIL(toAdd), "msg", c)
+	for {
+		if err := r.topUpMarket(ctx); err != nil {
+			log.Errorw("market top-up failed", "error", err)
 		}
 
-	cooldown:
 		select {
 		case <-r.close:
 			return
@@ -137,71 +175,86 @@ func (r *ribs) watchMarket(ctx context.Context) {
 	}
 }
 
-func _must(err error, msgAndArgs ...interface{}) {
+// topUpMarket adds funds to escrow of client wallets with low available market
+// balance, within the total budget
+func (r *ribs) topUpMarket(ctx context.Context) error {
+	wallets, err := r.Wallets()
 	if err != nil {
-		if len(msgAndArgs) == 0 {
-			panic(err)
-		}
-		panic(xerrors.Errorf(msgAndArgs[0].(string)+": %w", err))
+		return xerrors.Errorf("getting wallets: %w", err)
 	}
-}
 
-func (r *ribs) WalletInfo() (iface.WalletInfo, error) {
-	r.marketFundsLk.Lock()
-	defer r.marketFundsLk.Unlock()
+	cfg := r.dealCfg.get()
 
-	if r.cachedWalletInfo != nil && time.Since(r.lastWalletInfoUpdate) < walletUpgradeInterval {
-		return *r.cachedWalletInfo, nil
-	}
+	var c spendCommitments
+	var haveCommitments bool
 
-	addr, err := r.wallet.GetDefault()
-	if err != nil {
-		return iface.WalletInfo{}, xerrors.Errorf("get default wallet: %w", err)
+	// the total budget caps escrow of all wallets together
+	escrow := big.Zero()
+	for _, w := range wallets {
+		escrow = big.Add(escrow, w.MarketBalanceDetailed.Escrow)
 	}
 
-	ctx := context.TODO()
+	for _, w := range wallets {
+		switch w.Role {
+		case iface.WalletRoleDisabled, iface.WalletRoleVerified:
+			// verified deals don't need client escrow
+			continue
+		}
 
-	gw, closer, err := client.NewGatewayRPCV1(ctx, r.lotusRPCAddr, nil)
-	if err != nil {
-		panic(err)
-	}
-	defer closer()
+		avail := types.BigSub(w.MarketBalanceDetailed.Escrow, w.MarketBalanceDetailed.Locked)
+		if avail.GreaterThan(cfg.MinMarketBalance) {
+			continue
+		}
 
-	b, err := gw.WalletBalance(ctx, addr)
-	if err != nil {
-		return iface.WalletInfo{}, xerrors.Errorf("get wallet balance: %w", err)
-	}
+		log.Infow("market balance low, topping up", "wallet", w.Addr)
 
-	mb, err := gw.StateMarketBalance(ctx, addr, types.EmptyTSK)
-	if err != nil {
-		return iface.WalletInfo{}, xerrors.Errorf("get market balance: %w", err)
-	}
+		toAdd := big.Sub(cfg.AutoMarketBalance, avail)
 
-	dc, err := gw.StateVerifiedClientStatus(ctx, addr, types.EmptyTSK)
-	if err != nil {
-		return iface.WalletInfo{}, xerrors.Errorf("get verified client status: %w", err)
-	}
+		if !haveCommitments {
+			c, _, err = r.spendCommitments(ctx)
+			if err != nil {
+				return xerrors.Errorf("getting spend commitments: %w", err)
+			}
+			haveCommitments = true
+		}
 
-	id, err := gw.StateLookupID(ctx, addr, types.EmptyTSK)
-	if err != nil {
-		return iface.WalletInfo{}, xerrors.Errorf("get address id: %w", err)
-	}
+		if limited := budgetTopUp(cfg, c, escrow, toAdd); !limited.Equals(toAdd) {
+			log.Warnw("market top-up limited by total budget", "wallet", w.Addr, "wanted", types.FIL(toAdd), "limited", types.FIL(limited))
+			toAdd = limited
+		}
+		if !toAdd.GreaterThan(big.Zero()) {
+			continue
+		}
 
-	wi := iface.WalletInfo{
-		Addr:                  addr.String(),
-		IDAddr:                id.String(),
-		Balance:               types.FIL(b).Short(),
-		MarketBalance:         types.FIL(mb.Escrow).Short(),
-		MarketLocked:          types.FIL(mb.Locked).Short(),
-		MarketBalanceDetailed: mb,
-	}
+		if toAdd.GreaterThan(w.BalanceDetailed) {
+			log.Warnw("wallet balance too low for market top-up", "wallet", w.Addr, "balance", types.FIL(w.BalanceDetailed), "wanted", types.FIL(toAdd))
+			continue
+		}
 
-	if dc != nil {
-		wi.DataCap = types.SizeStr(*dc)
+		addr, err := address.NewFromString(w.Addr)
+		if err != nil {
+			return xerrors.Errorf("parsing wallet address: %w", err)
+		}
+
+		m, err := r.marketAdd(ctx, addr, toAdd)
+		if err != nil {
+			log.Errorw("error adding market funds", "wallet", w.Addr, "error", err)
+			continue
+		}
+
+		escrow = big.Add(escrow, toAdd)
+
+		log.Errorw("AUTO-ADDED MARKET FUNDS", "wallet", w.Addr, "amount", types.FIL(toAdd), "msg", m)
 	}
 
-	r.cachedWalletInfo = &wi
-	r.lastWalletInfoUpdate = time.Now()
+	return nil
+}
 
-	return wi, nil
+func _must(err error, msgAndArgs ...interface{}) {
+	if err != nil {
+		if len(msgAndArgs) == 0 {
+			panic(err)
+		}
+		panic(xerrors.Errorf(msgAndArgs[0].(string)+": %w", err))
+	}
 }
@@ -0,0 +1,274 @@
+package rbdeal
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/client"
+	"github.com/filecoin-project/lotus/chain/types"
+	iface "github.com/lotus-web3/ribs"
+	"golang.org/x/xerrors"
+)
+
+func (r *ribs) WalletInfo() (iface.WalletInfo, error) {
+	ws, err := r.Wallets()
+	if err != nil {
+		return iface.WalletInfo{}, err
+	}
+
+	for _, w := range ws {
+		if w.Default {
+			return w, nil
+		}
+	}
+
+	return iface.WalletInfo{}, xerrors.Errorf("no default wallet")
+}
+
+func (r *ribs) Wallets() ([]iface.WalletInfo, error) {
+	r.marketFundsLk.Lock()
+	defer r.marketFundsLk.Unlock()
+
+	if r.cachedWallets != nil && time.Since(r.lastWalletInfoUpdate) < walletUpgradeInterval {
+		return r.cachedWallets, nil
+	}
+
+	ctx := context.TODO()
+
+	addrs, err := r.wallet.WalletList(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("listing wallets: %w", err)
+	}
+
+	def, err := r.wallet.GetDefault()
+	if err != nil {
+		return nil, xerrors.Errorf("get default wallet: %w", err)
+	}
+
+	roles, err := r.db.WalletRoles()
+	if err != nil {
+		return nil, err
+	}
+
+	gw, closer, err := client.NewGatewayRPCV1(ctx, r.lotusRPCAddr, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("creating gateway rpc client: %w", err)
+	}
+	defer closer()
+
+	out := make([]iface.WalletInfo, 0, len(addrs))
+	for _, addr := range addrs {
+		wi, err := walletState(ctx, gw, addr)
+		if err != nil {
+			return nil, xerrors.Errorf("wallet %s: %w", addr, err)
+		}
+
+		wi.Default = addr == def
+		wi.Role = iface.WalletRoleAny
+		if role, ok := roles[addr]; ok {
+			wi.Role = role
+		}
+
+		out = append(out, wi)
+	}
+
+	r.cachedWallets = out
+	r.lastWalletInfoUpdate = time.Now()
+
+	return out, nil
+}
+
+// walletState returns the on-chain state of a wallet. Wallets which were
+// never funded have zero balances.
+func walletState(ctx context.Context, gw api.Gateway, addr address.Address) (iface.WalletInfo, error) {
+	wi := iface.WalletInfo{
+		Addr: addr.String(),
+		MarketBalanceDetailed: api.MarketBalance{
+			Escrow: big.Zero(),
+			Locked: big.Zero(),
+		},
+	}
+
+	b, err := gw.WalletBalance(ctx, addr)
+	if err != nil {
+		return wi, xerrors.Errorf("get wallet balance: %w", err)
+	}
+	wi.BalanceDetailed = b
+	wi.Balance = types.FIL(b).Short()
+
+	id, err := gw.StateLookupID(ctx, addr, types.EmptyTSK)
+	if err != nil {
+		// not on chain yet
+		wi.MarketBalance = types.FIL(big.Zero()).Short()
+		wi.MarketLocked = types.FIL(big.Zero()).Short()
+		return wi, nil
+	}
+	wi.IDAddr = id.String()
+
+	mb, err := gw.StateMarketBalance(ctx, addr, types.EmptyTSK)
+	if err != nil {
+		return wi, xerrors.Errorf("get market balance: %w", err)
+	}
+	wi.MarketBalanceDetailed = mb
+	wi.MarketBalance = types.FIL(mb.Escrow).Short()
+	wi.MarketLocked = types.FIL(mb.Locked).Short()
+
+	dc, err := gw.StateVerifiedClientStatus(ctx, addr, types.EmptyTSK)
+	if err != nil {
+		return wi, xerrors.Errorf("get verified client status: %w", err)
+	}
+	if dc != nil {
+		wi.DataCap = types.SizeStr(*dc)
+		wi.DataCapDetailed = dc
+	}
+
+	return wi, nil
+}
+
+func (r *ribs) NewWallet(ctx context.Context) (address.Address, error) {
+	a, err := r.wallet.WalletNew(ctx, types.KTSecp256k1)
+	if err != nil {
+		return address.Undef, xerrors.Errorf("creating wallet: %w", err)
+	}
+
+	r.invalidateWallets()
+
+	log.Infow("created client wallet", "addr", a)
+	return a, nil
+}
+
+func (r *ribs) SetWalletRole(addr address.Address, role iface.WalletRole) error {
+	switch role {
+	case iface.WalletRoleAny, iface.WalletRoleVerified, iface.WalletRoleUnverified, iface.WalletRoleDisabled:
+	default:
+		return xerrors.Errorf("unknown wallet role %q", role)
+	}
+
+	addrs, err := r.wallet.WalletList(context.TODO())
+	if err != nil {
+		return xerrors.Errorf("listing wallets: %w", err)
+	}
+	var found bool
+	for _, a := range addrs {
+		found = found || a == addr
+	}
+	if !found {
+		return xerrors.Errorf("wallet %s not found", addr)
+	}
+
+	if err := r.db.SetWalletRole(addr, role); err != nil {
+		return err
+	}
+
+	r.invalidateWallets()
+	return nil
+}
+
+func (r *ribs) invalidateWallets() {
+	r.marketFundsLk.Lock()
+	defer r.marketFundsLk.Unlock()
+
+	r.cachedWallets = nil
+}
+
+// selectClientWallet picks the client wallet for a deal with the given
+// verification policy, and whether the deal is verified. Verified deals go to
+// the wallet with most DataCap, unverified ones to the wallet with most
+// available escrow.
+func selectClientWallet(ws []iface.WalletInfo, v iface.DealVerification, minDatacap abi.StoragePower) (iface.WalletInfo, bool, error) {
+	var verif, unverif []iface.WalletInfo
+	var lowDatacap bool
+
+	for _, w := range ws {
+		isClient := w.DataCapDetailed != nil
+
+		switch w.Role {
+		case iface.WalletRoleAny, iface.WalletRoleVerified:
+			if isClient && !w.DataCapDetailed.LessThan(minDatacap) {
+				verif = append(verif, w)
+			}
+			lowDatacap = lowDatacap || (isClient && w.DataCapDetailed.LessThan(minDatacap))
+		}
+
+		switch w.Role {
+		case iface.WalletRoleUnverified:
+			unverif = append(unverif, w)
+		case iface.WalletRoleAny:
+			// verified clients only make unverified deals when asked to
+			if !isClient || v == iface.DealVerificationUnverified {
+				unverif = append(unverif, w)
+			}
+		}
+	}
+
+	if v != iface.DealVerificationUnverified && len(verif) > 0 {
+		sort.SliceStable(verif, func(i, j int) bool {
+			return verif[i].DataCapDetailed.GreaterThan(*verif[j].DataCapDetailed)
+		})
+		return verif[0], true, nil
+	}
+
+	switch {
+	case v == iface.DealVerificationVerified:
+		return iface.WalletInfo{}, false, xerrors.Errorf("no client wallet with at least %s datacap", types.SizeStr(minDatacap))
+	case len(unverif) == 0 && lowDatacap:
+		return iface.WalletInfo{}, false, xerrors.Errorf("not starting additional verified deals: datacap too low (min %s)", types.SizeStr(minDatacap))
+	case len(unverif) == 0:
+		return iface.WalletInfo{}, false, xerrors.Errorf("no client wallet for unverified deals")
+	}
+
+	avail := func(w iface.WalletInfo) abi.TokenAmount {
+		return big.Sub(w.MarketBalanceDetailed.Escrow, w.MarketBalanceDetailed.Locked)
+	}
+	sort.SliceStable(unverif, func(i, j int) bool {
+		return avail(unverif[i]).GreaterThan(avail(unverif[j]))
+	})
+
+	return unverif[0], false, nil
+}
+
+func (r *ribsDB) WalletRoles() (map[address.Address]iface.WalletRole, error) {
+	rows, err := r.db.Query(`select addr, role from wallet_roles`)
+	if err != nil {
+		return nil, xerrors.Errorf("querying wallet roles: %w", err)
+	}
+	defer rows.Close()
+
+	out := map[address.Address]iface.WalletRole{}
+	for rows.Next() {
+		var a string
+		var role iface.WalletRole
+		if err := rows.Scan(&a, &role); err != nil {
+			return nil, xerrors.Errorf("scanning wallet role: %w", err)
+		}
+
+		addr, err := address.NewFromString(a)
+		if err != nil {
+			return nil, xerrors.Errorf("parsing wallet address: %w", err)
+		}
+		out[addr] = role
+	}
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("iterating wallet roles: %w", err)
+	}
+
+	return out, nil
+}
+
+func (r *ribsDB) SetWalletRole(addr address.Address, role iface.WalletRole) error {
+	var err error
+	if role == iface.WalletRoleAny {
+		_, err = r.db.Exec(`delete from wallet_roles where addr = ?`, addr.String())
+	} else {
+		_, err = r.db.Exec(`insert into wallet_roles (addr, role) values (?, ?) on conflict (addr) do update set role = excluded.role`, addr.String(), role)
+	}
+	if err != nil {
+		return xerrors.Errorf("setting wallet role: %w", err)
+	}
+	return nil
+}
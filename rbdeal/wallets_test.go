@@ -0,0 +1,84 @@
+package rbdeal
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/api"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectClientWallet(t *testing.T) {
+	dc := func(v int64) *abi.StoragePower {
+		p := big.NewInt(v)
+		return &p
+	}
+	wallet := func(addr string, role iface.WalletRole, datacap *abi.StoragePower, escrow int64) iface.WalletInfo {
+		return iface.WalletInfo{
+			Addr:            addr,
+			Role:            role,
+			DataCapDetailed: datacap,
+			MarketBalanceDetailed: api.MarketBalance{
+				Escrow: big.NewInt(escrow),
+				Locked: big.Zero(),
+			},
+		}
+	}
+	min := big.NewInt(100)
+
+	ws := []iface.WalletInfo{
+		wallet("small-dc", iface.WalletRoleAny, dc(200), 0),
+		wallet("big-dc", iface.WalletRoleVerified, dc(1000), 0),
+		wallet("low-dc", iface.WalletRoleAny, dc(50), 50),
+		wallet("fil", iface.WalletRoleAny, nil, 10),
+		wallet("fil-rich", iface.WalletRoleUnverified, dc(5000), 20),
+		wallet("off", iface.WalletRoleDisabled, dc(10000), 1000),
+	}
+
+	w, verified, err := selectClientWallet(ws, iface.DealVerificationAuto, min)
+	require.NoError(t, err)
+	require.True(t, verified)
+	require.Equal(t, "big-dc", w.Addr)
+
+	w, verified, err = selectClientWallet(ws, iface.DealVerificationUnverified, min)
+	require.NoError(t, err)
+	require.False(t, verified)
+	require.Equal(t, "low-dc", w.Addr)
+
+	// without enough datacap verified-only policies don't make deals
+	noDc := []iface.WalletInfo{ws[2], ws[3], ws[5]}
+	_, _, err = selectClientWallet(noDc, iface.DealVerificationVerified, min)
+	require.Error(t, err)
+
+	// auto falls back to wallets which aren't verified clients
+	w, verified, err = selectClientWallet(noDc, iface.DealVerificationAuto, min)
+	require.NoError(t, err)
+	require.False(t, verified)
+	require.Equal(t, "fil", w.Addr)
+
+	// but doesn't spend FIL from a verified client out of datacap
+	_, _, err = selectClientWallet([]iface.WalletInfo{ws[2]}, iface.DealVerificationAuto, min)
+	require.ErrorContains(t, err, "datacap too low")
+}
+
+func TestWalletRoles(t *testing.T) {
+	db := openFixtureDB(t, nil)
+
+	a, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+
+	require.NoError(t, db.SetWalletRole(a, iface.WalletRoleVerified))
+	require.NoError(t, db.SetWalletRole(a, iface.WalletRoleDisabled))
+
+	roles, err := db.WalletRoles()
+	require.NoError(t, err)
+	require.Equal(t, map[address.Address]iface.WalletRole{a: iface.WalletRoleDisabled}, roles)
+
+	require.NoError(t, db.SetWalletRole(a, iface.WalletRoleAny))
+	roles, err = db.WalletRoles()
+	require.NoError(t, err)
+	require.Empty(t, roles)
+}
@@ -125,3 +125,26 @@ func TestFullGroup(t *testing.T) {
 
 	require.NoError(t, ri.Close())
 }
+
+func TestBatchPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	ri, err := Open(t.TempDir())
+	require.NoError(t, err)
+	defer ri.Close()
+	require.NoError(t, ri.Start())
+	r := ri.(*rbs)
+
+	wb := ri.Session(ctx).Batch(ctx)
+	require.NoError(t, wb.Policy(ctx, "archive"))
+	require.NoError(t, wb.Put(ctx, []blocks.Block{blocks.NewBlock([]byte("hello policy"))}))
+	require.NoError(t, wb.Flush(ctx))
+
+	groups, err := r.db.Groups()
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+
+	var policy string
+	require.NoError(t, r.db.db.QueryRow(`select policy from group_policies where group_id = ?`, groups[0]).Scan(&policy))
+	require.Equal(t, "archive", policy)
+}
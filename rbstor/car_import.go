@@ -0,0 +1,158 @@
+package rbstor
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	blocks "github.com/ipfs/go-block-format"
+	carv2 "github.com/ipld/go-car/v2"
+	iface "github.com/lotus-web3/ribs"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// blocks are deduplicated and written in batches of this size
+var importBatchBytes int64 = 16 << 20
+
+// groups written by an import are synced after this many bytes are written
+var importFlushBytes int64 = 1 << 30
+
+func (r *rbs) ImportCar(ctx context.Context, car io.Reader, opts iface.ImportCarOpts, progress func(iface.ImportProgress)) (iface.ImportProgress, error) {
+	var res iface.ImportProgress
+
+	// verifies block hashes unless the car is marked as trusted
+	br, err := carv2.NewBlockReader(car)
+	if err != nil {
+		return res, xerrors.Errorf("opening car reader: %w", err)
+	}
+
+	if opts.PreserveRoots {
+		res.Roots = br.Roots
+	}
+
+	b := &ribBatch{
+		r:                  r,
+		currentWriteTarget: iface.UndefGroupKey,
+		toFlush:            map[iface.GroupKey]struct{}{},
+	}
+
+	seenGroups := map[iface.GroupKey]struct{}{}
+	var sinceFlush int64
+
+	flush := func() error {
+		// flush resets batch roots, so roots are recorded in every group
+		// the import wrote to
+		if err := b.Roots(ctx, res.Roots); err != nil {
+			return err
+		}
+		if err := b.Flush(ctx); err != nil {
+			return xerrors.Errorf("flushing import batch: %w", err)
+		}
+
+		sinceFlush = 0
+		return nil
+	}
+
+	var pending []blocks.Block
+	var pendingBytes int64
+
+	writePending := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+
+		hashes := make([]mh.Multihash, len(pending))
+		for i, blk := range pending {
+			hashes[i] = blk.Cid().Hash()
+		}
+
+		stored := make([]bool, len(pending))
+		err := r.index.GetGroups(ctx, hashes, func(cidx int, gk iface.GroupKey) (bool, error) {
+			stored[cidx] = true
+			return false, nil
+		})
+		if err != nil {
+			return xerrors.Errorf("checking for stored blocks: %w", err)
+		}
+
+		toWrite := make([]blocks.Block, 0, len(pending))
+		inBatch := map[string]struct{}{}
+		for i, blk := range pending {
+			_, dup := inBatch[string(hashes[i])]
+			if stored[i] || dup {
+				res.DuplicateBlocks++
+				res.DuplicateBytes += int64(len(blk.RawData()))
+				continue
+			}
+			inBatch[string(hashes[i])] = struct{}{}
+
+			toWrite = append(toWrite, blk)
+			sinceFlush += int64(len(blk.RawData()))
+		}
+
+		if err := b.Put(ctx, toWrite); err != nil {
+			return xerrors.Errorf("writing blocks: %w", err)
+		}
+		for g := range b.toFlush {
+			if _, seen := seenGroups[g]; !seen {
+				seenGroups[g] = struct{}{}
+				res.Groups = append(res.Groups, g)
+			}
+		}
+
+		pending = pending[:0]
+		pendingBytes = 0
+
+		if sinceFlush >= importFlushBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		if progress != nil {
+			progress(res)
+		}
+		return nil
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+
+		blk, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return res, xerrors.Errorf("reading block %d: %w", res.Blocks, err)
+		}
+
+		res.Blocks++
+		res.Bytes += int64(len(blk.RawData()))
+
+		pending = append(pending, blk)
+		pendingBytes += int64(len(blk.RawData()))
+
+		if pendingBytes >= importBatchBytes {
+			if err := writePending(); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	if err := writePending(); err != nil {
+		return res, err
+	}
+	if err := flush(); err != nil {
+		return res, err
+	}
+
+	res.Done = true
+	if progress != nil {
+		progress(res)
+	}
+
+	return res, nil
+}
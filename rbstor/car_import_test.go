@@ -0,0 +1,96 @@
+package rbstor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func testImportCar(t *testing.T, roots []cid.Cid, blks []blocks.Block, corrupt int) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, car.WriteHeader(&car.CarHeader{Roots: roots, Version: 1}, &buf))
+
+	for i, b := range blks {
+		data := b.RawData()
+		if i == corrupt {
+			data = append([]byte{}, data...)
+			data[0] ^= 0xff
+		}
+		require.NoError(t, carutil.LdWrite(&buf, b.Cid().Bytes(), data))
+	}
+
+	return buf.Bytes()
+}
+
+func TestImportCar(t *testing.T) {
+	ctx := context.Background()
+
+	ri, err := Open(t.TempDir())
+	require.NoError(t, err)
+	defer ri.Close()
+	require.NoError(t, ri.Start())
+
+	blks := make([]blocks.Block, 100)
+	for i := range blks {
+		data := make([]byte, 200)
+		binary.LittleEndian.PutUint64(data, uint64(i))
+		blks[i] = blocks.NewBlock(data)
+	}
+
+	// one block already stored
+	wb := ri.Session(ctx).Batch(ctx)
+	require.NoError(t, wb.Put(ctx, blks[:1]))
+	require.NoError(t, wb.Flush(ctx))
+
+	// duplicate section in the car
+	carBlks := append(append([]blocks.Block{}, blks...), blks[5])
+	carData := testImportCar(t, []cid.Cid{blks[0].Cid()}, carBlks, -1)
+
+	var updates int
+	res, err := ri.Storage().ImportCar(ctx, bytes.NewReader(carData), iface.ImportCarOpts{PreserveRoots: true}, func(p iface.ImportProgress) {
+		updates++
+	})
+	require.NoError(t, err)
+	require.True(t, res.Done)
+	require.NotZero(t, updates)
+	require.Equal(t, int64(101), res.Blocks)
+	require.Equal(t, int64(2), res.DuplicateBlocks)
+	require.Equal(t, []cid.Cid{blks[0].Cid()}, res.Roots)
+	require.NotEmpty(t, res.Groups)
+
+	hashes := make([]multihash.Multihash, len(blks))
+	for i, b := range blks {
+		hashes[i] = b.Cid().Hash()
+	}
+
+	found := map[int]struct{}{}
+	err = ri.Session(ctx).View(ctx, hashes, func(cidx int, data []byte) {
+		require.Equal(t, blks[cidx].RawData(), data)
+		found[cidx] = struct{}{}
+	})
+	require.NoError(t, err)
+	require.Len(t, found, len(blks))
+
+	// importing again writes nothing
+	res, err = ri.Storage().ImportCar(ctx, bytes.NewReader(carData), iface.ImportCarOpts{}, nil)
+	require.NoError(t, err)
+	require.Equal(t, res.Blocks, res.DuplicateBlocks)
+	require.Nil(t, res.Roots)
+
+	// block data not matching the cid is rejected
+	more := make([]blocks.Block, 3)
+	for i := range more {
+		more[i] = blocks.NewBlock([]byte{byte(i), 1, 2, 3})
+	}
+	_, err = ri.Storage().ImportCar(ctx, bytes.NewReader(testImportCar(t, nil, more, 1)), iface.ImportCarOpts{}, nil)
+	require.ErrorContains(t, err, "reading block 1")
+}
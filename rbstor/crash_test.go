@@ -0,0 +1,133 @@
+package rbstor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/carlog"
+	"github.com/lotus-web3/ribs/carlog/faultfs"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+const crashBatches = 4
+
+func crashBatch(batch int) []blocks.Block {
+	return faultfs.Blocks(batch, 10)
+}
+
+// crashWorkload writes batches of blocks spanning multiple groups, recording
+// blocks of successfully flushed batches in committed. Nothing is synced on
+// return, as if the process died.
+func crashWorkload(root string, ffs *faultfs.FS, committed map[string][]byte) error {
+	ctx := context.Background()
+
+	ri, err := Open(root, WithWritableIndex(carlog.IndexHashLog), withCarLogOptions(carlog.WithFS(ffs)))
+	if err != nil {
+		return err
+	}
+	r := ri.(*rbs)
+	defer r.index.Close() // nolint:errcheck
+
+	sess := r.Session(ctx)
+
+	for batch := 0; batch < crashBatches; batch++ {
+		blks := crashBatch(batch)
+
+		wb := sess.Batch(ctx)
+		if err := wb.Put(ctx, blks); err != nil {
+			return err
+		}
+		if err := wb.Flush(ctx); err != nil {
+			return err
+		}
+
+		for _, b := range blks {
+			committed[string(b.Cid().Hash())] = b.RawData()
+		}
+	}
+
+	return nil
+}
+
+func requireIndexMatchesGroups(ctx context.Context, t *testing.T, r *rbs, committed map[string][]byte) {
+	var all []multihash.Multihash
+	for batch := 0; batch < crashBatches; batch++ {
+		for _, b := range crashBatch(batch) {
+			all = append(all, b.Cid().Hash())
+		}
+	}
+
+	indexed := map[int][]iface.GroupKey{}
+	err := r.index.GetGroups(ctx, all, func(cidx int, group iface.GroupKey) (bool, error) {
+		indexed[cidx] = append(indexed[cidx], group)
+		return true, nil
+	})
+	require.NoError(t, err)
+
+	// uncommitted blocks may be left as orphan entries in the top index (see
+	// Group.Put), but committed blocks must be indexed to a group which has them
+	for cidx, m := range all {
+		data, isCommitted := committed[string(m)]
+		if !isCommitted {
+			continue
+		}
+
+		var found bool
+		for _, g := range indexed[cidx] {
+			err := r.withReadableGroup(ctx, g, func(group *Group) error {
+				return group.View(ctx, []multihash.Multihash{m}, func(_ int, ok bool, b []byte) {
+					if ok {
+						require.Equal(t, data, b)
+						found = true
+					}
+				})
+			})
+			require.NoError(t, err)
+		}
+		require.True(t, found, "committed block %s not found in indexed groups %v", m, indexed[cidx])
+	}
+
+	// and reads through the session see all committed data
+	var mhs []multihash.Multihash
+	for k := range committed {
+		mhs = append(mhs, multihash.Multihash(k))
+	}
+	seen := map[int]bool{}
+	err = r.Session(ctx).View(ctx, mhs, func(cidx int, data []byte) {
+		require.Equal(t, committed[string(mhs[cidx])], data)
+		seen[cidx] = true
+	})
+	require.NoError(t, err)
+	require.Len(t, seen, len(mhs))
+}
+
+func TestRbstorCrash(t *testing.T) {
+	oldBlocks := maxGroupBlocks
+	maxGroupBlocks = 16 // spread batches over multiple groups
+	t.Cleanup(func() {
+		maxGroupBlocks = oldBlocks
+	})
+
+	faultfs.Run(t, crashWorkload, func(t *testing.T, root string, crashAt int, committed map[string][]byte) {
+		ctx := context.Background()
+
+		ri, err := Open(root, WithWritableIndex(carlog.IndexHashLog))
+		require.NoError(t, err, "reopen after crash at op %d", crashAt)
+		r := ri.(*rbs)
+
+		t.Run(fmt.Sprintf("op-%d", crashAt), func(t *testing.T) {
+			requireIndexMatchesGroups(ctx, t, r, committed)
+
+			// the store must accept writes after recovery
+			wb := r.Session(ctx).Batch(ctx)
+			require.NoError(t, wb.Put(ctx, crashBatch(crashBatches)))
+			require.NoError(t, wb.Flush(ctx))
+		})
+
+		require.NoError(t, r.index.Close())
+	})
+}
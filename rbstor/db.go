@@ -82,6 +82,18 @@ create table if not exists offloads
 
 create index if not exists offloads_group_id_index
 	on offloads (group_id);
+
+/* replication policy class names, interpreted by the deal layer */
+create table if not exists group_policies
+(
+	group_id integer not null
+		constraint group_policies_pk
+			primary key
+		constraint group_policies_groups_id_fk
+			references groups
+				on update cascade on delete cascade,
+	policy text not null
+);
 `
 
 type rbsDB struct {
@@ -426,3 +438,12 @@ func (r *rbsDB) WriteOffloadEntry(gid iface.GroupKey) (err error) {
 	}
 	return nil
 }
+
+func (r *rbsDB) SetGroupPolicy(gid iface.GroupKey, policy string) error {
+	_, err := r.db.Exec(`INSERT INTO group_policies (group_id, policy) VALUES (?, ?)
+		ON CONFLICT (group_id) DO UPDATE SET policy = EXCLUDED.policy`, gid, policy)
+	if err != nil {
+		return xerrors.Errorf("setting group policy: %w", err)
+	}
+	return nil
+}
@@ -21,6 +21,7 @@ func (r *rbs) GroupMeta(gk iface.GroupKey) (iface.GroupMeta, error) {
 	if err != nil {
 		return iface.GroupMeta{}, xerrors.Errorf("get group meta: %w", err)
 	}
+	m.MaxBlocks, m.MaxBytes = r.maxGroupBlocks, r.maxGroupSize
 
 	r.lk.Lock()
 	g, ok := r.openGroups[gk]
@@ -2,6 +2,7 @@ package rbstor
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"path/filepath"
@@ -21,8 +22,8 @@ import (
 	"golang.org/x/xerrors"
 )
 
+// default group size limits, see WithGroupLimits
 var (
-	// TODO: make this configurable
 	maxGroupSize int64 = 29500 << 20
 
 	maxGroupBlocks int64 = 20 << 20
@@ -61,6 +62,9 @@ type Group struct {
 	committedBlocks int64
 	committedSize   int64
 
+	// size limits, the group becomes full when reached
+	maxSize, maxBlocks int64
+
 	// atomic perf/diag counters
 	readBlocks  atomic.Int64
 	readSize    atomic.Int64
@@ -78,7 +82,7 @@ type Group struct {
 
 func OpenGroup(ctx context.Context, db *rbsDB, index iface.Index, staging *atomic.Pointer[iface.StagingStorageProvider],
 	id, committedBlocks, committedSize, recordedHead int64,
-	path string, state iface.GroupState, create bool) (*Group, error) {
+	path string, state iface.GroupState, create bool, jbOpts ...carlog.OpenOption) (*Group, error) {
 	groupPath := filepath.Join(path, "grp", strconv.FormatInt(id, 32))
 
 	if err := os.MkdirAll(groupPath, 0755); err != nil {
@@ -101,13 +105,30 @@ func OpenGroup(ctx context.Context, db *rbsDB, index iface.Index, staging *atomi
 		}
 	}
 
-	jb, err := jbOpenFunc(stw, filepath.Join(groupPath, "blklog.meta"), groupPath, func(to int64, h []mh.Multihash) error {
+	jbPath := filepath.Join(groupPath, "blklog.meta")
+	tc := func(to int64, h []mh.Multihash) error {
 		if to < recordedHead {
 			return xerrors.Errorf("cannot rewind jbob head to %d, recorded group head is %d", to, recordedHead)
 		}
 
 		return index.DropGroup(ctx, h, id)
-	})
+	}
+
+	jb, err := jbOpenFunc(stw, jbPath, groupPath, tc, jbOpts...)
+	if errors.Is(err, carlog.ErrNotCreated) && committedBlocks == 0 {
+		// unclean shutdown while creating the group, nothing was committed to it
+		log.Warnw("group carlog creation didn't complete, recreating", "group", id, "path", groupPath)
+
+		fs := carlog.OptionsFS(jbOpts...)
+		if err := fs.RemoveAll(groupPath); err != nil {
+			return nil, xerrors.Errorf("removing incomplete group directory: %w", err)
+		}
+		if err := fs.Mkdir(groupPath, 0755); err != nil {
+			return nil, xerrors.Errorf("create group directory: %w", err)
+		}
+
+		jb, err = carlog.Create(stw, jbPath, groupPath, tc, jbOpts...)
+	}
 	if err != nil {
 		return nil, xerrors.Errorf("open jbob (grp: %s): %w", groupPath, err)
 	}
@@ -122,6 +143,9 @@ func OpenGroup(ctx context.Context, db *rbsDB, index iface.Index, staging *atomi
 		committedBlocks: committedBlocks,
 		committedSize:   committedSize,
 
+		maxSize:   maxGroupSize,
+		maxBlocks: maxGroupBlocks,
+
 		path:  groupPath,
 		id:    id,
 		state: state,
@@ -150,13 +174,13 @@ func (m *Group) Put(ctx context.Context, b []blocks.Block) (int, error) {
 	}
 
 	// reserve space
-	availSpace := maxGroupSize - m.committedSize - m.inflightSize // todo async - inflight
+	availSpace := m.maxSize - m.committedSize - m.inflightSize // todo async - inflight
 
 	var writeSize int64
 	var writeBlocks int
 
 	for _, blk := range b {
-		if int64(len(blk.RawData()))+writeSize > availSpace || m.committedBlocks+int64(writeBlocks) >= maxGroupBlocks {
+		if int64(len(blk.RawData()))+writeSize > availSpace || m.committedBlocks+int64(writeBlocks) >= m.maxBlocks {
 			break
 		}
 		writeSize += int64(len(blk.RawData()))
@@ -241,6 +265,23 @@ func (m *Group) Put(ctx context.Context, b []blocks.Block) (int, error) {
 	return writeBlocks, nil
 }
 
+// AddRoots records roots of DAGs written to the group, see carlog.AddRoots
+func (m *Group) AddRoots(roots []cid.Cid) error {
+	if len(roots) == 0 {
+		return nil
+	}
+
+	m.dataLk.Lock()
+	defer m.dataLk.Unlock()
+
+	if m.state != iface.GroupStateWritable {
+		// roots are hints, they are dropped once the group is full
+		return nil
+	}
+
+	return m.jb.AddRoots(roots)
+}
+
 func (m *Group) Sync(ctx context.Context) error {
 	m.dataLk.Lock()
 	defer m.dataLk.Unlock()
@@ -339,6 +380,18 @@ func (m *Group) writeCar(w io.Writer) (int64, cid.Cid, error) {
 	return m.jb.WriteCar(w)
 }
 
+func (m *Group) writeCarV2(w io.Writer, carSize int64) (int64, cid.Cid, error) {
+	m.readers.Add(1)
+	defer m.readers.Done()
+
+	if m.offloaded.Load() != 0 {
+		return 0, cid.Undef, ErrOffloaded
+	}
+
+	// writeCarV2 is thread safe
+	return m.jb.WriteCarV2(w, carSize)
+}
+
 func (m *Group) hashSample() ([]mh.Multihash, error) {
 	// hashSample is thread safe
 	return m.jb.HashSample()
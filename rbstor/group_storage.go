@@ -5,10 +5,13 @@ import (
 	"time"
 
 	iface "github.com/lotus-web3/ribs"
+	"github.com/lotus-web3/ribs/carlog"
 	"golang.org/x/xerrors"
 )
 
-const MaxLocalGroupCount = 64 // todo user config
+// DefaultMaxLocalGroupCount is the default limit of groups with data stored
+// locally, see WithMaxLocalGroups
+const DefaultMaxLocalGroupCount = 64
 
 func (r *rbs) createGroup(ctx context.Context) (iface.GroupKey, *Group, error) {
 	if err := r.ensureSpaceForGroup(ctx); err != nil {
@@ -29,10 +32,13 @@ func (r *rbs) createGroup(ctx context.Context) (iface.GroupKey, *Group, error) {
 }
 
 func (r *rbs) openGroup(ctx context.Context, group iface.GroupKey, blocks, bytes, jbhead int64, state iface.GroupState, create bool) (*Group, error) {
-	g, err := OpenGroup(ctx, r.db, r.index, &r.staging, group, blocks, bytes, jbhead, r.root, state, create)
+	jbOpts := append([]carlog.OpenOption{carlog.WithWritableIndex(r.writableIndex), carlog.WithRootedCar(r.rootedCars)}, r.carLogOpts...)
+
+	g, err := OpenGroup(ctx, r.db, r.index, &r.staging, group, blocks, bytes, jbhead, r.root, state, create, jbOpts...)
 	if err != nil {
 		return nil, xerrors.Errorf("opening group: %w", err)
 	}
+	g.maxSize, g.maxBlocks = r.maxGroupSize, r.maxGroupBlocks
 
 	if state == iface.GroupStateWritable {
 		r.writableGroups[group] = g
@@ -136,7 +142,7 @@ func (r *rbs) ensureSpaceForGroup(ctx context.Context) error {
 		return xerrors.Errorf("counting non-offloaded groups: %w", err)
 	}
 
-	if localCount < MaxLocalGroupCount {
+	if localCount < r.maxLocalGroups() {
 		return nil
 	}
 
@@ -3,6 +3,7 @@ package rbstor
 import (
 	"context"
 	"github.com/filecoin-project/lotus/lib/must"
+	"github.com/lotus-web3/ribs/carlog"
 	"github.com/lotus-web3/ribs/ributil"
 	"io"
 	"os"
@@ -25,6 +26,16 @@ var log = logging.Logger("rbs")
 
 type openOptions struct {
 	db *ributil.RetryDB
+
+	writableIndex carlog.IndexKind
+
+	rootedCars bool
+
+	maxLocalGroups func() int
+
+	maxGroupSize, maxGroupBlocks int64
+
+	carLogOpts []carlog.OpenOption
 }
 
 type OpenOption func(*openOptions)
@@ -35,6 +46,51 @@ func WithDB(db *ributil.RetryDB) OpenOption {
 	}
 }
 
+// WithWritableIndex sets the index implementation used by writable groups.
+// Existing writable groups with a different index are migrated when opened.
+// Defaults to carlog.DefaultWritableIndex, or RBS_WRITABLE_INDEX if set.
+func WithWritableIndex(kind carlog.IndexKind) OpenOption {
+	return func(o *openOptions) {
+		o.writableIndex = kind
+	}
+}
+
+// WithRootedCars enables laying out DAGs under roots recorded with
+// Batch.Roots depth-first in deal CARs of groups finalized from now on.
+// Defaults to RBS_ROOTED_CARS=1 if set.
+func WithRootedCars(enable bool) OpenOption {
+	return func(o *openOptions) {
+		o.rootedCars = enable
+	}
+}
+
+// WithMaxLocalGroups sets a function returning the limit of groups with data
+// stored locally. When the limit is reached, groups are offloaded before
+// new ones are created. Defaults to DefaultMaxLocalGroupCount.
+func WithMaxLocalGroups(max func() int) OpenOption {
+	return func(o *openOptions) {
+		o.maxLocalGroups = max
+	}
+}
+
+// WithGroupLimits sets the data size and block count at which writable
+// groups are closed and finalized. Smaller groups make smaller deals.
+// Defaults to 29500MiB and 20Mi blocks.
+func WithGroupLimits(maxSize, maxBlocks int64) OpenOption {
+	return func(o *openOptions) {
+		o.maxGroupSize = maxSize
+		o.maxGroupBlocks = maxBlocks
+	}
+}
+
+// withCarLogOptions adds options passed to carlogs of all groups, e.g. to
+// inject file system faults in tests
+func withCarLogOptions(opts ...carlog.OpenOption) OpenOption {
+	return func(o *openOptions) {
+		o.carLogOpts = append(o.carLogOpts, opts...)
+	}
+}
+
 var workerCount = func() int {
 	var wc int
 	if wcs := os.Getenv("RBS_WORKERS"); wcs != "" {
@@ -62,7 +118,22 @@ func Open(root string, opts ...OpenOption) (iface.RBS, error) {
 		return nil, xerrors.Errorf("open top index: %w", err)
 	}
 
-	opt := &openOptions{}
+	opt := &openOptions{
+		writableIndex: carlog.DefaultWritableIndex,
+		rootedCars:    os.Getenv("RBS_ROOTED_CARS") == "1",
+
+		maxLocalGroups: func() int { return DefaultMaxLocalGroupCount },
+
+		maxGroupSize:   maxGroupSize,
+		maxGroupBlocks: maxGroupBlocks,
+	}
+
+	if ik := os.Getenv("RBS_WRITABLE_INDEX"); ik != "" {
+		opt.writableIndex, err = carlog.ParseIndexKind(ik)
+		if err != nil {
+			return nil, xerrors.Errorf("parsing RBS_WRITABLE_INDEX: %w", err)
+		}
+	}
 
 	for _, o := range opts {
 		o(opt)
@@ -78,6 +149,15 @@ func Open(root string, opts ...OpenOption) (iface.RBS, error) {
 		db:    db,
 		index: NewMeteredIndex(idx),
 
+		writableIndex: opt.writableIndex,
+		rootedCars:    opt.rootedCars,
+		carLogOpts:    opt.carLogOpts,
+
+		maxLocalGroups: opt.maxLocalGroups,
+
+		maxGroupSize:   opt.maxGroupSize,
+		maxGroupBlocks: opt.maxGroupBlocks,
+
 		writableGroups: make(map[iface.GroupKey]*Group),
 
 		// all open groups (including all writable)
@@ -124,6 +204,20 @@ type rbs struct {
 	db    *rbsDB
 	index *MeteredIndex
 
+	// writableIndex is the carlog index kind used by writable groups
+	writableIndex carlog.IndexKind
+
+	// rootedCars enables the rooted deal CAR layout, see Batch.Roots
+	rootedCars bool
+
+	// carLogOpts are extra options for group carlogs
+	carLogOpts []carlog.OpenOption
+
+	// size limits of writable groups, see WithGroupLimits
+	maxGroupSize, maxGroupBlocks int64
+
+	maxLocalGroups func() int
+
 	lk      sync.Mutex
 	writeLk sync.Mutex
 
@@ -192,6 +286,12 @@ type ribBatch struct {
 	currentWriteTarget iface.GroupKey
 	toFlush            map[iface.GroupKey]struct{}
 
+	// roots recorded in flushed groups on Flush
+	roots []cid.Cid
+
+	// replication policy recorded in flushed groups on Flush
+	policy string
+
 	// todo: use lru
 }
 
@@ -298,7 +398,25 @@ func (r *ribBatch) Unlink(ctx context.Context, c []mh.Multihash) error {
 	panic("implement me")
 }
 
+func (r *ribBatch) Roots(ctx context.Context, roots []cid.Cid) error {
+	r.roots = append(r.roots, roots...)
+	return nil
+}
+
+func (r *ribBatch) Policy(ctx context.Context, policy string) error {
+	r.policy = policy
+	return nil
+}
+
 func (r *ribBatch) Flush(ctx context.Context) error {
+	if r.policy != "" {
+		for key := range r.toFlush {
+			if err := r.r.db.SetGroupPolicy(key, r.policy); err != nil {
+				return xerrors.Errorf("group %d: %w", key, err)
+			}
+		}
+	}
+
 	r.r.lk.Lock()
 	defer r.r.lk.Unlock()
 
@@ -308,7 +426,10 @@ func (r *ribBatch) Flush(ctx context.Context) error {
 			continue // already flushed
 		}
 		r.r.lk.Unlock()
-		err := g.Sync(ctx)
+		err := g.AddRoots(r.roots)
+		if err == nil {
+			err = g.Sync(ctx)
+		}
 		r.r.lk.Lock()
 		if err != nil {
 			return xerrors.Errorf("sync group %d: %w", key, err)
@@ -320,6 +441,7 @@ func (r *ribBatch) Flush(ctx context.Context) error {
 	}
 
 	r.toFlush = map[iface.GroupKey]struct{}{}
+	r.roots = nil
 
 	return nil
 }
@@ -372,6 +494,21 @@ func (r *rbs) ReadCar(ctx context.Context, group iface.GroupKey, sz func(int64),
 	})
 }
 
+func (r *rbs) ReadCarV2(ctx context.Context, group iface.GroupKey, out io.Writer) error {
+	gm, err := r.db.GroupMeta(group)
+	if err != nil {
+		return xerrors.Errorf("getting group meta: %w", err)
+	}
+	if gm.DealCarSize == nil {
+		return xerrors.Errorf("group has no deal car size set")
+	}
+
+	return r.withReadableGroup(ctx, group, func(g *Group) error {
+		_, _, err := g.writeCarV2(out, *gm.DealCarSize)
+		return err
+	})
+}
+
 func (r *rbs) HashSample(ctx context.Context, group iface.GroupKey) ([]mh.Multihash, error) {
 	var out []mh.Multihash
 	err := r.withReadableGroup(ctx, group, func(g *Group) error {
@@ -0,0 +1,29 @@
+package boosttypes
+
+import (
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+)
+
+// DirectDealParams ask a storage provider to onboard a piece for a verified
+// registry allocation made by the client, without a market deal, over the
+// experimental ribs direct deal protocol. This is a ribs type, not a boost
+// one; data is fetched as for market deals. Providers reply with a
+// DealResponse.
+type DirectDealParams struct {
+	DealUUID     uuid.UUID
+	AllocationID uint64
+	PieceCid     cid.Cid
+	ClientAddr   address.Address
+
+	// StartEpoch is the allocation expiration, EndEpoch is the end of the
+	// minimum allocation term
+	StartEpoch abi.ChainEpoch
+	EndEpoch   abi.ChainEpoch
+
+	PieceSize    abi.PaddedPieceSize
+	DealDataRoot cid.Cid
+	Transfer     Transfer
+}
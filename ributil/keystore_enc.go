@@ -0,0 +1,313 @@
+package ributil
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+	"golang.org/x/xerrors"
+)
+
+// Encrypted keystores have a keystoreMetaFile next to the key files, holding
+// parameters of the scrypt KDF used to derive the keystore key from the
+// passphrase. Each key file is sealed with XChaCha20-Poly1305 under that key,
+// with the key name as additional data, so that key files can't be swapped.
+
+const keystoreMetaFile = "keystore.json"
+
+const keystoreCheckData = "ribs keystore"
+
+// scrypt parameters for new keystores, existing keystores use the parameters
+// stored in their metadata
+var (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+type keystoreMeta struct {
+	Version int
+	KDF     string
+
+	Salt    []byte
+	N, R, P int
+
+	// Check is keystoreCheckData sealed with the keystore key, used to tell
+	// a wrong passphrase apart from a corrupted key file
+	Check []byte
+}
+
+// PassphraseFunc returns the passphrase of an encrypted keystore. create is
+// set when the passphrase is for a new keystore.
+type PassphraseFunc func(create bool) ([]byte, error)
+
+// PassphraseFromEnv returns the wallet passphrase source configured with
+// environment variables, or nil if wallet encryption is not configured:
+//   - RIBS_WALLET_PASSPHRASE - the passphrase
+//   - RIBS_WALLET_PASSPHRASE_FILE - file containing the passphrase
+//   - RIBS_WALLET_ENCRYPT=1 - prompt for the passphrase on the terminal
+func PassphraseFromEnv() PassphraseFunc {
+	if p := os.Getenv("RIBS_WALLET_PASSPHRASE"); p != "" {
+		return func(bool) ([]byte, error) {
+			return []byte(p), nil
+		}
+	}
+
+	if f := os.Getenv("RIBS_WALLET_PASSPHRASE_FILE"); f != "" {
+		return func(bool) ([]byte, error) {
+			f, err := homedir.Expand(f)
+			if err != nil {
+				return nil, xerrors.Errorf("expand passphrase file path: %w", err)
+			}
+
+			p, err := os.ReadFile(f)
+			if err != nil {
+				return nil, xerrors.Errorf("reading passphrase file: %w", err)
+			}
+
+			p = bytes.TrimRight(p, "\r\n")
+			if len(p) == 0 {
+				return nil, xerrors.Errorf("passphrase file %s is empty", f)
+			}
+			return p, nil
+		}
+	}
+
+	if os.Getenv("RIBS_WALLET_ENCRYPT") == "1" {
+		return PromptPassphrase
+	}
+
+	return nil
+}
+
+// PromptPassphrase asks for the passphrase on the terminal, twice when
+// creating a keystore.
+func PromptPassphrase(create bool) ([]byte, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, xerrors.Errorf("wallet passphrase required but stdin is not a terminal, set RIBS_WALLET_PASSPHRASE or RIBS_WALLET_PASSPHRASE_FILE")
+	}
+
+	fmt.Fprint(os.Stderr, "Wallet passphrase: ")
+	p, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, xerrors.Errorf("reading passphrase: %w", err)
+	}
+	if len(p) == 0 {
+		return nil, xerrors.Errorf("empty passphrase")
+	}
+
+	if create {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		p2, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, xerrors.Errorf("reading passphrase: %w", err)
+		}
+		if !bytes.Equal(p, p2) {
+			return nil, xerrors.Errorf("passphrases don't match")
+		}
+	}
+
+	return p, nil
+}
+
+// IsEncryptedKeystore checks whether the keystore at p is encrypted
+func IsEncryptedKeystore(p string) (bool, error) {
+	_, err := os.Stat(filepath.Join(p, keystoreMetaFile))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// InitEncryptedKeystore creates an encrypted keystore at p. The directory must
+// not exist, or be empty.
+func InitEncryptedKeystore(p string, passphrase []byte) (*DiskKeyStore, error) {
+	if len(passphrase) == 0 {
+		return nil, xerrors.Errorf("empty passphrase")
+	}
+
+	if err := os.MkdirAll(p, 0700); err != nil {
+		return nil, err
+	}
+
+	ents, err := os.ReadDir(p)
+	if err != nil {
+		return nil, xerrors.Errorf("reading keystore dir: %w", err)
+	}
+	if len(ents) > 0 {
+		return nil, xerrors.Errorf("keystore dir %s is not empty", p)
+	}
+
+	meta := keystoreMeta{
+		Version: 1,
+		KDF:     "scrypt",
+		Salt:    make([]byte, 32),
+		N:       scryptN,
+		R:       scryptR,
+		P:       scryptP,
+	}
+	if _, err := rand.Read(meta.Salt); err != nil {
+		return nil, xerrors.Errorf("generating salt: %w", err)
+	}
+
+	aead, err := keystoreAEAD(meta, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	meta.Check, err = sealKey(aead, keystoreMetaFile, []byte(keystoreCheckData))
+	if err != nil {
+		return nil, err
+	}
+
+	mb, err := json.Marshal(&meta)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding keystore metadata: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(p, keystoreMetaFile), mb, 0600); err != nil {
+		return nil, xerrors.Errorf("writing keystore metadata: %w", err)
+	}
+
+	return &DiskKeyStore{path: p, aead: aead}, nil
+}
+
+// OpenEncryptedKeystore unlocks an existing encrypted keystore at p
+func OpenEncryptedKeystore(p string, passphrase []byte) (*DiskKeyStore, error) {
+	mb, err := os.ReadFile(filepath.Join(p, keystoreMetaFile))
+	if err != nil {
+		return nil, xerrors.Errorf("reading keystore metadata: %w", err)
+	}
+
+	var meta keystoreMeta
+	if err := json.Unmarshal(mb, &meta); err != nil {
+		return nil, xerrors.Errorf("decoding keystore metadata: %w", err)
+	}
+	if meta.Version != 1 || meta.KDF != "scrypt" {
+		return nil, xerrors.Errorf("unsupported keystore version %d, kdf %q", meta.Version, meta.KDF)
+	}
+
+	aead, err := keystoreAEAD(meta, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	check, err := openKey(aead, keystoreMetaFile, meta.Check)
+	if err != nil || string(check) != keystoreCheckData {
+		return nil, xerrors.Errorf("wrong wallet passphrase")
+	}
+
+	return &DiskKeyStore{path: p, aead: aead}, nil
+}
+
+// MigrateKeystore encrypts an unencrypted keystore at p. Keys are written to
+// a new keystore which replaces p once all keys are copied and read back. The
+// unencrypted keystore is removed unless keepBackup is set, in which case its
+// path is returned.
+func MigrateKeystore(p string, passphrase []byte, keepBackup bool) (string, error) {
+	p, err := homedir.Expand(p)
+	if err != nil {
+		return "", xerrors.Errorf("expand wallet path: %w", err)
+	}
+	p = strings.TrimRight(p, string(filepath.Separator))
+
+	if enc, err := IsEncryptedKeystore(p); err != nil {
+		return "", err
+	} else if enc {
+		return "", xerrors.Errorf("keystore %s is already encrypted", p)
+	}
+
+	src := &DiskKeyStore{path: p}
+	names, err := src.List()
+	if err != nil {
+		return "", xerrors.Errorf("listing keystore: %w", err)
+	}
+
+	tmp := p + ".encrypting"
+	if _, err := os.Stat(tmp); err == nil {
+		return "", xerrors.Errorf("%s exists, left over from an interrupted migration; remove it and retry", tmp)
+	}
+
+	dst, err := InitEncryptedKeystore(tmp, passphrase)
+	if err != nil {
+		return "", xerrors.Errorf("creating encrypted keystore: %w", err)
+	}
+
+	for _, name := range names {
+		ki, err := src.Get(name)
+		if err != nil {
+			return "", xerrors.Errorf("reading key: %w", err)
+		}
+		if err := dst.Put(name, ki); err != nil {
+			return "", xerrors.Errorf("writing key: %w", err)
+		}
+
+		dki, err := dst.Get(name)
+		if err != nil {
+			return "", xerrors.Errorf("reading back key: %w", err)
+		}
+		if dki.Type != ki.Type || !bytes.Equal(dki.PrivateKey, ki.PrivateKey) {
+			return "", xerrors.Errorf("key '%s' doesn't match after encryption", name)
+		}
+	}
+
+	backup := p + ".unencrypted"
+	if err := os.Rename(p, backup); err != nil {
+		return "", xerrors.Errorf("moving unencrypted keystore: %w", err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return "", xerrors.Errorf("moving encrypted keystore in place (unencrypted keystore is at %s): %w", backup, err)
+	}
+
+	if keepBackup {
+		return backup, nil
+	}
+
+	if err := os.RemoveAll(backup); err != nil {
+		return backup, xerrors.Errorf("removing unencrypted keystore: %w", err)
+	}
+	return "", nil
+}
+
+func keystoreAEAD(meta keystoreMeta, passphrase []byte) (cipher.AEAD, error) {
+	k, err := scrypt.Key(passphrase, meta.Salt, meta.N, meta.R, meta.P, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, xerrors.Errorf("deriving keystore key: %w", err)
+	}
+
+	return chacha20poly1305.NewX(k)
+}
+
+// sealKey encrypts key file data, the returned data is prefixed with a random
+// nonce
+func sealKey(aead cipher.AEAD, name string, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, xerrors.Errorf("generating nonce: %w", err)
+	}
+
+	return aead.Seal(nonce, nonce, data, []byte(name)), nil
+}
+
+func openKey(aead cipher.AEAD, name string, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted key too short")
+	}
+
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(name))
+}
@@ -178,6 +178,16 @@ func RobustGet(url string, dataSize int64, rcf func() *RateCounter) io.ReadClose
 	}
 }
 
+// RobustGetRange is like RobustGet, but reads size bytes starting at offset
+func RobustGetRange(url string, offset, size int64, rcf func() *RateCounter) io.ReadCloser {
+	return &robustHttpResponse{
+		getRC:    rcf,
+		url:      url,
+		atOff:    offset,
+		dataSize: offset + size,
+	}
+}
+
 type readerDeadliner struct {
 	io.Reader
 	setDeadline func(time.Time) error
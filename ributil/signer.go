@@ -0,0 +1,123 @@
+package ributil
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/api/client"
+	"github.com/filecoin-project/lotus/chain/types"
+	"golang.org/x/xerrors"
+)
+
+// Signer holds keys of client wallets, and signs messages and deal proposals
+// with them. LocalWallet keeps keys in a local keystore, RemoteWallet asks a
+// remote signer.
+type Signer interface {
+	WalletSign(ctx context.Context, addr address.Address, msg []byte, meta api.MsgMeta) (*crypto.Signature, error)
+	WalletList(ctx context.Context) ([]address.Address, error)
+	WalletNew(ctx context.Context, typ types.KeyType) (address.Address, error)
+
+	GetDefault() (address.Address, error)
+	SetDefault(a address.Address) error
+}
+
+var _ Signer = (*LocalWallet)(nil)
+var _ Signer = (*RemoteWallet)(nil)
+
+// RemoteWallet signs with keys held by a Lotus-compatible wallet JSON-RPC
+// endpoint, e.g. lotus-wallet or a lotus node. Keys never leave the remote
+// signer.
+type RemoteWallet struct {
+	api    api.Wallet
+	closer jsonrpc.ClientCloser
+
+	lk  sync.Mutex
+	def address.Address
+}
+
+// OpenRemoteWallet connects to a wallet JSON-RPC endpoint. Requests carry the
+// given header, e.g. an Authorization token. def is the default address, or
+// address.Undef to use the first listed by the signer.
+func OpenRemoteWallet(ctx context.Context, endpoint string, header http.Header, def address.Address) (*RemoteWallet, error) {
+	w, closer, err := client.NewWalletRPCV0(ctx, endpoint, header)
+	if err != nil {
+		return nil, xerrors.Errorf("connecting to remote wallet: %w", err)
+	}
+
+	rw := NewRemoteWallet(w, def)
+	rw.closer = closer
+
+	return rw, nil
+}
+
+// NewRemoteWallet wraps a wallet API client
+func NewRemoteWallet(w api.Wallet, def address.Address) *RemoteWallet {
+	return &RemoteWallet{
+		api: w,
+		def: def,
+	}
+}
+
+func (w *RemoteWallet) WalletSign(ctx context.Context, addr address.Address, msg []byte, meta api.MsgMeta) (*crypto.Signature, error) {
+	sig, err := w.api.WalletSign(ctx, addr, msg, meta)
+	if err != nil {
+		return nil, xerrors.Errorf("remote signing with '%s': %w", addr, err)
+	}
+	return sig, nil
+}
+
+func (w *RemoteWallet) WalletList(ctx context.Context) ([]address.Address, error) {
+	return w.api.WalletList(ctx)
+}
+
+func (w *RemoteWallet) WalletNew(ctx context.Context, typ types.KeyType) (address.Address, error) {
+	return w.api.WalletNew(ctx, typ)
+}
+
+func (w *RemoteWallet) GetDefault() (address.Address, error) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	if w.def != address.Undef {
+		return w.def, nil
+	}
+
+	l, err := w.api.WalletList(context.TODO())
+	if err != nil {
+		return address.Undef, xerrors.Errorf("listing remote wallet: %w", err)
+	}
+	if len(l) == 0 {
+		return address.Undef, xerrors.Errorf("failed to get default key: %w", types.ErrKeyInfoNotFound)
+	}
+
+	return l[0], nil
+}
+
+// SetDefault sets the default address for this process, the remote signer
+// has no notion of a default key
+func (w *RemoteWallet) SetDefault(a address.Address) error {
+	has, err := w.api.WalletHas(context.TODO(), a)
+	if err != nil {
+		return xerrors.Errorf("checking remote wallet: %w", err)
+	}
+	if !has {
+		return xerrors.Errorf("remote wallet doesn't have key %s: %w", a, types.ErrKeyInfoNotFound)
+	}
+
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	w.def = a
+	return nil
+}
+
+func (w *RemoteWallet) Close() {
+	if w.closer != nil {
+		w.closer()
+	}
+}
@@ -0,0 +1,99 @@
+package ributil
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-jsonrpc"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/lib/sigs"
+	"github.com/stretchr/testify/require"
+)
+
+type memKeyStore map[string]types.KeyInfo
+
+func (m memKeyStore) List() ([]string, error) {
+	var out []string
+	for k := range m {
+		out = append(out, k)
+	}
+	return out, nil
+}
+
+func (m memKeyStore) Get(k string) (types.KeyInfo, error) {
+	ki, ok := m[k]
+	if !ok {
+		return types.KeyInfo{}, types.ErrKeyInfoNotFound
+	}
+	return ki, nil
+}
+
+func (m memKeyStore) Put(k string, ki types.KeyInfo) error {
+	m[k] = ki
+	return nil
+}
+
+func (m memKeyStore) Delete(k string) error {
+	delete(m, k)
+	return nil
+}
+
+// standInSigner serves a local wallet over the lotus wallet API
+type standInSigner struct {
+	*LocalWallet
+}
+
+func (s *standInSigner) WalletHas(ctx context.Context, a address.Address) (bool, error) {
+	k, err := s.findKey(a)
+	return k != nil, err
+}
+
+func TestRemoteWallet(t *testing.T) {
+	ctx := context.Background()
+
+	lw, err := NewWallet(memKeyStore{})
+	require.NoError(t, err)
+
+	srv := jsonrpc.NewServer()
+	srv.Register("Filecoin", &standInSigner{lw})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	rw, err := OpenRemoteWallet(ctx, ts.URL, nil, address.Undef)
+	require.NoError(t, err)
+	defer rw.Close()
+
+	_, err = rw.GetDefault()
+	require.Error(t, err)
+
+	a1, err := rw.WalletNew(ctx, types.KTSecp256k1)
+	require.NoError(t, err)
+	a2, err := lw.WalletNew(ctx, types.KTSecp256k1)
+	require.NoError(t, err)
+
+	l, err := rw.WalletList(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []address.Address{a1, a2}, l)
+
+	require.NoError(t, rw.SetDefault(a2))
+	def, err := rw.GetDefault()
+	require.NoError(t, err)
+	require.Equal(t, a2, def)
+
+	other, err := NewWallet(memKeyStore{})
+	require.NoError(t, err)
+	unknown, err := other.WalletNew(ctx, types.KTSecp256k1)
+	require.NoError(t, err)
+	require.Error(t, rw.SetDefault(unknown))
+
+	msg := []byte("deal proposal")
+	sig, err := rw.WalletSign(ctx, a1, msg, api.MsgMeta{Type: api.MTDealProposal})
+	require.NoError(t, err)
+	require.NoError(t, sigs.Verify(sig, a1, msg))
+
+	_, err = rw.WalletSign(ctx, unknown, msg, api.MsgMeta{Type: api.MTDealProposal})
+	require.Error(t, err)
+}
@@ -2,6 +2,7 @@ package ributil
 
 import (
 	"context"
+	"crypto/cipher"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -30,15 +31,69 @@ const (
 	KDefault     = "default"
 )
 
+// OpenWallet opens the wallet at path, with encryption configured by the
+// environment, see PassphraseFromEnv.
 func OpenWallet(path string) (*LocalWallet, error) {
+	return OpenWalletWithPassphrase(path, PassphraseFromEnv())
+}
+
+// OpenWalletWithPassphrase opens the wallet at path. Encrypted wallets are
+// unlocked with the passphrase, prompting for it if pass is nil. If pass is
+// set, new wallets are created encrypted, and unencrypted wallets holding keys
+// are refused until migrated with MigrateKeystore.
+func OpenWalletWithPassphrase(path string, pass PassphraseFunc) (*LocalWallet, error) {
 	path, err := homedir.Expand(path)
 	if err != nil {
 		return nil, xerrors.Errorf("expand wallet path: %w", err)
 	}
 
-	kstore, err := OpenOrInitKeystore(path)
+	enc, err := IsEncryptedKeystore(path)
 	if err != nil {
-		return nil, err
+		return nil, xerrors.Errorf("checking keystore: %w", err)
+	}
+
+	var kstore *DiskKeyStore
+
+	switch {
+	case enc:
+		if pass == nil {
+			pass = PromptPassphrase
+		}
+
+		p, err := pass(false)
+		if err != nil {
+			return nil, xerrors.Errorf("getting wallet passphrase: %w", err)
+		}
+
+		kstore, err = OpenEncryptedKeystore(path, p)
+		if err != nil {
+			return nil, xerrors.Errorf("unlocking wallet: %w", err)
+		}
+	case pass != nil:
+		if _, err := os.Stat(path); err == nil {
+			keys, err := (&DiskKeyStore{path: path}).List()
+			if err != nil {
+				return nil, xerrors.Errorf("listing keystore: %w", err)
+			}
+			if len(keys) > 0 {
+				return nil, xerrors.Errorf("wallet encryption is configured, but wallet at %s is not encrypted; encrypt it with `ritool wallet encrypt`", path)
+			}
+		}
+
+		p, err := pass(true)
+		if err != nil {
+			return nil, xerrors.Errorf("getting wallet passphrase: %w", err)
+		}
+
+		kstore, err = InitEncryptedKeystore(path, p)
+		if err != nil {
+			return nil, xerrors.Errorf("creating encrypted wallet: %w", err)
+		}
+	default:
+		kstore, err = OpenOrInitKeystore(path)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return NewWallet(kstore)
@@ -249,13 +304,16 @@ func swapMainnetForTestnetPrefix(addr string) (string, error) {
 
 ////
 
+// DiskKeyStore keeps each key in a file under path. When aead is set, key files
+// are encrypted, see OpenEncryptedKeystore.
 type DiskKeyStore struct {
 	path string
+	aead cipher.AEAD
 }
 
 func OpenOrInitKeystore(p string) (*DiskKeyStore, error) {
 	if _, err := os.Stat(p); err == nil {
-		return &DiskKeyStore{p}, nil
+		return &DiskKeyStore{path: p}, nil
 	} else if !os.IsNotExist(err) {
 		return nil, err
 	}
@@ -264,7 +322,7 @@ func OpenOrInitKeystore(p string) (*DiskKeyStore, error) {
 		return nil, err
 	}
 
-	return &DiskKeyStore{p}, nil
+	return &DiskKeyStore{path: p}, nil
 }
 
 var kstrPermissionMsg = "permissions of key: '%s' are too relaxed, " +
@@ -284,6 +342,9 @@ func (fsr *DiskKeyStore) List() ([]string, error) {
 	}
 	keys := make([]string, 0, len(files))
 	for _, f := range files {
+		if f.Name() == keystoreMetaFile {
+			continue
+		}
 		if f.Mode()&0077 != 0 {
 			return nil, fmt.Errorf(kstrPermissionMsg, f.Name(), f.Mode())
 		}
@@ -324,6 +385,13 @@ func (fsr *DiskKeyStore) Get(name string) (types.KeyInfo, error) {
 		return types.KeyInfo{}, fmt.Errorf("reading key '%s': %w", name, err)
 	}
 
+	if fsr.aead != nil {
+		data, err = openKey(fsr.aead, name, data)
+		if err != nil {
+			return types.KeyInfo{}, fmt.Errorf("decrypting key '%s': %w", name, err)
+		}
+	}
+
 	var res types.KeyInfo
 	err = json.Unmarshal(data, &res)
 	if err != nil {
@@ -351,6 +419,13 @@ func (fsr *DiskKeyStore) Put(name string, info types.KeyInfo) error {
 		return fmt.Errorf("encoding key '%s': %w", name, err)
 	}
 
+	if fsr.aead != nil {
+		keyData, err = sealKey(fsr.aead, name, keyData)
+		if err != nil {
+			return fmt.Errorf("encrypting key '%s': %w", name, err)
+		}
+	}
+
 	err = os.WriteFile(keyPath, keyData, 0600)
 	if err != nil {
 		return fmt.Errorf("writing key '%s': %w", name, err)
@@ -0,0 +1,110 @@
+package ributil
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	// fast kdf for tests
+	scryptN = 1 << 10
+}
+
+func staticPass(p string) PassphraseFunc {
+	return func(bool) ([]byte, error) {
+		return []byte(p), nil
+	}
+}
+
+func TestEncryptedWallet(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "wallet")
+
+	w, err := OpenWalletWithPassphrase(path, staticPass("hunter2"))
+	require.NoError(t, err)
+
+	a, err := w.WalletNew(ctx, types.KTSecp256k1)
+	require.NoError(t, err)
+
+	k, err := w.findKey(a)
+	require.NoError(t, err)
+
+	// no key file holds the key in the clear
+	ents, err := os.ReadDir(path)
+	require.NoError(t, err)
+	for _, e := range ents {
+		d, err := os.ReadFile(filepath.Join(path, e.Name()))
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(d, k.PrivateKey))
+		require.NotContains(t, string(d), "PrivateKey")
+	}
+
+	_, err = OpenWalletWithPassphrase(path, staticPass("hunter3"))
+	require.ErrorContains(t, err, "wrong wallet passphrase")
+
+	// unencrypted access fails to decode the keys
+	_, err = (&DiskKeyStore{path: path}).Get(KDefault)
+	require.Error(t, err)
+
+	w, err = OpenWalletWithPassphrase(path, staticPass("hunter2"))
+	require.NoError(t, err)
+
+	def, err := w.GetDefault()
+	require.NoError(t, err)
+	require.Equal(t, a, def)
+
+	l, err := w.WalletList(ctx)
+	require.NoError(t, err)
+	require.Len(t, l, 1)
+}
+
+func TestMigrateKeystore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "wallet")
+
+	w, err := OpenWalletWithPassphrase(path, nil)
+	require.NoError(t, err)
+
+	a1, err := w.WalletNew(ctx, types.KTSecp256k1)
+	require.NoError(t, err)
+	a2, err := w.WalletNew(ctx, types.KTSecp256k1)
+	require.NoError(t, err)
+
+	msg := []byte("msg")
+	sig, err := w.WalletSign(ctx, a2, msg, api.MsgMeta{})
+	require.NoError(t, err)
+
+	// encryption configured, refuse to use the unencrypted wallet
+	_, err = OpenWalletWithPassphrase(path, staticPass("pass"))
+	require.ErrorContains(t, err, "not encrypted")
+
+	backup, err := MigrateKeystore(path, []byte("pass"), true)
+	require.NoError(t, err)
+	require.Equal(t, path+".unencrypted", backup)
+
+	_, err = MigrateKeystore(path, []byte("pass"), false)
+	require.ErrorContains(t, err, "already encrypted")
+
+	w, err = OpenWalletWithPassphrase(path, staticPass("pass"))
+	require.NoError(t, err)
+
+	l, err := w.WalletList(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []address.Address{a1, a2}, l)
+
+	def, err := w.GetDefault()
+	require.NoError(t, err)
+	require.Equal(t, a1, def)
+
+	sig2, err := w.WalletSign(ctx, a2, msg, api.MsgMeta{})
+	require.NoError(t, err)
+	require.Equal(t, sig, sig2)
+}